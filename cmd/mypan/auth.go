@@ -6,6 +6,7 @@ package main
 import (
 	"context"
 	"fmt"
+	"os"
 	"time"
 
 	"mypan/pkg/client"
@@ -20,12 +21,18 @@ import (
 type AuthMan struct {
 	client client.ClientI
 	store  store.StoreSerdeI
+
+	retryMin time.Duration
+	retryMax time.Duration
 }
 
 func NewAuthMan(client client.ClientI, store store.StoreSerdeI) *AuthMan {
 	am := &AuthMan{
 		client: client,
 		store:  store,
+
+		retryMin: refreshRetryMin,
+		retryMax: refreshRetryMax,
 	}
 	return am
 }
@@ -60,12 +67,7 @@ func (am *AuthMan) Refresh(ctx context.Context) error {
 	if err != nil {
 		return err
 	}
-	expires := time.Duration(resp.ExpiresIn) * time.Second
-	accessAuth := client.AccessAuth{
-		AccessToken:           resp.AccessToken,
-		AccessTokenExpireTime: time.Now().Add(expires),
-		RefreshToken:          resp.RefreshToken,
-	}
+	accessAuth := client.NewAccessAuth(client.OauthTokenResponse(resp), time.Now())
 	if err := am.setAccessAuth(accessAuth); err != nil {
 		return err
 	}
@@ -73,7 +75,84 @@ func (am *AuthMan) Refresh(ctx context.Context) error {
 	return nil
 }
 
+type AuthStatus struct {
+	Uk          int    `json:"uk,omitempty"`
+	BaiduName   string `json:"baidu_name,omitempty"`
+	NetdiskName string `json:"netdisk_name,omitempty"`
+	VipType     int    `json:"vip_type"`
+
+	Scope                  string    `json:"scope"`
+	AccessTokenExpireTime  time.Time `json:"access_token_expire_time"`
+	AccessTokenRemaining   string    `json:"access_token_remaining"`
+	RefreshTokenExpireTime time.Time `json:"refresh_token_expire_time"`
+	RefreshTokenRemaining  string    `json:"refresh_token_remaining"`
+	Expired                bool      `json:"expired"`
+}
+
+// Status reports stored access auth.  Account info is fetched only when the
+// access token is not yet expired
+func (am *AuthMan) Status(ctx context.Context) (AuthStatus, error) {
+	var st AuthStatus
+
+	accessAuth, err := am.getAccessAuth()
+	if err != nil && !os.IsNotExist(errors.Cause(err)) {
+		return st, errors.Wrap(err, "store get")
+	}
+	if accessAuth.AccessToken == "" {
+		return st, fmt.Errorf("not logged in")
+	}
+	now := time.Now()
+	remaining := func(t time.Time) string {
+		if t.IsZero() {
+			return "unknown"
+		}
+		return t.Sub(now).Truncate(time.Second).String()
+	}
+	st.Scope = accessAuth.Scope
+	st.AccessTokenExpireTime = accessAuth.AccessTokenExpireTime
+	st.AccessTokenRemaining = remaining(accessAuth.AccessTokenExpireTime)
+	st.RefreshTokenExpireTime = accessAuth.RefreshTokenExpireTime
+	st.RefreshTokenRemaining = remaining(accessAuth.RefreshTokenExpireTime)
+	st.Expired = now.After(accessAuth.AccessTokenExpireTime)
+	if st.Expired {
+		return st, nil
+	}
+	resp, err := am.client.UInfo(ctx)
+	if err != nil {
+		return st, errors.Wrap(err, "uinfo")
+	}
+	st.Uk = resp.Uk
+	st.BaiduName = resp.BaiduName
+	st.NetdiskName = resp.NetdiskName
+	st.VipType = resp.VipType
+	return st, nil
+}
+
+// Logout deletes stored access auth
+func (am *AuthMan) Logout() error {
+	if err := am.store.Delete(config.StoreKeyAccessAuth); err != nil {
+		return errors.Wrap(err, "store delete")
+	}
+	am.client.SetAccessAuth(client.AccessAuth{})
+	glog.Infof("logout ok")
+	return nil
+}
+
+// Backoff of retrying refresh of an expired access token
+const (
+	refreshRetryMin = time.Minute
+	refreshRetryMax = time.Hour
+)
+
+// RefreshRetry sets backoff of retrying refresh of an expired access token
+func (am *AuthMan) RefreshRetry(min, max time.Duration) *AuthMan {
+	am.retryMin = min
+	am.retryMax = max
+	return am
+}
+
 func (am *AuthMan) RefreshAccessTokenLoop(ctx context.Context) {
+	retryWait := am.retryMin
 	for {
 		var (
 			accessAuth = am.client.GetAccessAuth()
@@ -81,25 +160,31 @@ func (am *AuthMan) RefreshAccessTokenLoop(ctx context.Context) {
 			now        = time.Now()
 		)
 		if now.After(expireTime) {
-			glog.Errorf("refresh token: already expired (%s)", expireTime)
-			return
-		}
-		var (
-			timeAvail     = expireTime.Sub(now)
-			nextCheckWait time.Duration
-		)
-		if timeAvail < 24*time.Hour {
-			nextCheckWait = 7 * time.Minute
-		} else if timeAvail < 3*24*time.Hour {
-			nextCheckWait = 60 * time.Minute
-		} else {
-			nextCheckWait = 24 * time.Hour
+			// refresh token outlives access token by far
+			glog.Warningf("refresh token: access token already expired (%s)", expireTime)
+			if err := am.Refresh(ctx); err != nil {
+				// network may be down for now, keep trying
+				glog.Errorf("refresh token: %v, retry after %s", err, retryWait)
+				select {
+				case <-time.After(retryWait):
+				case <-ctx.Done():
+					glog.Infof("refresh token: ctx done: %v", ctx.Err())
+					return
+				}
+				if retryWait *= 2; retryWait > am.retryMax {
+					retryWait = am.retryMax
+				}
+				continue
+			}
+			retryWait = am.retryMin
+			continue
 		}
+		nextCheckWait := refreshCheckWait(expireTime.Sub(now))
 		glog.Infof("refresh token: next refresh after %s", nextCheckWait)
 		select {
 		case <-time.After(nextCheckWait):
 		case <-ctx.Done():
-			glog.Errorf("refresh token: ctx done: %v", ctx.Err())
+			glog.Infof("refresh token: ctx done: %v", ctx.Err())
 			return
 		}
 
@@ -109,6 +194,17 @@ func (am *AuthMan) RefreshAccessTokenLoop(ctx context.Context) {
 	}
 }
 
+// refreshCheckWait returns how long to wait before refreshing an access
+// token still valid for timeAvail
+func refreshCheckWait(timeAvail time.Duration) time.Duration {
+	if timeAvail < 24*time.Hour {
+		return 7 * time.Minute
+	} else if timeAvail < 3*24*time.Hour {
+		return 60 * time.Minute
+	}
+	return 24 * time.Hour
+}
+
 func (am *AuthMan) promptDeviceCodeAuth(ctx context.Context) (
 	deviceCode string,
 	interval time.Duration,
@@ -174,11 +270,7 @@ func (am *AuthMan) checkDeviceCodeAuthComplete(
 		glog.V(config.VerboseOn).Infof("    access token: %s\n", accessToken)
 		glog.V(config.VerboseOn).Infof("    expires in %s\n", expires)
 		glog.V(config.VerboseOn).Infof("    refresh token: %s\n", refreshToken)
-		accessAuth := client.AccessAuth{
-			AccessToken:           accessToken,
-			AccessTokenExpireTime: time.Now().Add(expires),
-			RefreshToken:          refreshToken,
-		}
+		accessAuth := client.NewAccessAuth(resp, time.Now())
 		return accessAuth, nil
 	}
 }
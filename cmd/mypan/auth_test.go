@@ -0,0 +1,45 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"mypan/pkg/client"
+	"mypan/pkg/config"
+	"mypan/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuthManLogout(t *testing.T) {
+	dir := t.TempDir()
+	dirStore, err := store.NewDirStore(dir)
+	require.NoError(t, err)
+	jsonStore := store.NewJSONStore(dirStore)
+	accessAuth := client.AccessAuth{
+		AccessToken:           "a",
+		RefreshToken:          "r",
+		AccessTokenExpireTime: time.Now().Add(time.Hour),
+	}
+	require.NoError(t, jsonStore.Set(config.StoreKeyAccessAuth, accessAuth))
+	fc := newFakeClient()
+	fc.SetAccessAuth(accessAuth)
+
+	am := NewAuthMan(fc, jsonStore)
+	require.NoError(t, am.Logout())
+	_, err = os.Stat(filepath.Join(dir, config.StoreKeyAccessAuth))
+	assert.True(t, os.IsNotExist(err), "%v", err)
+	assert.Equal(t, client.AccessAuth{}, fc.GetAccessAuth())
+	_, err = am.Status(context.Background())
+	assert.EqualError(t, err, "not logged in")
+
+	// nothing to delete
+	require.NoError(t, am.Logout())
+}
@@ -0,0 +1,230 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+
+	"mypan/pkg/chunk"
+	"mypan/pkg/client"
+
+	"github.com/pkg/errors"
+)
+
+// CatMan writes content of remote files to stdout.  Parts of plain files
+// are fetched with range requests so that only the bytes asked for are
+// transferred
+type CatMan struct {
+	client   client.ClientI
+	cryptMan *CryptMan
+	out      io.Writer
+}
+
+func NewCatMan(client client.ClientI) *CatMan {
+	cm := &CatMan{
+		client: client,
+		out:    os.Stdout,
+	}
+	return cm
+}
+
+func (cm *CatMan) Crypt(cryptMan *CryptMan) *CatMan {
+	cm.cryptMan = cryptMan
+	return cm
+}
+
+// Out sets where content goes.  It's stdout by default
+func (cm *CatMan) Out(out io.Writer) *CatMan {
+	cm.out = out
+	return cm
+}
+
+// Cat writes length bytes of relpath from offset.  Negative offset counts
+// from the end, negative length is for the rest of the file
+func (cm *CatMan) Cat(ctx context.Context, relpath string, offset, length int64) error {
+	whole := offset == 0 && length < 0
+	meta, err := cm.client.FileMetaByPath(ctx, cm.cryptMan.RemotePath(relpath))
+	if err != nil && !client.ErrIsNotExist(err) {
+		return errors.Wrap(err, "meta")
+	}
+	if err == nil && meta.IsDir != 0 {
+		return fmt.Errorf("%s: is a directory", relpath)
+	}
+	// whole files are downloaded as down does, which decrypts, joins
+	// chunks and verifies md5
+	if whole {
+		return cm.downMan().Down(ctx, relpath, "")
+	}
+	var size int64
+	switch {
+	case err != nil:
+		// maybe it was uploaded in chunks
+		manifestRelpath := cm.cryptMan.RemotePath(relpath + chunk.ManifestSuffix)
+		if _, err1 := cm.client.FileMetaByPath(ctx, manifestRelpath); err1 != nil {
+			return errors.Wrap(err, "meta")
+		}
+		manifest, err := readChunkManifest(ctx, cm.client, cm.cryptMan, manifestRelpath)
+		if err != nil {
+			return err
+		}
+		if cm.cryptMan == nil {
+			return cm.catChunks(ctx, relpath, manifest, offset, length)
+		}
+		size = manifest.Size
+	case cm.cryptMan != nil:
+		size = cm.cryptMan.PlainSize(int64(meta.Size))
+	default:
+		return cm.catRange(ctx, relpath, meta, offset, length)
+	}
+
+	// content of encrypted files is decoded from the start, bytes before
+	// the range are skipped
+	start, n := catRange(size, offset, length)
+	if n == 0 {
+		return nil
+	}
+	w := &catRangeWriter{w: cm.out, skip: start, n: n}
+	err = cm.downMan().Out(w).Down(ctx, relpath, "")
+	if errors.Is(err, errCatRangeDone) {
+		return nil
+	}
+	return err
+}
+
+func (cm *CatMan) downMan() *DownMan {
+	return NewDownMan(cm.client).
+		Crypt(cm.cryptMan).
+		Out(cm.out)
+}
+
+// catRange writes the range of plain file with a range request
+func (cm *CatMan) catRange(
+	ctx context.Context,
+	relpath string,
+	meta client.FileMetaResponse,
+	offset, length int64,
+) error {
+	start, n := catRange(int64(meta.Size), offset, length)
+	if n == 0 {
+		return nil
+	}
+	httpResp, err := cm.client.DownloadByDLink(ctx, meta.DLink, func(req *http.Request) {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+n-1))
+	})
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusPartialContent &&
+		!(httpResp.StatusCode == http.StatusOK && start == 0) {
+		return fmt.Errorf("download %s from %d: %s", relpath, start, httpResp.Status)
+	}
+	if _, err := io.CopyN(cm.out, httpResp.Body, n); err != nil {
+		return errors.Wrapf(err, "download %s", relpath)
+	}
+	return nil
+}
+
+// catChunks writes the range of plain chunked file.  Chunks are picked by
+// sizes in manifest, only those holding the range are fetched with range
+// requests
+func (cm *CatMan) catChunks(
+	ctx context.Context,
+	relpath string,
+	manifest *chunk.Manifest,
+	offset, length int64,
+) error {
+	start, n := catRange(manifest.Size, offset, length)
+	dir := path.Dir(relpath)
+	var chunkStart int64
+	for _, c := range manifest.Chunks {
+		if n == 0 {
+			break
+		}
+		chunkEnd := chunkStart + c.Size
+		if start < chunkEnd {
+			chunkRelpath := path.Join(dir, c.Name)
+			meta, err := cm.client.FileMetaByPath(ctx, chunkRelpath)
+			if err != nil {
+				return errors.Wrapf(err, "meta %s", chunkRelpath)
+			}
+			if int64(meta.Size) != c.Size {
+				return fmt.Errorf("%s: size %d, want %d in manifest", chunkRelpath, meta.Size, c.Size)
+			}
+			n1 := chunkEnd - start
+			if n1 > n {
+				n1 = n
+			}
+			if err := cm.catRange(ctx, chunkRelpath, meta, start-chunkStart, n1); err != nil {
+				return err
+			}
+			start += n1
+			n -= n1
+		}
+		chunkStart = chunkEnd
+	}
+	if n > 0 {
+		return fmt.Errorf("%s: chunks end at %d, short of size %d in manifest", relpath, chunkStart, manifest.Size)
+	}
+	return nil
+}
+
+// errCatRangeDone stops a download once the range is written
+var errCatRangeDone = errors.New("range done")
+
+// catRangeWriter skips skip bytes, then writes n bytes to w.  Writes fail
+// with errCatRangeDone after that
+type catRangeWriter struct {
+	w    io.Writer
+	skip int64
+	n    int64
+}
+
+func (crw *catRangeWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	if crw.skip > 0 {
+		if int64(len(p)) <= crw.skip {
+			crw.skip -= int64(len(p))
+			return total, nil
+		}
+		p = p[crw.skip:]
+		crw.skip = 0
+	}
+	if int64(len(p)) > crw.n {
+		p = p[:crw.n]
+	}
+	if _, err := crw.w.Write(p); err != nil {
+		return 0, err
+	}
+	crw.n -= int64(len(p))
+	if crw.n == 0 {
+		return total, errCatRangeDone
+	}
+	return total, nil
+}
+
+// catRange returns where to start and how many bytes to read from a file
+// of size
+func catRange(size, offset, length int64) (int64, int64) {
+	start := offset
+	if start < 0 {
+		start += size
+		if start < 0 {
+			start = 0
+		}
+	}
+	if start > size {
+		start = size
+	}
+	n := size - start
+	if length >= 0 && length < n {
+		n = length
+	}
+	return start, n
+}
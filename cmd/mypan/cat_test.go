@@ -0,0 +1,115 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mypan/pkg/crypt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCatRange(t *testing.T) {
+	for _, c := range []struct {
+		offset, length int64
+		start, n       int64
+	}{
+		{0, -1, 0, 10},
+		{2, 3, 2, 3},
+		{8, 100, 8, 2},
+		{20, -1, 10, 0},
+		{-4, -1, 6, 4},
+		{-4, 2, 6, 2},
+		{-100, 2, 0, 2},
+		{0, 0, 0, 0},
+	} {
+		start, n := catRange(10, c.offset, c.length)
+		assert.Equal(t, c.start, start, "offset %d length %d", c.offset, c.length)
+		assert.Equal(t, c.n, n, "offset %d length %d", c.offset, c.length)
+	}
+}
+
+func TestCatRangeWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &catRangeWriter{w: &buf, skip: 3, n: 4}
+	n, err := w.Write([]byte("01"))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = w.Write([]byte("2345"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, n)
+	_, err = w.Write([]byte("6789"))
+	assert.Equal(t, errCatRangeDone, err)
+	assert.Equal(t, "3456", buf.String())
+}
+
+func TestCatManCat(t *testing.T) {
+	ctx := context.Background()
+	data := []byte(strings.Repeat("0123456789", 300))
+	cipher, err := crypt.NewCipherFromKey(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	local := filepath.Join(t.TempDir(), "c")
+	require.NoError(t, os.WriteFile(local, data, 0644))
+
+	fc := newFakeClient()
+	fc.put(fc.AbsPath("plain/a"), data)
+	cm := NewCryptMan(fc, cipher).TmpDir(t.TempDir())
+	_, err = cm.UploadReader(ctx, bytes.NewReader(data), "enc/a")
+	require.NoError(t, err)
+	fc.maxFileSize = 1000
+	_, err = NewChunkMan(fc, 0).Up(ctx, local, "chunked/a")
+	require.NoError(t, err)
+	_, err = NewChunkMan(fc, 0).Crypt(cm).Up(ctx, local, "encchunked/a")
+	require.NoError(t, err)
+
+	for _, c := range []struct {
+		relpath        string
+		cryptMan       *CryptMan
+		offset, length int64
+	}{
+		{"plain/a", nil, 5, 10},
+		{"plain/a", nil, -7, 7},
+		{"enc/a", cm, 0, 10},
+		{"enc/a", cm, 1500, 20},
+		{"enc/a", cm, -7, 7},
+		{"chunked/a", nil, 995, 10},
+		{"chunked/a", nil, -7, 7},
+		{"encchunked/a", cm, 995, 2000},
+		{"encchunked/a", cm, -7, 7},
+		{"encchunked/a", cm, 0, -1},
+	} {
+		var buf bytes.Buffer
+		err := NewCatMan(fc).
+			Crypt(c.cryptMan).
+			Out(&buf).
+			Cat(ctx, c.relpath, c.offset, c.length)
+		require.NoError(t, err, "%s %d %d", c.relpath, c.offset, c.length)
+		start, n := catRange(int64(len(data)), c.offset, c.length)
+		assert.Equal(t, string(data[start:start+n]), buf.String(), "%s %d %d", c.relpath, c.offset, c.length)
+	}
+
+	t.Run("chunked range", func(t *testing.T) {
+		var buf bytes.Buffer
+		fc.calls = nil
+		require.NoError(t, NewCatMan(fc).Out(&buf).Cat(ctx, "chunked/a", 2995, -1))
+		assert.Equal(t, string(data[2995:]), buf.String())
+		// only the last chunk is fetched, from the offset
+		var downloads []string
+		for _, call := range fc.calls {
+			if strings.HasPrefix(call, "DownloadByDLink ") {
+				downloads = append(downloads, call)
+			}
+		}
+		if assert.Len(t, downloads, 1) {
+			assert.True(t, strings.HasSuffix(downloads[0], " bytes=995-999"), downloads[0])
+		}
+	})
+}
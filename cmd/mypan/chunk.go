@@ -0,0 +1,316 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"mypan/pkg/chunk"
+	"mypan/pkg/client"
+	"mypan/pkg/config"
+	"mypan/pkg/util"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// ChunkMan uploads files larger than the per-file size limit of the account
+// as numbered chunks plus a manifest
+type ChunkMan struct {
+	client    client.ClientI
+	cryptMan  *CryptMan
+	chunkSize int64
+}
+
+func NewChunkMan(client client.ClientI, chunkSize int64) *ChunkMan {
+	chm := &ChunkMan{
+		client:    client,
+		chunkSize: chunkSize,
+	}
+	return chm
+}
+
+func (chm *ChunkMan) Crypt(cryptMan *CryptMan) *ChunkMan {
+	chm.cryptMan = cryptMan
+	return chm
+}
+
+// NeedChunk tells whether a file of size bytes has to be chunked.  It's
+// false for a nil ChunkMan
+func (chm *ChunkMan) NeedChunk(ctx context.Context, size int64) (bool, error) {
+	if chm == nil {
+		return false, nil
+	}
+	storedSize := chm.cryptMan.StoredSize(size)
+	if storedSize <= client.MAX_FILE_SIZE_NORMAL {
+		return false, nil
+	}
+	limit, err := chm.client.MaxFileSize(ctx)
+	if err != nil {
+		return false, err
+	}
+	return storedSize > limit, nil
+}
+
+// chunkSizeWithin returns chunk size that fits within limit after encryption
+func (chm *ChunkMan) chunkSizeWithin(limit int64) int64 {
+	n := chm.chunkSize
+	if n <= 0 || n > limit {
+		n = limit
+	}
+	for n > 0 {
+		over := chm.cryptMan.StoredSize(n) - limit
+		if over <= 0 {
+			break
+		}
+		n -= over
+	}
+	return n
+}
+
+// Up uploads src as chunks and a manifest.  The result is that of the
+// manifest with size and md5 of the whole file, so that it can be cached as
+// one logical file
+func (chm *ChunkMan) Up(ctx context.Context, src, dst string) (UpResult, error) {
+	var result UpResult
+
+	f, err := os.Open(src)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return result, err
+	}
+	limit, err := chm.client.MaxFileSize(ctx)
+	if err != nil {
+		return result, err
+	}
+	chunkSize := chm.chunkSizeWithin(limit)
+
+	var (
+		dir      = path.Dir(dst)
+		name     = path.Base(dst)
+		wholeH   = md5.New()
+		off      int64
+		manifest = chunk.Manifest{
+			Version:   chunk.ManifestVersion,
+			Size:      fi.Size(),
+			ChunkSize: chunkSize,
+		}
+	)
+	for i, n := range chunk.Sizes(fi.Size(), chunkSize) {
+		chunkName := chunk.ChunkName(name, i)
+		chunkH := md5.New()
+		r := io.NewSectionReader(f, off, n)
+		glog.V(config.VerboseOn).Infof("upload chunk %d of %s: %d bytes", i, src, n)
+		if _, err := chm.upReader(ctx, r, n, io.MultiWriter(wholeH, chunkH), path.Join(dir, chunkName)); err != nil {
+			return result, errors.Wrapf(err, "chunk %d", i)
+		}
+		manifest.Chunks = append(manifest.Chunks, chunk.Chunk{
+			Name: chunkName,
+			Size: n,
+			Md5:  hex.EncodeToString(chunkH.Sum(nil)),
+		})
+		off += n
+	}
+	manifest.Md5 = hex.EncodeToString(wholeH.Sum(nil))
+
+	data := util.MustMarshalJSON(manifest)
+	result, err = chm.upReader(ctx, bytes.NewReader(data), int64(len(data)), nil, path.Join(dir, chunk.ManifestName(name)))
+	if err != nil {
+		return result, errors.Wrap(err, "manifest")
+	}
+	result.Size = uint64(chm.cryptMan.StoredSize(manifest.Size))
+	result.EncMd5 = ""
+	result.PlainMd5 = manifest.Md5
+	removeStale(ctx, chm.client, chm.cryptMan, dir, name, len(manifest.Chunks))
+	return result, nil
+}
+
+// upReader uploads size bytes from r, which are also written to w if it's
+// not nil.  Encrypted content is streamed.  Plain content is read through
+// for w before being uploaded from r directly, without spooling the chunk
+func (chm *ChunkMan) upReader(ctx context.Context, r io.ReadSeeker, size int64, w io.Writer, dst string) (UpResult, error) {
+	if cm := chm.cryptMan; cm != nil {
+		var tr io.Reader = r
+		if w != nil {
+			tr = io.TeeReader(r, w)
+		}
+		return cm.UploadReader(ctx, tr, dst)
+	}
+	if w != nil {
+		if _, err := io.Copy(w, r); err != nil {
+			return UpResult{}, errors.Wrap(err, "read")
+		}
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return UpResult{}, errors.Wrap(err, "seek")
+		}
+	}
+	resp, err := chm.client.UploadReadSeeker(ctx, r, size, dst)
+	return UpResult{UploadResponse: resp}, err
+}
+
+// removeStale removes files left in dir by earlier uploads of file name.
+// After a chunked upload of chunks chunks, they are the plain file and
+// chunks beyond.  After a plain upload, i.e. chunks is 0, they are the
+// manifest and all chunks, which would otherwise shadow the plain file
+func removeStale(
+	ctx context.Context,
+	client client.ClientI,
+	cryptMan *CryptMan,
+	dir, name string,
+	chunks int,
+) {
+	resp, err := client.ListEx(ctx, cryptMan.RemotePath(dir))
+	if err != nil {
+		glog.Warningf("list %s: %v", dir, err)
+		return
+	}
+	var stale []string
+	for _, v := range resp.List {
+		plainName, ok := cryptMan.PlainName(v.ServerFilename)
+		if !ok || v.IsDir != 0 {
+			continue
+		}
+		if chunks > 0 && plainName == name {
+			stale = append(stale, v.Path)
+		} else if base, ok := chunk.ParseManifestName(plainName); ok && base == name && chunks == 0 {
+			stale = append(stale, v.Path)
+		} else if base, i, ok := chunk.ParseChunkName(plainName); ok && base == name && i >= chunks {
+			stale = append(stale, v.Path)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	if _, err := client.DeleteMulti(ctx, stale); err != nil {
+		glog.Warningf("delete stale %s: %v", strings.Join(stale, ", "), err)
+	}
+}
+
+// readChunkManifest reads manifest at remote path relpath as stored on
+// server
+func readChunkManifest(
+	ctx context.Context,
+	client client.ClientI,
+	cryptMan *CryptMan,
+	relpath string,
+) (*chunk.Manifest, error) {
+	httpResp, err := client.Download(ctx, relpath)
+	if err != nil {
+		return nil, err
+	}
+	defer httpResp.Body.Close()
+	var buf bytes.Buffer
+	if cryptMan != nil {
+		w := cryptMan.DecryptWriter(&buf)
+		if _, err := io.Copy(w, httpResp.Body); err != nil {
+			return nil, err
+		}
+		if err := w.Close(); err != nil {
+			return nil, err
+		}
+	} else if _, err := io.Copy(&buf, httpResp.Body); err != nil {
+		return nil, err
+	}
+	manifest, err := chunk.ParseManifest(buf.Bytes())
+	if err != nil {
+		return nil, errors.Wrapf(err, "parse manifest %s", relpath)
+	}
+	return manifest, nil
+}
+
+// downChunked downloads chunks listed in the manifest at relpath, as stored
+// on server, and reassembles them
+func (dm *DownMan) downChunked(
+	ctx context.Context,
+	relpath string,
+	outpath string,
+) error {
+	manifest, err := readChunkManifest(ctx, dm.client, dm.cryptMan, relpath)
+	if err != nil {
+		return err
+	}
+	dir := path.Dir(relpath)
+	chunkPath := func(c chunk.Chunk) string {
+		return path.Join(dir, dm.cryptMan.RemotePath(c.Name))
+	}
+	if outpath == "" {
+		for _, c := range manifest.Chunks {
+			if err := dm.downRemote(ctx, chunkPath(c), ""); err != nil {
+				return errors.Wrap(err, c.Name)
+			}
+		}
+		return nil
+	}
+
+	if err := util.MkdirAll(filepath.Dir(outpath)); err != nil {
+		return err
+	}
+	tmpname := outpath + ".assembling"
+	f, err := os.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpname)
+	defer f.Close()
+	h := md5.New()
+	for i, c := range manifest.Chunks {
+		partpath := chunk.ChunkName(outpath, i)
+		if err := dm.downRemote(ctx, chunkPath(c), partpath); err != nil {
+			return errors.Wrap(err, c.Name)
+		}
+		if err := appendFile(io.MultiWriter(f, h), partpath); err != nil {
+			return err
+		}
+		os.Remove(partpath)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if gotMd5 := hex.EncodeToString(h.Sum(nil)); gotMd5 != manifest.Md5 {
+		return &DownCorruptError{
+			Path: dm.client.AbsPath(relpath),
+			Want: manifest.Md5,
+			Got:  gotMd5,
+		}
+	}
+	if err := os.Rename(tmpname, outpath); err != nil {
+		return err
+	}
+	if dm.cacheSetter != nil {
+		meta, err := dm.client.FileMetaByPath(ctx, relpath)
+		if err != nil {
+			glog.Warningf("filemeta %q: %v", relpath, err)
+			return nil
+		}
+		dm.cacheSetter.SetDst(
+			meta.Path, meta.Md5,
+			manifest.Md5,
+			manifest.Md5,
+			dm.cryptMan.StoredSize(manifest.Size),
+		)
+	}
+	return nil
+}
+
+func appendFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,503 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+
+	"mypan/pkg/client"
+	"mypan/pkg/util"
+)
+
+// fakeFile is a remote file or dir of fakeClient.  Path is absolute
+type fakeFile struct {
+	FsId           uint64 `json:"fs_id"`
+	Path           string `json:"path"`
+	ServerFilename string `json:"server_filename"`
+	Size           uint64 `json:"size"`
+	IsDir          int    `json:"isdir"`
+	Md5            string `json:"md5"`
+}
+
+// fakeClient serves listings of files kept in memory.  Methods not
+// implemented panic with the nil ClientI embedded
+type fakeClient struct {
+	client.ClientI
+	baseDir string
+	files   []fakeFile
+	calls   []string
+
+	// content of files by abspath
+	content map[string][]byte
+	// dlinks handed out, and those no longer valid
+	dlinks      int
+	staleDLinks map[string]bool
+	// maxFileSize is per-file size limit if not zero
+	maxFileSize int64
+	// contentMd5 makes downloads carry content-md5 of files having md5.
+	// corrupt tells how many more downloads of abspath are corrupted
+	contentMd5 bool
+	corrupt    map[string]int
+
+	accessAuth client.AccessAuth
+	// refresh answers OauthRefreshToken
+	refresh func() (client.OauthRefreshTokenResponse, error)
+}
+
+func newFakeClient() *fakeClient {
+	fc := &fakeClient{
+		baseDir:     "/apps/x",
+		content:     map[string][]byte{},
+		staleDLinks: map[string]bool{},
+		corrupt:     map[string]int{},
+	}
+	return fc
+}
+
+// addContent adds a file with data as content
+func (fc *fakeClient) addContent(relpath string, data []byte) *fakeClient {
+	fc.add(relpath, uint64(len(data)))
+	fc.content[fc.AbsPath(relpath)] = data
+	return fc
+}
+
+// add adds a file of size at relpath, and dirs above it.  relpath ending
+// with "/" is a dir
+func (fc *fakeClient) add(relpath string, size uint64) *fakeClient {
+	abspath := fc.AbsPath(strings.TrimSuffix(relpath, "/"))
+	for dir := path.Dir(abspath); dir != fc.baseDir && dir != "/"; dir = path.Dir(dir) {
+		if !fc.exists(dir) {
+			fc.files = append(fc.files, fakeFile{Path: dir, ServerFilename: path.Base(dir), IsDir: 1})
+		}
+	}
+	f := fakeFile{
+		FsId:           uint64(len(fc.files) + 1),
+		Path:           abspath,
+		ServerFilename: path.Base(abspath),
+		Size:           size,
+	}
+	if strings.HasSuffix(relpath, "/") {
+		f.IsDir = 1
+	}
+	fc.files = append(fc.files, f)
+	return fc
+}
+
+func (fc *fakeClient) exists(abspath string) bool {
+	for _, f := range fc.files {
+		if f.Path == abspath {
+			return true
+		}
+	}
+	return false
+}
+
+func (fc *fakeClient) GetAccessAuth() client.AccessAuth {
+	return fc.accessAuth
+}
+
+func (fc *fakeClient) SetAccessAuth(accessAuth client.AccessAuth) {
+	fc.accessAuth = accessAuth
+}
+
+func (fc *fakeClient) OauthRefreshToken(ctx context.Context) (client.OauthRefreshTokenResponse, error) {
+	return fc.refresh()
+}
+
+func (fc *fakeClient) AbsPath(relpath string) string {
+	if relpath == "" || relpath[0] != '/' {
+		return path.Join(fc.baseDir, relpath)
+	}
+	return relpath
+}
+
+// RelPath trims baseDir with the trailing slash as Client does
+func (fc *fakeClient) RelPath(abspath string) string {
+	return strings.TrimPrefix(abspath, fc.baseDir+"/")
+}
+
+// list returns files for which in returns true, decoded into v as the
+// list api response
+func (fc *fakeClient) list(in func(f fakeFile) bool, v interface{}) error {
+	var list []fakeFile
+	for _, f := range fc.files {
+		if in(f) {
+			list = append(list, f)
+		}
+	}
+	return json.Unmarshal(util.MustMarshalJSON(map[string]interface{}{"list": list}), v)
+}
+
+func (fc *fakeClient) ListEx(ctx context.Context, dir string) (client.ListResponse, error) {
+	var resp client.ListResponse
+	dir = fc.AbsPath(dir)
+	fc.calls = append(fc.calls, "ListEx "+dir)
+	err := fc.list(func(f fakeFile) bool {
+		return path.Dir(f.Path) == dir
+	}, &resp)
+	return resp, err
+}
+
+func (fc *fakeClient) ListAllEx(ctx context.Context, dir string) (client.ListAllResponse, error) {
+	var resp client.ListAllResponse
+	dir = fc.AbsPath(dir)
+	fc.calls = append(fc.calls, "ListAllEx "+dir)
+	err := fc.list(func(f fakeFile) bool {
+		return strings.HasPrefix(f.Path, strings.TrimSuffix(dir, "/")+"/")
+	}, &resp)
+	return resp, err
+}
+
+func (fc *fakeClient) stat(abspath string) (fakeFile, bool) {
+	for _, f := range fc.files {
+		if f.Path == abspath {
+			return f, true
+		}
+	}
+	return fakeFile{}, false
+}
+
+func (fc *fakeClient) FileMetaByPath(ctx context.Context, relpath string) (client.FileMetaResponse, error) {
+	abspath := fc.AbsPath(relpath)
+	fc.calls = append(fc.calls, "FileMetaByPath "+abspath)
+	f, ok := fc.stat(abspath)
+	if !ok {
+		return client.FileMetaResponse{}, &client.APIError{CodeInt: -9, IsError: true}
+	}
+	return fc.meta(f), nil
+}
+
+// FileMetas returns metas of files with fsIds that exist
+func (fc *fakeClient) FileMetas(ctx context.Context, fsIds []uint64) (client.FileMetasResponse, error) {
+	var s []string
+	for _, fsId := range fsIds {
+		s = append(s, strconv.FormatUint(fsId, 10))
+	}
+	fc.calls = append(fc.calls, "FileMetas "+strings.Join(s, " "))
+	var resp client.FileMetasResponse
+	for _, fsId := range fsIds {
+		for _, f := range fc.files {
+			if f.FsId == fsId {
+				resp.List = append(resp.List, fc.meta(f))
+				break
+			}
+		}
+	}
+	return resp, nil
+}
+
+// meta returns meta of f with a new dlink
+func (fc *fakeClient) meta(f fakeFile) client.FileMetaResponse {
+	fc.dlinks++
+	meta := client.FileMetaResponse{
+		DLink: fmt.Sprintf("%s?gen=%d", f.Path, fc.dlinks),
+		Path:  f.Path,
+		Size:  f.Size,
+		IsDir: f.IsDir,
+		FsId:  f.FsId,
+		Md5:   f.Md5,
+	}
+	return meta
+}
+
+// HeadByDLink answers with headers DownloadByDLink would give
+func (fc *fakeClient) HeadByDLink(ctx context.Context, dlink string) (*http.Response, error) {
+	fc.calls = append(fc.calls, "HeadByDLink "+dlink)
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+	}
+	fc.setContentMd5(resp, strings.SplitN(dlink, "?", 2)[0])
+	return resp, nil
+}
+
+func (fc *fakeClient) setContentMd5(resp *http.Response, abspath string) {
+	if !fc.contentMd5 {
+		return
+	}
+	if f, ok := fc.stat(abspath); ok && f.Md5 != "" {
+		resp.Header.Set("Content-Md5", f.Md5)
+	}
+}
+
+// DownloadByDLink serves content with range "bytes=N-" if asked for.
+// Stale dlinks are answered with 403
+func (fc *fakeClient) DownloadByDLink(ctx context.Context, dlink string, opts ...func(*http.Request)) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://fake/", nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, opt := range opts {
+		opt(req)
+	}
+	fc.calls = append(fc.calls, "DownloadByDLink "+dlink+" "+req.Header.Get("Range"))
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Header:     http.Header{},
+		Body:       io.NopCloser(bytes.NewReader(nil)),
+	}
+	if fc.staleDLinks[dlink] {
+		resp.StatusCode, resp.Status = http.StatusForbidden, "403 Forbidden"
+		return resp, nil
+	}
+	abspath := strings.SplitN(dlink, "?", 2)[0]
+	data := fc.content[abspath]
+	fc.setContentMd5(resp, abspath)
+	if fc.corrupt[abspath] > 0 && len(data) > 0 {
+		fc.corrupt[abspath]--
+		data = append([]byte{data[0] ^ 0xff}, data[1:]...)
+	}
+	if r := req.Header.Get("Range"); r != "" {
+		bounds := strings.SplitN(strings.TrimPrefix(r, "bytes="), "-", 2)
+		start, err := strconv.Atoi(bounds[0])
+		if err != nil || len(bounds) != 2 || start > len(data) {
+			return nil, fmt.Errorf("bad range %q", r)
+		}
+		end := len(data)
+		if bounds[1] != "" {
+			end, err = strconv.Atoi(bounds[1])
+			if err != nil || end < start {
+				return nil, fmt.Errorf("bad range %q", r)
+			}
+			if end++; end > len(data) {
+				end = len(data)
+			}
+		}
+		data = data[start:end]
+		resp.StatusCode, resp.Status = http.StatusPartialContent, "206 Partial Content"
+	}
+	resp.Body = io.NopCloser(bytes.NewReader(data))
+	return resp, nil
+}
+
+// Download serves content of file at relpath
+func (fc *fakeClient) Download(ctx context.Context, relpath string) (*http.Response, error) {
+	abspath := fc.AbsPath(relpath)
+	fc.calls = append(fc.calls, "Download "+abspath)
+	data, ok := fc.content[abspath]
+	if !ok {
+		return nil, &client.APIError{CodeInt: -9, IsError: true}
+	}
+	resp := &http.Response{
+		StatusCode: http.StatusOK,
+		Status:     "200 OK",
+		Body:       io.NopCloser(bytes.NewReader(data)),
+	}
+	return resp, nil
+}
+
+// Upload takes content of local file src
+func (fc *fakeClient) Upload(ctx context.Context, src, dst string, opts ...client.WriteOpt) (client.UploadResponse, error) {
+	data, err := os.ReadFile(src)
+	if err != nil {
+		return client.UploadResponse{}, err
+	}
+	abspath := fc.AbsPath(dst)
+	fc.calls = append(fc.calls, "Upload "+abspath)
+	// progress as Client reports it
+	if xlt, ok := ctx.Value(client.XloadTrackerKey).(client.XloadTrackerI); ok {
+		xlt.Start(int64(len(data)))
+		xlt.Increment(int64(len(data)))
+		xlt.Done()
+	}
+	return fc.put(abspath, data), nil
+}
+
+func (fc *fakeClient) UploadReader(ctx context.Context, r io.Reader, size int64, dst string, opts ...client.WriteOpt) (client.UploadResponse, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return client.UploadResponse{}, err
+	}
+	abspath := fc.AbsPath(dst)
+	fc.calls = append(fc.calls, "UploadReader "+abspath)
+	return fc.put(abspath, data), nil
+}
+
+func (fc *fakeClient) UploadReadSeeker(ctx context.Context, r io.ReadSeeker, size int64, dst string, opts ...client.WriteOpt) (client.UploadResponse, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return client.UploadResponse{}, err
+	}
+	abspath := fc.AbsPath(dst)
+	fc.calls = append(fc.calls, "UploadReadSeeker "+abspath)
+	return fc.put(abspath, data), nil
+}
+
+// put stores data at abspath, with md5 of content as that on server
+func (fc *fakeClient) put(abspath string, data []byte) client.UploadResponse {
+	if _, ok := fc.stat(abspath); !ok {
+		fc.add(abspath, uint64(len(data)))
+	}
+	sum := md5.Sum(data)
+	md5sum := hex.EncodeToString(sum[:])
+	for i := range fc.files {
+		if fc.files[i].Path == abspath {
+			fc.files[i].Size = uint64(len(data))
+			fc.files[i].Md5 = md5sum
+		}
+	}
+	fc.content[abspath] = data
+	return client.UploadResponse{Path: abspath, Size: uint64(len(data)), Md5: md5sum}
+}
+
+// MaxFileSize is maxFileSize if set
+func (fc *fakeClient) MaxFileSize(ctx context.Context) (int64, error) {
+	if fc.maxFileSize > 0 {
+		return fc.maxFileSize, nil
+	}
+	return client.MAX_FILE_SIZE_NORMAL, nil
+}
+
+func (fc *fakeClient) NewUploadSession(ctx context.Context, dst string, opts ...client.WriteOpt) (client.UploadSessionI, error) {
+	abspath := fc.AbsPath(dst)
+	fc.calls = append(fc.calls, "NewUploadSession "+abspath)
+	us := &fakeUploadSession{
+		fc:  fc,
+		dst: abspath,
+	}
+	return us, nil
+}
+
+// fakeUploadSession keeps content in memory.  Pieces may be written
+// concurrently
+type fakeUploadSession struct {
+	fc  *fakeClient
+	dst string
+
+	mu   sync.Mutex
+	data []byte
+}
+
+func (us *fakeUploadSession) WriteAt(ctx context.Context, off int64, r io.Reader) (int64, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if end := int(off) + len(data); end > len(us.data) {
+		us.data = append(us.data, make([]byte, end-len(us.data))...)
+	}
+	copy(us.data[off:], data)
+	return int64(len(data)), nil
+}
+
+// Create takes what's written, which must match blockList if given
+func (us *fakeUploadSession) Create(ctx context.Context, blockList []string, size int64) (client.UploadResponse, error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if int64(len(us.data)) != size {
+		return client.UploadResponse{}, fmt.Errorf("size mismatch: want %d, got %d", size, len(us.data))
+	}
+	for i, want := range blockList {
+		end := (i + 1) * client.UPLOAD_API_BLOCK_SIZE
+		if end > len(us.data) {
+			end = len(us.data)
+		}
+		sum := md5.Sum(us.data[i*client.UPLOAD_API_BLOCK_SIZE : end])
+		if hex.EncodeToString(sum[:]) != want {
+			return client.UploadResponse{}, fmt.Errorf("block %d: md5 mismatch", i)
+		}
+	}
+	us.fc.calls = append(us.fc.calls, "Create "+us.dst)
+	return us.fc.put(us.dst, us.data), nil
+}
+
+func (us *fakeUploadSession) Close() error {
+	return nil
+}
+
+// DeleteMulti removes files, and those under dirs, in fileList
+func (fc *fakeClient) DeleteMulti(ctx context.Context, fileList []string) (client.FileManagerResponse, error) {
+	fc.calls = append(fc.calls, "DeleteMulti "+strings.Join(fileList, " "))
+	for _, p := range fileList {
+		fc.remove(fc.AbsPath(p))
+	}
+	return client.FileManagerResponse{}, nil
+}
+
+func (fc *fakeClient) Delete(ctx context.Context, file string) (client.FileManagerResponse, error) {
+	return fc.DeleteMulti(ctx, []string{file})
+}
+
+func (fc *fakeClient) remove(abspath string) {
+	var files []fakeFile
+	for _, f := range fc.files {
+		if f.Path == abspath || strings.HasPrefix(f.Path, abspath+"/") {
+			delete(fc.content, f.Path)
+			continue
+		}
+		files = append(files, f)
+	}
+	fc.files = files
+}
+
+// CopyMulti copies files and dirs with what's under them, replacing dests
+func (fc *fakeClient) CopyMulti(ctx context.Context, pairs [][2]string, opts ...client.WriteOpt) (client.FileManagerResponse, error) {
+	var s []string
+	for _, pair := range pairs {
+		s = append(s, pair[0]+">"+pair[1])
+	}
+	fc.calls = append(fc.calls, "CopyMulti "+strings.Join(s, " "))
+	for _, pair := range pairs {
+		src, dst := fc.AbsPath(pair[0]), fc.AbsPath(pair[1])
+		f, ok := fc.stat(src)
+		if !ok {
+			return client.FileManagerResponse{}, &client.APIError{CodeInt: -9, IsError: true}
+		}
+		fc.remove(dst)
+		var copies []fakeFile
+		for _, f := range fc.files {
+			if f.Path == src || strings.HasPrefix(f.Path, src+"/") {
+				copies = append(copies, f)
+			}
+		}
+		if f.IsDir != 0 {
+			fc.add(fc.RelPath(dst)+"/", 0)
+		}
+		for _, f := range copies {
+			p := dst + strings.TrimPrefix(f.Path, src)
+			if f.IsDir != 0 {
+				if !fc.exists(p) {
+					fc.add(fc.RelPath(p)+"/", 0)
+				}
+				continue
+			}
+			fc.add(fc.RelPath(p), f.Size)
+			fc.files[len(fc.files)-1].Md5 = f.Md5
+			if data, ok := fc.content[f.Path]; ok {
+				fc.content[p] = data
+			}
+		}
+	}
+	return client.FileManagerResponse{}, nil
+}
+
+func (fc *fakeClient) Copy(ctx context.Context, path, dest string, opts ...client.WriteOpt) (client.FileManagerResponse, error) {
+	return fc.CopyMulti(ctx, [][2]string{{path, dest}}, opts...)
+}
+
+func (fc *fakeClient) MoveMulti(ctx context.Context, pairs [][2]string, opts ...client.WriteOpt) (client.FileManagerResponse, error) {
+	var s []string
+	for _, pair := range pairs {
+		s = append(s, pair[0]+">"+pair[1])
+	}
+	fc.calls = append(fc.calls, "MoveMulti "+strings.Join(s, " "))
+	return client.FileManagerResponse{}, nil
+}
@@ -0,0 +1,320 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"mypan/pkg/client"
+	"mypan/pkg/config"
+	"mypan/pkg/store"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+// How an argument is completed
+const (
+	pathArgNone = iota
+	pathArgRemote
+	pathArgRemoteDir
+	pathArgLocal
+	pathArgLocalDir
+)
+
+// pathArgKind returns how the i-th argument is completed.  The last of
+// kinds is for the rest
+func pathArgKind(kinds []int, i int) int {
+	if len(kinds) == 0 || i < 0 {
+		return pathArgNone
+	}
+	if i >= len(kinds) {
+		i = len(kinds) - 1
+	}
+	return kinds[i]
+}
+
+type pathEntry struct {
+	name  string
+	isDir bool
+}
+
+// completePath returns paths starting with word.  Dirs end with "/".
+// Files are left out if kind asks for dirs only
+func completePath(kind int, word string, readRemoteDir func(dir string) ([]pathEntry, error)) []string {
+	var (
+		dir  string
+		base = word
+	)
+	if i := strings.LastIndexByte(word, '/'); i >= 0 {
+		dir, base = word[:i+1], word[i+1:]
+	}
+	var (
+		ents []pathEntry
+		err  error
+	)
+	switch kind {
+	case pathArgRemote, pathArgRemoteDir:
+		ents, err = readRemoteDir(dir)
+	case pathArgLocal, pathArgLocalDir:
+		ents, err = readLocalDir(dir)
+	default:
+		return nil
+	}
+	if err != nil {
+		glog.V(config.VerboseOn).Infof("complete %q: %v", word, err)
+		return nil
+	}
+	dirOnly := kind == pathArgRemoteDir || kind == pathArgLocalDir
+	var candidates []string
+	for _, ent := range ents {
+		if !strings.HasPrefix(ent.name, base) {
+			continue
+		}
+		// hidden ones only when asked for
+		if base == "" && strings.HasPrefix(ent.name, ".") {
+			continue
+		}
+		if ent.isDir {
+			candidates = append(candidates, dir+ent.name+"/")
+		} else if !dirOnly {
+			candidates = append(candidates, dir+ent.name)
+		}
+	}
+	return candidates
+}
+
+func readLocalDir(dir string) ([]pathEntry, error) {
+	if dir == "" {
+		dir = "."
+	}
+	dirEnts, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	ents := make([]pathEntry, len(dirEnts))
+	for i, dirEnt := range dirEnts {
+		isDir := dirEnt.IsDir()
+		if dirEnt.Type()&os.ModeSymlink != 0 {
+			if fi, err := os.Stat(filepath.Join(dir, dirEnt.Name())); err == nil {
+				isDir = fi.IsDir()
+			}
+		}
+		ents[i] = pathEntry{name: dirEnt.Name(), isDir: isDir}
+	}
+	return ents, nil
+}
+
+// CompletionCacheEntry is a remote dir listing.  Names of dirs end with "/"
+type CompletionCacheEntry struct {
+	Time  time.Time `json:"time"`
+	Names []string  `json:"names"`
+}
+
+// CompletionCache keeps remote dir listings in cache store for shell
+// completion, which runs as a new process on each tab press
+type CompletionCache struct {
+	client   client.ClientI
+	cryptMan *CryptMan
+	store    store.StoreSerdeI
+	ttl      time.Duration
+}
+
+func NewCompletionCache(client client.ClientI, store store.StoreSerdeI) *CompletionCache {
+	cc := &CompletionCache{
+		client: client,
+		store:  store,
+		ttl:    time.Minute,
+	}
+	return cc
+}
+
+// Crypt makes dirs listed with plaintext names
+func (cc *CompletionCache) Crypt(cryptMan *CryptMan) *CompletionCache {
+	cc.cryptMan = cryptMan
+	return cc
+}
+
+func (cc *CompletionCache) TTL(ttl time.Duration) *CompletionCache {
+	cc.ttl = ttl
+	return cc
+}
+
+// ReadDir returns entries of plaintext remote dir, listed with ListEx if
+// the cached one is missing or stale.  Names are cached in plaintext, keyed
+// apart from listings without crypt
+func (cc *CompletionCache) ReadDir(ctx context.Context, dir string) ([]pathEntry, error) {
+	abspath := path.Clean(cc.client.AbsPath(cc.cryptMan.RemotePath(dir)))
+	key := abspath
+	if cc.cryptMan != nil {
+		key = "crypt:" + abspath
+	}
+	now := time.Now()
+	m := map[string]CompletionCacheEntry{}
+	if err := cc.store.Get(config.StoreKeyCompletionCache, &m); err != nil && !os.IsNotExist(errors.Cause(err)) {
+		glog.Warningf("load completion cache: %v", err)
+	}
+	ce, ok := m[key]
+	if !ok || now.Sub(ce.Time) >= cc.ttl {
+		resp, err := cc.client.ListEx(ctx, abspath)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list %q", abspath)
+		}
+		ce = CompletionCacheEntry{Time: now}
+		for _, ent := range resp.List {
+			name, _ := cc.cryptMan.PlainName(path.Base(ent.Path))
+			if ent.IsDir != 0 {
+				name += "/"
+			}
+			ce.Names = append(ce.Names, name)
+		}
+		for k, v := range m {
+			if now.Sub(v.Time) >= cc.ttl {
+				delete(m, k)
+			}
+		}
+		m[key] = ce
+		if err := cc.store.Set(config.StoreKeyCompletionCache, m); err != nil {
+			glog.Warningf("save completion cache: %v", err)
+		}
+	}
+	ents := make([]pathEntry, len(ce.Names))
+	for i, name := range ce.Names {
+		ents[i] = pathEntry{
+			name:  strings.TrimSuffix(name, "/"),
+			isDir: strings.HasSuffix(name, "/"),
+		}
+	}
+	return ents, nil
+}
+
+// completionShellEnv tells the shell completion is for.  Words are printed
+// escaped unless it is fish, which takes them as they are
+const completionShellEnv = "MYPAN_COMPLETION_SHELL"
+
+// complete prints candidates of word, the one under cursor as typed, one
+// per line.  Flags are completed if it starts with "-", then subcommands,
+// then paths of the argument by kinds
+func complete(cCtx *cli.Context, word string, kinds []int, readRemoteDir func(dir string) ([]pathEntry, error)) {
+	cur := word
+	if words, _ := shellSplit(word); len(words) > 0 {
+		cur = words[0].value
+	}
+	cmd := cCtx.Command
+	// help is added to each command
+	var subs []*cli.Command
+	for _, sub := range cmd.Subcommands {
+		if !sub.Hidden && sub.Name != "help" {
+			subs = append(subs, sub)
+		}
+	}
+	var candidates []string
+	switch {
+	case strings.HasPrefix(cur, "-"):
+		for _, flag := range cmd.Flags {
+			if vf, ok := flag.(cli.VisibleFlag); ok && !vf.IsVisible() {
+				continue
+			}
+			for _, name := range flag.Names() {
+				if utf8.RuneCountInString(name) > 1 {
+					name = "--" + name
+				} else {
+					name = "-" + name
+				}
+				if strings.HasPrefix(name, cur) {
+					candidates = append(candidates, name)
+				}
+			}
+		}
+	case len(subs) > 0:
+		if cCtx.NArg() > 1 {
+			break
+		}
+		for _, sub := range subs {
+			for _, name := range sub.Names() {
+				if strings.HasPrefix(name, cur) {
+					candidates = append(candidates, name)
+				}
+			}
+		}
+	default:
+		// word is the last of args, unless being the value of a flag
+		if n := cCtx.NArg(); n > 0 && cCtx.Args().Get(n-1) == word {
+			candidates = completePath(pathArgKind(kinds, n-1), cur, readRemoteDir)
+		}
+	}
+	escape := os.Getenv(completionShellEnv) != "fish"
+	for _, c := range candidates {
+		if escape {
+			c = shellEscape(c)
+		}
+		fmt.Fprintln(cCtx.App.Writer, c)
+	}
+}
+
+// setCommandsComplete sets complete on commands and their subcommands
+func setCommandsComplete(cmds []*cli.Command, complete cli.BashCompleteFunc) {
+	for _, cmd := range cmds {
+		if cmd.BashComplete == nil {
+			cmd.BashComplete = complete
+		}
+		setCommandsComplete(cmd.Subcommands, complete)
+	}
+}
+
+// completionScripts are to be sourced by shells.  They pass words up to
+// the cursor with --generate-bash-completion and take candidates one per
+// line.  Candidates ending with "/" are dirs, which take no trailing space
+var completionScripts = map[string]string{
+	"bash": `# bash completion for mypan
+_mypan_complete() {
+	local IFS=$'\n'
+	COMPREPLY=($(MYPAN_COMPLETION_SHELL=bash "${COMP_WORDS[0]}" "${COMP_WORDS[@]:1:COMP_CWORD}" --generate-bash-completion 2>/dev/null))
+	if [ "${#COMPREPLY[@]}" -eq 1 ] && [ "${COMPREPLY[0]%/}" != "${COMPREPLY[0]}" ]; then
+		compopt -o nospace
+	fi
+}
+complete -F _mypan_complete mypan
+`,
+	"zsh": `#compdef mypan
+# zsh completion for mypan
+_mypan() {
+	local -a candidates dirs others
+	local c
+	candidates=("${(@f)$(MYPAN_COMPLETION_SHELL=zsh "${words[1]}" "${(@)words[2,CURRENT]}" --generate-bash-completion 2>/dev/null)}")
+	for c in $candidates; do
+		[[ -z "$c" ]] && continue
+		if [[ "$c" == */ ]]; then
+			dirs+=("$c")
+		else
+			others+=("$c")
+		fi
+	done
+	(( $#dirs )) && compadd -U -Q -S '' -- $dirs
+	(( $#others )) && compadd -U -Q -- $others
+}
+# autoloaded from fpath, or sourced
+if [[ "${funcstack[1]}" == _mypan ]]; then
+	_mypan "$@"
+else
+	compdef _mypan mypan
+fi
+`,
+	"fish": `# fish completion for mypan
+function __mypan_complete
+	set -l words (commandline -opc)
+	set -l cur (commandline -ct)
+	MYPAN_COMPLETION_SHELL=fish $words[1] $words[2..-1] "$cur" --generate-bash-completion 2>/dev/null
+end
+complete -c mypan -f -a '(__mypan_complete)'
+`,
+}
@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mypan/pkg/crypt"
+	"mypan/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompletePath(t *testing.T) {
+	var listed []string
+	readRemoteDir := func(dir string) ([]pathEntry, error) {
+		listed = append(listed, dir)
+		return []pathEntry{
+			{name: "docs", isDir: true},
+			{name: "doc.txt"},
+			{name: ".hidden"},
+		}, nil
+	}
+	assert.Equal(t, []string{"docs/", "doc.txt"}, completePath(pathArgRemote, "", readRemoteDir))
+	assert.Equal(t, []string{"a/docs/"}, completePath(pathArgRemoteDir, "a/do", readRemoteDir))
+	assert.Equal(t, []string{"/.hidden"}, completePath(pathArgRemote, "/.h", readRemoteDir))
+	assert.Equal(t, []string{"", "a/", "/"}, listed)
+	assert.Empty(t, completePath(pathArgNone, "", readRemoteDir))
+
+	dir := t.TempDir()
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), nil, 0644))
+	require.NoError(t, os.Symlink("sub", filepath.Join(dir, "link")))
+	assert.ElementsMatch(t, []string{dir + "/sub/", dir + "/file", dir + "/link/"}, completePath(pathArgLocal, dir+"/", nil))
+	assert.ElementsMatch(t, []string{dir + "/sub/", dir + "/link/"}, completePath(pathArgLocalDir, dir+"/", nil))
+}
+
+func TestPathArgKind(t *testing.T) {
+	kinds := []int{pathArgRemote, pathArgLocal}
+	assert.Equal(t, pathArgRemote, pathArgKind(kinds, 0))
+	assert.Equal(t, pathArgLocal, pathArgKind(kinds, 1))
+	assert.Equal(t, pathArgLocal, pathArgKind(kinds, 5))
+	assert.Equal(t, pathArgNone, pathArgKind(kinds, -1))
+	assert.Equal(t, pathArgNone, pathArgKind(nil, 0))
+}
+
+func TestCompletionCacheCrypt(t *testing.T) {
+	ctx := context.Background()
+	cipher, err := crypt.NewCipherFromKey(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	dirStore, err := store.NewDirStore(t.TempDir())
+	require.NoError(t, err)
+	jsonStore := store.NewJSONStore(dirStore)
+	fc := newFakeClient().
+		add(cipher.EncryptPath("d/a.txt"), 1).
+		add(cipher.EncryptPath("d/e/b.txt"), 1)
+	cm := NewCryptMan(fc, cipher).EncryptNames(true)
+
+	ents, err := NewCompletionCache(fc, jsonStore).Crypt(cm).ReadDir(ctx, "d/")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []pathEntry{{name: "a.txt"}, {name: "e", isDir: true}}, ents)
+	assert.Equal(t, []string{"ListEx /apps/x/" + cipher.EncryptPath("d")}, fc.calls)
+
+	// listed again without crypt, the cached plaintext names are not used
+	ents, err = NewCompletionCache(fc, jsonStore).ReadDir(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []pathEntry{{name: cipher.EncryptName("d"), isDir: true}}, ents)
+	ents, err = NewCompletionCache(fc, jsonStore).Crypt(cm).ReadDir(ctx, "")
+	require.NoError(t, err)
+	assert.Equal(t, []pathEntry{{name: "d", isDir: true}}, ents)
+}
@@ -0,0 +1,281 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"mypan/pkg/config"
+
+	"github.com/pkg/errors"
+	"github.com/urfave/cli/v2"
+)
+
+const (
+	ConfigSourceFlag    = "flag"
+	ConfigSourceEnv     = "env"
+	ConfigSourceFile    = "file"
+	ConfigSourceDefault = "default"
+)
+
+// configurableGlobalFlags can be set in the config file.  configdir is not
+// here as it is where the config file is looked up
+var configurableGlobalFlags = []string{
+	"appid",
+	"appkey",
+	"secretkey",
+	"appbasedir",
+	"cachedir",
+	"timeout",
+	"noprogress",
+	"progress",
+	"progress-file",
+	"crypt-passphrase",
+	"crypt-keyfile",
+	"crypt-names",
+	"bwlimit",
+	"chunk",
+	"chunk-size",
+	"format",
+}
+
+type ConfigShowEntry struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// ConfigMan applies values from the config file to flags not set on command
+// line or by env vars.  It records where each value came from
+type ConfigMan struct {
+	file    *config.File
+	sources map[string]string
+}
+
+func NewConfigMan() *ConfigMan {
+	cm := &ConfigMan{
+		file:    &config.File{},
+		sources: map[string]string{},
+	}
+	return cm
+}
+
+func (cm *ConfigMan) Load(dir string) error {
+	file, err := config.LoadFile(dir)
+	if err != nil {
+		return errors.Wrap(err, "load config file")
+	}
+	cm.file = file
+	return nil
+}
+
+// Jobs returns scheduled sync jobs declared in the config file
+func (cm *ConfigMan) Jobs() []config.Job {
+	return cm.file.Jobs
+}
+
+func (cm *ConfigMan) fileSource() string {
+	return fmt.Sprintf("%s:%s", ConfigSourceFile, cm.file.Path)
+}
+
+func (cm *ConfigMan) ApplyGlobal(cCtx *cli.Context) error {
+	for _, name := range configurableGlobalFlags {
+		key := name
+		if err := cm.apply(cCtx, key, name, cm.file.Global); err != nil {
+			return err
+		}
+	}
+	for name := range cm.file.Global {
+		if !cm.isConfigurableGlobalFlag(name) {
+			return fmt.Errorf("%s: unknown global option %q", cm.file.Path, name)
+		}
+	}
+	return nil
+}
+
+// ApplyCommand applies per-command defaults.  It's meant to be used as
+// cli.Command.Before
+func (cm *ConfigMan) ApplyCommand(cCtx *cli.Context) error {
+	cmd := cCtx.Command
+	if cmd == nil {
+		return nil
+	}
+	cmdName := commandPath(cCtx)
+	// options are keyed by primary names of flags, aliases resolved
+	opts := map[string]interface{}{}
+	for _, name := range config.SortedKeys(cm.file.Commands[cmdName]) {
+		primary, ok := flagPrimaryName(cmd.Flags, name)
+		if !ok {
+			return fmt.Errorf("%s: command %q has no option %q", cm.file.Path, cmdName, name)
+		}
+		if _, ok := opts[primary]; ok {
+			return fmt.Errorf("%s: command %q has option %q set more than once", cm.file.Path, cmdName, primary)
+		}
+		opts[primary] = cm.file.Commands[cmdName][name]
+	}
+	for _, f := range cmd.Flags {
+		name := f.Names()[0]
+		key := cmdName + "." + name
+		if err := cm.apply(cCtx, key, name, opts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (cm *ConfigMan) apply(
+	cCtx *cli.Context,
+	key, name string,
+	opts map[string]interface{},
+) error {
+	if source := flagSource(cCtx, name); source != "" {
+		cm.sources[key] = source
+		return nil
+	}
+	v, ok := opts[name]
+	if !ok {
+		cm.sources[key] = ConfigSourceDefault
+		return nil
+	}
+	for _, s := range config.FileValues(v) {
+		if err := cCtx.Set(name, s); err != nil {
+			return errors.Wrapf(err, "%s: set %s", cm.file.Path, key)
+		}
+	}
+	cm.sources[key] = cm.fileSource()
+	return nil
+}
+
+func (cm *ConfigMan) isConfigurableGlobalFlag(name string) bool {
+	for _, n := range configurableGlobalFlags {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isSecretFlag tells whether value of flag name should not be shown
+func (cm *ConfigMan) isSecretFlag(name string) bool {
+	return name == "crypt-passphrase"
+}
+
+// Show returns the effective global options and file provided per-command
+// defaults
+func (cm *ConfigMan) Show(cCtx *cli.Context) []ConfigShowEntry {
+	var ents []ConfigShowEntry
+	for _, name := range configurableGlobalFlags {
+		value := fmt.Sprint(cCtx.Value(name))
+		if cm.isSecretFlag(name) && value != "" {
+			value = "***"
+		}
+		ents = append(ents, ConfigShowEntry{
+			Name:   name,
+			Value:  value,
+			Source: cm.sources[name],
+		})
+	}
+	cmdNames := make([]string, 0, len(cm.file.Commands))
+	for cmdName := range cm.file.Commands {
+		cmdNames = append(cmdNames, cmdName)
+	}
+	sort.Strings(cmdNames)
+	for _, cmdName := range cmdNames {
+		opts := cm.file.Commands[cmdName]
+		for _, name := range config.SortedKeys(opts) {
+			ents = append(ents, ConfigShowEntry{
+				Name:   cmdName + "." + name,
+				Value:  strings.Join(config.FileValues(opts[name]), ","),
+				Source: cm.fileSource(),
+			})
+		}
+	}
+	return ents
+}
+
+// flagSource returns where the value of flag name came from.  It returns
+// empty string if the flag was not set
+func flagSource(cCtx *cli.Context, name string) string {
+	if !cCtx.IsSet(name) {
+		return ""
+	}
+	f := lookupFlag(cCtx, name)
+	if f == nil || !f.IsSet() {
+		return ConfigSourceFlag
+	}
+	// cli.Flag.IsSet() reports true only when the value came from env
+	// vars.  Tell whether it was then overridden on command line
+	envFlag, ok := f.(interface{ GetEnvVars() []string })
+	if !ok {
+		return ConfigSourceEnv
+	}
+	for _, env := range envFlag.GetEnvVars() {
+		if v, ok := os.LookupEnv(env); ok {
+			if fmt.Sprint(cCtx.Value(name)) == v {
+				return ConfigSourceEnv
+			}
+			break
+		}
+	}
+	return ConfigSourceFlag
+}
+
+func lookupFlag(cCtx *cli.Context, name string) cli.Flag {
+	for _, c := range cCtx.Lineage() {
+		var flags []cli.Flag
+		if c.Command != nil {
+			flags = c.Command.Flags
+		} else if c.App != nil {
+			flags = c.App.Flags
+		}
+		for _, f := range flags {
+			if _, ok := flagPrimaryName([]cli.Flag{f}, name); ok {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+// flagPrimaryName returns the first name of the flag having name, which can
+// be an alias
+func flagPrimaryName(flags []cli.Flag, name string) (string, bool) {
+	for _, f := range flags {
+		for _, n := range f.Names() {
+			if n == name {
+				return f.Names()[0], true
+			}
+		}
+	}
+	return "", false
+}
+
+// commandPath returns space separated names of the command and its parents,
+// e.g. "auth status"
+func commandPath(cCtx *cli.Context) string {
+	var names []string
+	for _, c := range cCtx.Lineage() {
+		if cmd := c.Command; cmd != nil {
+			names = append([]string{cmd.Name}, names...)
+		}
+	}
+	// the first one is the root command
+	if len(names) > 0 {
+		names = names[1:]
+	}
+	return strings.Join(names, " ")
+}
+
+// setCommandsBefore sets before on commands and their subcommands
+func setCommandsBefore(cmds []*cli.Command, before cli.BeforeFunc) {
+	for _, cmd := range cmds {
+		if cmd.Before == nil {
+			cmd.Before = before
+		}
+		setCommandsBefore(cmd.Subcommands, before)
+	}
+}
@@ -0,0 +1,72 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"testing"
+
+	"mypan/pkg/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli/v2"
+)
+
+func TestConfigManApplyCommandAlias(t *testing.T) {
+	run := func(opts map[string]interface{}) (int, error) {
+		cm := NewConfigMan()
+		cm.file = &config.File{
+			Path:     "config.toml",
+			Commands: map[string]map[string]interface{}{"syncup": opts},
+		}
+		var parallel int
+		app := &cli.App{
+			Commands: []*cli.Command{{
+				Name:   "syncup",
+				Flags:  []cli.Flag{&cli.IntFlag{Name: "parallel", Aliases: []string{"p"}, Value: 1}},
+				Before: cm.ApplyCommand,
+				Action: func(cCtx *cli.Context) error {
+					parallel = cCtx.Int("parallel")
+					return nil
+				},
+			}},
+		}
+		err := app.Run([]string{"mypan", "syncup"})
+		return parallel, err
+	}
+
+	parallel, err := run(map[string]interface{}{"p": int64(4)})
+	require.NoError(t, err)
+	assert.Equal(t, 4, parallel)
+
+	_, err = run(map[string]interface{}{"p": int64(4), "parallel": int64(2)})
+	assert.Error(t, err)
+	_, err = run(map[string]interface{}{"q": int64(4)})
+	assert.Error(t, err)
+}
+
+func TestConfigManShowSorted(t *testing.T) {
+	cm := NewConfigMan()
+	cm.file = &config.File{
+		Path: "config.toml",
+		Commands: map[string]map[string]interface{}{
+			"syncup":   {"parallel": int64(4)},
+			"down":     {"ondup": "overwrite"},
+			"syncdown": {"dryrun": true},
+		},
+	}
+	app := &cli.App{
+		Action: func(cCtx *cli.Context) error {
+			var names []string
+			for _, ent := range cm.Show(cCtx) {
+				if ent.Source == cm.fileSource() {
+					names = append(names, ent.Name)
+				}
+			}
+			assert.Equal(t, []string{"down.ondup", "syncdown.dryrun", "syncup.parallel"}, names)
+			return nil
+		},
+	}
+	require.NoError(t, app.Run([]string{"mypan"}))
+}
@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"strings"
+
+	"mypan/pkg/client"
+	"mypan/pkg/crypt"
+	"mypan/pkg/util"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// UpResult is the result of uploading a file
+type UpResult struct {
+	client.UploadResponse
+
+	// EncMd5 and PlainMd5 are md5 of the uploaded ciphertext and the
+	// plaintext.  They are set only when encryption is enabled
+	EncMd5   string `json:"enc_md5,omitempty"`
+	PlainMd5 string `json:"plain_md5,omitempty"`
+}
+
+// CryptMan applies client side encryption to file content and optionally
+// to names under the app base dir.  Methods of a nil CryptMan leave things
+// as is
+type CryptMan struct {
+	client       client.ClientI
+	cipher       *crypt.Cipher
+	encryptNames bool
+	tmpDir       string
+}
+
+func NewCryptMan(client client.ClientI, cipher *crypt.Cipher) *CryptMan {
+	cm := &CryptMan{
+		client: client,
+		cipher: cipher,
+		tmpDir: os.TempDir(),
+	}
+	return cm
+}
+
+func (cm *CryptMan) EncryptNames(encryptNames bool) *CryptMan {
+	cm.encryptNames = encryptNames
+	return cm
+}
+
+// TmpDir sets where encrypted content is staged before upload
+func (cm *CryptMan) TmpDir(tmpDir string) *CryptMan {
+	cm.tmpDir = tmpDir
+	return cm
+}
+
+// RemotePath maps plaintext remote path p to the one stored on server
+func (cm *CryptMan) RemotePath(p string) string {
+	if cm == nil || !cm.encryptNames {
+		return p
+	}
+	return cm.mapPath(p, func(rel string) string {
+		return cm.cipher.EncryptPath(rel)
+	})
+}
+
+// PlainPath maps remote path p stored on server to plaintext.  Components
+// that cannot be decrypted are left as is
+func (cm *CryptMan) PlainPath(p string) string {
+	if cm == nil || !cm.encryptNames {
+		return p
+	}
+	return cm.mapPath(p, func(rel string) string {
+		parts := strings.Split(rel, "/")
+		for i, part := range parts {
+			if name, ok := cm.PlainName(part); ok {
+				parts[i] = name
+			}
+		}
+		return strings.Join(parts, "/")
+	})
+}
+
+// mapPath applies fn to part of p relative to the app base dir.  Paths
+// outside of it are not touched
+func (cm *CryptMan) mapPath(p string, fn func(rel string) string) string {
+	if !strings.HasPrefix(p, "/") {
+		return fn(p)
+	}
+	base := cm.client.AbsPath("")
+	rel := strings.TrimPrefix(p, base+"/")
+	if rel == p {
+		return p
+	}
+	return cm.client.AbsPath(fn(rel))
+}
+
+// PlainName decrypts a single name stored on server.  It returns false if
+// the name cannot be decrypted
+func (cm *CryptMan) PlainName(name string) (string, bool) {
+	if cm == nil || !cm.encryptNames || name == "" || name == "." || name == ".." {
+		return name, true
+	}
+	plain, err := cm.cipher.DecryptName(name)
+	if err != nil {
+		return name, false
+	}
+	return plain, true
+}
+
+// PlainSize returns plaintext size of content of size bytes stored on server
+func (cm *CryptMan) PlainSize(size int64) int64 {
+	if cm == nil {
+		return size
+	}
+	plainSize, err := crypt.DecryptedSize(size)
+	if err != nil {
+		return size
+	}
+	return plainSize
+}
+
+// StoredSize returns size on server of plaintext of size bytes
+func (cm *CryptMan) StoredSize(size int64) int64 {
+	if cm == nil {
+		return size
+	}
+	return crypt.EncryptedSize(size)
+}
+
+// Upload encrypts src to a temporary file then uploads it
+func (cm *CryptMan) Upload(ctx context.Context, src, dst string, opts ...client.WriteOpt) (UpResult, error) {
+	var result UpResult
+
+	f, err := os.Open(src)
+	if err != nil {
+		return result, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return result, err
+	}
+	if err := util.MkdirAll(cm.tmpDir); err != nil {
+		return result, err
+	}
+	tmpf, err := os.CreateTemp(cm.tmpDir, "up-*.enc")
+	if err != nil {
+		return result, err
+	}
+	tmpname := tmpf.Name()
+	defer os.Remove(tmpname)
+
+	var (
+		plainH = md5.New()
+		encH   = md5.New()
+	)
+	r, err := cm.cipher.EncryptReader(io.TeeReader(f, plainH))
+	if err != nil {
+		tmpf.Close()
+		return result, err
+	}
+	_, err = io.Copy(io.MultiWriter(tmpf, encH), r)
+	if closeErr := tmpf.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return result, errors.Wrapf(err, "encrypt %s", src)
+	}
+	// uploaded along as local mtime
+	if err := os.Chtimes(tmpname, fi.ModTime(), fi.ModTime()); err != nil {
+		glog.Warningf("chtimes %s: %v", tmpname, err)
+	}
+
+	resp, err := cm.client.Upload(ctx, tmpname, cm.RemotePath(dst), opts...)
+	if err != nil {
+		return result, err
+	}
+	result.UploadResponse = resp
+	if resp.Skipped {
+		return result, nil
+	}
+	result.EncMd5 = hex.EncodeToString(encH.Sum(nil))
+	result.PlainMd5 = hex.EncodeToString(plainH.Sum(nil))
+	return result, nil
+}
+
+// UploadReader encrypts content read from r while uploading it
+func (cm *CryptMan) UploadReader(ctx context.Context, r io.Reader, dst string, opts ...client.WriteOpt) (UpResult, error) {
+	var (
+		result UpResult
+		plainH = md5.New()
+		encH   = md5.New()
+	)
+	encR, err := cm.cipher.EncryptReader(io.TeeReader(r, plainH))
+	if err != nil {
+		return result, err
+	}
+	resp, err := cm.client.UploadReader(ctx, io.TeeReader(encR, encH), -1, cm.RemotePath(dst), opts...)
+	if err != nil {
+		return result, err
+	}
+	result.UploadResponse = resp
+	if resp.Skipped {
+		return result, nil
+	}
+	result.EncMd5 = hex.EncodeToString(encH.Sum(nil))
+	result.PlainMd5 = hex.EncodeToString(plainH.Sum(nil))
+	return result, nil
+}
+
+// DecryptWriter returns a writer decrypting content written to it
+func (cm *CryptMan) DecryptWriter(w io.Writer) io.WriteCloser {
+	return cm.cipher.DecryptWriter(w)
+}
+
+// DecryptFile decrypts src into dst then removes src.  It returns md5 of the
+// plaintext
+func (cm *CryptMan) DecryptFile(src, dst string) (string, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	tmpname := dst + ".decrypting"
+	tmpf, err := os.Create(tmpname)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmpname)
+
+	h := md5.New()
+	w := cm.cipher.DecryptWriter(io.MultiWriter(tmpf, h))
+	_, err = io.Copy(w, f)
+	if err == nil {
+		err = w.Close()
+	}
+	if closeErr := tmpf.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", errors.Wrapf(err, "decrypt %s", src)
+	}
+	if err := os.Rename(tmpname, dst); err != nil {
+		return "", err
+	}
+	f.Close()
+	if err := os.Remove(src); err != nil {
+		glog.Warningf("remove %s: %v", src, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
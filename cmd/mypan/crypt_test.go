@@ -0,0 +1,31 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"mypan/pkg/crypt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCryptManPaths(t *testing.T) {
+	cipher, err := crypt.NewCipherFromKey(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	cm := NewCryptMan(newFakeClient(), cipher).EncryptNames(true)
+	enc := cipher.EncryptPath("a/b")
+
+	assert.Equal(t, enc, cm.RemotePath("a/b"))
+	assert.Equal(t, "/apps/x/"+enc, cm.RemotePath("/apps/x/a/b"))
+	assert.Equal(t, "/apps/x/a/b", cm.PlainPath("/apps/x/"+enc))
+	// outside of the app base dir
+	assert.Equal(t, "/apps/xy/a", cm.RemotePath("/apps/xy/a"))
+	assert.Equal(t, "/apps/x", cm.RemotePath("/apps/x"))
+
+	var nilMan *CryptMan
+	assert.Equal(t, "/apps/x/a/b", nilMan.RemotePath("/apps/x/a/b"))
+}
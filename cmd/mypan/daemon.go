@@ -0,0 +1,342 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"mypan/pkg/config"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"github.com/robfig/cron/v3"
+)
+
+const (
+	DaemonSocketName = "daemon.sock"
+)
+
+type DaemonJobFunc func(ctx context.Context, job config.Job) error
+
+type DaemonJobResult struct {
+	Start time.Time `json:"start"`
+	End   time.Time `json:"end"`
+	Error string    `json:"error,omitempty"`
+}
+
+type DaemonJobStatus struct {
+	config.Job
+
+	Queued  bool             `json:"queued"`
+	Running bool             `json:"running"`
+	Next    time.Time        `json:"next"`
+	Last    *DaemonJobResult `json:"last,omitempty"`
+}
+
+type daemonJob struct {
+	job     config.Job
+	entryId cron.EntryID
+	queued  bool
+	running bool
+	last    *DaemonJobResult
+}
+
+// Daemon keeps access token fresh and runs scheduled sync jobs.  Jobs are
+// run one at a time as they share the same cache stores
+type Daemon struct {
+	authMan    *AuthMan
+	jobFunc    DaemonJobFunc
+	socketPath string
+
+	ctx   context.Context
+	cron  *cron.Cron
+	runMu *sync.Mutex
+
+	mu   *sync.Mutex
+	jobs map[string]*daemonJob
+}
+
+func NewDaemon(
+	authMan *AuthMan,
+	jobs []config.Job,
+	jobFunc DaemonJobFunc,
+	socketPath string,
+) *Daemon {
+	d := &Daemon{
+		authMan:    authMan,
+		jobFunc:    jobFunc,
+		socketPath: socketPath,
+
+		cron:  cron.New(),
+		runMu: &sync.Mutex{},
+
+		mu:   &sync.Mutex{},
+		jobs: map[string]*daemonJob{},
+	}
+	for _, job := range jobs {
+		d.jobs[job.Name] = &daemonJob{
+			job: job,
+		}
+	}
+	return d
+}
+
+func (d *Daemon) Run(ctx context.Context) error {
+	d.ctx = ctx
+	for name, dj := range d.jobs {
+		name := name
+		entryId, err := d.cron.AddFunc(dj.job.Schedule, func() {
+			if err := d.trigger(name); err != nil {
+				glog.Warningf("job %s: %v", name, err)
+			}
+		})
+		if err != nil {
+			return errors.Wrapf(err, "job %s: schedule %q", name, dj.job.Schedule)
+		}
+		dj.entryId = entryId
+		glog.Infof("job %s: scheduled %q", name, dj.job.Schedule)
+	}
+
+	ln, err := d.listen()
+	if err != nil {
+		return err
+	}
+	srv := &http.Server{
+		Handler: d,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+
+	go d.authMan.RefreshAccessTokenLoop(ctx)
+	d.cron.Start()
+	defer func() {
+		<-d.cron.Stop().Done()
+	}()
+
+	glog.Infof("daemon: listening on %s", d.socketPath)
+	if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+func (d *Daemon) listen() (net.Listener, error) {
+	// remove stale socket left by previous run
+	if err := os.Remove(d.socketPath); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", d.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(d.socketPath, os.FileMode(0600)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+var errDaemonJobNotFound = fmt.Errorf("job not found")
+var errDaemonJobRunning = fmt.Errorf("job already running")
+var errDaemonJobQueued = fmt.Errorf("job already queued")
+
+// trigger queues job name to run in the background.  It's running once
+// other jobs are done
+func (d *Daemon) trigger(name string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dj, ok := d.jobs[name]
+	if !ok {
+		return errDaemonJobNotFound
+	}
+	if dj.running {
+		return errDaemonJobRunning
+	}
+	if dj.queued {
+		return errDaemonJobQueued
+	}
+	dj.queued = true
+	go d.runJob(d.ctx, dj)
+	return nil
+}
+
+func (d *Daemon) runJob(ctx context.Context, dj *daemonJob) {
+	d.runMu.Lock()
+	defer d.runMu.Unlock()
+
+	d.mu.Lock()
+	dj.queued = false
+	dj.running = true
+	d.mu.Unlock()
+
+	name := dj.job.Name
+	glog.Infof("job %s: start", name)
+	result := &DaemonJobResult{
+		Start: time.Now(),
+	}
+	err := d.jobFunc(ctx, dj.job)
+	result.End = time.Now()
+	if err != nil {
+		result.Error = err.Error()
+		glog.Errorf("job %s: %v", name, err)
+	} else {
+		glog.Infof("job %s: done in %s", name, result.End.Sub(result.Start))
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dj.running = false
+	dj.last = result
+}
+
+func (d *Daemon) status(dj *daemonJob) DaemonJobStatus {
+	st := DaemonJobStatus{
+		Job:     dj.job,
+		Queued:  dj.queued,
+		Running: dj.running,
+		Last:    dj.last,
+	}
+	if entryId := dj.entryId; entryId != 0 {
+		st.Next = d.cron.Entry(entryId).Next
+	}
+	return st
+}
+
+// ServeHTTP implements the control API
+//
+//	GET  /jobs
+//	GET  /jobs/NAME
+//	POST /jobs/NAME/trigger
+func (d *Daemon) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	path := strings.Trim(req.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case len(parts) == 1 && parts[0] == "jobs" && req.Method == http.MethodGet:
+		d.mu.Lock()
+		var sts []DaemonJobStatus
+		for _, name := range d.jobNames() {
+			sts = append(sts, d.status(d.jobs[name]))
+		}
+		d.mu.Unlock()
+		daemonReply(w, http.StatusOK, sts)
+	case len(parts) == 2 && parts[0] == "jobs" && req.Method == http.MethodGet:
+		d.mu.Lock()
+		dj, ok := d.jobs[parts[1]]
+		var st DaemonJobStatus
+		if ok {
+			st = d.status(dj)
+		}
+		d.mu.Unlock()
+		if !ok {
+			daemonReplyErr(w, http.StatusNotFound, errDaemonJobNotFound)
+			return
+		}
+		daemonReply(w, http.StatusOK, st)
+	case len(parts) == 3 && parts[0] == "jobs" && parts[2] == "trigger" && req.Method == http.MethodPost:
+		switch err := d.trigger(parts[1]); err {
+		case nil:
+			daemonReply(w, http.StatusAccepted, nil)
+		case errDaemonJobNotFound:
+			daemonReplyErr(w, http.StatusNotFound, err)
+		case errDaemonJobRunning, errDaemonJobQueued:
+			daemonReplyErr(w, http.StatusConflict, err)
+		default:
+			daemonReplyErr(w, http.StatusInternalServerError, err)
+		}
+	default:
+		daemonReplyErr(w, http.StatusNotFound, fmt.Errorf("unknown request %s %s", req.Method, req.URL.Path))
+	}
+}
+
+func (d *Daemon) jobNames() []string {
+	m := map[string]interface{}{}
+	for name := range d.jobs {
+		m[name] = nil
+	}
+	return config.SortedKeys(m)
+}
+
+type daemonError struct {
+	Error string `json:"error"`
+}
+
+func daemonReply(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func daemonReplyErr(w http.ResponseWriter, code int, err error) {
+	daemonReply(w, code, daemonError{Error: err.Error()})
+}
+
+// DaemonClient talks to the daemon control API
+type DaemonClient struct {
+	httpclient *http.Client
+}
+
+func NewDaemonClient(socketPath string) *DaemonClient {
+	dialer := &net.Dialer{}
+	dc := &DaemonClient{
+		httpclient: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+	return dc
+}
+
+func (dc *DaemonClient) Jobs(ctx context.Context) ([]DaemonJobStatus, error) {
+	var sts []DaemonJobStatus
+	err := dc.do(ctx, http.MethodGet, "/jobs", &sts)
+	return sts, err
+}
+
+func (dc *DaemonClient) Job(ctx context.Context, name string) (DaemonJobStatus, error) {
+	var st DaemonJobStatus
+	err := dc.do(ctx, http.MethodGet, "/jobs/"+name, &st)
+	return st, err
+}
+
+func (dc *DaemonClient) Trigger(ctx context.Context, name string) error {
+	return dc.do(ctx, http.MethodPost, "/jobs/"+name+"/trigger", nil)
+}
+
+func (dc *DaemonClient) do(ctx context.Context, method, path string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, "http://daemon"+path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := dc.httpclient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		var de daemonError
+		if err := json.NewDecoder(resp.Body).Decode(&de); err != nil {
+			return fmt.Errorf("%s %s: %s", method, path, resp.Status)
+		}
+		return fmt.Errorf("%s %s: %s", method, path, de.Error)
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
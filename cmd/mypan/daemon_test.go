@@ -0,0 +1,202 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"mypan/pkg/client"
+	"mypan/pkg/config"
+	"mypan/pkg/store"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestAuthMan(t *testing.T, fc *fakeClient) *AuthMan {
+	dirStore, err := store.NewDirStore(t.TempDir())
+	require.NoError(t, err)
+	return NewAuthMan(fc, store.NewJSONStore(dirStore))
+}
+
+func TestRefreshCheckWait(t *testing.T) {
+	for _, c := range []struct {
+		avail, want time.Duration
+	}{
+		{time.Hour, 7 * time.Minute},
+		{48 * time.Hour, time.Hour},
+		{10 * 24 * time.Hour, 24 * time.Hour},
+	} {
+		assert.Equal(t, c.want, refreshCheckWait(c.avail), "%s", c.avail)
+	}
+}
+
+func TestAuthManRefreshLoop(t *testing.T) {
+	const fails = 3
+	var (
+		mu        sync.Mutex
+		times     []time.Time
+		refreshed = make(chan struct{})
+	)
+	fc := newFakeClient()
+	fc.SetAccessAuth(client.AccessAuth{
+		AccessToken:           "old",
+		AccessTokenExpireTime: time.Now().Add(-time.Hour),
+	})
+	fc.refresh = func() (client.OauthRefreshTokenResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		times = append(times, time.Now())
+		if len(times) <= fails {
+			return client.OauthRefreshTokenResponse{}, errors.New("network down")
+		}
+		if len(times) == fails+1 {
+			close(refreshed)
+		}
+		return client.OauthRefreshTokenResponse{AccessToken: "new", ExpiresIn: 30 * 24 * 3600}, nil
+	}
+	am := newTestAuthMan(t, fc).RefreshRetry(10*time.Millisecond, 20*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		am.RefreshAccessTokenLoop(ctx)
+		close(stopped)
+	}()
+	select {
+	case <-refreshed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not refreshed")
+	}
+	// the new token is good for long, the loop waits till cancelled
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("loop not stopped on cancel")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(t, times, fails+1)
+	// retry wait doubles till the max
+	for i, want := range []time.Duration{
+		10 * time.Millisecond,
+		20 * time.Millisecond,
+		20 * time.Millisecond,
+	} {
+		assert.GreaterOrEqual(t, times[i+1].Sub(times[i]), want, "retry %d", i)
+	}
+	assert.Equal(t, "new", fc.GetAccessAuth().AccessToken)
+}
+
+func TestDaemon(t *testing.T) {
+	var (
+		mu      sync.Mutex
+		runs    = map[string]int{}
+		release = make(chan struct{})
+	)
+	jobFunc := func(ctx context.Context, job config.Job) error {
+		mu.Lock()
+		runs[job.Name]++
+		mu.Unlock()
+		switch job.Name {
+		case "fail":
+			return errors.New("boom")
+		case "slow":
+			select {
+			case <-release:
+			case <-ctx.Done():
+			}
+		}
+		return nil
+	}
+	runCount := func(name string) int {
+		mu.Lock()
+		defer mu.Unlock()
+		return runs[name]
+	}
+	fc := newFakeClient()
+	fc.SetAccessAuth(client.AccessAuth{
+		AccessToken:           "a",
+		AccessTokenExpireTime: time.Now().Add(10 * 24 * time.Hour),
+	})
+	socketPath := filepath.Join(t.TempDir(), DaemonSocketName)
+	d := NewDaemon(newTestAuthMan(t, fc), []config.Job{
+		{Name: "tick", Schedule: "@every 1s"},
+		{Name: "fail", Schedule: "@yearly"},
+		{Name: "slow", Schedule: "@yearly"},
+	}, jobFunc, socketPath)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- d.Run(ctx)
+	}()
+	dc := NewDaemonClient(socketPath)
+	require.Eventually(t, func() bool {
+		_, err := dc.Jobs(ctx)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// scheduled by interval
+	require.Eventually(t, func() bool {
+		return runCount("tick") > 0
+	}, 5*time.Second, 10*time.Millisecond)
+	st, err := dc.Job(ctx, "tick")
+	require.NoError(t, err)
+	assert.False(t, st.Next.IsZero())
+	assert.Equal(t, 0, runCount("fail"))
+
+	// result of a failed job is kept
+	require.NoError(t, dc.Trigger(ctx, "fail"))
+	require.Eventually(t, func() bool {
+		st, err := dc.Job(ctx, "fail")
+		return err == nil && st.Last != nil
+	}, 5*time.Second, 10*time.Millisecond)
+	st, err = dc.Job(ctx, "fail")
+	require.NoError(t, err)
+	assert.Equal(t, "boom", st.Last.Error)
+	assert.False(t, st.Running)
+
+	// a running job is not triggered again
+	require.NoError(t, dc.Trigger(ctx, "slow"))
+	require.Eventually(t, func() bool {
+		st, err := dc.Job(ctx, "slow")
+		return err == nil && st.Running
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, dc.Trigger(ctx, "slow"), "POST /jobs/slow/trigger: job already running")
+	assert.EqualError(t, dc.Trigger(ctx, "none"), "POST /jobs/none/trigger: job not found")
+
+	// a job waiting for the running one is queued, not running
+	require.NoError(t, dc.Trigger(ctx, "fail"))
+	st, err = dc.Job(ctx, "fail")
+	require.NoError(t, err)
+	assert.True(t, st.Queued)
+	assert.False(t, st.Running)
+	assert.EqualError(t, dc.Trigger(ctx, "fail"), "POST /jobs/fail/trigger: job already queued")
+	close(release)
+	require.Eventually(t, func() bool {
+		st, err := dc.Job(ctx, "slow")
+		return err == nil && st.Last != nil && !st.Running
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, runCount("slow"))
+	require.Eventually(t, func() bool {
+		return runCount("fail") == 2
+	}, 5*time.Second, 10*time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-stopped:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("daemon not stopped on cancel")
+	}
+}
@@ -0,0 +1,242 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"mypan/pkg/client"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+const (
+	DedupePolicyOldest   = "oldest"
+	DedupePolicyNewest   = "newest"
+	DedupePolicyShortest = "shortest"
+	DedupePolicyPrefer   = "prefer"
+)
+
+var DedupePolicies = []string{
+	DedupePolicyOldest,
+	DedupePolicyNewest,
+	DedupePolicyShortest,
+	DedupePolicyPrefer,
+}
+
+type DupFile struct {
+	Path        string `json:"path"`
+	ServerMtime uint64 `json:"server_mtime"`
+	Keep        bool   `json:"keep"`
+}
+
+// DupGroup is a set of files with the same md5 and size
+type DupGroup struct {
+	Md5    string    `json:"md5"`
+	Size   int64     `json:"size"`
+	Wasted int64     `json:"wasted"`
+	Files  []DupFile `json:"files"`
+}
+
+// kept tells whether it's decided which files to keep
+func (g *DupGroup) kept() bool {
+	for _, f := range g.Files {
+		if f.Keep {
+			return true
+		}
+	}
+	return false
+}
+
+// DedupeMan finds duplicate files by md5 and size reported in listing,
+// then decides which to keep by policy or by asking
+type DedupeMan struct {
+	client client.ClientI
+	policy string
+	prefer string
+}
+
+func NewDedupeMan(client client.ClientI) *DedupeMan {
+	dm := &DedupeMan{
+		client: client,
+	}
+	return dm
+}
+
+// Policy sets how to pick the file to keep.  prefer is the preferred path
+// prefix of DedupePolicyPrefer
+func (dm *DedupeMan) Policy(policy, prefer string) *DedupeMan {
+	dm.policy = policy
+	dm.prefer = prefer
+	return dm
+}
+
+// Find returns duplicate groups under dir, the most wasted first
+func (dm *DedupeMan) Find(ctx context.Context, dir string) ([]DupGroup, error) {
+	resp, err := dm.client.ListAllEx(ctx, dir)
+	if err != nil {
+		return nil, errors.Wrapf(err, "list all %s", dir)
+	}
+	type key struct {
+		md5  string
+		size int64
+	}
+	var (
+		keys   []key
+		groups = map[key]*DupGroup{}
+	)
+	for _, v := range resp.List {
+		// empty files are all the same, but not duplicates worth noting
+		if v.IsDir != 0 || v.Md5 == "" || v.Size == 0 {
+			continue
+		}
+		k := key{v.Md5, int64(v.Size)}
+		g, ok := groups[k]
+		if !ok {
+			g = &DupGroup{Md5: k.md5, Size: k.size}
+			groups[k] = g
+			keys = append(keys, k)
+		}
+		g.Files = append(g.Files, DupFile{
+			Path:        v.Path,
+			ServerMtime: v.ServerMtime,
+		})
+	}
+	var ret []DupGroup
+	for _, k := range keys {
+		g := groups[k]
+		if len(g.Files) < 2 {
+			continue
+		}
+		sort.Slice(g.Files, func(i, j int) bool {
+			return g.Files[i].Path < g.Files[j].Path
+		})
+		g.Wasted = g.Size * int64(len(g.Files)-1)
+		dm.decide(g)
+		ret = append(ret, *g)
+	}
+	sort.SliceStable(ret, func(i, j int) bool {
+		return ret[i].Wasted > ret[j].Wasted
+	})
+	return ret, nil
+}
+
+// decide marks the file to keep by policy.  Nothing is marked if there is
+// no policy, or no file matches the preferred prefix
+func (dm *DedupeMan) decide(g *DupGroup) {
+	keep := -1
+	for i, f := range g.Files {
+		if keep < 0 {
+			if dm.policy != DedupePolicyPrefer || dm.preferred(f.Path) {
+				keep = i
+			}
+			continue
+		}
+		k := g.Files[keep]
+		switch dm.policy {
+		case DedupePolicyOldest:
+			if f.ServerMtime < k.ServerMtime {
+				keep = i
+			}
+		case DedupePolicyNewest:
+			if f.ServerMtime > k.ServerMtime {
+				keep = i
+			}
+		case DedupePolicyShortest:
+			if len(f.Path) < len(k.Path) {
+				keep = i
+			}
+		}
+	}
+	if dm.policy != "" && keep >= 0 {
+		g.Files[keep].Keep = true
+	}
+}
+
+func (dm *DedupeMan) preferred(p string) bool {
+	return p == dm.prefer || strings.HasPrefix(p, strings.TrimSuffix(dm.prefer, "/")+"/")
+}
+
+// Ask asks which file of each group to keep, reading answers from r.  An
+// empty answer accepts the file marked by policy, if any.  Groups with an
+// answer of "s", or an empty one without the mark, are left undecided
+func (dm *DedupeMan) Ask(groups []DupGroup, r io.Reader, w io.Writer) error {
+	scanner := bufio.NewScanner(r)
+	for gi := range groups {
+		g := &groups[gi]
+		fmt.Fprintf(w, "%s %s, %d copies\n", g.Md5, humanize.IBytes(uint64(g.Size)), len(g.Files))
+		marked := 0
+		for i, f := range g.Files {
+			mark := " "
+			if f.Keep {
+				mark = "*"
+				marked = i + 1
+			}
+			fmt.Fprintf(w, "%s %d) %s\n", mark, i+1, f.Path)
+		}
+		for {
+			if marked > 0 {
+				fmt.Fprintf(w, "keep [1-%d] (default %d), s to skip: ", len(g.Files), marked)
+			} else {
+				fmt.Fprintf(w, "keep [1-%d], s to skip: ", len(g.Files))
+			}
+			if !scanner.Scan() {
+				if err := scanner.Err(); err != nil {
+					return err
+				}
+				return io.ErrUnexpectedEOF
+			}
+			answer := strings.TrimSpace(scanner.Text())
+			if answer == "" && marked > 0 {
+				break
+			}
+			if answer == "s" || answer == "" {
+				for i := range g.Files {
+					g.Files[i].Keep = false
+				}
+				break
+			}
+			n, err := strconv.Atoi(answer)
+			if err != nil || n < 1 || n > len(g.Files) {
+				continue
+			}
+			for i := range g.Files {
+				g.Files[i].Keep = i == n-1
+			}
+			break
+		}
+	}
+	return nil
+}
+
+// Remove deletes files not kept in decided groups
+func (dm *DedupeMan) Remove(ctx context.Context, groups []DupGroup) (client.FileManagerResponse, error) {
+	paths := dedupeRemovePaths(groups)
+	if len(paths) == 0 {
+		return client.FileManagerResponse{}, nil
+	}
+	return dm.client.DeleteMulti(ctx, paths)
+}
+
+func dedupeRemovePaths(groups []DupGroup) []string {
+	var paths []string
+	for _, g := range groups {
+		if !g.kept() {
+			continue
+		}
+		for _, f := range g.Files {
+			if !f.Keep {
+				paths = append(paths, f.Path)
+			}
+		}
+	}
+	return paths
+}
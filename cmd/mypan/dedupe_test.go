@@ -0,0 +1,97 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDupGroup() DupGroup {
+	return DupGroup{
+		Md5:  "m",
+		Size: 10,
+		Files: []DupFile{
+			{Path: "/d/archive/long/a.jpg", ServerMtime: 200},
+			{Path: "/d/b.jpg", ServerMtime: 100},
+			{Path: "/d/new/c.jpg", ServerMtime: 300},
+		},
+	}
+}
+
+func dupKept(g DupGroup) []string {
+	var kept []string
+	for _, f := range g.Files {
+		if f.Keep {
+			kept = append(kept, f.Path)
+		}
+	}
+	return kept
+}
+
+func TestDedupeDecide(t *testing.T) {
+	testCases := []struct {
+		policy string
+		prefer string
+		want   []string
+	}{
+		{policy: "", want: nil},
+		{policy: DedupePolicyOldest, want: []string{"/d/b.jpg"}},
+		{policy: DedupePolicyNewest, want: []string{"/d/new/c.jpg"}},
+		{policy: DedupePolicyShortest, want: []string{"/d/b.jpg"}},
+		{policy: DedupePolicyPrefer, prefer: "/d/new/", want: []string{"/d/new/c.jpg"}},
+		{policy: DedupePolicyPrefer, prefer: "/d/archive", want: []string{"/d/archive/long/a.jpg"}},
+		// prefix is matched by path components
+		{policy: DedupePolicyPrefer, prefer: "/d/arch", want: nil},
+		{policy: DedupePolicyPrefer, prefer: "/x", want: nil},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.policy+" "+tc.prefer, func(t *testing.T) {
+			g := newDupGroup()
+			NewDedupeMan(nil).Policy(tc.policy, tc.prefer).decide(&g)
+			assert.Equal(t, tc.want, dupKept(g))
+		})
+	}
+}
+
+func TestDedupeAsk(t *testing.T) {
+	testCases := []struct {
+		name   string
+		policy string
+		input  string
+		want   []string
+	}{
+		{name: "empty accepts policy pick", policy: DedupePolicyNewest, input: "\n", want: []string{"/d/new/c.jpg"}},
+		{name: "number overrides", policy: DedupePolicyNewest, input: "1\n", want: []string{"/d/archive/long/a.jpg"}},
+		{name: "skip", policy: DedupePolicyNewest, input: "s\n", want: nil},
+		{name: "empty without policy", input: "\n", want: nil},
+		{name: "invalid asked again", input: "9\nx\n2\n", want: []string{"/d/b.jpg"}},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			dm := NewDedupeMan(nil).Policy(tc.policy, "")
+			groups := []DupGroup{newDupGroup()}
+			dm.decide(&groups[0])
+			var w bytes.Buffer
+			assert.NoError(t, dm.Ask(groups, strings.NewReader(tc.input), &w))
+			assert.Equal(t, tc.want, dupKept(groups[0]))
+		})
+	}
+
+	groups := []DupGroup{newDupGroup()}
+	assert.Equal(t, io.ErrUnexpectedEOF, NewDedupeMan(nil).Ask(groups, strings.NewReader(""), io.Discard))
+}
+
+func TestDedupeRemovePaths(t *testing.T) {
+	undecided := newDupGroup()
+	decided := newDupGroup()
+	decided.Files[1].Keep = true
+	assert.Equal(t, []string{"/d/archive/long/a.jpg", "/d/new/c.jpg"}, dedupeRemovePaths([]DupGroup{undecided, decided}))
+	assert.Empty(t, dedupeRemovePaths([]DupGroup{undecided}))
+	assert.Empty(t, dedupeRemovePaths(nil))
+}
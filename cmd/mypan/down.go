@@ -5,6 +5,8 @@ package main
 
 import (
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"net/http"
@@ -12,6 +14,7 @@ import (
 	"path/filepath"
 	"strings"
 
+	"mypan/pkg/chunk"
 	"mypan/pkg/client"
 	"mypan/pkg/util"
 
@@ -27,28 +30,64 @@ var UnitBytesIEC = progress.Units{
 	},
 }
 
+// downCorruptRetries is the number of retries when downloaded content does
+// not match content-md5
+const downCorruptRetries = 2
+
+// DownCorruptError is returned when md5 of downloaded content does not match
+// content-md5 from server
+type DownCorruptError struct {
+	Path        string
+	CorruptPath string
+	Want        string
+	Got         string
+}
+
+func (err *DownCorruptError) Error() string {
+	msg := fmt.Sprintf("%s: md5 mismatch, want %s, got %s", err.Path, err.Want, err.Got)
+	if err.CorruptPath != "" {
+		msg += ", kept as " + err.CorruptPath
+	}
+	return msg
+}
+
 type DownMan struct {
 	client client.ClientI
 
 	cacheSetter CacheSetterI
-	progress    progress.Writer
+	cryptMan    *CryptMan
+	progress    ProgressMaker
 	parallelDo  *util.ParallelDo
 	continue_   bool
+	out         io.Writer
 }
 
 func NewDownMan(client client.ClientI) *DownMan {
 	dm := &DownMan{
 		client: client,
+		out:    os.Stdout,
 	}
 	return dm
 }
 
+// Out sets where content goes when there is no local path.  It's stdout by
+// default
+func (dm *DownMan) Out(out io.Writer) *DownMan {
+	dm.out = out
+	return dm
+}
+
 func (dm *DownMan) CacheSetter(cacheSetter CacheSetterI) *DownMan {
 	dm.cacheSetter = cacheSetter
 	return dm
 }
 
-func (dm *DownMan) Progress(progress progress.Writer) *DownMan {
+func (dm *DownMan) Crypt(cryptMan *CryptMan) *DownMan {
+	dm.cryptMan = cryptMan
+	return dm
+}
+
+func (dm *DownMan) Progress(progress ProgressMaker) *DownMan {
 	dm.progress = progress
 	return dm
 }
@@ -67,14 +106,24 @@ func (dm *DownMan) Down(
 	ctx context.Context,
 	relpath, outpath string,
 ) error {
-	meta, err := dm.client.FileMetaByPath(ctx, relpath)
+	realRelpath := dm.cryptMan.RemotePath(relpath)
+	meta, err := dm.client.FileMetaByPath(ctx, realRelpath)
+	if client.ErrIsNotExist(err) {
+		// maybe it was uploaded in chunks
+		manifestRelpath := dm.cryptMan.RemotePath(relpath + chunk.ManifestSuffix)
+		if _, err1 := dm.client.FileMetaByPath(ctx, manifestRelpath); err1 == nil {
+			return util.TryParallelDo(ctx, dm.parallelDo, func(ctx context.Context) error {
+				return dm.downChunked(ctx, manifestRelpath, outpath)
+			})
+		}
+	}
 	if err != nil {
 		return errors.Wrap(err, "meta")
 	}
 	if meta.IsDir == 0 {
-		return dm.down(ctx, relpath, outpath, meta.DLink)
+		return dm.down(ctx, realRelpath, outpath, meta.DLink)
 	}
-	return dm.downDir(ctx, relpath, outpath)
+	return dm.downDir(ctx, realRelpath, outpath)
 }
 
 func (dm *DownMan) DownByFsId(
@@ -98,7 +147,22 @@ func (dm *DownMan) downDir(
 		if ent.IsDir != 0 {
 			continue
 		}
-		outpath := filepath.Join(outpath, strings.TrimPrefix(ent.Path, abspath))
+		subpath := dm.cryptMan.PlainPath(strings.TrimPrefix(ent.Path, abspath))
+		if _, _, ok := chunk.ParseChunkName(subpath); ok {
+			continue
+		}
+		if name, ok := chunk.ParseManifestName(subpath); ok {
+			outpath := filepath.Join(outpath, name)
+			entRelpath := dm.client.RelPath(ent.Path)
+			err := util.TryParallelDo(ctx, dm.parallelDo, func(ctx context.Context) error {
+				return dm.downChunked(ctx, entRelpath, outpath)
+			})
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		outpath := filepath.Join(outpath, subpath)
 		err := dm.downFileByFsId(ctx, outpath, ent.FsId)
 		if err != nil {
 			return err
@@ -127,10 +191,40 @@ func (dm *DownMan) down(
 	dlink string,
 ) error {
 	return util.TryParallelDo(ctx, dm.parallelDo, func(ctx context.Context) error {
-		return dm.down_(ctx, relpath, outpath, dlink)
+		return dm.downRetry(ctx, relpath, outpath, dlink)
 	})
 }
 
+// downRemote downloads file at relpath, as stored on server, in the
+// calling goroutine
+func (dm *DownMan) downRemote(
+	ctx context.Context,
+	relpath string,
+	outpath string,
+) error {
+	meta, err := dm.client.FileMetaByPath(ctx, relpath)
+	if err != nil {
+		return errors.Wrap(err, "meta")
+	}
+	return dm.downRetry(ctx, relpath, outpath, meta.DLink)
+}
+
+func (dm *DownMan) downRetry(
+	ctx context.Context,
+	relpath string,
+	outpath string,
+	dlink string,
+) error {
+	for i := 0; ; i++ {
+		err := dm.down_(ctx, relpath, outpath, dlink)
+		var corruptErr *DownCorruptError
+		if !errors.As(err, &corruptErr) || outpath == "" || i >= downCorruptRetries {
+			return err
+		}
+		glog.Warningf("%v, retry", err)
+	}
+}
+
 func (dm *DownMan) down_(
 	ctx context.Context,
 	relpath string,
@@ -141,9 +235,15 @@ func (dm *DownMan) down_(
 		opts    []func(*http.Request)
 		w       io.Writer
 		tmpname string
+		decW    io.WriteCloser
+		h       = md5.New()
 	)
 	if outpath == "" {
-		w = os.Stdout
+		w = dm.out
+		if cm := dm.cryptMan; cm != nil {
+			decW = cm.DecryptWriter(w)
+			w = decW
+		}
 	} else {
 		dir := filepath.Dir(outpath)
 		if err := util.MkdirAll(dir); err != nil {
@@ -157,11 +257,15 @@ func (dm *DownMan) down_(
 				opts = append(opts, func(req *http.Request) {
 					req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
 				})
-				f, err := os.OpenFile(tmpname0, os.O_APPEND|os.O_WRONLY, os.FileMode(0666))
+				f, err := os.OpenFile(tmpname0, os.O_APPEND|os.O_RDWR, os.FileMode(0666))
 				if err != nil {
 					return err
 				}
 				defer f.Close()
+				// hash what was downloaded before
+				if _, err := io.Copy(h, io.NewSectionReader(f, 0, offset)); err != nil {
+					return err
+				}
 				w = f
 			}
 			// if it's syncdown, it's ensured by sync that we
@@ -182,7 +286,7 @@ func (dm *DownMan) down_(
 	}
 
 	if progress := dm.progress; progress != nil {
-		pt := NewProgressTracker(dm.progress, relpath)
+		pt := progress.NewTracker(dm.cryptMan.PlainPath(relpath))
 		ctx = context.WithValue(ctx, client.XloadTrackerKey, pt)
 	}
 	httpResp, err := dm.client.DownloadByDLink(ctx, dlink, opts...)
@@ -190,29 +294,62 @@ func (dm *DownMan) down_(
 		return err
 	}
 	defer httpResp.Body.Close()
-	if outpath != "" {
-		// NOTE not sure if Content-Md5 header is reliable
-		srcMd5 := httpResp.Header.Get("content-md5")
-		if srcMd5 == "" {
-			glog.Warningf("content-md5 header absent")
-		} else {
-			defer dm.callCacheSetter(ctx, relpath, srcMd5)
-		}
+	// NOTE not sure if Content-Md5 header is reliable
+	srcMd5 := httpResp.Header.Get("content-md5")
+	if srcMd5 == "" {
+		glog.Warningf("content-md5 header absent")
 	}
 
-	if _, err := io.Copy(w, httpResp.Body); err != nil {
+	if _, err := io.Copy(io.MultiWriter(w, h), httpResp.Body); err != nil {
 		return err
 	}
-	if tmpname != "" {
-		err := os.Rename(tmpname, outpath)
-		if err != nil {
+	if srcMd5 != "" {
+		if gotMd5 := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(gotMd5, srcMd5) {
+			corruptErr := &DownCorruptError{
+				Path: dm.client.AbsPath(relpath),
+				Want: srcMd5,
+				Got:  gotMd5,
+			}
+			if tmpname != "" {
+				corruptname := outpath + ".corrupt"
+				if err := os.Rename(tmpname, corruptname); err != nil {
+					// do not resume from corrupt content on retry
+					glog.Warningf("keep corrupt file: %v", err)
+					os.Remove(tmpname)
+				} else {
+					corruptErr.CorruptPath = corruptname
+				}
+			}
+			return corruptErr
+		}
+	}
+	if decW != nil {
+		// flush and authenticate the last chunk
+		if err := decW.Close(); err != nil {
 			return err
 		}
 	}
+	if tmpname != "" {
+		var plainMd5 string
+		if cm := dm.cryptMan; cm != nil {
+			plainMd5, err = cm.DecryptFile(tmpname, outpath)
+			if err != nil {
+				return err
+			}
+		} else {
+			err := os.Rename(tmpname, outpath)
+			if err != nil {
+				return err
+			}
+		}
+		if srcMd5 != "" {
+			dm.callCacheSetter(ctx, relpath, srcMd5, plainMd5)
+		}
+	}
 	return nil
 }
 
-func (dm *DownMan) callCacheSetter(ctx context.Context, relpath, srcMd5 string) {
+func (dm *DownMan) callCacheSetter(ctx context.Context, relpath, srcMd5, plainMd5 string) {
 	if dm.cacheSetter == nil {
 		return
 	}
@@ -225,6 +362,7 @@ func (dm *DownMan) callCacheSetter(ctx context.Context, relpath, srcMd5 string)
 	dm.cacheSetter.SetDst(
 		meta.Path, meta.Md5,
 		srcMd5,
+		plainMd5,
 		int64(meta.Size),
 	)
 }
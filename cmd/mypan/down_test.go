@@ -0,0 +1,82 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownManCorrupt(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("content")
+	newClient := func(corrupt int) *fakeClient {
+		fc := newFakeClient()
+		fc.contentMd5 = true
+		fc.put(fc.AbsPath("d/a"), data)
+		fc.corrupt[fc.AbsPath("d/a")] = corrupt
+		return fc
+	}
+	downloads := func(fc *fakeClient) int {
+		n := 0
+		for _, call := range fc.calls {
+			if strings.HasPrefix(call, "DownloadByDLink ") {
+				n++
+			}
+		}
+		return n
+	}
+
+	t.Run("retry", func(t *testing.T) {
+		fc := newClient(1)
+		outpath := filepath.Join(t.TempDir(), "a")
+		require.NoError(t, NewDownMan(fc).Down(ctx, "d/a", outpath))
+		assert.Equal(t, 2, downloads(fc))
+		got, err := os.ReadFile(outpath)
+		require.NoError(t, err)
+		assert.Equal(t, data, got)
+		// corrupt content of the first try is kept aside
+		got, err = os.ReadFile(outpath + ".corrupt")
+		require.NoError(t, err)
+		assert.NotEqual(t, data, got)
+	})
+	t.Run("give up", func(t *testing.T) {
+		fc := newClient(downCorruptRetries + 1)
+		outpath := filepath.Join(t.TempDir(), "a")
+		err := NewDownMan(fc).Down(ctx, "d/a", outpath)
+		var corruptErr *DownCorruptError
+		require.True(t, errors.As(err, &corruptErr), "%v", err)
+		assert.Equal(t, "/apps/x/d/a", corruptErr.Path)
+		assert.Equal(t, outpath+".corrupt", corruptErr.CorruptPath)
+		assert.Equal(t, fc.files[len(fc.files)-1].Md5, corruptErr.Want)
+		assert.NotEqual(t, corruptErr.Want, corruptErr.Got)
+		assert.Equal(t, downCorruptRetries+1, downloads(fc))
+		for _, p := range []string{outpath, outpath + ".downloading"} {
+			_, err := os.Stat(p)
+			assert.True(t, os.IsNotExist(err), p)
+		}
+	})
+	t.Run("stdout", func(t *testing.T) {
+		// content already written out cannot be taken back
+		fc := newClient(1)
+		stdout := os.Stdout
+		devnull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+		require.NoError(t, err)
+		defer devnull.Close()
+		os.Stdout = devnull
+		defer func() { os.Stdout = stdout }()
+		err = NewDownMan(fc).Down(ctx, "d/a", "")
+		var corruptErr *DownCorruptError
+		require.True(t, errors.As(err, &corruptErr), "%v", err)
+		assert.Empty(t, corruptErr.CorruptPath)
+		assert.Equal(t, 1, downloads(fc))
+	})
+}
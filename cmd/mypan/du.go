@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"path"
+	"sort"
+	"strings"
+
+	"mypan/pkg/client"
+
+	"github.com/dustin/go-humanize"
+	"github.com/pkg/errors"
+)
+
+// TreeNode is a remote file or dir with sizes and counts aggregated over
+// its descendants
+type TreeNode struct {
+	Name      string `json:"name"`
+	Path      string `json:"path"`
+	IsDir     bool   `json:"isdir"`
+	Size      int64  `json:"size"`
+	SizeHuman string `json:"size_human,omitempty"`
+	Files     int    `json:"files"`
+
+	Children []*TreeNode `json:"children,omitempty"`
+}
+
+// DuEntry is the aggregated size of a dir
+type DuEntry struct {
+	Path      string `json:"path"`
+	Size      int64  `json:"size"`
+	SizeHuman string `json:"size_human,omitempty"`
+	Files     int    `json:"files"`
+}
+
+// DuMan computes disk usage of remote dirs from one recursive listing
+type DuMan struct {
+	client   client.ClientI
+	cryptMan *CryptMan
+	maxDepth int
+	human    bool
+	bySize   bool
+}
+
+func NewDuMan(client client.ClientI) *DuMan {
+	dm := &DuMan{
+		client:   client,
+		maxDepth: -1,
+	}
+	return dm
+}
+
+// Crypt makes dir taken and paths and sizes reported in plaintext
+func (dm *DuMan) Crypt(cryptMan *CryptMan) *DuMan {
+	dm.cryptMan = cryptMan
+	return dm
+}
+
+// MaxDepth limits depth of reported dirs.  Negative for no limit
+func (dm *DuMan) MaxDepth(maxDepth int) *DuMan {
+	dm.maxDepth = maxDepth
+	return dm
+}
+
+// Human makes sizes also reported in human readable form
+func (dm *DuMan) Human(human bool) *DuMan {
+	dm.human = human
+	return dm
+}
+
+// SortBySize sorts by size in descending order instead of by path
+func (dm *DuMan) SortBySize(bySize bool) *DuMan {
+	dm.bySize = bySize
+	return dm
+}
+
+// Tree builds tree of dir, pruned to max depth
+func (dm *DuMan) Tree(ctx context.Context, dir string) (*TreeNode, error) {
+	resp, err := dm.client.ListAllEx(ctx, dm.cryptMan.RemotePath(dir))
+	if err != nil {
+		return nil, errors.Wrapf(err, "list all %s", dir)
+	}
+	abspath := path.Clean(dm.client.AbsPath(dir))
+	prefix := strings.TrimSuffix(abspath, "/") + "/"
+	root := &TreeNode{
+		Name:  path.Base(abspath),
+		Path:  abspath,
+		IsDir: true,
+	}
+	nodes := map[string]*TreeNode{
+		abspath: root,
+	}
+	// getDir returns node of dir p, creating it and its ancestors if not
+	// listed yet
+	var getDir func(p string) *TreeNode
+	getDir = func(p string) *TreeNode {
+		if node, ok := nodes[p]; ok {
+			return node
+		}
+		if !strings.HasPrefix(p, prefix) {
+			return root
+		}
+		node := &TreeNode{
+			Name:  path.Base(p),
+			Path:  p,
+			IsDir: true,
+		}
+		nodes[p] = node
+		parent := getDir(path.Dir(p))
+		parent.Children = append(parent.Children, node)
+		return node
+	}
+	for _, v := range resp.List {
+		p := dm.cryptMan.PlainPath(v.Path)
+		if v.IsDir != 0 {
+			getDir(p)
+			continue
+		}
+		parent := getDir(path.Dir(p))
+		parent.Children = append(parent.Children, &TreeNode{
+			Name:  path.Base(p),
+			Path:  p,
+			Size:  dm.cryptMan.PlainSize(int64(v.Size)),
+			Files: 1,
+		})
+	}
+	dm.finish(root, 0)
+	return root, nil
+}
+
+// finish aggregates sizes, sorts children and prunes them below max depth
+func (dm *DuMan) finish(node *TreeNode, depth int) {
+	for _, child := range node.Children {
+		dm.finish(child, depth+1)
+		node.Size += child.Size
+		node.Files += child.Files
+	}
+	if dm.human {
+		node.SizeHuman = humanize.IBytes(uint64(node.Size))
+	}
+	sort.Slice(node.Children, func(i, j int) bool {
+		a, b := node.Children[i], node.Children[j]
+		if dm.bySize && a.Size != b.Size {
+			return a.Size > b.Size
+		}
+		return a.Name < b.Name
+	})
+	if dm.maxDepth >= 0 && depth >= dm.maxDepth {
+		node.Children = nil
+	}
+}
+
+// Du returns aggregated sizes of dir and dirs below it
+func (dm *DuMan) Du(ctx context.Context, dir string) ([]DuEntry, error) {
+	root, err := dm.Tree(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var (
+		ents []DuEntry
+		walk func(node *TreeNode)
+	)
+	walk = func(node *TreeNode) {
+		ents = append(ents, DuEntry{
+			Path:      node.Path,
+			Size:      node.Size,
+			SizeHuman: node.SizeHuman,
+			Files:     node.Files,
+		})
+		for _, child := range node.Children {
+			if child.IsDir {
+				walk(child)
+			}
+		}
+	}
+	walk(root)
+	sort.SliceStable(ents, func(i, j int) bool {
+		if dm.bySize {
+			return ents[i].Size > ents[j].Size
+		}
+		return ents[i].Path < ents[j].Path
+	})
+	return ents, nil
+}
@@ -0,0 +1,128 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"mypan/pkg/crypt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newDuClient() *fakeClient {
+	fc := newFakeClient().
+		add("d/a", 10).
+		add("d/e/b", 200).
+		add("d/e/f/c", 3000).
+		add("d/empty/", 0).
+		add("x/y", 1)
+	// dirs not listed are synthesized
+	fc.files = append(fc.files, fakeFile{Path: "/apps/x/d/g/h/i", Size: 40000})
+	return fc
+}
+
+func TestDuManDu(t *testing.T) {
+	ctx := context.Background()
+	testCases := []struct {
+		name string
+		dm   func(fc *fakeClient) *DuMan
+		want []DuEntry
+	}{
+		{
+			name: "all",
+			dm:   func(fc *fakeClient) *DuMan { return NewDuMan(fc) },
+			want: []DuEntry{
+				{Path: "/apps/x/d", Size: 43210, Files: 4},
+				{Path: "/apps/x/d/e", Size: 3200, Files: 2},
+				{Path: "/apps/x/d/e/f", Size: 3000, Files: 1},
+				{Path: "/apps/x/d/empty"},
+				{Path: "/apps/x/d/g", Size: 40000, Files: 1},
+				{Path: "/apps/x/d/g/h", Size: 40000, Files: 1},
+			},
+		},
+		{
+			name: "depth 1 by size",
+			dm: func(fc *fakeClient) *DuMan {
+				return NewDuMan(fc).MaxDepth(1).SortBySize(true).Human(true)
+			},
+			want: []DuEntry{
+				{Path: "/apps/x/d", Size: 43210, SizeHuman: "42 KiB", Files: 4},
+				{Path: "/apps/x/d/g", Size: 40000, SizeHuman: "39 KiB", Files: 1},
+				{Path: "/apps/x/d/e", Size: 3200, SizeHuman: "3.1 KiB", Files: 2},
+				{Path: "/apps/x/d/empty", SizeHuman: "0 B"},
+			},
+		},
+		{
+			name: "depth 0",
+			dm:   func(fc *fakeClient) *DuMan { return NewDuMan(fc).MaxDepth(0) },
+			want: []DuEntry{
+				{Path: "/apps/x/d", Size: 43210, Files: 4},
+			},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ents, err := tc.dm(newDuClient()).Du(ctx, "d/")
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, ents)
+		})
+	}
+}
+
+func TestDuManTree(t *testing.T) {
+	root, err := NewDuMan(newDuClient()).MaxDepth(2).Tree(context.Background(), "d")
+	require.NoError(t, err)
+
+	type node struct {
+		path  string
+		size  int64
+		files int
+	}
+	var (
+		got  []node
+		walk func(n *TreeNode)
+	)
+	walk = func(n *TreeNode) {
+		got = append(got, node{n.Path, n.Size, n.Files})
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(root)
+	assert.Equal(t, []node{
+		{"/apps/x/d", 43210, 4},
+		{"/apps/x/d/a", 10, 1},
+		{"/apps/x/d/e", 3200, 2},
+		{"/apps/x/d/e/b", 200, 1},
+		{"/apps/x/d/e/f", 3000, 1},
+		{"/apps/x/d/empty", 0, 0},
+		{"/apps/x/d/g", 40000, 1},
+		{"/apps/x/d/g/h", 40000, 1},
+	}, got)
+	assert.Equal(t, "d", root.Name)
+	assert.True(t, root.Children[1].IsDir)
+	assert.False(t, root.Children[0].IsDir)
+}
+
+func TestDuManCrypt(t *testing.T) {
+	ctx := context.Background()
+	cipher, err := crypt.NewCipherFromKey(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	fc := newFakeClient().
+		add(cipher.EncryptPath("d/a"), uint64(crypt.EncryptedSize(10))).
+		add(cipher.EncryptPath("d/e/b"), uint64(crypt.EncryptedSize(200)))
+	cm := NewCryptMan(fc, cipher).EncryptNames(true)
+
+	ents, err := NewDuMan(fc).Crypt(cm).Du(ctx, "d")
+	require.NoError(t, err)
+	assert.Equal(t, []DuEntry{
+		{Path: "/apps/x/d", Size: 210, Files: 2},
+		{Path: "/apps/x/d/e", Size: 200, Files: 1},
+	}, ents)
+	assert.Equal(t, []string{"ListAllEx /apps/x/" + cipher.EncryptPath("d")}, fc.calls)
+}
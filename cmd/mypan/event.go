@@ -0,0 +1,69 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	EventXloadStart    = "xload_start"
+	EventXloadProgress = "xload_progress"
+	EventXloadDone     = "xload_done"
+	EventSync          = "sync"
+)
+
+const (
+	SyncActionUpload   = "upload"
+	SyncActionDownload = "download"
+	SyncActionDelete   = "delete"
+	SyncActionCopy     = "copy"
+)
+
+type Event struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"`
+
+	// xload events, one start and done of each file.  Total is -1 if not
+	// known
+	Name  string `json:"name,omitempty"`
+	Total int64  `json:"total"`
+	Done  int64  `json:"done"`
+
+	// sync events
+	Action string `json:"action,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Cause  string `json:"cause,omitempty"`
+}
+
+// EventWriter writes events as newline-delimited JSON
+type EventWriter struct {
+	mu  *sync.Mutex
+	enc *json.Encoder
+}
+
+func NewEventWriter(w io.Writer) *EventWriter {
+	ew := &EventWriter{
+		mu:  &sync.Mutex{},
+		enc: json.NewEncoder(w),
+	}
+	return ew
+}
+
+func (ew *EventWriter) Emit(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+	ew.mu.Lock()
+	defer ew.mu.Unlock()
+	if err := ew.enc.Encode(ev); err != nil {
+		glog.Warningf("emit event: %v", err)
+	}
+}
@@ -0,0 +1,101 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// decodeEvents returns events in buf as "event name/path total done" or
+// "event action path size cause", with time and prefix stripped
+func decodeEvents(t *testing.T, buf *bytes.Buffer, prefix string) []string {
+	var evs []string
+	dec := json.NewDecoder(buf)
+	for dec.More() {
+		var ev Event
+		require.NoError(t, dec.Decode(&ev))
+		assert.False(t, ev.Time.IsZero())
+		if ev.Event == EventSync {
+			evs = append(evs, fmt.Sprintf("%s %s %s %d %s",
+				ev.Event, ev.Action, strings.TrimPrefix(ev.Path, prefix), ev.Size, ev.Cause))
+		} else {
+			evs = append(evs, fmt.Sprintf("%s %s %d %d",
+				ev.Event, strings.TrimPrefix(ev.Name, prefix), ev.Total, ev.Done))
+		}
+	}
+	return evs
+}
+
+func TestSyncEvents(t *testing.T) {
+	var (
+		ctx = context.Background()
+		src = t.TempDir()
+		fc  = newFakeClient()
+		buf bytes.Buffer
+	)
+	writeFiles(t, src, map[string]string{"a": "aaa", "d/b": "bbbbb"})
+	fc.put(fc.AbsPath("r/old"), []byte("old"))
+	ew := NewEventWriter(&buf)
+	srcCacheStore, dstCacheStore := newCacheStores(t)
+	su := NewSyncUp(src, "r", fc, srcCacheStore, dstCacheStore,
+		Events(ew),
+		Progress(NewJSONProgress(ew, 0)),
+	)
+	require.NoError(t, su.Do(ctx))
+
+	// decisions come first, then progress of each transfer in plan order,
+	// feeding overall trackers
+	assert.Equal(t, []string{
+		"sync upload /a 3 absent on dst",
+		"sync upload /d/b 5 absent on dst",
+		"sync delete /apps/x/r/old 3 absent on src",
+		"xload_start overall files 3 0",
+		"xload_start overall bytes 8 0",
+		"xload_start /a 3 0",
+		"xload_progress /a 3 3",
+		"xload_progress overall bytes 8 3",
+		"xload_done /a 3 3",
+		"xload_progress overall files 3 1",
+		"xload_start /d/b 5 0",
+		"xload_progress /d/b 5 5",
+		"xload_progress overall bytes 8 8",
+		"xload_done /d/b 5 5",
+		"xload_progress overall files 3 2",
+		"xload_progress overall files 3 3",
+		"xload_done overall files 3 3",
+		"xload_done overall bytes 8 8",
+	}, decodeEvents(t, &buf, src))
+}
+
+func TestJSONTrackerInterval(t *testing.T) {
+	var buf bytes.Buffer
+	jt := NewJSONProgress(NewEventWriter(&buf), time.Hour).NewTracker("f")
+	jt.Start(10)
+	for i := 0; i < 10; i++ {
+		jt.Increment(1)
+	}
+	jt.Done()
+	// progress within the interval is not emitted, done has the count
+	assert.Equal(t, []string{
+		"xload_start f 10 0",
+		"xload_done f 10 10",
+	}, decodeEvents(t, &buf, ""))
+}
+
+func TestEventZeroCounts(t *testing.T) {
+	var buf bytes.Buffer
+	jt := NewJSONProgress(NewEventWriter(&buf), time.Hour).NewTracker("f")
+	jt.Start(0)
+	// counts are there even if zero
+	assert.Contains(t, buf.String(), `"total":0,"done":0`)
+}
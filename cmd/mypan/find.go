@@ -0,0 +1,142 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"mypan/pkg/client"
+	"mypan/pkg/find"
+
+	"github.com/pkg/errors"
+)
+
+type FindEntry struct {
+	Path  string `json:"path"`
+	IsDir int    `json:"isdir"`
+
+	Size        uint64 `json:"size"`
+	ServerCtime uint64 `json:"server_ctime"`
+	ServerMtime uint64 `json:"server_mtime"`
+	LocalCtime  uint64 `json:"local_ctime"`
+	LocalMtime  uint64 `json:"local_mtime"`
+	Category    int    `json:"category"`
+	Md5         string `json:"md5"`
+	FsId        uint64 `json:"fs_id"`
+}
+
+// entry returns fe as find.Entry, rel being its path below the starting dir
+func (fe FindEntry) entry(rel string) *find.Entry {
+	return &find.Entry{
+		Path:        fe.Path,
+		RelPath:     "./" + rel,
+		IsDir:       fe.IsDir != 0,
+		Size:        int64(fe.Size),
+		ServerCtime: time.Unix(int64(fe.ServerCtime), 0),
+		ServerMtime: time.Unix(int64(fe.ServerMtime), 0),
+		LocalCtime:  time.Unix(int64(fe.LocalCtime), 0),
+		LocalMtime:  time.Unix(int64(fe.LocalMtime), 0),
+		Category:    fe.Category,
+		Md5:         fe.Md5,
+		Depth:       strings.Count(rel, "/") + 1,
+	}
+}
+
+// Finder lists remote dir recursively and returns entries matching query
+type Finder struct {
+	client   client.ClientI
+	cryptMan *CryptMan
+	query    *find.Query
+}
+
+func NewFinder(client client.ClientI, query *find.Query) *Finder {
+	f := &Finder{
+		client: client,
+		query:  query,
+	}
+	return f
+}
+
+// Crypt makes the starting dir, matched and returned paths and sizes
+// plaintext
+func (f *Finder) Crypt(cryptMan *CryptMan) *Finder {
+	f.cryptMan = cryptMan
+	return f
+}
+
+func (f *Finder) Find(ctx context.Context, dir string) ([]FindEntry, error) {
+	resp, err := f.client.ListAllEx(ctx, f.cryptMan.RemotePath(dir))
+	if err != nil {
+		return nil, errors.Wrapf(err, "list all %s", dir)
+	}
+	var (
+		ents   []FindEntry
+		prefix = strings.TrimSuffix(f.client.AbsPath(dir), "/") + "/"
+	)
+	for _, v := range resp.List {
+		size := v.Size
+		if v.IsDir == 0 {
+			size = uint64(f.cryptMan.PlainSize(int64(size)))
+		}
+		fe := FindEntry{
+			Path:        f.cryptMan.PlainPath(v.Path),
+			IsDir:       v.IsDir,
+			Size:        size,
+			ServerCtime: v.ServerCtime,
+			ServerMtime: v.ServerMtime,
+			LocalCtime:  v.LocalCtime,
+			LocalMtime:  v.LocalMtime,
+			Category:    v.Category,
+			Md5:         v.Md5,
+			FsId:        v.FsId,
+		}
+		if f.query.Match(fe.entry(strings.TrimPrefix(fe.Path, prefix))) {
+			ents = append(ents, fe)
+		}
+	}
+	return ents, nil
+}
+
+// Exec runs -exec commands on each of ents
+func (f *Finder) Exec(ctx context.Context, ents []FindEntry) error {
+	for _, ent := range ents {
+		for _, argv := range f.query.Exec {
+			argv1 := make([]string, len(argv))
+			for i, arg := range argv {
+				argv1[i] = strings.ReplaceAll(arg, "{}", ent.Path)
+			}
+			cmd := exec.CommandContext(ctx, argv1[0], argv1[1:]...)
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			if err := cmd.Run(); err != nil {
+				return errors.Wrapf(err, "exec for %s", ent.Path)
+			}
+		}
+	}
+	return nil
+}
+
+// Delete removes ents in batch.  Entries under deleted dirs are skipped
+func (f *Finder) Delete(ctx context.Context, ents []FindEntry) (client.FileManagerResponse, error) {
+	matches := make([]GlobMatch, len(ents))
+	for i, ent := range ents {
+		matches[i] = GlobMatch{
+			Path:  ent.Path,
+			IsDir: ent.IsDir != 0,
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Path < matches[j].Path
+	})
+	matches = pruneGlobMatches(matches)
+	if len(matches) == 0 {
+		return client.FileManagerResponse{}, nil
+	}
+	return NewGlobMan(f.client).Crypt(f.cryptMan).Remove(ctx, matches)
+}
@@ -0,0 +1,47 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"mypan/pkg/crypt"
+	"mypan/pkg/find"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFinderCrypt(t *testing.T) {
+	ctx := context.Background()
+	cipher, err := crypt.NewCipherFromKey(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	fc := newFakeClient().
+		add(cipher.EncryptPath("d/a.jpg"), uint64(crypt.EncryptedSize(100))).
+		add(cipher.EncryptPath("d/e/b.txt"), uint64(crypt.EncryptedSize(200)))
+	cm := NewCryptMan(fc, cipher).EncryptNames(true)
+
+	query, err := find.Parse(strings.Split("-path ./e/* -o -size 100", " "), time.Now())
+	require.NoError(t, err)
+	finder := NewFinder(fc, query).Crypt(cm)
+	ents, err := finder.Find(ctx, "d")
+	require.NoError(t, err)
+	var got []string
+	for _, ent := range ents {
+		got = append(got, ent.Path)
+	}
+	assert.ElementsMatch(t, []string{"/apps/x/d/a.jpg", "/apps/x/d/e/b.txt"}, got)
+	assert.Equal(t, []string{"ListAllEx /apps/x/" + cipher.EncryptPath("d")}, fc.calls)
+
+	fc.calls = nil
+	_, err = finder.Delete(ctx, ents)
+	require.NoError(t, err)
+	assert.Len(t, fc.calls, 1)
+	assert.Empty(t, remoteNames(fc, cipher.EncryptPath("d/e")))
+	assert.Equal(t, []string{cipher.EncryptName("e")}, remoteNames(fc, cipher.EncryptPath("d")))
+}
@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"mypan/pkg/client"
+	"mypan/pkg/util"
+
+	"github.com/pkg/errors"
+)
+
+// GlobMatch is a remote path matching a pattern
+type GlobMatch struct {
+	// Path is in the same form as the pattern, relative to the app base
+	// dir or absolute
+	Path  string `json:"path"`
+	IsDir bool   `json:"isdir"`
+
+	// Sub is part of Path below the leading dir of the pattern without
+	// glob meta characters
+	Sub string `json:"-"`
+}
+
+// ExpandEntry is an operation on an expanded path, as shown by --dryrun
+type ExpandEntry struct {
+	Path string `json:"path"`
+	Dest string `json:"dest,omitempty"`
+}
+
+// GlobMan expands shell style patterns in remote paths by listing the
+// leading dir without glob meta characters.  "**" matches any levels of
+// dirs
+type GlobMan struct {
+	client   client.ClientI
+	cryptMan *CryptMan
+}
+
+func NewGlobMan(client client.ClientI) *GlobMan {
+	gm := &GlobMan{
+		client: client,
+	}
+	return gm
+}
+
+// Crypt makes patterns match plaintext names
+func (gm *GlobMan) Crypt(cryptMan *CryptMan) *GlobMan {
+	gm.cryptMan = cryptMan
+	return gm
+}
+
+// ExpandAll expands each of patterns.  Paths without glob meta characters
+// are only unescaped without checking existence
+func (gm *GlobMan) ExpandAll(ctx context.Context, patterns []string) ([]GlobMatch, error) {
+	var matches []GlobMatch
+	for _, pattern := range patterns {
+		matches1, err := gm.Expand(ctx, pattern)
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, matches1...)
+	}
+	return matches, nil
+}
+
+// Expand returns paths matching pattern.  It's an error if there is none.
+// Meta characters escaped with backslash in a pattern are taken literally.
+// A path without unescaped meta characters is not a pattern and returned
+// unescaped without listing
+func (gm *GlobMan) Expand(ctx context.Context, pattern string) ([]GlobMatch, error) {
+	if !util.HasGlobMeta(pattern) {
+		p := util.UnescapeGlob(pattern)
+		return []GlobMatch{{Path: p, Sub: path.Base(p)}}, nil
+	}
+	dir, rest := util.SplitGlob(pattern)
+	if _, err := util.MatchGlob(rest, ""); err != nil {
+		return nil, errors.Wrapf(err, "pattern %q", pattern)
+	}
+
+	type entry struct {
+		path  string
+		isDir bool
+	}
+	var (
+		ents      []entry
+		remoteDir = gm.cryptMan.RemotePath(dir)
+	)
+	// list recursively only when needed: rest has more than one component,
+	// or is "**" matching any levels
+	if strings.Contains(rest, "/") || rest == "**" {
+		resp, err := gm.client.ListAllEx(ctx, remoteDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list all %q", dir)
+		}
+		for _, v := range resp.List {
+			ents = append(ents, entry{v.Path, v.IsDir != 0})
+		}
+	} else {
+		resp, err := gm.client.ListEx(ctx, remoteDir)
+		if err != nil {
+			return nil, errors.Wrapf(err, "list %q", dir)
+		}
+		for _, v := range resp.List {
+			ents = append(ents, entry{v.Path, v.IsDir != 0})
+		}
+	}
+
+	var (
+		matches []GlobMatch
+		prefix  = strings.TrimSuffix(gm.client.AbsPath(dir), "/") + "/"
+	)
+	for _, ent := range ents {
+		sub := strings.TrimPrefix(gm.cryptMan.PlainPath(ent.path), prefix)
+		if ok, _ := util.MatchGlob(rest, sub); ok {
+			matches = append(matches, GlobMatch{
+				Path:  path.Join(dir, sub),
+				IsDir: ent.isDir,
+				Sub:   sub,
+			})
+		}
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%s: no match", pattern)
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].Path < matches[j].Path
+	})
+	return pruneGlobMatches(matches), nil
+}
+
+// pruneGlobMatches drops matches under matched dirs as operations on dirs
+// cover them
+func pruneGlobMatches(matches []GlobMatch) []GlobMatch {
+	var (
+		ret  []GlobMatch
+		dirs = map[string]bool{}
+	)
+	for _, m := range matches {
+		covered := false
+		for p := path.Dir(m.Path); p != "." && p != "/" && p != ""; p = path.Dir(p) {
+			if dirs[p] {
+				covered = true
+				break
+			}
+		}
+		if covered {
+			continue
+		}
+		if m.IsDir {
+			dirs[m.Path] = true
+		}
+		ret = append(ret, m)
+	}
+	return ret
+}
+
+// Remove deletes matched paths in one batch request
+func (gm *GlobMan) Remove(ctx context.Context, matches []GlobMatch) (client.FileManagerResponse, error) {
+	paths := make([]string, len(matches))
+	for i, m := range matches {
+		paths[i] = gm.cryptMan.RemotePath(m.Path)
+	}
+	return gm.client.DeleteMulti(ctx, paths)
+}
+
+func globMatchPaths(matches []GlobMatch) []string {
+	paths := make([]string, len(matches))
+	for i, m := range matches {
+		paths[i] = m.Path
+	}
+	return paths
+}
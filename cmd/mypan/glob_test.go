@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGlobManExpand(t *testing.T) {
+	ctx := context.Background()
+	newClient := func() *fakeClient {
+		return newFakeClient().
+			add("d/a.jpg", 1).
+			add("d/photo[1].jpg", 1).
+			add("d/e/b.jpg", 1).
+			add("d[x]/c.jpg", 1)
+	}
+	testCases := []struct {
+		pattern string
+		want    []string
+		calls   []string
+	}{
+		{
+			pattern: "d/*.jpg",
+			want:    []string{"d/a.jpg", "d/photo[1].jpg"},
+			calls:   []string{"ListEx /apps/x/d"},
+		},
+		{
+			pattern: "d/**",
+			want:    []string{"d/a.jpg", "d/e", "d/photo[1].jpg"},
+			calls:   []string{"ListAllEx /apps/x/d"},
+		},
+		{
+			pattern: "d/**/*.jpg",
+			want:    []string{"d/a.jpg", "d/e/b.jpg", "d/photo[1].jpg"},
+			calls:   []string{"ListAllEx /apps/x/d"},
+		},
+		{
+			// no unescaped meta characters, not a pattern
+			pattern: `d/photo\[1\].jpg`,
+			want:    []string{"d/photo[1].jpg"},
+		},
+		{
+			pattern: `d/photo\[?\].jpg`,
+			want:    []string{"d/photo[1].jpg"},
+			calls:   []string{"ListEx /apps/x/d"},
+		},
+		{
+			pattern: `d\[x\]/*`,
+			want:    []string{"d[x]/c.jpg"},
+			calls:   []string{"ListEx /apps/x/d[x]"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			fc := newClient()
+			matches, err := NewGlobMan(fc).Expand(ctx, tc.pattern)
+			require.NoError(t, err)
+			assert.Equal(t, tc.want, globMatchPaths(matches))
+			assert.Equal(t, tc.calls, fc.calls)
+		})
+	}
+
+	_, err := NewGlobMan(newClient()).Expand(ctx, "d/*.png")
+	assert.EqualError(t, err, "d/*.png: no match")
+}
+
+func TestGlobManRemoveEscaped(t *testing.T) {
+	ctx := context.Background()
+	fc := newFakeClient().
+		add("d/a*b", 1).
+		add("d/a1b", 1).
+		add(`d/a\*b`, 1)
+	gm := NewGlobMan(fc)
+	matches, err := gm.ExpandAll(ctx, []string{`d/a\*b`})
+	require.NoError(t, err)
+	_, err = gm.Remove(ctx, matches)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"DeleteMulti d/a*b"}, fc.calls)
+	assert.Equal(t, []string{"a1b", `a\*b`}, remoteNames(fc, "d"))
+}
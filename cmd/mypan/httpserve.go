@@ -0,0 +1,157 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/golang/glog"
+)
+
+// HTTPDirEntry is an entry of dir listing in JSON
+type HTTPDirEntry struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	IsDir bool      `json:"isdir"`
+	Mtime time.Time `json:"mtime"`
+	Md5   string    `json:"md5,omitempty"`
+}
+
+var httpDirTemplate = template.Must(template.New("dir").Funcs(template.FuncMap{
+	"escape": url.PathEscape,
+	"size": func(size int64) string {
+		return humanize.IBytes(uint64(size))
+	},
+	"time": func(t time.Time) string {
+		return t.Format("2006-01-02 15:04:05")
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>{{.Path}}</title></head>
+<body>
+<h1>{{.Path}}</h1>
+<table>
+{{if ne .Path "/"}}<tr><td><a href="../">../</a></td><td></td><td></td></tr>
+{{end}}{{range .Entries}}<tr>
+{{if .IsDir}}<td><a href="{{escape .Name}}/">{{.Name}}/</a></td><td></td>{{else}}<td><a href="{{escape .Name}}">{{.Name}}</a></td><td>{{size .Size}}</td>{{end}}
+<td>{{time .Mtime}}</td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
+
+// HTTPServer serves files of RemoteFS read-only.  Dirs are listed in HTML,
+// or in JSON with "?format=json" or "Accept: application/json"
+type HTTPServer struct {
+	rfs *RemoteFS
+}
+
+func NewHTTPServer(rfs *RemoteFS) *HTTPServer {
+	hs := &HTTPServer{
+		rfs: rfs,
+	}
+	return hs
+}
+
+func (hs *HTTPServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var (
+		ctx  = req.Context()
+		name = path.Clean("/" + req.URL.Path)
+	)
+	info, err := hs.rfs.Stat(ctx, name)
+	if err != nil {
+		hs.error(w, req, err)
+		return
+	}
+	if info.IsDir() {
+		if !strings.HasSuffix(req.URL.Path, "/") {
+			u := *req.URL
+			u.Path += "/"
+			http.Redirect(w, req, u.String(), http.StatusMovedPermanently)
+			return
+		}
+		hs.serveDir(w, req, name)
+		return
+	}
+	rfr, err := hs.rfs.Open(ctx, name)
+	if err != nil {
+		hs.error(w, req, err)
+		return
+	}
+	defer rfr.Close()
+	if rfi, ok := info.(RemoteFileInfo); ok && rfi.Md5() != "" {
+		w.Header().Set("ETag", fmt.Sprintf(`"%s"`, rfi.Md5()))
+	}
+	// ranges are served by seeking, which makes rfr request from there
+	http.ServeContent(w, req, info.Name(), info.ModTime(), rfr)
+}
+
+func (hs *HTTPServer) serveDir(w http.ResponseWriter, req *http.Request, name string) {
+	infos, err := hs.rfs.ReadDir(req.Context(), name)
+	if err != nil {
+		hs.error(w, req, err)
+		return
+	}
+	ents := make([]HTTPDirEntry, len(infos))
+	for i, info := range infos {
+		ents[i] = HTTPDirEntry{
+			Name:  info.Name(),
+			Size:  info.Size(),
+			IsDir: info.IsDir(),
+			Mtime: info.ModTime(),
+		}
+		if rfi, ok := info.(RemoteFileInfo); ok {
+			ents[i].Md5 = rfi.Md5()
+		}
+	}
+	sort.Slice(ents, func(i, j int) bool {
+		if ents[i].IsDir != ents[j].IsDir {
+			return ents[i].IsDir
+		}
+		return ents[i].Name < ents[j].Name
+	})
+	if req.URL.Query().Get("format") == "json" ||
+		strings.Contains(req.Header.Get("Accept"), "application/json") {
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(ents); err != nil {
+			glog.Warningf("http: %s: %v", req.URL.Path, err)
+		}
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := httpDirTemplate.Execute(w, struct {
+		Path    string
+		Entries []HTTPDirEntry
+	}{
+		Path:    name,
+		Entries: ents,
+	}); err != nil {
+		glog.Warningf("http: %s: %v", req.URL.Path, err)
+	}
+}
+
+func (hs *HTTPServer) error(w http.ResponseWriter, req *http.Request, err error) {
+	if os.IsNotExist(err) {
+		http.Error(w, "not found", http.StatusNotFound)
+		return
+	}
+	glog.Warningf("http: %s: %v", req.URL.Path, err)
+	http.Error(w, "internal server error", http.StatusInternalServerError)
+}
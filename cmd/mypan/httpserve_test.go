@@ -0,0 +1,55 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHTTPServer(t *testing.T) {
+	fc := newFakeClient().
+		addContent("r/d/f.txt", []byte("0123456789")).
+		add("r/d/sub/", 0)
+	hs := NewHTTPServer(NewRemoteFS(fc, "r"))
+	do := func(method, target string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		hs.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(http.MethodGet, "/d/f.txt", http.Header{"Range": {"bytes=4-6"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "456", w.Body.String())
+
+	w = do(http.MethodGet, "/d/f.txt", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "0123456789", w.Body.String())
+
+	w = do(http.MethodGet, "/d", nil)
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "/d/", w.Header().Get("Location"))
+
+	w = do(http.MethodGet, "/d/?format=json", nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var ents []HTTPDirEntry
+	require.NoError(t, json.Unmarshal(w.Body.Bytes(), &ents))
+	require.Len(t, ents, 2)
+	assert.Equal(t, "sub", ents[0].Name)
+	assert.True(t, ents[0].IsDir)
+	assert.Equal(t, "f.txt", ents[1].Name)
+	assert.EqualValues(t, 10, ents[1].Size)
+
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/nope", nil).Code)
+	assert.Equal(t, http.StatusMethodNotAllowed, do(http.MethodPut, "/d/f.txt", nil).Code)
+}
@@ -4,20 +4,32 @@
 package main
 
 import (
+	"bufio"
 	"context"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
 	"os/signal"
+	"path"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"mypan/pkg/client"
 	"mypan/pkg/config"
+	"mypan/pkg/crypt"
+	"mypan/pkg/find"
+	"mypan/pkg/s3"
 	"mypan/pkg/store"
 	"mypan/pkg/util"
 
+	"github.com/dustin/go-humanize"
 	"github.com/golang/glog"
 	"github.com/jedib0t/go-pretty/progress"
 	ptable "github.com/jedib0t/go-pretty/table"
@@ -43,6 +55,11 @@ func (rdr Render) pRender(w ptable.Writer) {
 	w.SortBy([]ptable.SortBy{
 		{Number: 1, Mode: ptable.Asc},
 	})
+	rdr.pRenderAsIs(w)
+}
+
+// pRenderAsIs renders rows in the order they were appended
+func (rdr Render) pRenderAsIs(w ptable.Writer) {
 	w.Style().Options.DrawBorder = false
 	w.Style().Options.SeparateRows = false
 	w.Style().Options.SeparateColumns = false
@@ -57,11 +74,33 @@ func (rdr Render) Render(v interface{}) {
 		rdr.RenderAsJSON(v)
 		return
 	}
+	if rdr.format == "jsonl" {
+		rdr.RenderAsJSONLines(v)
+		return
+	}
 	switch val := v.(type) {
 	case client.ListResponse:
 		rdr.RenderListResponse(val)
 	case client.ListAllResponse:
 		rdr.RenderListAllResponse(val)
+	case []ConfigShowEntry:
+		rdr.RenderConfigShowEntries(val)
+	case SyncSummary:
+		rdr.RenderSyncSummary(val)
+	case []VerifyEntry:
+		rdr.RenderVerifyEntries(val)
+	case []ExpandEntry:
+		rdr.RenderExpandEntries(val)
+	case []FindEntry:
+		rdr.RenderFindEntries(val)
+	case []DuEntry:
+		rdr.RenderDuEntries(val)
+	case *TreeNode:
+		rdr.RenderTree(val)
+	case []DupGroup:
+		rdr.RenderDupGroups(val)
+	case []DiffEntry:
+		rdr.RenderDiffEntries(val)
 	default:
 		rdr.RenderAsJSON(v)
 	}
@@ -71,6 +110,19 @@ func (rdr Render) RenderAsJSON(v interface{}) {
 	fmt.Printf("%s\n", util.MustMarshalJSON(v))
 }
 
+// RenderAsJSONLines renders each element of slice v as a line of JSON.
+// Other values are rendered as JSON
+func (rdr Render) RenderAsJSONLines(v interface{}) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		rdr.RenderAsJSON(v)
+		return
+	}
+	for i := 0; i < rv.Len(); i++ {
+		rdr.RenderAsJSON(rv.Index(i).Interface())
+	}
+}
+
 func (rdr Render) RenderListResponse(resp client.ListResponse) {
 	w := ptable.NewWriter()
 	for _, f := range resp.List {
@@ -121,22 +173,193 @@ func (rdr Render) RenderListAllResponse(resp client.ListAllResponse) {
 	rdr.pRender(w)
 }
 
+func (rdr Render) RenderConfigShowEntries(ents []ConfigShowEntry) {
+	w := ptable.NewWriter()
+	for _, ent := range ents {
+		w.AppendRow([]interface{}{
+			ent.Name,
+			ent.Value,
+			ent.Source,
+		})
+	}
+	rdr.pRender(w)
+}
+
+func (rdr Render) RenderSyncSummary(summary SyncSummary) {
+	w := ptable.NewWriter()
+	for _, ent := range summary.Entries {
+		w.AppendRow([]interface{}{
+			ent.Result,
+			ent.Count,
+			humanize.IBytes(uint64(ent.Bytes)),
+		})
+	}
+	w.AppendFooter([]interface{}{
+		summary.Elapsed.Round(time.Millisecond),
+		"",
+		humanize.IBytes(uint64(summary.Throughput)) + "/s",
+	})
+	rdr.pRender(w)
+}
+
+func (rdr Render) RenderFindEntries(ents []FindEntry) {
+	w := ptable.NewWriter()
+	for _, f := range ents {
+		name := f.Path
+		var sizeCol string
+		if f.IsDir == 0 {
+			sizeCol = strconv.FormatUint(f.Size, 10)
+		} else {
+			name += "/"
+			sizeCol = "-"
+		}
+		w.AppendRow([]interface{}{
+			name,
+			sizeCol,
+			unixTimeFormatter(int64(f.ServerMtime)),
+			f.Md5,
+		})
+	}
+	rdr.pRender(w)
+}
+
+func (rdr Render) RenderDuEntries(ents []DuEntry) {
+	w := ptable.NewWriter()
+	for _, ent := range ents {
+		w.AppendRow([]interface{}{
+			sizeOrHuman(ent.Size, ent.SizeHuman),
+			ent.Files,
+			ent.Path,
+		})
+	}
+	rdr.pRenderAsIs(w)
+}
+
+func (rdr Render) RenderTree(root *TreeNode) {
+	w := ptable.NewWriter()
+	var walk func(node *TreeNode, indent, branch string)
+	walk = func(node *TreeNode, indent, branch string) {
+		name := node.Name
+		if node.IsDir {
+			name += "/"
+		}
+		w.AppendRow([]interface{}{
+			indent + branch + name,
+			sizeOrHuman(node.Size, node.SizeHuman),
+		})
+		if branch == "├── " {
+			indent += "│   "
+		} else if branch == "└── " {
+			indent += "    "
+		}
+		for i, child := range node.Children {
+			if i == len(node.Children)-1 {
+				walk(child, indent, "└── ")
+			} else {
+				walk(child, indent, "├── ")
+			}
+		}
+	}
+	walk(root, "", "")
+	rdr.pRenderAsIs(w)
+}
+
+func (rdr Render) RenderDupGroups(groups []DupGroup) {
+	w := ptable.NewWriter()
+	var wasted int64
+	for _, g := range groups {
+		wasted += g.Wasted
+		decided := g.kept()
+		for _, f := range g.Files {
+			mark := ""
+			if decided {
+				mark = "rm"
+				if f.Keep {
+					mark = "keep"
+				}
+			}
+			w.AppendRow([]interface{}{
+				g.Md5,
+				g.Size,
+				mark,
+				f.Path,
+			})
+		}
+	}
+	rdr.pRenderAsIs(w)
+	if len(groups) > 0 {
+		fmt.Printf("%d groups, %s wasted\n", len(groups), humanize.IBytes(uint64(wasted)))
+	}
+}
+
+func (rdr Render) RenderDiffEntries(ents []DiffEntry) {
+	w := ptable.NewWriter()
+	for _, ent := range ents {
+		w.AppendRow([]interface{}{
+			ent.Status,
+			ent.Cause,
+			ent.Local,
+			ent.Remote,
+		})
+	}
+	rdr.pRenderAsIs(w)
+}
+
+func sizeOrHuman(size int64, human string) string {
+	if human != "" {
+		return human
+	}
+	return strconv.FormatInt(size, 10)
+}
+
+func (rdr Render) RenderExpandEntries(ents []ExpandEntry) {
+	w := ptable.NewWriter()
+	for _, ent := range ents {
+		w.AppendRow([]interface{}{
+			ent.Path,
+			ent.Dest,
+		})
+	}
+	rdr.pRender(w)
+}
+
+func (rdr Render) RenderVerifyEntries(ents []VerifyEntry) {
+	w := ptable.NewWriter()
+	for _, ent := range ents {
+		w.AppendRow([]interface{}{
+			ent.Path,
+			ent.Result,
+			ent.LocalPath,
+		})
+	}
+	rdr.pRender(w)
+}
+
 type MyApp struct {
-	ctx     context.Context
-	timeout time.Duration
-	render  Render
+	ctx       context.Context
+	ctxCancel context.CancelFunc
+	timeout   time.Duration
+	render    Render
+	configMan *ConfigMan
 
 	dstClient   client.ClientI
+	cryptMan    *CryptMan
+	tmpDir      string
+	chunkMan    *ChunkMan
 	configStore store.StoreSerdeI
 	cacheStore  store.StoreSerdeI
 
-	progress *progress.Progress
+	progress      *progress.Progress
+	progressMaker ProgressMaker
+	events        *EventWriter
+	eventsFile    *os.File
 }
 
 func NewMyApp() MyApp {
 	myApp := MyApp{
-		ctx:    context.Background(),
-		render: NewRender("json"),
+		ctx:       context.Background(),
+		render:    NewRender("json"),
+		configMan: NewConfigMan(),
 	}
 	return myApp
 }
@@ -145,12 +368,27 @@ func (myApp MyApp) syncAction(cCtx *cli.Context, src, dst string, up bool) error
 	if src == "" || dst == "" {
 		return cli.Exit("src and dst arguments are required", 1)
 	}
-	var (
-		ctx        = myApp.ctx
-		dstClient  = myApp.dstClient
-		cacheStore = myApp.cacheStore
-	)
+	opts := myApp.syncOpts(cCtx)
+	if cCtx.String("dst-backend") == dstBackendLocal {
+		// encryption and chunking are for remote storage
+		opts = append(opts, DstLocalDir())
+	} else {
+		if cryptMan := myApp.cryptMan; cryptMan != nil {
+			opts = append(opts, Encrypt(cryptMan))
+		}
+		if chunkMan := myApp.chunkMan; chunkMan != nil {
+			opts = append(opts, Chunk(chunkMan))
+		}
+	}
+	su, err := myApp.newSync(src, dst, up, opts...)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	return myApp.runSync(cCtx, su)
+}
 
+// syncOpts returns options of sync from command line flags
+func (myApp MyApp) syncOpts(cCtx *cli.Context) []SyncOpt {
 	var opts []SyncOpt
 	if cCtx.Bool("dryrun") {
 		opts = append(opts, DryRun(true))
@@ -158,19 +396,54 @@ func (myApp MyApp) syncAction(cCtx *cli.Context, src, dst string, up bool) error
 	if cCtx.Bool("nodelete") {
 		opts = append(opts, NoDelete(true))
 	}
-	if progress := myApp.progress; progress != nil {
-		opts = append(opts, Progress(progress))
+	if progressMaker := myApp.progressMaker; progressMaker != nil {
+		opts = append(opts, Progress(progressMaker))
+	}
+	if events := myApp.events; events != nil {
+		opts = append(opts, Events(events))
 	}
 	if p := cCtx.Int("parallel"); p > 1 {
 		opts = append(opts, Parallel(p))
 	}
+	if patterns := cCtx.StringSlice("exclude"); len(patterns) > 0 {
+		opts = append(opts, Exclude(patterns))
+	}
+	return opts
+}
+
+// newNoSummaryFlag returns flag for not printing summary of sync at the end
+func newNoSummaryFlag() *cli.BoolFlag {
+	return &cli.BoolFlag{Name: "no-summary", Usage: "log instead of printing counts and bytes of actions taken at the end"}
+}
+
+func (myApp MyApp) runSync(cCtx *cli.Context, su *Sync) error {
+	myApp.progressRender()
+	err := su.Do(myApp.ctx)
+	// summary is also there on failure to tell how far it went
+	myApp.progreseStop()
+	if cCtx.Bool("no-summary") {
+		glog.Infof("sync summary: %s", su.Summary())
+	} else {
+		myApp.render.Render(su.Summary())
+	}
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+func (myApp MyApp) newSync(src, dst string, up bool, opts ...SyncOpt) (*Sync, error) {
+	var (
+		dstClient  = myApp.dstClient
+		cacheStore = myApp.cacheStore
+	)
 	dstCacheStore, err := store.NewFileCacheStore(
 		config.StoreKeyDstCacheEntry,
 		cacheStore,
 		NewDstCacheEntry,
 	)
 	if err != nil {
-		return cli.Exit(errors.Wrap(err, "dst cache store"), 1)
+		return nil, errors.Wrap(err, "dst cache store")
 	}
 	srcCacheStore, err := store.NewFileCacheStore(
 		config.StoreKeySrcCacheEntry,
@@ -178,7 +451,7 @@ func (myApp MyApp) syncAction(cCtx *cli.Context, src, dst string, up bool) error
 		NewSrcCacheEntry,
 	)
 	if err != nil {
-		return cli.Exit(errors.Wrap(err, "src cache store"), 1)
+		return nil, errors.Wrap(err, "src cache store")
 	}
 	var su *Sync
 	if up {
@@ -187,30 +460,382 @@ func (myApp MyApp) syncAction(cCtx *cli.Context, src, dst string, up bool) error
 		opts = append(opts, Continue())
 		su = NewSyncDown(src, dst, dstClient, srcCacheStore, dstCacheStore, opts...)
 	}
-	myApp.progressRender()
-	if err := su.Do(ctx); err != nil {
+	return su, nil
+}
+
+// syncJob runs a sync job declared in config file
+func (myApp MyApp) syncJob(ctx context.Context, job config.Job) error {
+	var opts []SyncOpt
+	if job.DryRun {
+		opts = append(opts, DryRun(true))
+	}
+	if job.NoDelete {
+		opts = append(opts, NoDelete(true))
+	}
+	if p := job.Parallel; p > 1 {
+		opts = append(opts, Parallel(p))
+	}
+	if len(job.Exclude) > 0 {
+		opts = append(opts, Exclude(job.Exclude))
+	}
+	if cryptMan := myApp.cryptMan; cryptMan != nil {
+		opts = append(opts, Encrypt(cryptMan))
+	}
+	if chunkMan := myApp.chunkMan; chunkMan != nil {
+		opts = append(opts, Chunk(chunkMan))
+	}
+	up := job.Direction == config.JobDirectionUp
+	su, err := myApp.newSync(job.Src, job.Dst, up, opts...)
+	if err != nil {
 		return err
 	}
-	return nil
+	err = su.Do(ctx)
+	glog.Infof("job %s: %s", job.Name, su.Summary())
+	return err
 }
 
+// newOndupFlag returns flag for conflict policy of commands writing to
+// remote
+func newOndupFlag() *cli.StringFlag {
+	return &cli.StringFlag{
+		Name:  "ondup",
+		Value: client.ONDUP_OVERWRITE,
+		Usage: fmt.Sprintf("what to do when remote path exists, allowed values are %v", client.OndupValues),
+		Action: func(cCtx *cli.Context, v string) error {
+			_, err := client.ParseOndup(v)
+			return err
+		},
+	}
+}
+
+func newFromFileFlag() *cli.PathFlag {
+	return &cli.PathFlag{
+		Name:  "from-file",
+		Usage: "read pairs of paths, one pair per line separated by tab or spaces, from file, or stdin with -",
+	}
+}
+
+// upload uploads local file src, or stdin with "-", to remotepath dst,
+// in chunks or encrypted as configured
+func (myApp MyApp) upload(ctx context.Context, src, dst, ondup string) (interface{}, error) {
+	var (
+		cryptMan  = myApp.cryptMan
+		wopt      = client.Ondup(ondup)
+		needChunk bool
+	)
+	if src != "-" {
+		fi, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		needChunk, err = myApp.chunkMan.NeedChunk(ctx, fi.Size())
+		if err != nil {
+			return nil, err
+		}
+		if needChunk && ondup != client.ONDUP_OVERWRITE {
+			return nil, fmt.Errorf("ondup other than overwrite is not supported for chunked upload")
+		}
+	}
+	// "-" for reading from stdin
+	var (
+		result interface{}
+		err    error
+	)
+	switch {
+	case needChunk:
+		return myApp.chunkMan.Up(ctx, src, dst)
+	case cryptMan != nil && src == "-":
+		result, err = cryptMan.UploadReader(ctx, os.Stdin, dst, wopt)
+	case cryptMan != nil:
+		result, err = cryptMan.Upload(ctx, src, dst, wopt)
+	case src == "-":
+		result, err = myApp.dstClient.UploadReader(ctx, os.Stdin, -1, dst, wopt)
+	default:
+		result, err = myApp.dstClient.Upload(ctx, src, dst, wopt)
+	}
+	if err == nil && ondup == client.ONDUP_OVERWRITE {
+		// a chunked copy from earlier uploads would shadow the new one
+		removeStale(ctx, myApp.dstClient, cryptMan, path.Dir(dst), path.Base(dst), 0)
+	}
+	return result, err
+}
+
+// copyMoveAction copies or moves remotepath0 to remotepath1, or sources
+// into the directory given as the last argument, and pairs from
+// --from-file
 func (myApp MyApp) copyMoveAction(
 	cCtx *cli.Context,
-	action func(context.Context, string, string) (client.FileManagerResponse, error),
+	action func(context.Context, [][2]string, ...client.WriteOpt) (client.FileManagerResponse, error),
 ) error {
-	remotepath0 := cCtx.Args().Get(0)
-	remotepath1 := cCtx.Args().Get(1)
-	if remotepath0 == "" || remotepath1 == "" {
+	args := cCtx.Args().Slice()
+	if len(args) == 1 {
 		return cli.Exit("remotepath0 and remotepath1 arguments are required", 1)
 	}
-	resp, err := action(myApp.ctx, remotepath0, remotepath1)
+	pairs, err := copyMovePairs(myApp.ctx, NewGlobMan(myApp.dstClient).Crypt(myApp.cryptMan), args)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
+	return myApp.fileManagerAction(cCtx, pairs, action)
+}
+
+// copyMovePairs returns pairs of source and destination from args of copy
+// and move: remotepath0 remotepath1, or sources expanded with globMan and a
+// dir as the last
+func copyMovePairs(ctx context.Context, globMan *GlobMan, args []string) ([][2]string, error) {
+	var pairs [][2]string
+	switch {
+	case len(args) == 2 && !util.HasGlobMeta(args[0]):
+		// not a pattern, only unescaped
+		matches, err := globMan.Expand(ctx, args[0])
+		if err != nil {
+			return nil, err
+		}
+		pairs = append(pairs, [2]string{matches[0].Path, args[1]})
+	case len(args) >= 2:
+		dir := args[len(args)-1]
+		matches, err := globMan.ExpandAll(ctx, args[:len(args)-1])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range matches {
+			pairs = append(pairs, [2]string{m.Path, path.Join(dir, m.Sub)})
+		}
+	}
+	return pairs, nil
+}
+
+// downGlob downloads remote paths matching pattern into dir outpath
+func (myApp MyApp) downGlob(cCtx *cli.Context, downMan *DownMan, pattern, outpath string) error {
+	if outpath == "" {
+		return fmt.Errorf("local dir is required to download %q", pattern)
+	}
+	matches, err := NewGlobMan(myApp.dstClient).
+		Crypt(myApp.cryptMan).
+		Expand(myApp.ctx, pattern)
+	if err != nil {
+		return err
+	}
+	var pairs [][2]string
+	for _, m := range matches {
+		pairs = append(pairs, [2]string{m.Path, filepath.Join(outpath, filepath.FromSlash(m.Sub))})
+	}
+	if myApp.renderDryRun(cCtx, pairs) {
+		return nil
+	}
+	for _, p := range pairs {
+		if err := downMan.Down(myApp.ctx, p[0], p[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// catAction writes remote files matching args to stdout.  With headers,
+// each file is preceded by its name if there are several, as head(1) does
+func (myApp MyApp) catAction(cCtx *cli.Context, offset, length int64, headers bool) error {
+	if cCtx.NArg() == 0 {
+		return cli.Exit("remotepath argument is required", 1)
+	}
+	matches, err := NewGlobMan(myApp.dstClient).
+		Crypt(myApp.cryptMan).
+		ExpandAll(myApp.ctx, cCtx.Args().Slice())
 	if err != nil {
 		return cli.Exit(err, 1)
 	}
+	var relpaths []string
+	for _, m := range matches {
+		if !m.IsDir {
+			relpaths = append(relpaths, m.Path)
+		}
+	}
+	catMan := NewCatMan(myApp.dstClient).Crypt(myApp.cryptMan)
+	for i, relpath := range relpaths {
+		if headers && len(relpaths) > 1 {
+			if i > 0 {
+				fmt.Println()
+			}
+			fmt.Printf("==> %s <==\n", relpath)
+		}
+		if err := catMan.Cat(myApp.ctx, relpath, offset, length); err != nil {
+			return cli.Exit(err, 1)
+		}
+	}
+	return nil
+}
+
+const (
+	dstBackendRemote = "remote"
+	dstBackendLocal  = "local"
+)
+
+func newDstBackendFlag() *cli.StringFlag {
+	backends := []string{dstBackendRemote, dstBackendLocal}
+	return &cli.StringFlag{
+		Name:  "dst-backend",
+		Value: dstBackendRemote,
+		Usage: fmt.Sprintf("where remotepath is, allowed values are %v", backends),
+		Action: func(cCtx *cli.Context, v string) error {
+			for _, backend := range backends {
+				if v == backend {
+					return nil
+				}
+			}
+			return fmt.Errorf("invalid dst backend %q, allowed values are %v", v, backends)
+		},
+	}
+}
+
+// newServeFlags returns flags common to servers followed by flags
+func newServeFlags(addr string, flags ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{Name: "addr", Value: addr, Usage: "address to listen on"},
+		&cli.DurationFlag{Name: "dir-cache-ttl", Value: 30 * time.Second, Usage: "how long dir listings are cached, 0 to disable"},
+	}, flags...)
+}
+
+func newBasicAuthFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{Name: "user", Usage: "require basic auth with this user name"},
+		&cli.StringFlag{Name: "password", EnvVars: []string{"MYPAN_SERVE_PASSWORD"}, Usage: "password of basic auth"},
+	}
+}
+
+// checkBasicAuthFlags requires both --user and --password or neither.
+// Serving read-write without them takes --no-auth
+func checkBasicAuthFlags(cCtx *cli.Context) error {
+	user, password := cCtx.String("user"), cCtx.String("password")
+	switch {
+	case user != "" && password == "":
+		return fmt.Errorf("--password is required with --user")
+	case user == "" && password != "":
+		return fmt.Errorf("--user is required with --password")
+	case user == "" && !cCtx.Bool("read-only") && !cCtx.Bool("no-auth"):
+		return fmt.Errorf("refuse to serve read-write without --user and --password, pass --read-only or --no-auth to allow it")
+	}
+	return nil
+}
+
+func (myApp MyApp) newRemoteFS(cCtx *cli.Context) *RemoteFS {
+	return NewRemoteFS(myApp.dstClient, cCtx.Args().First()).
+		TTL(cCtx.Duration("dir-cache-ttl")).
+		ReadOnly(cCtx.Bool("read-only")).
+		TmpDir(myApp.tmpDir)
+}
+
+func (myApp MyApp) serve(cCtx *cli.Context, name string, h http.Handler) error {
+	h = BasicAuth(h, cCtx.String("user"), cCtx.String("password"))
+	h = BearerAuth(h, cCtx.String("token"))
+	if err := ListenAndServe(myApp.ctx, name, cCtx.String("addr"), h); err != nil {
+		return cli.Exit(err, 1)
+	}
+	return nil
+}
+
+func newDryRunFlag() *cli.BoolFlag {
+	return &cli.BoolFlag{Name: "dryrun", Usage: "print expansion of remote path patterns and exit"}
+}
+
+// renderDryRun renders pairs if --dryrun is set and tells whether it is
+func (myApp MyApp) renderDryRun(cCtx *cli.Context, pairs [][2]string) bool {
+	if !cCtx.Bool("dryrun") {
+		return false
+	}
+	ents := make([]ExpandEntry, len(pairs))
+	for i, p := range pairs {
+		ents[i] = ExpandEntry{Path: p[0], Dest: p[1]}
+	}
+	myApp.render.Render(ents)
+	return true
+}
+
+// remotePaths maps plaintext remote paths to those stored on server
+func (myApp MyApp) remotePaths(paths []string) []string {
+	ret := make([]string, len(paths))
+	for i, p := range paths {
+		ret[i] = myApp.cryptMan.RemotePath(p)
+	}
+	return ret
+}
+
+func (myApp MyApp) renderDryRunPaths(cCtx *cli.Context, paths []string) bool {
+	pairs := make([][2]string, len(paths))
+	for i, p := range paths {
+		pairs[i] = [2]string{p, ""}
+	}
+	return myApp.renderDryRun(cCtx, pairs)
+}
+
+func (myApp MyApp) fileManagerAction(
+	cCtx *cli.Context,
+	pairs [][2]string,
+	action func(context.Context, [][2]string, ...client.WriteOpt) (client.FileManagerResponse, error),
+) error {
+	if p := cCtx.Path("from-file"); p != "" {
+		pairs1, err := readPairsFile(p)
+		if err != nil {
+			return cli.Exit(err, 1)
+		}
+		pairs = append(pairs, pairs1...)
+	}
+	if len(pairs) == 0 {
+		return cli.Exit("remotepath0 and remotepath1 arguments are required", 1)
+	}
+	if myApp.renderDryRun(cCtx, pairs) {
+		return nil
+	}
+	for i, pair := range pairs {
+		pairs[i] = [2]string{myApp.cryptMan.RemotePath(pair[0]), myApp.cryptMan.RemotePath(pair[1])}
+	}
+	resp, err := action(myApp.ctx, pairs, client.Ondup(cCtx.String("ondup")))
+	// per-entry result is rendered also on partial failure
 	myApp.render.Render(resp)
+	if err != nil {
+		return cli.Exit(err, 1)
+	}
 	return nil
 }
 
+// readPairsFile reads pairs of paths, one pair per line.  A pair is
+// separated by tab if there is one, otherwise by spaces.  Empty lines and
+// lines starting with # are ignored
+func readPairsFile(name string) ([][2]string, error) {
+	var r io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	var (
+		pairs   [][2]string
+		scanner = bufio.NewScanner(r)
+		lineno  int
+	)
+	for scanner.Scan() {
+		lineno++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var fields []string
+		if strings.Contains(line, "\t") {
+			fields = strings.Split(line, "\t")
+		} else {
+			fields = strings.Fields(line)
+		}
+		if len(fields) != 2 || fields[0] == "" || fields[1] == "" {
+			return nil, fmt.Errorf("%s:%d: expecting a pair of paths", name, lineno)
+		}
+		pairs = append(pairs, [2]string{fields[0], fields[1]})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return pairs, nil
+}
+
 func (myApp MyApp) Run(args []string) error {
 	cfg := config.Global
 
@@ -221,10 +846,34 @@ func (myApp MyApp) Run(args []string) error {
 		}
 		return store.NewJSONStore(dirStore), nil
 	}
+	// completeArgs completes arguments by kinds.  Before is skipped on
+	// completion, so it's called here for the client to list remote dirs
+	completeArgs := func(kinds ...int) cli.BashCompleteFunc {
+		return func(cCtx *cli.Context) {
+			var word string
+			// the last is --generate-bash-completion
+			if n := len(args); n > 2 {
+				word = args[n-2]
+			}
+			complete(cCtx, word, kinds, func(dir string) ([]pathEntry, error) {
+				lineage := cCtx.Lineage()
+				if err := cCtx.App.Before(lineage[len(lineage)-1]); err != nil {
+					return nil, err
+				}
+				ctx, cancel := context.WithTimeout(myApp.ctx, 5*time.Second)
+				defer cancel()
+				return NewCompletionCache(myApp.dstClient, myApp.cacheStore).
+					Crypt(myApp.cryptMan).
+					ReadDir(ctx, dir)
+			})
+		}
+	}
 	app := &cli.App{
-		Name:          "mypan",
-		Usage:         "A baidu netdisk client",
-		AllowExtFlags: true,
+		Name:                 "mypan",
+		Usage:                "A baidu netdisk client",
+		AllowExtFlags:        true,
+		EnableBashCompletion: true,
+		BashComplete:         completeArgs(),
 		Flags: []cli.Flag{
 			&cli.Int64Flag{Name: "appid", Value: cfg.AppID, Destination: &cfg.AppID, EnvVars: []string{"MYPAN_APPID"}},
 			&cli.StringFlag{Name: "appkey", Value: cfg.AppKey, Destination: &cfg.AppKey, EnvVars: []string{"MYPAN_APPKEY"}},
@@ -235,28 +884,82 @@ func (myApp MyApp) Run(args []string) error {
 
 			&cli.DurationFlag{Name: "timeout", Destination: &myApp.timeout},
 			&cli.BoolFlag{Name: "noprogress"},
+			&cli.StringFlag{
+				Name:  "progress",
+				Value: "bar",
+				Usage: "allowed values are bar, json",
+				Action: func(cCtx *cli.Context, v string) error {
+					if v != "bar" && v != "json" {
+						return fmt.Errorf("invalid progress %q, allowed values are bar, json", v)
+					}
+					return nil
+				}},
+			&cli.PathFlag{Name: "progress-file", Usage: "write json progress events to file instead of stderr"},
+			&cli.StringFlag{
+				Name:    "crypt-passphrase",
+				Usage:   "encrypt uploads and decrypt downloads with keys derived from passphrase",
+				EnvVars: []string{"MYPAN_CRYPT_PASSPHRASE"},
+			},
+			&cli.PathFlag{
+				Name:    "crypt-keyfile",
+				Usage:   "encrypt uploads and decrypt downloads with keys derived from content of the file",
+				EnvVars: []string{"MYPAN_CRYPT_KEYFILE"},
+			},
+			&cli.BoolFlag{Name: "crypt-names", Usage: "also encrypt remote file names"},
+			&cli.StringFlag{
+				Name:    "bwlimit",
+				Usage:   "bandwidth limit like 10M, UP:DOWN like 10M:off, or schedule like \"08:00,2M 19:00,off\"",
+				EnvVars: []string{"MYPAN_BWLIMIT"},
+			},
+			&cli.BoolFlag{Name: "chunk", Usage: "upload files over the per-file size limit as chunks"},
+			&cli.StringFlag{Name: "chunk-size", Usage: "size of chunks like 2G, defaults to the per-file size limit"},
 			&cli.StringFlag{
 				Name:  "format",
 				Value: "json",
-				Usage: "allowed values are json, table",
+				Usage: "allowed values are json, jsonl, table",
 				Action: func(cCtx *cli.Context, v string) error {
-					if v != "json" && v != "table" {
-						return fmt.Errorf("invalid format %q, allowed values are json, table", v)
+					if v != "json" && v != "jsonl" && v != "table" {
+						return fmt.Errorf("invalid format %q, allowed values are json, jsonl, table", v)
 					}
 					myApp.render = NewRender(v)
 					return nil
 				}},
 		},
 		Before: func(cCtx *cli.Context) error {
+			// config file
+			if err := myApp.configMan.Load(cfg.ConfigDir); err != nil {
+				return err
+			}
+			if err := myApp.configMan.ApplyGlobal(cCtx); err != nil {
+				return err
+			}
 			// progress
 			if !cCtx.Bool("noprogress") {
-				progress := &progress.Progress{}
-				progress.Style().Options.TimeInProgressPrecision = time.Second
-				myApp.progress = progress
+				switch cCtx.String("progress") {
+				case "json":
+					w := os.Stderr
+					if p := cCtx.Path("progress-file"); p != "" {
+						f, err := os.Create(p)
+						if err != nil {
+							return errors.Wrap(err, "progress file")
+						}
+						myApp.eventsFile = f
+						w = f
+					}
+					myApp.events = NewEventWriter(w)
+					myApp.progressMaker = NewJSONProgress(myApp.events, time.Second)
+				default:
+					progress := &progress.Progress{}
+					progress.Style().Options.TimeInProgressPrecision = time.Second
+					// keep stdout clean for "down remotepath -"
+					progress.SetOutputWriter(os.Stderr)
+					myApp.progress = progress
+					myApp.progressMaker = NewBarProgress(progress)
+				}
 			}
 			// ctx
 			if timeout := myApp.timeout; timeout != 0 {
-				myApp.ctx, _ = context.WithTimeout(myApp.ctx, timeout)
+				myApp.ctx, myApp.ctxCancel = context.WithTimeout(myApp.ctx, timeout)
 			}
 			myApp.ctx, _ = signal.NotifyContext(myApp.ctx, syscall.SIGINT, syscall.SIGTERM)
 
@@ -278,6 +981,10 @@ func (myApp MyApp) Run(args []string) error {
 			if err := myApp.configStore.Get(config.StoreKeyAccessAuth, &accessAuth); err != nil {
 				glog.Warningf("load access auth: %v", err)
 			}
+			bwSchedule, err := client.ParseBwSchedule(cCtx.String("bwlimit"))
+			if err != nil {
+				return errors.Wrap(err, "parse bwlimit")
+			}
 			clientCfg := client.Config{
 				AppID:      cfg.AppID,
 				AppKey:     cfg.AppKey,
@@ -285,8 +992,31 @@ func (myApp MyApp) Run(args []string) error {
 				AppBaseDir: cfg.AppBaseDir,
 
 				AccessAuth: accessAuth,
+				BwSchedule: bwSchedule,
+				TmpDir:     filepath.Join(cfg.CacheDir, "tmp"),
 			}
 			myApp.dstClient = client.New(clientCfg)
+			myApp.tmpDir = clientCfg.TmpDir
+			// encryption
+			if cipher, err := newCipher(cCtx); err != nil {
+				return err
+			} else if cipher != nil {
+				myApp.cryptMan = NewCryptMan(myApp.dstClient, cipher).
+					EncryptNames(cCtx.Bool("crypt-names")).
+					TmpDir(myApp.tmpDir)
+			}
+			// chunking
+			if cCtx.Bool("chunk") {
+				var chunkSize uint64
+				if s := cCtx.String("chunk-size"); s != "" {
+					chunkSize, err = humanize.ParseBytes(s)
+					if err != nil {
+						return errors.Wrap(err, "parse chunk-size")
+					}
+				}
+				myApp.chunkMan = NewChunkMan(myApp.dstClient, int64(chunkSize)).
+					Crypt(myApp.cryptMan)
+			}
 			return nil
 		},
 		ExitErrHandler: func(cCtx *cli.Context, err error) {
@@ -321,6 +1051,165 @@ func (myApp MyApp) Run(args []string) error {
 					}
 					return nil
 				},
+				Subcommands: []*cli.Command{
+					{
+						Name:  "status",
+						Usage: "show logged in account and token expiry",
+						Action: func(cCtx *cli.Context) error {
+							authMan := NewAuthMan(myApp.dstClient, myApp.configStore)
+							st, err := authMan.Status(myApp.ctx)
+							if err != nil {
+								return cli.Exit(err, 1)
+							}
+							myApp.render.Render(st)
+							if st.Expired {
+								return cli.Exit("access token expired", 1)
+							}
+							return nil
+						},
+					},
+					{
+						Name:  "logout",
+						Usage: "wipe stored credentials",
+						Action: func(cCtx *cli.Context) error {
+							authMan := NewAuthMan(myApp.dstClient, myApp.configStore)
+							if err := authMan.Logout(); err != nil {
+								return cli.Exit(err, 1)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name: "config",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "show",
+						Usage: "show effective config and where each value came from",
+						Action: func(cCtx *cli.Context) error {
+							ents := myApp.configMan.Show(cCtx)
+							myApp.render.Render(ents)
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "daemon",
+				Usage: "keep access token fresh and run scheduled sync jobs",
+				Flags: []cli.Flag{
+					&cli.PathFlag{Name: "socket", Usage: "control socket path (default: cachedir/" + DaemonSocketName + ")"},
+				},
+				Action: func(cCtx *cli.Context) error {
+					authMan := NewAuthMan(myApp.dstClient, myApp.configStore)
+					d := NewDaemon(
+						authMan,
+						myApp.configMan.Jobs(),
+						myApp.syncJob,
+						myApp.daemonSocketPath(cCtx),
+					)
+					if err := d.Run(myApp.ctx); err != nil {
+						return cli.Exit(err, 1)
+					}
+					return nil
+				},
+				Subcommands: []*cli.Command{
+					{
+						Name:      "jobs",
+						Usage:     "list jobs, their next run and last result",
+						ArgsUsage: "[name]",
+						Action: func(cCtx *cli.Context) error {
+							dc := NewDaemonClient(myApp.daemonSocketPath(cCtx))
+							var (
+								v   interface{}
+								err error
+							)
+							if name := cCtx.Args().First(); name != "" {
+								v, err = dc.Job(myApp.ctx, name)
+							} else {
+								v, err = dc.Jobs(myApp.ctx)
+							}
+							if err != nil {
+								return cli.Exit(err, 1)
+							}
+							myApp.render.Render(v)
+							return nil
+						},
+					},
+					{
+						Name:      "trigger",
+						Usage:     "run a job now",
+						ArgsUsage: "name",
+						Action: func(cCtx *cli.Context) error {
+							name := cCtx.Args().First()
+							if name == "" {
+								return cli.Exit("name argument is required", 1)
+							}
+							dc := NewDaemonClient(myApp.daemonSocketPath(cCtx))
+							if err := dc.Trigger(myApp.ctx, name); err != nil {
+								return cli.Exit(err, 1)
+							}
+							return nil
+						},
+					},
+				},
+			},
+			{
+				Name:  "serve",
+				Usage: "serve remote files over network protocols",
+				Subcommands: []*cli.Command{
+					{
+						Name:  "webdav",
+						Usage: "serve remotepath over WebDAV",
+						Flags: append(newServeFlags("127.0.0.1:8080", newBasicAuthFlags()...),
+							&cli.BoolFlag{Name: "read-only", Usage: "reject changes"},
+							&cli.BoolFlag{Name: "no-auth", Usage: "allow serving read-write without --user and --password"},
+						),
+						ArgsUsage:    "[remotepath]",
+						BashComplete: completeArgs(pathArgRemoteDir),
+						Action: func(cCtx *cli.Context) error {
+							if err := checkBasicAuthFlags(cCtx); err != nil {
+								return cli.Exit(err, 1)
+							}
+							return myApp.serve(cCtx, "webdav", NewWebdavHandler(myApp.newRemoteFS(cCtx)))
+						},
+					},
+					{
+						Name:  "http",
+						Usage: "serve remotepath read-only over HTTP, with dir listings in HTML and JSON",
+						Flags: newServeFlags("127.0.0.1:8080",
+							&cli.StringFlag{Name: "token", EnvVars: []string{"MYPAN_SERVE_TOKEN"}, Usage: "require this bearer token"},
+							&cli.BoolFlag{Name: "no-auth", Usage: "allow serving on non-loopback address without --token"},
+						),
+						ArgsUsage:    "[remotepath]",
+						BashComplete: completeArgs(pathArgRemoteDir),
+						Action: func(cCtx *cli.Context) error {
+							if cCtx.String("token") == "" && !cCtx.Bool("no-auth") && !isLoopbackAddr(cCtx.String("addr")) {
+								return cli.Exit("refuse to serve on non-loopback address without --token, pass --no-auth to allow it", 1)
+							}
+							rfs := myApp.newRemoteFS(cCtx).ReadOnly(true)
+							return myApp.serve(cCtx, "http", NewHTTPServer(rfs))
+						},
+					},
+					{
+						Name:  "s3",
+						Usage: "serve an S3 API with top-level remote dirs as buckets, path-style addressing only",
+						Flags: newServeFlags("127.0.0.1:9000",
+							&cli.StringFlag{Name: "access-key", EnvVars: []string{"MYPAN_S3_ACCESS_KEY"}, Required: true, Usage: "access key clients sign requests with"},
+							&cli.StringFlag{Name: "secret-key", EnvVars: []string{"MYPAN_S3_SECRET_KEY"}, Required: true, Usage: "secret key of access key"},
+							&cli.BoolFlag{Name: "read-only", Usage: "reject changes"},
+							&cli.DurationFlag{Name: "upload-expiry", Value: s3UploadExpiry, Usage: "abort multipart uploads not used for this long"},
+						),
+						Action: func(cCtx *cli.Context) error {
+							gw := NewS3Gateway(myApp.newRemoteFS(cCtx), s3.Credentials{
+								AccessKey: cCtx.String("access-key"),
+								SecretKey: cCtx.String("secret-key"),
+							}).UploadExpiry(cCtx.Duration("upload-expiry"))
+							return myApp.serve(cCtx, "s3", gw)
+						},
+					},
+				},
 			},
 			{
 				Name: "quota",
@@ -345,9 +1234,10 @@ func (myApp MyApp) Run(args []string) error {
 				},
 			},
 			{
-				Name:      "ls",
-				ArgsUsage: "remotepath",
-				Aliases:   []string{"list"},
+				Name:         "ls",
+				ArgsUsage:    "remotepath",
+				BashComplete: completeArgs(pathArgRemoteDir),
+				Aliases:      []string{"list"},
 				Action: func(cCtx *cli.Context) error {
 					dir := cCtx.Args().First()
 					resp, err := myApp.dstClient.ListEx(myApp.ctx, dir)
@@ -359,9 +1249,10 @@ func (myApp MyApp) Run(args []string) error {
 				},
 			},
 			{
-				Name:      "lsa",
-				Aliases:   []string{"listall"},
-				ArgsUsage: "remotepath",
+				Name:         "lsa",
+				Aliases:      []string{"listall"},
+				ArgsUsage:    "remotepath",
+				BashComplete: completeArgs(pathArgRemoteDir),
 				Action: func(cCtx *cli.Context) error {
 					dir := cCtx.Args().First()
 					resp, err := myApp.dstClient.ListAllEx(myApp.ctx, dir)
@@ -373,11 +1264,22 @@ func (myApp MyApp) Run(args []string) error {
 				},
 			},
 			{
-				Name:      "stat",
-				ArgsUsage: "[remotepath]",
+				Name:         "stat",
+				Flags:        []cli.Flag{newDryRunFlag()},
+				ArgsUsage:    "[remotepath]",
+				BashComplete: completeArgs(pathArgRemote),
 				Action: func(cCtx *cli.Context) error {
-					relpaths := cCtx.Args().Slice()
-					resp, err := myApp.dstClient.FileMetasByPath(myApp.ctx, relpaths)
+					matches, err := NewGlobMan(myApp.dstClient).
+						Crypt(myApp.cryptMan).
+						ExpandAll(myApp.ctx, cCtx.Args().Slice())
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					relpaths := globMatchPaths(matches)
+					if myApp.renderDryRunPaths(cCtx, relpaths) {
+						return nil
+					}
+					resp, err := myApp.dstClient.FileMetasByPath(myApp.ctx, myApp.remotePaths(relpaths))
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
@@ -386,15 +1288,24 @@ func (myApp MyApp) Run(args []string) error {
 				},
 			},
 			{
-				Name:      "rm",
-				Aliases:   []string{"remove"},
-				ArgsUsage: "remotepath...",
+				Name:         "rm",
+				Aliases:      []string{"remove"},
+				Flags:        []cli.Flag{newDryRunFlag()},
+				ArgsUsage:    "remotepath...",
+				BashComplete: completeArgs(pathArgRemote),
 				Action: func(cCtx *cli.Context) error {
-					filelist := cCtx.Args().Slice()
-					if len(filelist) == 0 {
+					if cCtx.NArg() == 0 {
 						return cli.Exit("filelist argument is required", 1)
 					}
-					resp, err := myApp.dstClient.DeleteMulti(myApp.ctx, filelist)
+					globMan := NewGlobMan(myApp.dstClient).Crypt(myApp.cryptMan)
+					matches, err := globMan.ExpandAll(myApp.ctx, cCtx.Args().Slice())
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					if myApp.renderDryRunPaths(cCtx, globMatchPaths(matches)) {
+						return nil
+					}
+					resp, err := globMan.Remove(myApp.ctx, matches)
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
@@ -403,9 +1314,11 @@ func (myApp MyApp) Run(args []string) error {
 				},
 			},
 			{
-				Name:      "up",
-				Aliases:   []string{"upload"},
-				ArgsUsage: "localpath remotepath",
+				Name:         "up",
+				Aliases:      []string{"upload"},
+				Flags:        []cli.Flag{newOndupFlag()},
+				ArgsUsage:    "localpath|- remotepath",
+				BashComplete: completeArgs(pathArgLocal, pathArgRemote),
 				Action: func(cCtx *cli.Context) error {
 					src := cCtx.Args().Get(0)
 					dst := cCtx.Args().Get(1)
@@ -413,7 +1326,8 @@ func (myApp MyApp) Run(args []string) error {
 						return cli.Exit("src and dst arguments are required", 1)
 					}
 					myApp.progressRender()
-					resp, err := myApp.dstClient.Upload(myApp.ctx, src, dst)
+					ctx := myApp.trackerCtx(myApp.ctx, src)
+					resp, err := myApp.upload(ctx, src, dst, cCtx.String("ondup"))
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
@@ -426,9 +1340,13 @@ func (myApp MyApp) Run(args []string) error {
 				Flags: []cli.Flag{
 					&cli.BoolFlag{Name: "dryrun"},
 					&cli.BoolFlag{Name: "nodelete"},
+					newNoSummaryFlag(),
 					&cli.IntFlag{Name: "parallel", Aliases: []string{"p"}},
+					&cli.StringSliceFlag{Name: "exclude", Usage: "skip names matching the glob pattern"},
+					newDstBackendFlag(),
 				},
-				ArgsUsage: "localpath remotepath",
+				ArgsUsage:    "localpath remotepath",
+				BashComplete: completeArgs(pathArgLocalDir, pathArgRemoteDir),
 				Action: func(cCtx *cli.Context) error {
 					src := cCtx.Args().Get(0)
 					dst := cCtx.Args().Get(1)
@@ -441,22 +1359,37 @@ func (myApp MyApp) Run(args []string) error {
 				Flags: []cli.Flag{
 					&cli.BoolFlag{Name: "continue", Aliases: []string{"c"}},
 					&cli.Uint64Flag{Name: "fsid"},
+					newDryRunFlag(),
 				},
-				ArgsUsage: "remotepath localpath",
+				ArgsUsage:    "remotepath localpath|-",
+				BashComplete: completeArgs(pathArgRemote, pathArgLocal),
 				Action: func(cCtx *cli.Context) error {
 					myApp.progressRender()
 					downMan := NewDownMan(myApp.dstClient).
 						Continue(cCtx.Bool("continue")).
-						Progress(myApp.progress)
+						Crypt(myApp.cryptMan).
+						Progress(myApp.progressMaker)
 
 					var err error
+					outpath := cCtx.Args().Get(1)
+					// "-" or empty for writing to stdout
+					if outpath == "-" {
+						outpath = ""
+					}
+					relpath := cCtx.Args().Get(0)
 					if fsId := cCtx.Uint64("fsid"); fsId > 0 {
-						outpath := cCtx.Args().Get(1)
 						err = downMan.DownByFsId(myApp.ctx, fsId, outpath)
+					} else if util.HasGlobMeta(relpath) {
+						err = myApp.downGlob(cCtx, downMan, relpath, outpath)
 					} else {
-						relpath := cCtx.Args().Get(0)
-						outpath := cCtx.Args().Get(1)
-						err = downMan.Down(myApp.ctx, relpath, outpath)
+						var matches []GlobMatch
+						// not a pattern, only unescaped
+						matches, err = NewGlobMan(myApp.dstClient).
+							Crypt(myApp.cryptMan).
+							Expand(myApp.ctx, relpath)
+						if err == nil {
+							err = downMan.Down(myApp.ctx, matches[0].Path, outpath)
+						}
 					}
 					if err != nil {
 						return cli.Exit(err, 1)
@@ -464,27 +1397,168 @@ func (myApp MyApp) Run(args []string) error {
 					return nil
 				},
 			},
+			{
+				Name: "cat",
+				Flags: []cli.Flag{
+					&cli.Int64Flag{Name: "offset", Usage: "start at this byte, negative for counting from the end"},
+					&cli.Int64Flag{Name: "length", Value: -1, Usage: "write at most this many bytes, negative for no limit"},
+				},
+				ArgsUsage:    "remotepath...",
+				BashComplete: completeArgs(pathArgRemote),
+				Action: func(cCtx *cli.Context) error {
+					return myApp.catAction(cCtx, cCtx.Int64("offset"), cCtx.Int64("length"), false)
+				},
+			},
+			{
+				Name: "head",
+				Flags: []cli.Flag{
+					&cli.Int64Flag{Name: "bytes", Aliases: []string{"c"}, Required: true, Usage: "write the first N bytes"},
+				},
+				ArgsUsage:    "remotepath...",
+				BashComplete: completeArgs(pathArgRemote),
+				Action: func(cCtx *cli.Context) error {
+					n := cCtx.Int64("bytes")
+					if n < 0 {
+						return cli.Exit(fmt.Sprintf("invalid bytes %d", n), 1)
+					}
+					return myApp.catAction(cCtx, 0, n, true)
+				},
+			},
+			{
+				Name: "tail",
+				Flags: []cli.Flag{
+					&cli.Int64Flag{Name: "bytes", Aliases: []string{"c"}, Required: true, Usage: "write the last N bytes"},
+				},
+				ArgsUsage:    "remotepath...",
+				BashComplete: completeArgs(pathArgRemote),
+				Action: func(cCtx *cli.Context) error {
+					n := cCtx.Int64("bytes")
+					if n < 0 {
+						return cli.Exit(fmt.Sprintf("invalid bytes %d", n), 1)
+					}
+					return myApp.catAction(cCtx, -n, n, true)
+				},
+			},
+			{
+				Name:         "verify",
+				Usage:        "check local files against content-md5 of remote ones",
+				ArgsUsage:    "remotepath localpath",
+				BashComplete: completeArgs(pathArgRemote, pathArgLocal),
+				Action: func(cCtx *cli.Context) error {
+					relpath := cCtx.Args().Get(0)
+					localpath := cCtx.Args().Get(1)
+					if relpath == "" || localpath == "" {
+						return cli.Exit("remotepath and localpath arguments are required", 1)
+					}
+					if myApp.cryptMan != nil {
+						// content-md5 is that of ciphertext which
+						// cannot be reproduced from local files
+						return cli.Exit("verify does not work with encryption", 1)
+					}
+					verifyMan := NewVerifyMan(myApp.dstClient)
+					ents, err := verifyMan.Verify(myApp.ctx, relpath, localpath)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					myApp.render.Render(ents)
+					for _, ent := range ents {
+						if ent.Result == VerifyResultMismatch || ent.Result == VerifyResultMissing {
+							return cli.Exit("verify failed", 1)
+						}
+					}
+					return nil
+				},
+			},
 			{
 				Name: "syncdown",
 				Flags: []cli.Flag{
 					&cli.BoolFlag{Name: "dryrun"},
 					&cli.BoolFlag{Name: "nodelete"},
+					newNoSummaryFlag(),
 					&cli.BoolFlag{Name: "continue", Aliases: []string{"c"}},
 					&cli.IntFlag{Name: "parallel", Aliases: []string{"p"}},
+					&cli.StringSliceFlag{Name: "exclude", Usage: "skip names matching the glob pattern"},
 				},
-				ArgsUsage: "remotepath localpath",
+				ArgsUsage:    "remotepath localpath",
+				BashComplete: completeArgs(pathArgRemoteDir, pathArgLocalDir),
 				Action: func(cCtx *cli.Context) error {
 					dst := cCtx.Args().Get(0)
 					src := cCtx.Args().Get(1)
 					return myApp.syncAction(cCtx, src, dst, false)
 				},
 			},
+			{
+				Name:  "syncremote",
+				Usage: "mirror remote dir to another remote dir with server side copy",
+				Flags: []cli.Flag{
+					&cli.BoolFlag{Name: "dryrun"},
+					&cli.BoolFlag{Name: "nodelete"},
+					newNoSummaryFlag(),
+					&cli.StringSliceFlag{Name: "exclude", Usage: "skip names matching the glob pattern"},
+				},
+				ArgsUsage:    "remotepath0 remotepath1",
+				BashComplete: completeArgs(pathArgRemoteDir),
+				Action: func(cCtx *cli.Context) error {
+					src := cCtx.Args().Get(0)
+					dst := cCtx.Args().Get(1)
+					if src == "" || dst == "" {
+						return cli.Exit("src and dst arguments are required", 1)
+					}
+					// dst under src would be copied into itself, src
+					// under dst deleted as extra
+					if remotePathsOverlap(myApp.dstClient.AbsPath(src), myApp.dstClient.AbsPath(dst)) {
+						return cli.Exit(fmt.Sprintf("%s and %s overlap", src, dst), 1)
+					}
+					su := NewSyncRemote(src, dst, myApp.dstClient, myApp.syncOpts(cCtx)...)
+					return myApp.runSync(cCtx, su)
+				},
+			},
+			{
+				Name:  "diff",
+				Usage: "compare local and remote as sync does, exit with 1 if they differ",
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{Name: "exclude", Usage: "skip names matching the glob pattern"},
+				},
+				ArgsUsage:    "localpath remotepath",
+				BashComplete: completeArgs(pathArgLocalDir, pathArgRemoteDir),
+				Action: func(cCtx *cli.Context) error {
+					src := cCtx.Args().Get(0)
+					dst := cCtx.Args().Get(1)
+					if src == "" || dst == "" {
+						return cli.Exit("localpath and remotepath arguments are required", 2)
+					}
+					opts := []SyncOpt{DryRun(true)}
+					if patterns := cCtx.StringSlice("exclude"); len(patterns) > 0 {
+						opts = append(opts, Exclude(patterns))
+					}
+					if cryptMan := myApp.cryptMan; cryptMan != nil {
+						opts = append(opts, Encrypt(cryptMan))
+					}
+					if chunkMan := myApp.chunkMan; chunkMan != nil {
+						opts = append(opts, Chunk(chunkMan))
+					}
+					su, err := myApp.newSync(src, dst, true, opts...)
+					if err != nil {
+						return cli.Exit(err, 2)
+					}
+					if err := su.Plan(myApp.ctx); err != nil {
+						return cli.Exit(err, 2)
+					}
+					ents := su.Diff()
+					myApp.render.Render(ents)
+					if len(ents) > 0 {
+						return cli.Exit("", 1)
+					}
+					return nil
+				},
+			},
 			{
 				Name: "walk",
 				Flags: []cli.Flag{
 					&cli.IntFlag{Name: "parallel", Aliases: []string{"p"}},
 				},
-				ArgsUsage: "remotepath argv...",
+				ArgsUsage:    "remotepath argv...",
+				BashComplete: completeArgs(pathArgRemoteDir, pathArgNone),
 				Action: func(cCtx *cli.Context) error {
 					src := cCtx.Args().Get(0)
 					argv := cCtx.Args().Tail()
@@ -499,36 +1573,201 @@ func (myApp MyApp) Run(args []string) error {
 				},
 			},
 			{
-				Name:      "rename",
-				ArgsUsage: "remotepath newname",
+				Name: "du",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "max-depth", Aliases: []string{"d"}, Value: -1, Usage: "report dirs at most this deep below remotepath, negative for no limit"},
+					&cli.BoolFlag{Name: "human", Aliases: []string{"H"}, Usage: "also report sizes like 1.5 GiB"},
+					&cli.BoolFlag{Name: "sort-size", Aliases: []string{"S"}, Usage: "sort by size, largest first"},
+				},
+				ArgsUsage:    "[remotepath]",
+				BashComplete: completeArgs(pathArgRemoteDir),
 				Action: func(cCtx *cli.Context) error {
-					path := cCtx.Args().Get(0)
-					newname := cCtx.Args().Get(1)
-					if path == "" || newname == "" {
-						return cli.Exit("path and newname arguments are required", 1)
+					ents, err := NewDuMan(myApp.dstClient).
+						Crypt(myApp.cryptMan).
+						MaxDepth(cCtx.Int("max-depth")).
+						Human(cCtx.Bool("human")).
+						SortBySize(cCtx.Bool("sort-size")).
+						Du(myApp.ctx, cCtx.Args().First())
+					if err != nil {
+						return cli.Exit(err, 1)
 					}
-					resp, err := myApp.dstClient.Rename(myApp.ctx, path, newname)
+					myApp.render.Render(ents)
+					return nil
+				},
+			},
+			{
+				Name: "tree",
+				Flags: []cli.Flag{
+					&cli.IntFlag{Name: "max-depth", Aliases: []string{"d"}, Value: -1, Usage: "show entries at most this deep below remotepath, negative for no limit"},
+					&cli.BoolFlag{Name: "human", Aliases: []string{"H"}, Usage: "also report sizes like 1.5 GiB"},
+					&cli.BoolFlag{Name: "sort-size", Aliases: []string{"S"}, Usage: "sort by size, largest first"},
+				},
+				ArgsUsage:    "[remotepath]",
+				BashComplete: completeArgs(pathArgRemoteDir),
+				Action: func(cCtx *cli.Context) error {
+					root, err := NewDuMan(myApp.dstClient).
+						Crypt(myApp.cryptMan).
+						MaxDepth(cCtx.Int("max-depth")).
+						Human(cCtx.Bool("human")).
+						SortBySize(cCtx.Bool("sort-size")).
+						Tree(myApp.ctx, cCtx.Args().First())
 					if err != nil {
 						return cli.Exit(err, 1)
 					}
-					myApp.render.Render(resp)
+					myApp.render.Render(root)
+					return nil
+				},
+			},
+			{
+				Name:  "dedupe",
+				Usage: "find files with the same md5 and size, and optionally remove all but one of them",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "keep",
+						Usage: fmt.Sprintf("which one of duplicates to keep, allowed values are %v", DedupePolicies),
+						Action: func(cCtx *cli.Context, v string) error {
+							for _, policy := range DedupePolicies {
+								if v == policy {
+									return nil
+								}
+							}
+							return fmt.Errorf("invalid keep policy %q, allowed values are %v", v, DedupePolicies)
+						},
+					},
+					&cli.StringFlag{Name: "prefer", Usage: "path prefix of files to keep with --keep prefer"},
+					&cli.BoolFlag{Name: "interactive", Aliases: []string{"i"}, Usage: "ask which one of duplicates to keep"},
+					&cli.BoolFlag{Name: "dryrun", Usage: "print the plan without removing anything"},
+				},
+				ArgsUsage:    "[remotepath]",
+				BashComplete: completeArgs(pathArgRemoteDir),
+				Action: func(cCtx *cli.Context) error {
+					policy := cCtx.String("keep")
+					prefer := cCtx.String("prefer")
+					if policy == DedupePolicyPrefer && prefer == "" {
+						return cli.Exit("--prefer is required by --keep prefer", 1)
+					}
+					if prefer != "" {
+						prefer = myApp.dstClient.AbsPath(prefer)
+					}
+					dedupeMan := NewDedupeMan(myApp.dstClient).Policy(policy, prefer)
+					groups, err := dedupeMan.Find(myApp.ctx, cCtx.Args().First())
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					if cCtx.Bool("interactive") {
+						if err := dedupeMan.Ask(groups, os.Stdin, os.Stderr); err != nil {
+							return cli.Exit(err, 1)
+						}
+					}
+					myApp.render.Render(groups)
+					if cCtx.Bool("dryrun") {
+						return nil
+					}
+					if _, err := dedupeMan.Remove(myApp.ctx, groups); err != nil {
+						return cli.Exit(err, 1)
+					}
 					return nil
 				},
 			},
 			{
-				Name:      "mv",
-				Aliases:   []string{"move"},
-				ArgsUsage: "remotepath0 remotepath1",
+				Name:            "find",
+				Usage:           "find remote entries matching expression, see pkg/find for predicates",
+				ArgsUsage:       "remotepath [expression]",
+				BashComplete:    completeArgs(pathArgRemoteDir, pathArgNone),
+				SkipFlagParsing: true,
 				Action: func(cCtx *cli.Context) error {
-					return myApp.copyMoveAction(cCtx, myApp.dstClient.Move)
+					dir := cCtx.Args().First()
+					if dir == "" || strings.HasPrefix(dir, "-") {
+						return cli.Exit("remotepath argument is required", 1)
+					}
+					query, err := find.Parse(cCtx.Args().Tail(), time.Now())
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					finder := NewFinder(myApp.dstClient, query).Crypt(myApp.cryptMan)
+					ents, err := finder.Find(myApp.ctx, dir)
+					if err != nil {
+						return cli.Exit(err, 1)
+					}
+					if query.Print {
+						myApp.render.Render(ents)
+					}
+					if err := finder.Exec(myApp.ctx, ents); err != nil {
+						return cli.Exit(err, 1)
+					}
+					if query.Delete {
+						if _, err := finder.Delete(myApp.ctx, ents); err != nil {
+							return cli.Exit(err, 1)
+						}
+					}
+					return nil
+				},
+			},
+			{
+				Name:         "rename",
+				Flags:        []cli.Flag{newOndupFlag(), newFromFileFlag()},
+				ArgsUsage:    "remotepath newname",
+				BashComplete: completeArgs(pathArgRemote, pathArgNone),
+				Action: func(cCtx *cli.Context) error {
+					var pairs [][2]string
+					path := cCtx.Args().Get(0)
+					newname := cCtx.Args().Get(1)
+					if path != "" || newname != "" {
+						if path == "" || newname == "" {
+							return cli.Exit("path and newname arguments are required", 1)
+						}
+						pairs = append(pairs, [2]string{path, newname})
+					}
+					return myApp.fileManagerAction(cCtx, pairs, myApp.dstClient.RenameMulti)
 				},
 			},
 			{
-				Name:      "cp",
-				Aliases:   []string{"copy"},
-				ArgsUsage: "remotepath0 remotepath1",
+				Name:         "mv",
+				Aliases:      []string{"move"},
+				Flags:        []cli.Flag{newOndupFlag(), newFromFileFlag(), newDryRunFlag()},
+				ArgsUsage:    "remotepath0 remotepath1 | remotepath... remotedir",
+				BashComplete: completeArgs(pathArgRemote),
 				Action: func(cCtx *cli.Context) error {
-					return myApp.copyMoveAction(cCtx, myApp.dstClient.Copy)
+					return myApp.copyMoveAction(cCtx, myApp.dstClient.MoveMulti)
+				},
+			},
+			{
+				Name:         "cp",
+				Aliases:      []string{"copy"},
+				Flags:        []cli.Flag{newOndupFlag(), newFromFileFlag(), newDryRunFlag()},
+				ArgsUsage:    "remotepath0 remotepath1 | remotepath... remotedir",
+				BashComplete: completeArgs(pathArgRemote),
+				Action: func(cCtx *cli.Context) error {
+					return myApp.copyMoveAction(cCtx, myApp.dstClient.CopyMulti)
+				},
+			},
+			{
+				Name:  "shell",
+				Usage: "run commands interactively with a current remote dir",
+				Action: func(cCtx *cli.Context) error {
+					if !cCtx.IsSet("format") {
+						myApp.render = NewRender("table")
+					}
+					shell := NewShell(myApp).
+						HistoryFile(filepath.Join(cfg.CacheDir, config.ShellHistoryFile))
+					if err := shell.Run(); err != nil {
+						return cli.Exit(err, 1)
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "completion",
+				Usage:     "print completion script for the shell",
+				ArgsUsage: "bash|zsh|fish",
+				Action: func(cCtx *cli.Context) error {
+					shell := cCtx.Args().First()
+					script, ok := completionScripts[shell]
+					if !ok {
+						return cli.Exit(fmt.Sprintf("unknown shell %q, allowed values are bash, zsh, fish", shell), 1)
+					}
+					fmt.Print(script)
+					return nil
 				},
 			},
 			{
@@ -544,10 +1783,58 @@ func (myApp MyApp) Run(args []string) error {
 			&cli.Author{Name: "Yousong Zhou", Email: "yszhou4tech@gmail.com"},
 		},
 	}
+	setCommandsBefore(app.Commands, myApp.configMan.ApplyCommand)
+	setCommandsComplete(app.Commands, completeArgs())
+	defer func() {
+		if myApp.ctxCancel != nil {
+			myApp.ctxCancel()
+		}
+		if myApp.eventsFile != nil {
+			myApp.eventsFile.Close()
+		}
+	}()
 	defer myApp.progreseStop()
 	return app.Run(args)
 }
 
+func (myApp MyApp) daemonSocketPath(cCtx *cli.Context) string {
+	if p := cCtx.Path("socket"); p != "" {
+		return p
+	}
+	return filepath.Join(cCtx.Path("cachedir"), DaemonSocketName)
+}
+
+// trackerCtx returns ctx with an upload/download tracker if progress is
+// enabled
+func (myApp MyApp) trackerCtx(ctx context.Context, message string) context.Context {
+	if pm := myApp.progressMaker; pm != nil {
+		pt := pm.NewTracker(message)
+		ctx = context.WithValue(ctx, client.XloadTrackerKey, pt)
+	}
+	return ctx
+}
+
+// newCipher returns nil if encryption is not enabled
+func newCipher(cCtx *cli.Context) (*crypt.Cipher, error) {
+	passphrase := cCtx.String("crypt-passphrase")
+	keyfile := cCtx.Path("crypt-keyfile")
+	switch {
+	case passphrase != "" && keyfile != "":
+		return nil, fmt.Errorf("crypt-passphrase and crypt-keyfile are mutually exclusive")
+	case passphrase != "":
+		return crypt.NewCipherFromPassphrase(passphrase)
+	case keyfile != "":
+		key, err := ioutil.ReadFile(keyfile)
+		if err != nil {
+			return nil, errors.Wrap(err, "read crypt keyfile")
+		}
+		return crypt.NewCipherFromKey(key)
+	case cCtx.Bool("crypt-names"):
+		return nil, fmt.Errorf("crypt-names requires crypt-passphrase or crypt-keyfile")
+	}
+	return nil, nil
+}
+
 func (myApp MyApp) progressRender() {
 	if progress := myApp.progress; progress != nil {
 		go progress.Render()
@@ -0,0 +1,543 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"mypan/pkg/client"
+	"mypan/pkg/util"
+
+	"github.com/pkg/errors"
+)
+
+// RemoteFileInfo is os.FileInfo of a remote entry
+type RemoteFileInfo struct {
+	name  string
+	size  int64
+	isDir bool
+	mtime time.Time
+
+	md5  string
+	fsId uint64
+}
+
+func (rfi RemoteFileInfo) Name() string {
+	return rfi.name
+}
+func (rfi RemoteFileInfo) Size() int64 {
+	return rfi.size
+}
+func (rfi RemoteFileInfo) Mode() os.FileMode {
+	if rfi.isDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+func (rfi RemoteFileInfo) ModTime() time.Time {
+	return rfi.mtime
+}
+func (rfi RemoteFileInfo) IsDir() bool {
+	return rfi.isDir
+}
+func (rfi RemoteFileInfo) Sys() interface{} {
+	return nil
+}
+
+// Md5 returns md5 as reported by server.  It may not be that of the content
+func (rfi RemoteFileInfo) Md5() string {
+	return rfi.md5
+}
+
+type remoteFSDir struct {
+	time  time.Time
+	infos []os.FileInfo
+}
+
+type remoteFSList struct {
+	time  time.Time
+	infos map[string]RemoteFileInfo
+}
+
+type remoteFSDLink struct {
+	time  time.Time
+	dlink string
+}
+
+// dlinks are valid for hours.  They are refreshed earlier, or on failure
+const remoteFSDLinkTTL = time.Hour
+
+// RemoteFS presents remote dir root as a file system for servers.  Names
+// are slash separated paths relative to root.  Dir listings are cached for
+// a while and dropped on changes made through it, as are recursive ones
+type RemoteFS struct {
+	client   client.ClientI
+	root     string
+	ttl      time.Duration
+	readOnly bool
+	tmpDir   string
+
+	mu     *sync.Mutex
+	dirs   map[string]remoteFSDir
+	lists  map[string]remoteFSList
+	dlinks map[string]remoteFSDLink
+}
+
+func NewRemoteFS(client client.ClientI, root string) *RemoteFS {
+	rfs := &RemoteFS{
+		client: client,
+		root:   path.Clean(client.AbsPath(root)),
+		ttl:    30 * time.Second,
+		tmpDir: os.TempDir(),
+
+		mu:     &sync.Mutex{},
+		dirs:   map[string]remoteFSDir{},
+		lists:  map[string]remoteFSList{},
+		dlinks: map[string]remoteFSDLink{},
+	}
+	return rfs
+}
+
+// TTL sets how long dir listings are cached.  Zero disables the cache
+func (rfs *RemoteFS) TTL(ttl time.Duration) *RemoteFS {
+	rfs.ttl = ttl
+	return rfs
+}
+
+// ReadOnly makes changes fail with os.ErrPermission
+func (rfs *RemoteFS) ReadOnly(readOnly bool) *RemoteFS {
+	rfs.readOnly = readOnly
+	return rfs
+}
+
+// TmpDir sets where files being written are spooled before upload
+func (rfs *RemoteFS) TmpDir(tmpDir string) *RemoteFS {
+	rfs.tmpDir = tmpDir
+	return rfs
+}
+
+// AbsPath returns remote path of name
+func (rfs *RemoteFS) AbsPath(name string) string {
+	return path.Join(rfs.root, path.Clean("/"+name))
+}
+
+func (rfs *RemoteFS) checkWrite(name string) error {
+	if rfs.readOnly {
+		return &os.PathError{Op: "write", Path: name, Err: os.ErrPermission}
+	}
+	return nil
+}
+
+func (rfs *RemoteFS) notExist(op, name string, err error) error {
+	if client.ErrIsNotExist(err) {
+		return &os.PathError{Op: op, Path: name, Err: os.ErrNotExist}
+	}
+	return errors.Wrapf(err, "%s %s", op, name)
+}
+
+func (rfs *RemoteFS) ReadDir(ctx context.Context, name string) ([]os.FileInfo, error) {
+	abspath := rfs.AbsPath(name)
+	if infos, ok := rfs.cachedDir(abspath); ok {
+		return infos, nil
+	}
+	resp, err := rfs.client.ListEx(ctx, abspath)
+	if err != nil {
+		return nil, rfs.notExist("readdir", name, err)
+	}
+	infos := make([]os.FileInfo, 0, len(resp.List))
+	for _, v := range resp.List {
+		infos = append(infos, RemoteFileInfo{
+			name:  v.ServerFilename,
+			size:  int64(v.Size),
+			isDir: v.IsDir != 0,
+			mtime: time.Unix(int64(v.ServerMtime), 0),
+			md5:   v.Md5,
+			fsId:  v.FsId,
+		})
+	}
+	if rfs.ttl > 0 {
+		rfs.mu.Lock()
+		rfs.dirs[abspath] = remoteFSDir{
+			time:  time.Now(),
+			infos: infos,
+		}
+		rfs.mu.Unlock()
+	}
+	return infos, nil
+}
+
+// ListAll returns files under dir name recursively, keyed by slash separated
+// path relative to it.  The returned map is shared with the cache and must
+// not be modified
+func (rfs *RemoteFS) ListAll(ctx context.Context, name string) (map[string]RemoteFileInfo, error) {
+	abspath := rfs.AbsPath(name)
+	rfs.mu.Lock()
+	list, ok := rfs.lists[abspath]
+	if ok && time.Since(list.time) > rfs.ttl {
+		delete(rfs.lists, abspath)
+		ok = false
+	}
+	rfs.mu.Unlock()
+	if ok {
+		return list.infos, nil
+	}
+	resp, err := rfs.client.ListAllEx(ctx, abspath)
+	if err != nil {
+		return nil, rfs.notExist("listall", name, err)
+	}
+	infos := make(map[string]RemoteFileInfo, len(resp.List))
+	for _, v := range resp.List {
+		if v.IsDir != 0 {
+			continue
+		}
+		relpath := strings.TrimPrefix(v.Path, abspath+"/")
+		infos[relpath] = RemoteFileInfo{
+			name:  v.ServerFilename,
+			size:  int64(v.Size),
+			mtime: time.Unix(int64(v.ServerMtime), 0),
+			md5:   v.Md5,
+			fsId:  v.FsId,
+		}
+	}
+	if rfs.ttl > 0 {
+		rfs.mu.Lock()
+		rfs.lists[abspath] = remoteFSList{
+			time:  time.Now(),
+			infos: infos,
+		}
+		rfs.mu.Unlock()
+	}
+	return infos, nil
+}
+
+func (rfs *RemoteFS) cachedDir(abspath string) ([]os.FileInfo, bool) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	dir, ok := rfs.dirs[abspath]
+	if !ok {
+		return nil, false
+	}
+	if time.Since(dir.time) > rfs.ttl {
+		delete(rfs.dirs, abspath)
+		return nil, false
+	}
+	return dir.infos, true
+}
+
+// invalidate drops cached listings and download links affected by changes
+// to abspath
+func (rfs *RemoteFS) invalidate(abspath string) {
+	rfs.mu.Lock()
+	defer rfs.mu.Unlock()
+	delete(rfs.dirs, path.Dir(abspath))
+	prefix := abspath + "/"
+	for p := range rfs.dirs {
+		if p == abspath || strings.HasPrefix(p, prefix) {
+			delete(rfs.dirs, p)
+		}
+	}
+	// recursive listings of dirs above it too
+	for p := range rfs.lists {
+		if p == abspath || strings.HasPrefix(p, prefix) || strings.HasPrefix(abspath, p+"/") {
+			delete(rfs.lists, p)
+		}
+	}
+	for p := range rfs.dlinks {
+		if p == abspath || strings.HasPrefix(p, prefix) {
+			delete(rfs.dlinks, p)
+		}
+	}
+}
+
+// dlink returns download link of file abspath.  It's fetched again if
+// refresh is true or the cached one is old
+func (rfs *RemoteFS) dlink(ctx context.Context, abspath string, refresh bool) (string, error) {
+	rfs.mu.Lock()
+	dl, ok := rfs.dlinks[abspath]
+	rfs.mu.Unlock()
+	if ok && !refresh && time.Since(dl.time) < remoteFSDLinkTTL {
+		return dl.dlink, nil
+	}
+	meta, err := rfs.client.FileMetaByPath(ctx, abspath)
+	if err != nil {
+		return "", err
+	}
+	rfs.mu.Lock()
+	rfs.dlinks[abspath] = remoteFSDLink{
+		time:  time.Now(),
+		dlink: meta.DLink,
+	}
+	rfs.mu.Unlock()
+	return meta.DLink, nil
+}
+
+func (rfs *RemoteFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	abspath := rfs.AbsPath(name)
+	if abspath == rfs.root {
+		return RemoteFileInfo{
+			name:  path.Base(abspath),
+			isDir: true,
+		}, nil
+	}
+	if infos, ok := rfs.cachedDir(path.Dir(abspath)); ok {
+		base := path.Base(abspath)
+		for _, info := range infos {
+			if info.Name() == base {
+				return info, nil
+			}
+		}
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	meta, err := rfs.client.FileMetaByPath(ctx, abspath)
+	if err != nil {
+		return nil, rfs.notExist("stat", name, err)
+	}
+	info := RemoteFileInfo{
+		name:  path.Base(meta.Path),
+		size:  int64(meta.Size),
+		isDir: meta.IsDir != 0,
+		mtime: time.Unix(int64(meta.ServerMtime), 0),
+		md5:   meta.Md5,
+		fsId:  meta.FsId,
+	}
+	return info, nil
+}
+
+// Open opens file name for reading.  Content is fetched with range requests
+// as it's read
+func (rfs *RemoteFS) Open(ctx context.Context, name string) (*RemoteFileReader, error) {
+	info, err := rfs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, &os.PathError{Op: "open", Path: name, Err: ErrDirUnexpected}
+	}
+	rfr := &RemoteFileReader{
+		ctx:     ctx,
+		rfs:     rfs,
+		abspath: rfs.AbsPath(name),
+		info:    info,
+	}
+	return rfr, nil
+}
+
+// Create opens file name for writing.  Content is spooled to a local
+// temporary file and uploaded on Close
+func (rfs *RemoteFS) Create(ctx context.Context, name string) (*RemoteFileWriter, error) {
+	if err := rfs.checkWrite(name); err != nil {
+		return nil, err
+	}
+	if err := util.MkdirAll(rfs.tmpDir); err != nil {
+		return nil, err
+	}
+	f, err := os.CreateTemp(rfs.tmpDir, "spool-*")
+	if err != nil {
+		return nil, err
+	}
+	rfw := &RemoteFileWriter{
+		ctx:     ctx,
+		rfs:     rfs,
+		abspath: rfs.AbsPath(name),
+		f:       f,
+	}
+	return rfw, nil
+}
+
+func (rfs *RemoteFS) Mkdir(ctx context.Context, name string) error {
+	if err := rfs.checkWrite(name); err != nil {
+		return err
+	}
+	abspath := rfs.AbsPath(name)
+	defer rfs.invalidate(abspath)
+	if _, err := rfs.client.Mkdir(ctx, abspath); err != nil {
+		return errors.Wrapf(err, "mkdir %s", name)
+	}
+	return nil
+}
+
+func (rfs *RemoteFS) Remove(ctx context.Context, name string) error {
+	if err := rfs.checkWrite(name); err != nil {
+		return err
+	}
+	abspath := rfs.AbsPath(name)
+	if abspath == rfs.root {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrPermission}
+	}
+	defer rfs.invalidate(abspath)
+	if _, err := rfs.client.Delete(ctx, abspath); err != nil {
+		return rfs.notExist("remove", name, err)
+	}
+	return nil
+}
+
+// Rename moves oldName to newName, replacing it if exists
+func (rfs *RemoteFS) Rename(ctx context.Context, oldName, newName string) error {
+	if err := rfs.checkWrite(newName); err != nil {
+		return err
+	}
+	oldpath, newpath := rfs.AbsPath(oldName), rfs.AbsPath(newName)
+	defer rfs.invalidate(newpath)
+	defer rfs.invalidate(oldpath)
+	if _, err := rfs.client.Move(ctx, oldpath, newpath, client.Ondup(client.ONDUP_OVERWRITE)); err != nil {
+		return rfs.notExist("rename", oldName, err)
+	}
+	return nil
+}
+
+// Copy copies name to newName on server side, replacing it if exists
+func (rfs *RemoteFS) Copy(ctx context.Context, name, newName string) error {
+	if err := rfs.checkWrite(newName); err != nil {
+		return err
+	}
+	newpath := rfs.AbsPath(newName)
+	defer rfs.invalidate(newpath)
+	if _, err := rfs.client.Copy(ctx, rfs.AbsPath(name), newpath, client.Ondup(client.ONDUP_OVERWRITE)); err != nil {
+		return rfs.notExist("copy", name, err)
+	}
+	return nil
+}
+
+// RemoteFileReader reads and seeks in a remote file
+type RemoteFileReader struct {
+	ctx     context.Context
+	rfs     *RemoteFS
+	abspath string
+	info    os.FileInfo
+
+	offset int64
+	body   io.ReadCloser
+}
+
+func (rfr *RemoteFileReader) Stat() (os.FileInfo, error) {
+	return rfr.info, nil
+}
+
+func (rfr *RemoteFileReader) Read(p []byte) (int, error) {
+	if rfr.offset >= rfr.info.Size() {
+		return 0, io.EOF
+	}
+	if rfr.body == nil {
+		if err := rfr.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rfr.body.Read(p)
+	rfr.offset += int64(n)
+	return n, err
+}
+
+// open requests content from the current offset.  The download link is
+// refreshed and tried again once on failure, as it may have expired
+func (rfr *RemoteFileReader) open() error {
+	var (
+		offset = rfr.offset
+		err    error
+	)
+	for _, refresh := range []bool{false, true} {
+		var dlink string
+		dlink, err = rfr.rfs.dlink(rfr.ctx, rfr.abspath, refresh)
+		if err != nil {
+			return err
+		}
+		var httpResp *http.Response
+		httpResp, err = rfr.rfs.client.DownloadByDLink(rfr.ctx, dlink, func(req *http.Request) {
+			req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		})
+		if err != nil {
+			continue
+		}
+		if httpResp.StatusCode == http.StatusPartialContent ||
+			(httpResp.StatusCode == http.StatusOK && offset == 0) {
+			rfr.body = httpResp.Body
+			return nil
+		}
+		httpResp.Body.Close()
+		err = fmt.Errorf("download %s from %d: %s", rfr.abspath, offset, httpResp.Status)
+	}
+	return err
+}
+
+func (rfr *RemoteFileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += rfr.offset
+	case io.SeekEnd:
+		offset += rfr.info.Size()
+	default:
+		return rfr.offset, fmt.Errorf("seek: invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return rfr.offset, fmt.Errorf("seek: negative offset %d", offset)
+	}
+	if offset != rfr.offset && rfr.body != nil {
+		rfr.body.Close()
+		rfr.body = nil
+	}
+	rfr.offset = offset
+	return offset, nil
+}
+
+func (rfr *RemoteFileReader) Close() error {
+	if rfr.body != nil {
+		err := rfr.body.Close()
+		rfr.body = nil
+		return err
+	}
+	return nil
+}
+
+// RemoteFileWriter spools writes to a local temporary file and uploads it
+// on Close
+type RemoteFileWriter struct {
+	ctx     context.Context
+	rfs     *RemoteFS
+	abspath string
+	f       *os.File
+}
+
+func (rfw *RemoteFileWriter) Write(p []byte) (int, error) {
+	return rfw.f.Write(p)
+}
+
+func (rfw *RemoteFileWriter) Stat() (os.FileInfo, error) {
+	fi, err := rfw.f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	info := RemoteFileInfo{
+		name:  path.Base(rfw.abspath),
+		size:  fi.Size(),
+		mtime: fi.ModTime(),
+	}
+	return info, nil
+}
+
+// Abort drops what was written without uploading
+func (rfw *RemoteFileWriter) Abort() error {
+	defer os.Remove(rfw.f.Name())
+	return rfw.f.Close()
+}
+
+func (rfw *RemoteFileWriter) Close() error {
+	spool := rfw.f.Name()
+	defer os.Remove(spool)
+	if err := rfw.f.Close(); err != nil {
+		return err
+	}
+	defer rfw.rfs.invalidate(rfw.abspath)
+	if _, err := rfw.rfs.client.Upload(rfw.ctx, spool, rfw.abspath, client.Ondup(client.ONDUP_OVERWRITE)); err != nil {
+		return errors.Wrapf(err, "upload %s", rfw.abspath)
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteFileReader(t *testing.T) {
+	ctx := context.Background()
+	data := []byte("0123456789abcdef")
+	fc := newFakeClient().addContent("r/f", data)
+	rfs := NewRemoteFS(fc, "r")
+
+	rfr, err := rfs.Open(ctx, "f")
+	require.NoError(t, err)
+	defer rfr.Close()
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(rfr, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "0123", string(buf))
+
+	// seeking closes the body and requests from the new offset
+	off, err := rfr.Seek(-6, io.SeekEnd)
+	require.NoError(t, err)
+	assert.EqualValues(t, 10, off)
+	_, err = io.ReadFull(rfr, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "abcd", string(buf))
+
+	off, err = rfr.Seek(-8, io.SeekCurrent)
+	require.NoError(t, err)
+	assert.EqualValues(t, 6, off)
+
+	// expired dlink is refreshed and tried again.  gen=1 is from Stat in
+	// Open, gen=2 is cached by the first read
+	fc.staleDLinks["/apps/x/r/f?gen=2"] = true
+	_, err = io.ReadFull(rfr, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "6789", string(buf))
+
+	rest, err := io.ReadAll(rfr)
+	require.NoError(t, err)
+	assert.Equal(t, "abcdef", string(rest))
+
+	assert.Equal(t, []string{
+		"FileMetaByPath /apps/x/r/f",
+		"FileMetaByPath /apps/x/r/f",
+		"DownloadByDLink /apps/x/r/f?gen=2 bytes=0-",
+		"DownloadByDLink /apps/x/r/f?gen=2 bytes=10-",
+		"DownloadByDLink /apps/x/r/f?gen=2 bytes=6-",
+		"FileMetaByPath /apps/x/r/f",
+		"DownloadByDLink /apps/x/r/f?gen=3 bytes=6-",
+	}, fc.calls)
+
+	_, err = rfr.Seek(-1, io.SeekStart)
+	assert.Error(t, err)
+	_, err = rfr.Seek(0, 9)
+	assert.Error(t, err)
+}
+
+func TestRemoteFSInvalidate(t *testing.T) {
+	rfs := NewRemoteFS(newFakeClient(), "/r")
+	now := time.Now()
+	for _, p := range []string{"/r", "/r/a", "/r/a/b", "/r/a/b/c", "/r/a/bc"} {
+		rfs.dirs[p] = remoteFSDir{time: now}
+	}
+	for _, p := range []string{"/r/a/b", "/r/a/b/c/f", "/r/a/bc", "/r/f"} {
+		rfs.dlinks[p] = remoteFSDLink{time: now}
+	}
+	rfs.invalidate("/r/a/b")
+
+	var dirs, dlinks []string
+	for p := range rfs.dirs {
+		dirs = append(dirs, p)
+	}
+	for p := range rfs.dlinks {
+		dlinks = append(dlinks, p)
+	}
+	assert.ElementsMatch(t, []string{"/r", "/r/a/bc"}, dirs)
+	assert.ElementsMatch(t, []string{"/r/a/bc", "/r/f"}, dlinks)
+}
+
+func TestRemoteFSCreate(t *testing.T) {
+	ctx := context.Background()
+	tmpDir := filepath.Join(t.TempDir(), "tmp")
+	fc := newFakeClient().add("r/", 0)
+	rfs := NewRemoteFS(fc, "r").TmpDir(tmpDir)
+	_, err := rfs.ReadDir(ctx, "")
+	require.NoError(t, err)
+	require.Contains(t, rfs.dirs, "/apps/x/r")
+
+	rfw, err := rfs.Create(ctx, "new")
+	require.NoError(t, err)
+	_, err = rfw.Write([]byte("hello"))
+	require.NoError(t, err)
+	spools, err := os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Len(t, spools, 1)
+
+	require.NoError(t, rfw.Close())
+	assert.Equal(t, "hello", string(fc.content["/apps/x/r/new"]))
+	spools, err = os.ReadDir(tmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, spools)
+	// listing of the parent is dropped
+	assert.NotContains(t, rfs.dirs, "/apps/x/r")
+
+	_, err = NewRemoteFS(fc, "r").ReadOnly(true).Create(ctx, "new")
+	assert.ErrorIs(t, err, os.ErrPermission)
+}
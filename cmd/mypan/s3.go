@@ -0,0 +1,1069 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mypan/pkg/client"
+	"mypan/pkg/s3"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	s3Namespace     = "http://s3.amazonaws.com/doc/2006-03-01/"
+	s3MaxKeys       = 1000
+	s3MaxPartNumber = 10000
+
+	// how long parts wait for part 1 to start
+	s3PartWait = time.Minute
+	// how long a multipart upload is kept since last used
+	s3UploadExpiry = 24 * time.Hour
+)
+
+type s3Error struct {
+	status  int
+	code    string
+	message string
+}
+
+func (err *s3Error) Error() string {
+	return fmt.Sprintf("%s: %s", err.code, err.message)
+}
+
+func newS3Error(status int, code, message string) error {
+	return &s3Error{
+		status:  status,
+		code:    code,
+		message: message,
+	}
+}
+
+var (
+	errS3NoSuchBucket     = newS3Error(http.StatusNotFound, "NoSuchBucket", "The specified bucket does not exist")
+	errS3NoSuchKey        = newS3Error(http.StatusNotFound, "NoSuchKey", "The specified key does not exist")
+	errS3NoSuchUpload     = newS3Error(http.StatusNotFound, "NoSuchUpload", "The specified multipart upload does not exist")
+	errS3BucketExists     = newS3Error(http.StatusConflict, "BucketAlreadyOwnedByYou", "The bucket already exists")
+	errS3BucketNotEmpty   = newS3Error(http.StatusConflict, "BucketNotEmpty", "The bucket is not empty")
+	errS3BadDigest        = newS3Error(http.StatusBadRequest, "BadDigest", "The Content-MD5 does not match")
+	errS3InvalidPart      = newS3Error(http.StatusBadRequest, "InvalidPart", "One or more of the specified parts could not be found")
+	errS3InvalidPartOrder = newS3Error(http.StatusBadRequest, "InvalidPartOrder", "The list of parts was not in ascending order")
+	errS3MalformedXML     = newS3Error(http.StatusBadRequest, "MalformedXML", "The XML is not well-formed")
+	errS3NotImplemented   = newS3Error(http.StatusNotImplemented, "NotImplemented", "The operation is not implemented")
+	errS3AccessDenied     = newS3Error(http.StatusForbidden, "AccessDenied", "Access denied")
+
+	errS3MissingContentLength = newS3Error(http.StatusLengthRequired, "MissingContentLength", "You must provide the Content-Length HTTP header")
+	errS3IncompleteBody       = newS3Error(http.StatusBadRequest, "IncompleteBody", "The body does not match the Content-Length HTTP header")
+	errS3InvalidPartSize      = newS3Error(http.StatusBadRequest, "InvalidArgument", "Parts except the last one must be of the same size")
+	errS3PartGap              = newS3Error(http.StatusBadRequest, "InvalidPart", "Parts must be numbered from 1 without gaps")
+)
+
+type S3ErrorResponse struct {
+	XMLName  xml.Name `xml:"Error"`
+	Code     string
+	Message  string
+	Resource string
+}
+
+type S3Bucket struct {
+	Name         string
+	CreationDate string
+}
+
+type S3ListAllMyBucketsResult struct {
+	XMLName xml.Name   `xml:"ListAllMyBucketsResult"`
+	Xmlns   string     `xml:"xmlns,attr"`
+	Buckets []S3Bucket `xml:"Buckets>Bucket"`
+}
+
+type S3Object struct {
+	Key          string
+	LastModified string
+	ETag         string
+	Size         int64
+	StorageClass string
+}
+
+type S3CommonPrefix struct {
+	Prefix string
+}
+
+type S3ListBucketResult struct {
+	XMLName               xml.Name `xml:"ListBucketResult"`
+	Xmlns                 string   `xml:"xmlns,attr"`
+	Name                  string
+	Prefix                string
+	Delimiter             string `xml:",omitempty"`
+	MaxKeys               int
+	EncodingType          string `xml:",omitempty"`
+	IsTruncated           bool
+	Marker                *string `xml:",omitempty"`
+	NextMarker            string  `xml:",omitempty"`
+	KeyCount              *int    `xml:",omitempty"`
+	ContinuationToken     string  `xml:",omitempty"`
+	NextContinuationToken string  `xml:",omitempty"`
+	StartAfter            string  `xml:",omitempty"`
+	Contents              []S3Object
+	CommonPrefixes        []S3CommonPrefix
+}
+
+type S3InitiateMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Bucket   string
+	Key      string
+	UploadId string
+}
+
+type S3CompleteMultipartUpload struct {
+	Parts []struct {
+		PartNumber int
+		ETag       string
+	} `xml:"Part"`
+}
+
+type S3CompleteMultipartUploadResult struct {
+	XMLName  xml.Name `xml:"CompleteMultipartUploadResult"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string
+	Bucket   string
+	Key      string
+	ETag     string
+}
+
+type S3CopyObjectResult struct {
+	XMLName      xml.Name `xml:"CopyObjectResult"`
+	Xmlns        string   `xml:"xmlns,attr"`
+	LastModified string
+	ETag         string
+}
+
+type S3Delete struct {
+	Quiet   bool
+	Objects []struct {
+		Key string
+	} `xml:"Object"`
+}
+
+type S3DeleteError struct {
+	Key     string
+	Code    string
+	Message string
+}
+
+type S3DeleteResult struct {
+	XMLName xml.Name `xml:"DeleteResult"`
+	Xmlns   string   `xml:"xmlns,attr"`
+	Deleted []struct {
+		Key string
+	}
+	Errors []S3DeleteError `xml:"Error"`
+}
+
+type S3LocationConstraint struct {
+	XMLName  xml.Name `xml:"LocationConstraint"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Location string   `xml:",chardata"`
+}
+
+// s3Upload is a multipart upload in progress.  Parts are written to the
+// session as they come.  Part n starts at offset (n-1) * partSize, partSize
+// being the size of part 1
+type s3Upload struct {
+	bucket  string
+	key     string
+	session client.UploadSessionI
+	// used is when the upload was last looked up
+	used time.Time
+
+	// partSize is set when part 1 starts, and sized is closed then
+	partSize int64
+	sized    chan struct{}
+	parts    map[int]s3Part
+}
+
+// s3Part is an uploaded part
+type s3Part struct {
+	size int64
+	etag string
+}
+
+// S3Gateway serves a minimal S3 API with path-style addressing.  Buckets
+// are top-level dirs of RemoteFS and keys are slash separated paths in them.
+// Keys ending in "/" stand for dirs.  Parts of multipart uploads are
+// spooled as they come, and uploaded on completion.  Parts except the last
+// one must be of the same size.  Uploads not used for a while are aborted
+type S3Gateway struct {
+	rfs          *RemoteFS
+	creds        s3.Credentials
+	uploadExpiry time.Duration
+
+	mu      *sync.Mutex
+	uploads map[string]*s3Upload
+}
+
+func NewS3Gateway(rfs *RemoteFS, creds s3.Credentials) *S3Gateway {
+	gw := &S3Gateway{
+		rfs:          rfs,
+		creds:        creds,
+		uploadExpiry: s3UploadExpiry,
+
+		mu:      &sync.Mutex{},
+		uploads: map[string]*s3Upload{},
+	}
+	return gw
+}
+
+// UploadExpiry sets how long multipart uploads are kept since last used
+func (gw *S3Gateway) UploadExpiry(expiry time.Duration) *S3Gateway {
+	gw.uploadExpiry = expiry
+	return gw
+}
+
+func (gw *S3Gateway) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if err := gw.serve(w, req); err != nil {
+		gw.error(w, req, err)
+	}
+}
+
+func (gw *S3Gateway) serve(w http.ResponseWriter, req *http.Request) error {
+	sig, err := s3.Verify(req, gw.creds, time.Now())
+	if err != nil {
+		return err
+	}
+	// payload is checked against the signature as it's read
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{sig.Body(req), req.Body}
+	var (
+		ctx         = req.Context()
+		q           = req.URL.Query()
+		bucket, key = s3SplitPath(req.URL.Path)
+	)
+	if bucket == "" {
+		if req.Method != http.MethodGet {
+			return errS3NotImplemented
+		}
+		return gw.listBuckets(w, req)
+	}
+	if key == "" {
+		switch {
+		case req.Method == http.MethodPut:
+			return gw.createBucket(w, req, bucket)
+		case req.Method == http.MethodDelete:
+			return gw.deleteBucket(w, req, bucket)
+		}
+		if err := gw.checkBucket(ctx, bucket); err != nil {
+			return err
+		}
+		switch {
+		case req.Method == http.MethodHead:
+			return nil
+		case req.Method == http.MethodGet && q.Has("location"):
+			return s3WriteXML(w, http.StatusOK, S3LocationConstraint{Xmlns: s3Namespace})
+		case req.Method == http.MethodGet:
+			return gw.listObjects(w, req, bucket)
+		case req.Method == http.MethodPost && q.Has("delete"):
+			return gw.deleteObjects(w, req, bucket)
+		}
+		return errS3NotImplemented
+	}
+	if err := gw.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	switch {
+	case req.Method == http.MethodGet, req.Method == http.MethodHead:
+		return gw.getObject(w, req, bucket, key)
+	case req.Method == http.MethodPut && q.Has("uploadId"):
+		return gw.uploadPart(w, req, bucket, key)
+	case req.Method == http.MethodPut && req.Header.Get("X-Amz-Copy-Source") != "":
+		return gw.copyObject(w, req, bucket, key)
+	case req.Method == http.MethodPut:
+		return gw.putObject(w, req, bucket, key)
+	case req.Method == http.MethodPost && q.Has("uploads"):
+		return gw.createMultipartUpload(w, req, bucket, key)
+	case req.Method == http.MethodPost && q.Has("uploadId"):
+		return gw.completeMultipartUpload(w, req, bucket, key)
+	case req.Method == http.MethodDelete && q.Has("uploadId"):
+		return gw.abortMultipartUpload(w, req, bucket, key)
+	case req.Method == http.MethodDelete:
+		if err := gw.deleteObject(ctx, bucket, key); err != nil {
+			return err
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	return errS3NotImplemented
+}
+
+func (gw *S3Gateway) error(w http.ResponseWriter, req *http.Request, err error) {
+	var (
+		s3Err   *s3Error
+		authErr *s3.AuthError
+	)
+	switch {
+	case errors.As(err, &s3Err):
+	case errors.As(err, &authErr):
+		status := http.StatusForbidden
+		switch authErr.Code {
+		case "AuthorizationHeaderMalformed", "AuthorizationQueryParametersError", "InvalidRequest", "XAmzContentSHA256Mismatch":
+			status = http.StatusBadRequest
+		}
+		s3Err = &s3Error{
+			status:  status,
+			code:    authErr.Code,
+			message: authErr.Message,
+		}
+	case os.IsNotExist(err):
+		s3Err = errS3NoSuchKey.(*s3Error)
+	case os.IsPermission(err):
+		s3Err = errS3AccessDenied.(*s3Error)
+	default:
+		glog.Warningf("s3: %s %s: %v", req.Method, req.URL.Path, err)
+		s3Err = &s3Error{
+			status:  http.StatusInternalServerError,
+			code:    "InternalError",
+			message: err.Error(),
+		}
+	}
+	if err := s3WriteXML(w, s3Err.status, S3ErrorResponse{
+		Code:     s3Err.code,
+		Message:  s3Err.message,
+		Resource: req.URL.Path,
+	}); err != nil {
+		glog.Warningf("s3: %s %s: %v", req.Method, req.URL.Path, err)
+	}
+}
+
+func s3WriteXML(w http.ResponseWriter, status int, v interface{}) error {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	return xml.NewEncoder(w).Encode(v)
+}
+
+// s3SplitPath splits path-style request path into bucket and key
+func s3SplitPath(p string) (string, string) {
+	p = strings.TrimPrefix(p, "/")
+	if i := strings.IndexByte(p, '/'); i >= 0 {
+		return p[:i], p[i+1:]
+	}
+	return p, ""
+}
+
+func s3ETag(md5 string) string {
+	if md5 == "" {
+		return ""
+	}
+	return `"` + md5 + `"`
+}
+
+func s3Time(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000Z")
+}
+
+func (gw *S3Gateway) checkBucket(ctx context.Context, bucket string) error {
+	infos, err := gw.rfs.ReadDir(ctx, "/")
+	if err != nil {
+		return err
+	}
+	for _, info := range infos {
+		if info.Name() == bucket && info.IsDir() {
+			return nil
+		}
+	}
+	return errS3NoSuchBucket
+}
+
+func (gw *S3Gateway) listBuckets(w http.ResponseWriter, req *http.Request) error {
+	infos, err := gw.rfs.ReadDir(req.Context(), "/")
+	if err != nil {
+		return err
+	}
+	result := S3ListAllMyBucketsResult{
+		Xmlns:   s3Namespace,
+		Buckets: []S3Bucket{},
+	}
+	for _, info := range infos {
+		if !info.IsDir() {
+			continue
+		}
+		result.Buckets = append(result.Buckets, S3Bucket{
+			Name:         info.Name(),
+			CreationDate: s3Time(info.ModTime()),
+		})
+	}
+	return s3WriteXML(w, http.StatusOK, result)
+}
+
+func (gw *S3Gateway) createBucket(w http.ResponseWriter, req *http.Request, bucket string) error {
+	ctx := req.Context()
+	if err := gw.checkBucket(ctx, bucket); err == nil {
+		return errS3BucketExists
+	} else if err != errS3NoSuchBucket {
+		return err
+	}
+	if err := gw.rfs.Mkdir(ctx, bucket); err != nil {
+		return err
+	}
+	w.Header().Set("Location", "/"+bucket)
+	return nil
+}
+
+func (gw *S3Gateway) deleteBucket(w http.ResponseWriter, req *http.Request, bucket string) error {
+	ctx := req.Context()
+	if err := gw.checkBucket(ctx, bucket); err != nil {
+		return err
+	}
+	infos, err := gw.rfs.ReadDir(ctx, bucket)
+	if err != nil {
+		return err
+	}
+	if len(infos) > 0 {
+		return errS3BucketNotEmpty
+	}
+	if err := gw.rfs.Remove(ctx, bucket); err != nil {
+		return err
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+// s3ListEntry is an object, or a common prefix if info is nil
+type s3ListEntry struct {
+	key  string
+	info os.FileInfo
+}
+
+// listEntries returns objects in bucket with prefix, sorted by key.  Keys
+// with delimiter after prefix are rolled up into common prefixes.  With "/"
+// as delimiter only the dir of prefix is listed
+func (gw *S3Gateway) listEntries(ctx context.Context, bucket, prefix, delimiter string) ([]s3ListEntry, error) {
+	var ents []s3ListEntry
+	dir := prefix[:strings.LastIndexByte(prefix, '/')+1]
+	if delimiter == "/" {
+		infos, err := gw.rfs.ReadDir(ctx, bucket+"/"+dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		for _, info := range infos {
+			ent := s3ListEntry{key: dir + info.Name(), info: info}
+			if info.IsDir() {
+				ent = s3ListEntry{key: ent.key + "/"}
+			}
+			if strings.HasPrefix(ent.key, prefix) {
+				ents = append(ents, ent)
+			}
+		}
+	} else {
+		infos, err := gw.rfs.ListAll(ctx, bucket+"/"+dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, nil
+			}
+			return nil, err
+		}
+		prefixes := map[string]bool{}
+		for relpath, info := range infos {
+			key := dir + relpath
+			if !strings.HasPrefix(key, prefix) {
+				continue
+			}
+			if delimiter != "" {
+				if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+					prefixes[key[:len(prefix)+i+len(delimiter)]] = true
+					continue
+				}
+			}
+			ents = append(ents, s3ListEntry{key: key, info: info})
+		}
+		for p := range prefixes {
+			ents = append(ents, s3ListEntry{key: p})
+		}
+	}
+	sort.Slice(ents, func(i, j int) bool {
+		return ents[i].key < ents[j].key
+	})
+	return ents, nil
+}
+
+// listObjects serves ListObjectsV2, or ListObjects without list-type=2
+func (gw *S3Gateway) listObjects(w http.ResponseWriter, req *http.Request, bucket string) error {
+	var (
+		q         = req.URL.Query()
+		v2        = q.Get("list-type") == "2"
+		prefix    = q.Get("prefix")
+		delimiter = q.Get("delimiter")
+		maxKeys   = s3MaxKeys
+		after     string
+	)
+	if s := q.Get("max-keys"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid max-keys")
+		}
+		if n < maxKeys {
+			maxKeys = n
+		}
+	}
+	result := S3ListBucketResult{
+		Xmlns:          s3Namespace,
+		Name:           bucket,
+		MaxKeys:        maxKeys,
+		Contents:       []S3Object{},
+		CommonPrefixes: []S3CommonPrefix{},
+	}
+	if v2 {
+		after = q.Get("start-after")
+		result.StartAfter = after
+		if token := q.Get("continuation-token"); token != "" {
+			b, err := base64.RawURLEncoding.DecodeString(token)
+			if err != nil {
+				return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid continuation-token")
+			}
+			after = string(b)
+			result.ContinuationToken = token
+		}
+	} else {
+		after = q.Get("marker")
+	}
+
+	ents, err := gw.listEntries(req.Context(), bucket, prefix, delimiter)
+	if err != nil {
+		return err
+	}
+	i := sort.Search(len(ents), func(i int) bool {
+		return ents[i].key > after
+	})
+	ents = ents[i:]
+	if len(ents) > maxKeys {
+		ents = ents[:maxKeys]
+		result.IsTruncated = true
+	}
+
+	encode := func(s string) string { return s }
+	if q.Get("encoding-type") == "url" {
+		result.EncodingType = "url"
+		encode = url.QueryEscape
+	}
+	result.Prefix = encode(prefix)
+	result.Delimiter = encode(delimiter)
+	result.StartAfter = encode(result.StartAfter)
+	for _, ent := range ents {
+		if ent.info == nil {
+			result.CommonPrefixes = append(result.CommonPrefixes, S3CommonPrefix{Prefix: encode(ent.key)})
+			continue
+		}
+		obj := S3Object{
+			Key:          encode(ent.key),
+			LastModified: s3Time(ent.info.ModTime()),
+			Size:         ent.info.Size(),
+			StorageClass: "STANDARD",
+		}
+		if rfi, ok := ent.info.(RemoteFileInfo); ok {
+			obj.ETag = s3ETag(rfi.Md5())
+		}
+		result.Contents = append(result.Contents, obj)
+	}
+	if result.IsTruncated {
+		last := ents[len(ents)-1].key
+		if v2 {
+			result.NextContinuationToken = base64.RawURLEncoding.EncodeToString([]byte(last))
+		} else {
+			result.NextMarker = encode(last)
+		}
+	}
+	if v2 {
+		keyCount := len(ents)
+		result.KeyCount = &keyCount
+	} else {
+		marker := encode(q.Get("marker"))
+		result.Marker = &marker
+	}
+	return s3WriteXML(w, http.StatusOK, result)
+}
+
+func (gw *S3Gateway) getObject(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	var (
+		ctx  = req.Context()
+		name = bucket + "/" + key
+	)
+	info, err := gw.rfs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if info.IsDir() != strings.HasSuffix(key, "/") {
+		return errS3NoSuchKey
+	}
+	if info.IsDir() {
+		w.Header().Set("Content-Length", "0")
+		w.Header().Set("Last-Modified", info.ModTime().UTC().Format(http.TimeFormat))
+		return nil
+	}
+	rfr, err := gw.rfs.Open(ctx, name)
+	if err != nil {
+		return err
+	}
+	defer rfr.Close()
+	if rfi, ok := info.(RemoteFileInfo); ok && rfi.Md5() != "" {
+		w.Header().Set("ETag", s3ETag(rfi.Md5()))
+	}
+	http.ServeContent(w, req, info.Name(), info.ModTime(), rfr)
+	return nil
+}
+
+// s3DecodeXML decodes body of req into v.  Body is read through for the
+// payload to be checked
+func s3DecodeXML(req *http.Request, v interface{}) error {
+	b, err := io.ReadAll(req.Body)
+	if err != nil {
+		return err
+	}
+	if err := xml.Unmarshal(b, v); err != nil {
+		return errS3MalformedXML
+	}
+	return nil
+}
+
+// checkContentMD5 checks h against Content-MD5 header if it's present
+func s3CheckContentMD5(req *http.Request, h hash.Hash) error {
+	want := req.Header.Get("Content-Md5")
+	if want == "" {
+		return nil
+	}
+	if base64.StdEncoding.EncodeToString(h.Sum(nil)) != want {
+		return errS3BadDigest
+	}
+	return nil
+}
+
+func (gw *S3Gateway) putObject(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	var (
+		ctx  = req.Context()
+		name = bucket + "/" + key
+		body = req.Body
+	)
+	if strings.HasSuffix(key, "/") {
+		if n, _ := io.Copy(io.Discard, body); n > 0 {
+			return newS3Error(http.StatusBadRequest, "InvalidArgument", "dir key with content")
+		}
+		if _, err := gw.rfs.Stat(ctx, name); err == nil {
+			return nil
+		}
+		return gw.rfs.Mkdir(ctx, name)
+	}
+	rfw, err := gw.rfs.Create(ctx, name)
+	if err != nil {
+		return err
+	}
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(rfw, h), body); err != nil {
+		rfw.Abort()
+		return err
+	}
+	if err := s3CheckContentMD5(req, h); err != nil {
+		rfw.Abort()
+		return err
+	}
+	if err := rfw.Close(); err != nil {
+		return err
+	}
+	w.Header().Set("ETag", s3ETag(hex.EncodeToString(h.Sum(nil))))
+	return nil
+}
+
+func (gw *S3Gateway) copyObject(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	var (
+		ctx  = req.Context()
+		name = bucket + "/" + key
+	)
+	src := req.Header.Get("X-Amz-Copy-Source")
+	if i := strings.Index(src, "?versionId="); i >= 0 {
+		src = src[:i]
+	}
+	src, err := url.PathUnescape(src)
+	if err != nil {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid x-amz-copy-source")
+	}
+	srcBucket, srcKey := s3SplitPath("/" + strings.TrimPrefix(src, "/"))
+	if srcKey == "" || strings.HasSuffix(srcKey, "/") {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid x-amz-copy-source")
+	}
+	if err := gw.checkBucket(ctx, srcBucket); err != nil {
+		return err
+	}
+	srcName := srcBucket + "/" + srcKey
+	if info, err := gw.rfs.Stat(ctx, srcName); err != nil {
+		return err
+	} else if info.IsDir() {
+		return errS3NoSuchKey
+	}
+	if gw.rfs.AbsPath(srcName) != gw.rfs.AbsPath(name) {
+		if err := gw.rfs.Copy(ctx, srcName, name); err != nil {
+			return err
+		}
+	}
+	info, err := gw.rfs.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	result := S3CopyObjectResult{
+		Xmlns:        s3Namespace,
+		LastModified: s3Time(info.ModTime()),
+	}
+	if rfi, ok := info.(RemoteFileInfo); ok {
+		result.ETag = s3ETag(rfi.Md5())
+	}
+	return s3WriteXML(w, http.StatusOK, result)
+}
+
+// deleteObject removes key.  Missing keys are not an error.  Dir keys are
+// removed only if the dir is empty
+func (gw *S3Gateway) deleteObject(ctx context.Context, bucket, key string) error {
+	name := bucket + "/" + key
+	if strings.HasSuffix(key, "/") {
+		infos, err := gw.rfs.ReadDir(ctx, name)
+		if err != nil || len(infos) > 0 {
+			return nil
+		}
+	}
+	if err := gw.rfs.Remove(ctx, name); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (gw *S3Gateway) deleteObjects(w http.ResponseWriter, req *http.Request, bucket string) error {
+	ctx := req.Context()
+	var del S3Delete
+	if err := s3DecodeXML(req, &del); err != nil {
+		return err
+	}
+	if gw.rfs.readOnly {
+		return errS3AccessDenied
+	}
+	result := S3DeleteResult{
+		Xmlns: s3Namespace,
+	}
+	var (
+		keys  []string
+		paths []string
+	)
+	for _, obj := range del.Objects {
+		if strings.HasSuffix(obj.Key, "/") {
+			if err := gw.deleteObject(ctx, bucket, obj.Key); err != nil {
+				result.Errors = append(result.Errors, S3DeleteError{Key: obj.Key, Code: "InternalError", Message: err.Error()})
+			} else {
+				result.Deleted = append(result.Deleted, struct{ Key string }{obj.Key})
+			}
+			continue
+		}
+		keys = append(keys, obj.Key)
+		paths = append(paths, gw.rfs.AbsPath(bucket+"/"+obj.Key))
+	}
+	if len(paths) > 0 {
+		failed := map[string]client.FileManagerInfo{}
+		_, err := gw.rfs.client.DeleteMulti(ctx, paths)
+		for _, p := range paths {
+			gw.rfs.invalidate(p)
+		}
+		if err != nil {
+			var fmErr *client.FileManagerError
+			if !errors.As(err, &fmErr) {
+				return err
+			}
+			for _, info := range fmErr.Failed {
+				// -9, not found
+				if info.Errno != -9 {
+					failed[info.Path] = info
+				}
+			}
+		}
+		for i, key := range keys {
+			if info, ok := failed[paths[i]]; ok {
+				result.Errors = append(result.Errors, S3DeleteError{
+					Key:     key,
+					Code:    "InternalError",
+					Message: fmt.Sprintf("errno %d", info.Errno),
+				})
+			} else {
+				result.Deleted = append(result.Deleted, struct{ Key string }{key})
+			}
+		}
+	}
+	if del.Quiet {
+		result.Deleted = nil
+	}
+	return s3WriteXML(w, http.StatusOK, result)
+}
+
+func (gw *S3Gateway) createMultipartUpload(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	name := bucket + "/" + key
+	if err := gw.rfs.checkWrite(name); err != nil {
+		return err
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	uploadId := hex.EncodeToString(b)
+	gw.expireUploads(time.Now())
+	session, err := gw.rfs.client.NewUploadSession(req.Context(), gw.rfs.AbsPath(name), client.Ondup(client.ONDUP_OVERWRITE))
+	if err != nil {
+		return err
+	}
+	gw.mu.Lock()
+	gw.uploads[uploadId] = &s3Upload{
+		bucket:  bucket,
+		key:     key,
+		session: session,
+		used:    time.Now(),
+		sized:   make(chan struct{}),
+		parts:   map[int]s3Part{},
+	}
+	gw.mu.Unlock()
+	return s3WriteXML(w, http.StatusOK, S3InitiateMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Bucket:   bucket,
+		Key:      key,
+		UploadId: uploadId,
+	})
+}
+
+func (gw *S3Gateway) upload(req *http.Request, bucket, key string) (*s3Upload, error) {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	up, ok := gw.uploads[req.URL.Query().Get("uploadId")]
+	if !ok || up.bucket != bucket || up.key != key {
+		return nil, errS3NoSuchUpload
+	}
+	up.used = time.Now()
+	return up, nil
+}
+
+// expireUploads aborts uploads not used for uploadExpiry
+func (gw *S3Gateway) expireUploads(now time.Time) {
+	var expired []*s3Upload
+	gw.mu.Lock()
+	for uploadId, up := range gw.uploads {
+		if now.Sub(up.used) > gw.uploadExpiry {
+			delete(gw.uploads, uploadId)
+			expired = append(expired, up)
+		}
+	}
+	gw.mu.Unlock()
+	for _, up := range expired {
+		glog.Infof("expire upload of %s/%s", up.bucket, up.key)
+		if err := up.session.Close(); err != nil {
+			glog.Warningf("close upload session of %s/%s: %v", up.bucket, up.key, err)
+		}
+	}
+}
+
+// s3ContentLength returns length of the payload, decoded if it's
+// aws-chunked
+func s3ContentLength(req *http.Request) (int64, error) {
+	if s := req.Header.Get("X-Amz-Decoded-Content-Length"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || n < 0 {
+			return 0, newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid x-amz-decoded-content-length")
+		}
+		return n, nil
+	}
+	if req.ContentLength < 0 || strings.HasPrefix(req.Header.Get("X-Amz-Content-Sha256"), s3.StreamingPayload) {
+		return 0, errS3MissingContentLength
+	}
+	return req.ContentLength, nil
+}
+
+// partOffset returns offset of part n of size.  Parts other than part 1
+// wait for it to start, as where they are follows from its size
+func (gw *S3Gateway) partOffset(ctx context.Context, up *s3Upload, n int, size int64) (int64, error) {
+	if n == 1 {
+		gw.mu.Lock()
+		defer gw.mu.Unlock()
+		select {
+		case <-up.sized:
+			if size != up.partSize {
+				return 0, errS3InvalidPartSize
+			}
+		default:
+			up.partSize = size
+			close(up.sized)
+		}
+		return 0, nil
+	}
+	select {
+	case <-up.sized:
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-time.After(s3PartWait):
+		return 0, newS3Error(http.StatusBadRequest, "InvalidArgument", "Part 1 must be uploaded first")
+	}
+	if up.partSize == 0 || size > up.partSize {
+		return 0, errS3InvalidPartSize
+	}
+	return int64(n-1) * up.partSize, nil
+}
+
+// uploadPart spools the part to where it is in the upload
+func (gw *S3Gateway) uploadPart(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	ctx := req.Context()
+	up, err := gw.upload(req, bucket, key)
+	if err != nil {
+		return err
+	}
+	partNumber, err := strconv.Atoi(req.URL.Query().Get("partNumber"))
+	if err != nil || partNumber < 1 || partNumber > s3MaxPartNumber {
+		return newS3Error(http.StatusBadRequest, "InvalidArgument", "invalid partNumber")
+	}
+	size, err := s3ContentLength(req)
+	if err != nil {
+		return err
+	}
+	off, err := gw.partOffset(ctx, up, partNumber, size)
+	if err != nil {
+		return err
+	}
+
+	h := md5.New()
+	n, err := up.session.WriteAt(ctx, off, io.TeeReader(io.LimitReader(req.Body, size), h))
+	if err != nil {
+		return err
+	}
+	if n != size {
+		return errS3IncompleteBody
+	}
+	// more would have gone to the next part
+	if _, err := io.ReadFull(req.Body, make([]byte, 1)); err != io.EOF {
+		return errS3IncompleteBody
+	}
+	if err := s3CheckContentMD5(req, h); err != nil {
+		return err
+	}
+	part := s3Part{
+		size: size,
+		etag: hex.EncodeToString(h.Sum(nil)),
+	}
+	gw.mu.Lock()
+	up.parts[partNumber] = part
+	gw.mu.Unlock()
+	w.Header().Set("ETag", s3ETag(part.etag))
+	return nil
+}
+
+// completeMultipartUpload uploads the object spooled from parts.  An empty
+// object is uploaded as a file
+func (gw *S3Gateway) completeMultipartUpload(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	ctx := req.Context()
+	up, err := gw.upload(req, bucket, key)
+	if err != nil {
+		return err
+	}
+	var complete S3CompleteMultipartUpload
+	if err := s3DecodeXML(req, &complete); err != nil {
+		return err
+	}
+	if len(complete.Parts) == 0 {
+		return errS3MalformedXML
+	}
+	var (
+		size int64
+		h    = md5.New()
+	)
+	gw.mu.Lock()
+	for i, p := range complete.Parts {
+		if i > 0 && p.PartNumber <= complete.Parts[i-1].PartNumber {
+			gw.mu.Unlock()
+			return errS3InvalidPartOrder
+		}
+		part, ok := up.parts[p.PartNumber]
+		if !ok || part.etag != strings.Trim(p.ETag, `"`) {
+			gw.mu.Unlock()
+			return errS3InvalidPart
+		}
+		if p.PartNumber != i+1 {
+			gw.mu.Unlock()
+			return errS3PartGap
+		}
+		if i < len(complete.Parts)-1 && part.size != up.partSize {
+			gw.mu.Unlock()
+			return errS3InvalidPartSize
+		}
+		size += part.size
+		b, _ := hex.DecodeString(part.etag)
+		h.Write(b)
+	}
+	gw.mu.Unlock()
+
+	name := bucket + "/" + key
+	if size == 0 {
+		rfw, err := gw.rfs.Create(ctx, name)
+		if err != nil {
+			return err
+		}
+		if err := rfw.Close(); err != nil {
+			return err
+		}
+	} else {
+		abspath := gw.rfs.AbsPath(name)
+		_, err := up.session.Create(ctx, nil, size)
+		gw.rfs.invalidate(abspath)
+		if err != nil {
+			return errors.Wrapf(err, "upload %s", abspath)
+		}
+	}
+	gw.removeUpload(req.URL.Query().Get("uploadId"), up)
+	return s3WriteXML(w, http.StatusOK, S3CompleteMultipartUploadResult{
+		Xmlns:    s3Namespace,
+		Location: "/" + name,
+		Bucket:   bucket,
+		Key:      key,
+		ETag:     s3ETag(fmt.Sprintf("%s-%d", hex.EncodeToString(h.Sum(nil)), len(complete.Parts))),
+	})
+}
+
+// abortMultipartUpload forgets the upload and parts spooled for it
+func (gw *S3Gateway) abortMultipartUpload(w http.ResponseWriter, req *http.Request, bucket, key string) error {
+	up, err := gw.upload(req, bucket, key)
+	if err != nil {
+		return err
+	}
+	gw.removeUpload(req.URL.Query().Get("uploadId"), up)
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (gw *S3Gateway) removeUpload(uploadId string, up *s3Upload) {
+	gw.mu.Lock()
+	delete(gw.uploads, uploadId)
+	gw.mu.Unlock()
+	if err := up.session.Close(); err != nil {
+		glog.Warningf("close upload session of %s/%s: %v", up.bucket, up.key, err)
+	}
+}
@@ -0,0 +1,314 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"mypan/pkg/client"
+	"mypan/pkg/s3"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type s3Tester struct {
+	t     *testing.T
+	fc    *fakeClient
+	gw    *S3Gateway
+	creds s3.Credentials
+}
+
+func newS3Tester(t *testing.T) *s3Tester {
+	fc := newFakeClient().
+		addContent("r/b/dir/a.txt", []byte("hello")).
+		addContent("r/b/z.txt", []byte("zzz"))
+	creds := s3.Credentials{AccessKey: "ak", SecretKey: "sk"}
+	st := &s3Tester{
+		t:     t,
+		fc:    fc,
+		gw:    NewS3Gateway(NewRemoteFS(fc, "r").TmpDir(t.TempDir()), creds),
+		creds: creds,
+	}
+	return st
+}
+
+// do serves the request signed, with header set before signing
+func (st *s3Tester) do(method, target string, body []byte, header http.Header) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "http://s3.local"+target, bytes.NewReader(body))
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if st.creds.AccessKey != "" {
+		s3.Sign(req, st.creds, "us-east-1", time.Now())
+	}
+	w := httptest.NewRecorder()
+	st.gw.ServeHTTP(w, req)
+	return w
+}
+
+func (st *s3Tester) errorCode(w *httptest.ResponseRecorder) string {
+	var resp S3ErrorResponse
+	require.NoError(st.t, xml.Unmarshal(w.Body.Bytes(), &resp), w.Body.String())
+	return resp.Code
+}
+
+func TestS3GatewayAuth(t *testing.T) {
+	st := newS3Tester(t)
+	st.creds = s3.Credentials{}
+	w := st.do(http.MethodGet, "/", nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "AccessDenied", st.errorCode(w))
+
+	st.creds = s3.Credentials{AccessKey: "ak", SecretKey: "x"}
+	w = st.do(http.MethodGet, "/", nil, nil)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Equal(t, "SignatureDoesNotMatch", st.errorCode(w))
+}
+
+func TestS3GatewayList(t *testing.T) {
+	st := newS3Tester(t)
+	w := st.do(http.MethodGet, "/", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	var buckets S3ListAllMyBucketsResult
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &buckets))
+	require.Len(t, buckets.Buckets, 1)
+	assert.Equal(t, "b", buckets.Buckets[0].Name)
+
+	list := func(query string) S3ListBucketResult {
+		w := st.do(http.MethodGet, "/b?"+query, nil, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var result S3ListBucketResult
+		require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+		return result
+	}
+	keys := func(result S3ListBucketResult) []string {
+		var keys []string
+		for _, obj := range result.Contents {
+			keys = append(keys, obj.Key)
+		}
+		for _, p := range result.CommonPrefixes {
+			keys = append(keys, p.Prefix)
+		}
+		return keys
+	}
+	result := list("list-type=2&delimiter=/")
+	assert.Equal(t, []string{"z.txt", "dir/"}, keys(result))
+	assert.EqualValues(t, 3, result.Contents[0].Size)
+
+	result = list("list-type=2")
+	assert.Equal(t, []string{"dir/a.txt", "z.txt"}, keys(result))
+
+	st.fc.calls = nil
+	st.gw.rfs.invalidate(st.gw.rfs.AbsPath("b"))
+	result = list("list-type=2&max-keys=1")
+	assert.Equal(t, []string{"dir/a.txt"}, keys(result))
+	require.True(t, result.IsTruncated)
+	result = list("list-type=2&continuation-token=" + result.NextContinuationToken)
+	assert.Equal(t, []string{"z.txt"}, keys(result))
+	assert.False(t, result.IsTruncated)
+	// pages after the first reuse the listing
+	assert.Equal(t, []string{"ListEx /apps/x/r", "ListAllEx /apps/x/r/b"}, st.fc.calls)
+
+	w = st.do(http.MethodGet, "/nosuch", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "NoSuchBucket", st.errorCode(w))
+}
+
+func TestS3GatewayGet(t *testing.T) {
+	st := newS3Tester(t)
+	w := st.do(http.MethodGet, "/b/dir/a.txt", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+
+	w = st.do(http.MethodGet, "/b/dir/a.txt", nil, http.Header{"Range": {"bytes=1-2"}})
+	assert.Equal(t, http.StatusPartialContent, w.Code)
+	assert.Equal(t, "el", w.Body.String())
+
+	w = st.do(http.MethodGet, "/b/nosuch", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	assert.Equal(t, "NoSuchKey", st.errorCode(w))
+
+	// dirs only by keys ending in "/"
+	w = st.do(http.MethodGet, "/b/dir", nil, nil)
+	assert.Equal(t, http.StatusNotFound, w.Code)
+	w = st.do(http.MethodHead, "/b/dir/", nil, nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestS3GatewayPut(t *testing.T) {
+	st := newS3Tester(t)
+	sum := sha256.Sum256([]byte("world"))
+	payloadHash := http.Header{"X-Amz-Content-Sha256": {hex.EncodeToString(sum[:])}}
+
+	w := st.do(http.MethodPut, "/b/new.txt", []byte("world"), payloadHash)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, `"7d793037a0760186574b0282f2f435e7"`, w.Header().Get("ETag"))
+	assert.Equal(t, "world", string(st.fc.content["/apps/x/r/b/new.txt"]))
+
+	// body not matching the signed hash
+	w = st.do(http.MethodPut, "/b/bad.txt", []byte("World"), payloadHash)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "XAmzContentSHA256Mismatch", st.errorCode(w))
+	assert.NotContains(t, st.fc.content, "/apps/x/r/b/bad.txt")
+
+	w = st.do(http.MethodPut, "/b/md5.txt", []byte("world"), http.Header{"Content-Md5": {"AAAAAAAAAAAAAAAAAAAAAA=="}})
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "BadDigest", st.errorCode(w))
+	assert.NotContains(t, st.fc.content, "/apps/x/r/b/md5.txt")
+}
+
+func TestS3GatewayMultipart(t *testing.T) {
+	data := make([]byte, 2*client.UPLOAD_API_BLOCK_SIZE+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	part1, part2 := data[:2*client.UPLOAD_API_BLOCK_SIZE], data[2*client.UPLOAD_API_BLOCK_SIZE:]
+
+	create := func(st *s3Tester, key string) string {
+		w := st.do(http.MethodPost, "/b/"+key+"?uploads", nil, nil)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var result S3InitiateMultipartUploadResult
+		require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+		return result.UploadId
+	}
+	uploadPart := func(st *s3Tester, key, uploadId string, n int, data []byte) *httptest.ResponseRecorder {
+		return st.do(http.MethodPut, "/b/"+key+"?partNumber="+strconv.Itoa(n)+"&uploadId="+uploadId, data, nil)
+	}
+	complete := func(st *s3Tester, key, uploadId string, etags ...string) *httptest.ResponseRecorder {
+		var b strings.Builder
+		b.WriteString("<CompleteMultipartUpload>")
+		for i, etag := range etags {
+			if etag != "" {
+				b.WriteString("<Part><PartNumber>" + strconv.Itoa(i+1) + "</PartNumber><ETag>" + etag + "</ETag></Part>")
+			}
+		}
+		b.WriteString("</CompleteMultipartUpload>")
+		return st.do(http.MethodPost, "/b/"+key+"?uploadId="+uploadId, []byte(b.String()), nil)
+	}
+
+	t.Run("complete", func(t *testing.T) {
+		st := newS3Tester(t)
+		uploadId := create(st, "big.bin")
+		assert.Equal(t, []string{"ListEx /apps/x/r", "NewUploadSession /apps/x/r/b/big.bin"}, st.fc.calls)
+
+		// part 2 waits for part 1 to know where it starts
+		done := make(chan *httptest.ResponseRecorder)
+		go func() {
+			done <- uploadPart(st, "big.bin", uploadId, 2, part2)
+		}()
+		w1 := uploadPart(st, "big.bin", uploadId, 1, part1)
+		require.Equal(t, http.StatusOK, w1.Code, w1.Body.String())
+		w2 := <-done
+		require.Equal(t, http.StatusOK, w2.Code, w2.Body.String())
+
+		us := st.gw.uploads[uploadId].session.(*fakeUploadSession)
+		assert.Equal(t, data, us.data)
+
+		w := complete(st, "big.bin", uploadId, w1.Header().Get("ETag"), w2.Header().Get("ETag"))
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		var result S3CompleteMultipartUploadResult
+		require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+		assert.True(t, strings.HasSuffix(result.ETag, `-2"`), result.ETag)
+		assert.Equal(t, data, st.fc.content["/apps/x/r/b/big.bin"])
+		assert.Empty(t, st.gw.uploads)
+	})
+	t.Run("part sizes", func(t *testing.T) {
+		st := newS3Tester(t)
+		uploadId := create(st, "big.bin")
+		w := uploadPart(st, "big.bin", uploadId, 1, part1)
+		require.Equal(t, http.StatusOK, w.Code)
+		w = uploadPart(st, "big.bin", uploadId, 2, data)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "InvalidArgument", st.errorCode(w))
+
+		// parts not a multiple of block size, like 5MiB of rclone
+		uploadId = create(st, "odd.bin")
+		partSize := 5 << 20
+		var etags []string
+		for i := 0; i*partSize < len(data); i++ {
+			end := (i + 1) * partSize
+			if end > len(data) {
+				end = len(data)
+			}
+			w = uploadPart(st, "odd.bin", uploadId, i+1, data[i*partSize:end])
+			require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+			etags = append(etags, w.Header().Get("ETag"))
+		}
+		w = complete(st, "odd.bin", uploadId, etags...)
+		require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+		assert.Equal(t, data, st.fc.content["/apps/x/r/b/odd.bin"])
+	})
+	t.Run("invalid parts", func(t *testing.T) {
+		st := newS3Tester(t)
+		uploadId := create(st, "big.bin")
+		w1 := uploadPart(st, "big.bin", uploadId, 1, part1)
+		require.Equal(t, http.StatusOK, w1.Code)
+		w3 := uploadPart(st, "big.bin", uploadId, 3, part2)
+		require.Equal(t, http.StatusOK, w3.Code)
+
+		w := complete(st, "big.bin", uploadId, w1.Header().Get("ETag"), "", w3.Header().Get("ETag"))
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "InvalidPart", st.errorCode(w))
+		w = complete(st, "big.bin", uploadId, `"x"`)
+		assert.Equal(t, http.StatusBadRequest, w.Code)
+		assert.Equal(t, "InvalidPart", st.errorCode(w))
+		assert.NotContains(t, st.fc.content, "/apps/x/r/b/big.bin")
+	})
+	t.Run("abort", func(t *testing.T) {
+		st := newS3Tester(t)
+		uploadId := create(st, "big.bin")
+		w := st.do(http.MethodDelete, "/b/big.bin?uploadId="+uploadId, nil, nil)
+		assert.Equal(t, http.StatusNoContent, w.Code)
+		w = uploadPart(st, "big.bin", uploadId, 1, []byte("hello"))
+		assert.Equal(t, http.StatusNotFound, w.Code)
+		assert.Equal(t, "NoSuchUpload", st.errorCode(w))
+	})
+}
+
+func TestS3GatewayUploadExpiry(t *testing.T) {
+	st := newS3Tester(t)
+	st.gw.UploadExpiry(time.Hour)
+	w := st.do(http.MethodPost, "/b/old.bin?uploads", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	var result S3InitiateMultipartUploadResult
+	require.NoError(t, xml.Unmarshal(w.Body.Bytes(), &result))
+	st.gw.uploads[result.UploadId].used = time.Now().Add(-2 * time.Hour)
+
+	// abandoned ones are aborted as new uploads start
+	w = st.do(http.MethodPost, "/b/new.bin?uploads", nil, nil)
+	require.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Len(t, st.gw.uploads, 1)
+	assert.NotContains(t, st.gw.uploads, result.UploadId)
+	w = st.do(http.MethodPut, "/b/old.bin?partNumber=1&uploadId="+result.UploadId, []byte("hello"), nil)
+	assert.Equal(t, "NoSuchUpload", st.errorCode(w))
+}
+
+func TestS3ContentLength(t *testing.T) {
+	req := httptest.NewRequest(http.MethodPut, "/b/k", io.LimitReader(strings.NewReader("hello"), 5))
+	_, err := s3ContentLength(req)
+	assert.Equal(t, errS3MissingContentLength, err)
+
+	req.ContentLength = 5
+	n, err := s3ContentLength(req)
+	require.NoError(t, err)
+	assert.EqualValues(t, 5, n)
+
+	req.Header.Set("X-Amz-Content-Sha256", s3.StreamingSignedPayload)
+	_, err = s3ContentLength(req)
+	assert.Equal(t, errS3MissingContentLength, err)
+	req.Header.Set("X-Amz-Decoded-Content-Length", "3")
+	n, err = s3ContentLength(req)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+}
@@ -0,0 +1,83 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/golang/glog"
+)
+
+// BasicAuth requires requests to h to carry user and password.  h is
+// returned as is if user is empty
+func BasicAuth(h http.Handler, user, password string) http.Handler {
+	if user == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		u, p, ok := req.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(u), []byte(user)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(p), []byte(password)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Basic realm="mypan"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// BearerAuth requires requests to h to carry token in Authorization header
+// as "Bearer TOKEN".  h is returned as is if token is empty
+func BearerAuth(h http.Handler, token string) http.Handler {
+	if token == "" {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// auth scheme is case insensitive
+		scheme, got, ok := strings.Cut(req.Header.Get("Authorization"), " ")
+		if !ok || !strings.EqualFold(scheme, "Bearer") ||
+			subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="mypan"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+// isLoopbackAddr tells whether listening on addr is reachable only from
+// the local host.  Empty host is for all interfaces
+func isLoopbackAddr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil || host == "" {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ListenAndServe serves h on addr until ctx is done
+func ListenAndServe(ctx context.Context, name, addr string, h http.Handler) error {
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: h,
+	}
+	go func() {
+		<-ctx.Done()
+		srv.Close()
+	}()
+	glog.Infof("%s: listening on %s", name, addr)
+	if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
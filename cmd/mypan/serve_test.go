@@ -0,0 +1,56 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBearerAuth(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {})
+	h := BearerAuth(ok, "secret")
+	for auth, want := range map[string]int{
+		"Bearer secret":  http.StatusOK,
+		"bearer secret":  http.StatusOK,
+		"secret":         http.StatusUnauthorized,
+		"Basic secret":   http.StatusUnauthorized,
+		"Bearer secret1": http.StatusUnauthorized,
+		"Bearer ":        http.StatusUnauthorized,
+		"":               http.StatusUnauthorized,
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if auth != "" {
+			req.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		assert.Equal(t, want, w.Code, auth)
+		if want == http.StatusUnauthorized {
+			assert.Equal(t, `Bearer realm="mypan"`, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	BearerAuth(ok, "").ServeHTTP(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestIsLoopbackAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"127.0.0.1:8080": true,
+		"localhost:8080": true,
+		"[::1]:8080":     true,
+		":8080":          false,
+		"0.0.0.0:8080":   false,
+		"10.0.0.1:8080":  false,
+		"8080":           false,
+	} {
+		assert.Equal(t, want, isLoopbackAddr(addr), addr)
+	}
+}
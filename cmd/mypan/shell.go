@@ -0,0 +1,655 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"mypan/pkg/client"
+	"mypan/pkg/util"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+	"golang.org/x/term"
+)
+
+// shellWord is a word of command line and where it is in the line
+type shellWord struct {
+	start int
+	end   int
+	value string
+}
+
+// shellSplit splits line into words.  Quotes and backslash escapes are
+// handled as in sh, without expansions.  Words parsed so far are returned
+// with the error of an unterminated quote
+func shellSplit(line string) ([]shellWord, error) {
+	var (
+		words  []shellWord
+		word   strings.Builder
+		start  = -1
+		quote  byte
+		escape bool
+	)
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case escape:
+			word.WriteByte(c)
+			escape = false
+			continue
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else if c == '\\' && quote == '"' {
+				escape = true
+			} else {
+				word.WriteByte(c)
+			}
+			continue
+		case c == ' ' || c == '\t':
+			if start >= 0 {
+				words = append(words, shellWord{start: start, end: i, value: word.String()})
+				word.Reset()
+				start = -1
+			}
+			continue
+		}
+		if start < 0 {
+			start = i
+		}
+		switch c {
+		case '\\':
+			escape = true
+		case '\'', '"':
+			quote = c
+		default:
+			word.WriteByte(c)
+		}
+	}
+	if start >= 0 {
+		words = append(words, shellWord{start: start, end: len(line), value: word.String()})
+	}
+	if quote != 0 {
+		return words, errors.New("unterminated quote")
+	}
+	return words, nil
+}
+
+// shellEscape escapes s to be a single word of command line
+func shellEscape(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case ' ', '\t', '\\', '\'', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+type shellCommand struct {
+	usage string
+	// args tells how each argument is completed.  The last one is for
+	// the rest
+	args []int
+	run  func(ctx context.Context, args []string) error
+}
+
+func (cmd shellCommand) argKind(i int) int {
+	return pathArgKind(cmd.args, i)
+}
+
+// Shell reads commands from stdin and runs them against remote with a
+// current remote dir.  Remote dir listings are cached for tab completion
+// and dropped on changes made through it.  Paths are plaintext when names
+// are encrypted, and mapped to the ones on server by cryptMan of myApp
+type Shell struct {
+	myApp       MyApp
+	rfs         *RemoteFS
+	cwd         string
+	home        string
+	term        *term.Terminal
+	historyFile string
+
+	commands map[string]shellCommand
+}
+
+func NewShell(myApp MyApp) *Shell {
+	dstClient := myApp.dstClient
+	home := path.Clean(dstClient.AbsPath(""))
+	sh := &Shell{
+		myApp: myApp,
+		rfs:   NewRemoteFS(dstClient, "/").TmpDir(myApp.tmpDir),
+		cwd:   home,
+		home:  home,
+	}
+	sh.commands = map[string]shellCommand{
+		"cd":   {"cd [remotedir]", []int{pathArgRemoteDir}, sh.cd},
+		"pwd":  {"pwd", nil, sh.pwd},
+		"ls":   {"ls [remotepath]", []int{pathArgRemote}, sh.ls},
+		"lcd":  {"lcd [localdir]", []int{pathArgLocalDir}, sh.lcd},
+		"lpwd": {"lpwd", nil, sh.lpwd},
+		"get":  {"get remotepath [localpath]", []int{pathArgRemote, pathArgLocal}, sh.get},
+		"put":  {"put localpath [remotepath]", []int{pathArgLocal, pathArgRemote}, sh.put},
+		"rm":   {"rm remotepath...", []int{pathArgRemote}, sh.rm},
+		"mv":   {"mv remotepath0 remotepath1 | remotepath... remotedir", []int{pathArgRemote}, sh.mv},
+		"help": {"help", nil, sh.help},
+		"exit": {"exit", nil, nil},
+	}
+	return sh
+}
+
+// HistoryFile sets where lines entered are kept across runs
+func (sh *Shell) HistoryFile(historyFile string) *Shell {
+	sh.historyFile = historyFile
+	return sh
+}
+
+// abspath returns remote path of p relative to the current dir
+func (sh *Shell) abspath(p string) string {
+	if strings.HasPrefix(p, "/") {
+		return path.Clean(p)
+	}
+	return path.Join(sh.cwd, p)
+}
+
+// remotePath returns path on server of abspath p
+func (sh *Shell) remotePath(p string) string {
+	return sh.myApp.cryptMan.RemotePath(p)
+}
+
+// globMan expands patterns of plaintext paths
+func (sh *Shell) globMan() *GlobMan {
+	return NewGlobMan(sh.myApp.dstClient).Crypt(sh.myApp.cryptMan)
+}
+
+func (sh *Shell) prompt() string {
+	return fmt.Sprintf("mypan:%s> ", sh.cwd)
+}
+
+// Run reads and runs commands until exit or end of input.  Line editing,
+// history and tab completion are available when stdin is a terminal
+func (sh *Shell) Run() error {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			if sh.exec(scanner.Text()) {
+				return nil
+			}
+		}
+		return scanner.Err()
+	}
+	tio := &shellTermIO{
+		in:  shellInput{os.Stdin},
+		out: os.Stdout,
+	}
+	sh.term = term.NewTerminal(tio, "")
+	sh.term.AutoCompleteCallback = sh.complete
+	sh.loadHistory(tio)
+	for {
+		line, err := sh.readLine(fd)
+		if err == io.EOF {
+			fmt.Println()
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if sh.historyFile != "" && strings.TrimSpace(line) != "" {
+			if err := appendShellHistory(sh.historyFile, line); err != nil {
+				glog.Warningf("save shell history: %v", err)
+			}
+		}
+		if sh.exec(line) {
+			return nil
+		}
+	}
+}
+
+// shellHistorySize is how many lines of history are kept, as many as
+// term.Terminal keeps
+const shellHistorySize = 100
+
+// loadHistory reads lines of history through the terminal, which is how
+// they get into history of term.Terminal.  The history file is trimmed to
+// the lines loaded
+func (sh *Shell) loadHistory(tio *shellTermIO) {
+	if sh.historyFile == "" {
+		return
+	}
+	lines, err := readShellHistory(sh.historyFile)
+	if err != nil {
+		glog.Warningf("load shell history: %v", err)
+		return
+	}
+	if len(lines) == 0 {
+		return
+	}
+	tio.history = strings.NewReader(strings.Join(lines, "\r") + "\r")
+	for range lines {
+		if _, err := sh.term.ReadLine(); err != nil {
+			break
+		}
+	}
+	tio.history = nil
+	if err := writeShellHistory(sh.historyFile, lines); err != nil {
+		glog.Warningf("save shell history: %v", err)
+	}
+}
+
+// readShellHistory returns the last lines of history in file.  Lines with
+// control characters are left out as they would be taken as keys
+func readShellHistory(file string) ([]string, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var lines []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" || strings.IndexFunc(line, unicode.IsControl) >= 0 {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) > shellHistorySize {
+		lines = lines[len(lines)-shellHistorySize:]
+	}
+	return lines, nil
+}
+
+func writeShellHistory(file string, lines []string) error {
+	if err := util.MkdirAll(filepath.Dir(file)); err != nil {
+		return err
+	}
+	return os.WriteFile(file, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+}
+
+func appendShellHistory(file, line string) error {
+	if err := util.MkdirAll(filepath.Dir(file)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(f, line)
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+// shellTermIO is input and output of the terminal.  History, if not nil,
+// is read instead of input, with output discarded
+type shellTermIO struct {
+	history io.Reader
+	in      io.Reader
+	out     io.Writer
+}
+
+func (tio *shellTermIO) Read(p []byte) (int, error) {
+	if tio.history != nil {
+		return tio.history.Read(p)
+	}
+	return tio.in.Read(p)
+}
+
+func (tio *shellTermIO) Write(p []byte) (int, error) {
+	if tio.history != nil {
+		return len(p), nil
+	}
+	return tio.out.Write(p)
+}
+
+// shellInput reads "\n" as "\r".  Input typed ahead while commands run in
+// normal mode has line ends translated
+type shellInput struct {
+	r io.Reader
+}
+
+func (si shellInput) Read(p []byte) (int, error) {
+	n, err := si.r.Read(p)
+	for i := range p[:n] {
+		if p[i] == '\n' {
+			p[i] = '\r'
+		}
+	}
+	return n, err
+}
+
+// readLine reads a line in raw mode.  Commands run in normal mode for their
+// output to be rendered as usual
+func (sh *Shell) readLine(fd int) (string, error) {
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(fd, state)
+	if width, height, err := term.GetSize(fd); err == nil && width > 0 {
+		sh.term.SetSize(width, height)
+	}
+	sh.term.SetPrompt(sh.prompt())
+	return sh.term.ReadLine()
+}
+
+// exec runs command line and tells whether the shell should exit
+func (sh *Shell) exec(line string) bool {
+	words, err := shellSplit(line)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return false
+	}
+	if len(words) == 0 {
+		return false
+	}
+	name := words[0].value
+	args := make([]string, len(words)-1)
+	for i, w := range words[1:] {
+		args[i] = w.value
+	}
+	if name == "exit" || name == "quit" {
+		return true
+	}
+	cmd, ok := sh.commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "%s: unknown command, try help\n", name)
+		return false
+	}
+	// interrupt cancels the command, not the shell
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := cmd.run(ctx, args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", name, err)
+	}
+	return false
+}
+
+func (sh *Shell) help(ctx context.Context, args []string) error {
+	var names []string
+	for name := range sh.commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Println(sh.commands[name].usage)
+	}
+	return nil
+}
+
+func (sh *Shell) cd(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("too many arguments")
+	}
+	dir := sh.home
+	if len(args) == 1 {
+		dir = sh.abspath(args[0])
+	}
+	info, err := sh.rfs.Stat(ctx, sh.remotePath(dir))
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return errors.Errorf("%s: not a dir", dir)
+	}
+	sh.cwd = dir
+	return nil
+}
+
+func (sh *Shell) pwd(ctx context.Context, args []string) error {
+	fmt.Println(sh.cwd)
+	return nil
+}
+
+func (sh *Shell) ls(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("too many arguments")
+	}
+	dir := sh.cwd
+	if len(args) == 1 {
+		dir = sh.abspath(args[0])
+	}
+	resp, err := sh.myApp.dstClient.ListEx(ctx, sh.remotePath(dir))
+	if err != nil {
+		return err
+	}
+	sh.myApp.render.Render(sh.plainList(resp))
+	return nil
+}
+
+// plainList returns resp with names and sizes in plaintext
+func (sh *Shell) plainList(resp client.ListResponse) client.ListResponse {
+	cryptMan := sh.myApp.cryptMan
+	if cryptMan == nil {
+		return resp
+	}
+	for i := range resp.List {
+		ent := &resp.List[i]
+		ent.Path = cryptMan.PlainPath(ent.Path)
+		ent.ServerFilename = path.Base(ent.Path)
+		if ent.IsDir == 0 {
+			ent.Size = uint64(cryptMan.PlainSize(int64(ent.Size)))
+		}
+	}
+	return resp
+}
+
+func (sh *Shell) lcd(ctx context.Context, args []string) error {
+	if len(args) > 1 {
+		return errors.New("too many arguments")
+	}
+	if len(args) == 1 {
+		return os.Chdir(args[0])
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return err
+	}
+	return os.Chdir(home)
+}
+
+func (sh *Shell) lpwd(ctx context.Context, args []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	fmt.Println(wd)
+	return nil
+}
+
+// get downloads remotepath, which may have glob patterns, to localpath or
+// into it if it's a dir
+func (sh *Shell) get(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("remotepath and optional localpath arguments are required")
+	}
+	local := "."
+	if len(args) == 2 {
+		local = args[1]
+	}
+	myApp := sh.myApp
+	matches, err := sh.globMan().Expand(ctx, sh.abspath(args[0]))
+	if err != nil {
+		return err
+	}
+	intoDir := len(matches) > 1
+	if fi, err := os.Stat(local); err == nil && fi.IsDir() {
+		intoDir = true
+	}
+	downMan := NewDownMan(myApp.dstClient).
+		Crypt(myApp.cryptMan).
+		Progress(myApp.progressMaker)
+	myApp.progressRender()
+	defer myApp.progreseStop()
+	for _, m := range matches {
+		outpath := local
+		if intoDir {
+			outpath = filepath.Join(local, filepath.FromSlash(m.Sub))
+		}
+		if err := downMan.Down(ctx, m.Path, outpath); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// put uploads file localpath to remotepath or into it if it's a dir
+func (sh *Shell) put(ctx context.Context, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errors.New("localpath and optional remotepath arguments are required")
+	}
+	local := args[0]
+	if fi, err := os.Stat(local); err != nil {
+		return err
+	} else if fi.IsDir() {
+		return errors.Errorf("%s: is a dir, try syncup", local)
+	}
+	dst := sh.cwd
+	if len(args) == 2 {
+		dst = sh.abspath(args[1])
+	}
+	if info, err := sh.rfs.Stat(ctx, sh.remotePath(dst)); err == nil && info.IsDir() {
+		dst = path.Join(dst, filepath.Base(local))
+	}
+	defer sh.rfs.invalidate(sh.remotePath(dst))
+	myApp := sh.myApp
+	myApp.progressRender()
+	defer myApp.progreseStop()
+	_, err := myApp.upload(myApp.trackerCtx(ctx, local), local, dst, client.ONDUP_OVERWRITE)
+	return err
+}
+
+func (sh *Shell) rm(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errors.New("remotepath arguments are required")
+	}
+	patterns := make([]string, len(args))
+	for i, arg := range args {
+		patterns[i] = sh.abspath(arg)
+	}
+	matches, err := sh.globMan().ExpandAll(ctx, patterns)
+	if err != nil {
+		return err
+	}
+	paths := globMatchPaths(matches)
+	for i, p := range paths {
+		paths[i] = sh.remotePath(p)
+		defer sh.rfs.invalidate(paths[i])
+	}
+	_, err = sh.myApp.dstClient.DeleteMulti(ctx, paths)
+	return err
+}
+
+func (sh *Shell) mv(ctx context.Context, args []string) error {
+	if len(args) < 2 {
+		return errors.New("remotepath0 and remotepath1 arguments are required")
+	}
+	paths := make([]string, len(args))
+	for i, arg := range args {
+		paths[i] = sh.abspath(arg)
+	}
+	pairs, err := copyMovePairs(ctx, sh.globMan(), paths)
+	if err != nil {
+		return err
+	}
+	for i, pair := range pairs {
+		pairs[i] = [2]string{sh.remotePath(pair[0]), sh.remotePath(pair[1])}
+		defer sh.rfs.invalidate(pairs[i][0])
+		defer sh.rfs.invalidate(pairs[i][1])
+	}
+	_, err = sh.myApp.dstClient.MoveMulti(ctx, pairs)
+	return err
+}
+
+// complete completes the word before pos on tab
+func (sh *Shell) complete(line string, pos int, key rune) (string, int, bool) {
+	if key != '\t' {
+		return "", 0, false
+	}
+	prefix := line[:pos]
+	words, _ := shellSplit(prefix)
+	cur := shellWord{start: pos, end: pos}
+	if n := len(words); n > 0 && words[n-1].end == pos {
+		cur = words[n-1]
+		words = words[:n-1]
+	}
+
+	var candidates []string
+	if len(words) == 0 {
+		for name := range sh.commands {
+			if strings.HasPrefix(name, cur.value) {
+				candidates = append(candidates, name)
+			}
+		}
+	} else if cmd, ok := sh.commands[words[0].value]; ok {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		candidates = completePath(cmd.argKind(len(words)-1), cur.value, func(dir string) ([]pathEntry, error) {
+			infos, err := sh.rfs.ReadDir(ctx, sh.remotePath(sh.abspath(dir)))
+			if err != nil {
+				return nil, err
+			}
+			ents := make([]pathEntry, len(infos))
+			for i, info := range infos {
+				name, _ := sh.myApp.cryptMan.PlainName(info.Name())
+				ents[i] = pathEntry{name: name, isDir: info.IsDir()}
+			}
+			return ents, nil
+		})
+	}
+	if len(candidates) == 0 {
+		return "", 0, false
+	}
+	sort.Strings(candidates)
+	common := candidates[0]
+	for _, c := range candidates[1:] {
+		common = commonPrefix(common, c)
+	}
+	if common == cur.value && len(candidates) > 1 {
+		// nothing to add, show what are there
+		names := make([]string, len(candidates))
+		for i, c := range candidates {
+			names[i] = c[strings.LastIndexByte(strings.TrimSuffix(c, "/"), '/')+1:]
+		}
+		fmt.Fprintf(sh.term, "%s\n", strings.Join(names, "  "))
+		return "", 0, false
+	}
+	escaped := shellEscape(common)
+	if len(candidates) == 1 && !strings.HasSuffix(common, "/") {
+		escaped += " "
+	}
+	newLine := line[:cur.start] + escaped + line[pos:]
+	return newLine, cur.start + len(escaped), true
+}
+
+func commonPrefix(a, b string) string {
+	i := 0
+	for i < len(a) && i < len(b) && a[i] == b[i] {
+		i++
+	}
+	// keep runes whole
+	for i > 0 && i < len(a) && !utf8.RuneStart(a[i]) {
+		i--
+	}
+	return a[:i]
+}
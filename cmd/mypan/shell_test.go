@@ -0,0 +1,121 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"mypan/pkg/crypt"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/term"
+)
+
+func TestShellSplit(t *testing.T) {
+	words, err := shellSplit(`  get "my file.txt" a\ b 'c"d' e`)
+	require.NoError(t, err)
+	var values []string
+	for _, w := range words {
+		values = append(values, w.value)
+	}
+	assert.Equal(t, []string{"get", "my file.txt", "a b", `c"d`, "e"}, values)
+	assert.Equal(t, shellWord{start: 2, end: 5, value: "get"}, words[0])
+	assert.Equal(t, shellWord{start: 6, end: 19, value: "my file.txt"}, words[1])
+
+	words, err = shellSplit(`cd "my d`)
+	assert.Error(t, err)
+	require.Len(t, words, 2)
+	assert.Equal(t, shellWord{start: 3, end: 8, value: "my d"}, words[1])
+
+	for _, s := range []string{`a b`, `it's`, `back\slash`, `"q"`} {
+		words, err := shellSplit(shellEscape(s))
+		require.NoError(t, err)
+		require.Len(t, words, 1)
+		assert.Equal(t, s, words[0].value)
+	}
+}
+
+func TestShellCryptNames(t *testing.T) {
+	ctx := context.Background()
+	cipher, err := crypt.NewCipherFromKey(bytes.Repeat([]byte{1}, 32))
+	require.NoError(t, err)
+	enc := func(p string) string {
+		return "/apps/x/" + cipher.EncryptPath(p)
+	}
+	fc := newFakeClient()
+	fc.add(cipher.EncryptPath("docs/a.txt"), 10)
+	fc.add(cipher.EncryptPath("docs/b.txt"), 10)
+	sh := NewShell(MyApp{
+		dstClient: fc,
+		cryptMan:  NewCryptMan(fc, cipher).EncryptNames(true),
+	})
+
+	require.NoError(t, sh.cd(ctx, []string{"docs"}))
+	assert.Equal(t, "/apps/x/docs", sh.cwd)
+	assert.Error(t, sh.cd(ctx, []string{"nosuch"}))
+
+	line, pos, ok := sh.complete("rm a", 4, '\t')
+	require.True(t, ok)
+	assert.Equal(t, "rm a.txt ", line)
+	assert.Equal(t, 9, pos)
+
+	resp, err := fc.ListEx(ctx, enc("docs"))
+	require.NoError(t, err)
+	resp = sh.plainList(resp)
+	require.Len(t, resp.List, 2)
+	assert.Equal(t, "/apps/x/docs/a.txt", resp.List[0].Path)
+	assert.Equal(t, "a.txt", resp.List[0].ServerFilename)
+
+	fc.calls = nil
+	require.NoError(t, sh.rm(ctx, []string{"a*"}))
+	require.NoError(t, sh.mv(ctx, []string{"b.txt", "/apps/x/c.txt"}))
+	assert.Equal(t, []string{
+		"ListEx " + enc("docs"),
+		"DeleteMulti " + enc("docs/a.txt"),
+		"MoveMulti " + enc("docs/b.txt") + ">" + enc("c.txt"),
+	}, fc.calls)
+}
+
+func TestShellHistory(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "shell_history")
+	var b strings.Builder
+	for i := 0; i < 150; i++ {
+		fmt.Fprintf(&b, "ls %d\n", i)
+	}
+	b.WriteString("ls \x1b\n\n")
+	require.NoError(t, os.WriteFile(file, []byte(b.String()), 0600))
+
+	sh := NewShell(MyApp{dstClient: newFakeClient()}).HistoryFile(file)
+	var out bytes.Buffer
+	tio := &shellTermIO{
+		// up twice then enter
+		in:  strings.NewReader("\x1b[A\x1b[A\r"),
+		out: &out,
+	}
+	sh.term = term.NewTerminal(tio, "")
+	sh.loadHistory(tio)
+	line, err := sh.term.ReadLine()
+	require.NoError(t, err)
+	assert.Equal(t, "ls 148", line)
+	assert.NotContains(t, out.String(), "ls 120")
+
+	// trimmed to lines loaded
+	lines, err := readShellHistory(file)
+	require.NoError(t, err)
+	require.Len(t, lines, shellHistorySize)
+	assert.Equal(t, "ls 50", lines[0])
+
+	require.NoError(t, appendShellHistory(file, "pwd"))
+	lines, err = readShellHistory(file)
+	require.NoError(t, err)
+	assert.Equal(t, "pwd", lines[len(lines)-1])
+	assert.Equal(t, "ls 51", lines[0])
+}
@@ -5,11 +5,9 @@ package main
 
 import (
 	"context"
-	"crypto/md5"
-	"encoding/hex"
 	"fmt"
-	"io"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
@@ -21,7 +19,6 @@ import (
 	"mypan/pkg/util"
 
 	"github.com/golang/glog"
-	"github.com/jedib0t/go-pretty/progress"
 	"github.com/pkg/errors"
 )
 
@@ -46,7 +43,7 @@ func ErrIsNotExist(err error) bool {
 }
 
 type CacheSetterI interface {
-	SetDst(dstAbsPath, dstMd5, srcMd5 string, size int64)
+	SetDst(dstAbsPath, dstMd5, srcMd5, plainMd5 string, size int64)
 }
 
 type Src interface {
@@ -113,18 +110,20 @@ type SrcClient interface {
 
 type SrcCacheEntryI interface {
 	Md5() string
+	EncMd5() string
 }
 
 type DstCacheEntryI interface {
 	DstMd5() string
 	SrcMd5() string
+	PlainMd5() string
 	Size() int64
 }
 
 type DstClient interface {
 	New(ctx context.Context, path string) (Dst, error)
 	List(ctx context.Context, dst Dst) (DstList, error)
-	Up(ctx context.Context, src Src, path string) (client.UploadResponse, error)
+	Up(ctx context.Context, src Src, path string) (UpResult, error)
 	Down(ctx context.Context, dst Dst, path string) error
 	Delete(ctx context.Context, dst Dst) error
 }
@@ -140,14 +139,22 @@ type Sync struct {
 	srcCacheStore *store.FileCacheStore
 	dstCacheStore *store.FileCacheStore
 	cacheSetter   CacheSetterI
+	cryptMan      *CryptMan
+	chunkMan      *ChunkMan
 
-	progress   progress.Writer
+	progress   ProgressMaker
+	events     *EventWriter
 	parallelDo *util.ParallelDo
+	stats      *SyncStats
+	plan       []syncPlanItem
 
 	up        bool
+	remote    bool
+	dstLocal  bool
 	dryrun    bool
 	nodelete  bool
 	continue_ bool
+	excludes  []string
 }
 
 func NewSyncUp(
@@ -188,6 +195,45 @@ func NewSyncDown(
 	return su
 }
 
+// NewSyncRemote returns a Sync mirroring remote dir src to remote dir dst.
+// Files are compared by md5 and size, and copied on server side.  Names and
+// content are taken as they are stored, without encryption
+func NewSyncRemote(
+	src, dst string,
+	client client.ClientI,
+	opts ...SyncOpt,
+) *Sync {
+	su := newSync(
+		src,
+		dst,
+		client,
+		nil,
+		nil,
+		opts...,
+	)
+	su.up = true
+	su.remote = true
+	dcr := NewDstClientRemote(client, nil, nil, nil)
+	scr := NewSrcClientRemote(dcr)
+	su.srcClient = scr
+	su.dstClient = dcr
+	if su.dryrun {
+		su.srcClient = SrcClientRemoteReadOnly{scr}
+		su.dstClient = DstClientRemoteReadOnly{dcr}
+	}
+	return su
+}
+
+// remotePathsOverlap tells whether one of absolute remote paths a, b is the
+// same as or under the other
+func remotePathsOverlap(a, b string) bool {
+	a, b = path.Clean(a), path.Clean(b)
+	under := func(p, dir string) bool {
+		return p == dir || strings.HasPrefix(p, strings.TrimSuffix(dir, "/")+"/")
+	}
+	return under(a, b) || under(b, a)
+}
+
 func newSync(
 	src, dst string,
 	client client.ClientI,
@@ -198,15 +244,11 @@ func newSync(
 	cacheSetter := NewCacheSetter(dstCacheStore)
 	downMan := NewDownMan(client).CacheSetter(cacheSetter)
 
-	srcClient := SrcClientLocal{}
-	dstClient := NewDstClientRemote(client, downMan)
 	su := &Sync{
 		client: client,
 
-		src:       src,
-		dst:       dst,
-		srcClient: srcClient,
-		dstClient: dstClient,
+		src: src,
+		dst: dst,
 
 		srcCacheStore: srcCacheStore,
 		dstCacheStore: dstCacheStore,
@@ -215,16 +257,70 @@ func newSync(
 	for _, opt := range opts {
 		opt(su)
 	}
+	srcClient := SrcClientLocal{}
+	dstClient := NewDstClientRemote(client, downMan, su.cryptMan, su.chunkMan)
+	su.srcClient = srcClient
+	su.dstClient = dstClient
 	if su.dryrun {
 		su.srcClient = SrcClientLocalReadOnly{srcClient}
 		su.dstClient = DstClientRemoteReadOnly{dstClient}
 	}
+	if su.dstLocal {
+		if abspath, err := filepath.Abs(dst); err == nil {
+			su.dst = abspath
+		}
+		dcl := NewDstClientLocalDir(srcCacheStore)
+		su.dstClient = dcl
+		if su.dryrun {
+			su.dstClient = DstClientLocalDirReadOnly{dcl}
+		}
+	}
+	su.stats = NewSyncStats(su.progress)
+	// not Parallel(su.parallelDo), downloads are already run with it as
+	// planned transfers
 	downMan.Continue(su.continue_)
-	downMan.Progress(su.progress)
-	downMan.Parallel(su.parallelDo)
+	downMan.Crypt(su.cryptMan)
+	downMan.Progress(su.stats.ProgressMaker())
 	return su
 }
 
+// syncPlanItem is an action decided in the planning pass.  Transfers are run
+// with parallelDo
+type syncPlanItem struct {
+	action   string
+	path     string
+	size     int64
+	cause    string
+	transfer bool
+	do       func(ctx context.Context) error
+
+	// local, remote are paths of the entry on both sides, whether it
+	// exists or not
+	local  string
+	remote string
+}
+
+const (
+	syncCauseAbsentOnDst = "absent on dst"
+	syncCauseAbsentOnSrc = "absent on src"
+)
+
+const (
+	DiffStatusAdded    = "added"
+	DiffStatusRemoved  = "removed"
+	DiffStatusModified = "modified"
+)
+
+// DiffEntry is a file differing between local and remote.  Added ones exist
+// only locally, removed ones only remotely
+type DiffEntry struct {
+	Status string `json:"status"`
+	Local  string `json:"local"`
+	Remote string `json:"remote"`
+	Size   int64  `json:"size"`
+	Cause  string `json:"cause"`
+}
+
 type SyncOpt func(*Sync)
 
 func DryRun(dryrun bool) SyncOpt {
@@ -245,12 +341,20 @@ func Continue() SyncOpt {
 	}
 }
 
-func Progress(progress progress.Writer) SyncOpt {
+func Progress(progress ProgressMaker) SyncOpt {
 	return func(su *Sync) {
 		su.progress = progress
 	}
 }
 
+// Events makes sync emit an event for each upload, download, delete
+// decision
+func Events(events *EventWriter) SyncOpt {
+	return func(su *Sync) {
+		su.events = events
+	}
+}
+
 func Parallel(n int) SyncOpt {
 	return func(su *Sync) {
 		su.parallelDo = util.NewParallelDo(n,
@@ -259,7 +363,45 @@ func Parallel(n int) SyncOpt {
 	}
 }
 
+// Exclude skips src and dst entries with names matching any of the glob
+// patterns.  Excluded entries are neither transferred nor deleted
+func Exclude(patterns []string) SyncOpt {
+	return func(su *Sync) {
+		su.excludes = append(su.excludes, patterns...)
+	}
+}
+
+// Encrypt enables client side encryption of remote content
+func Encrypt(cryptMan *CryptMan) SyncOpt {
+	return func(su *Sync) {
+		su.cryptMan = cryptMan
+	}
+}
+
+// DstLocalDir makes dst a local dir instead of a remote one
+func DstLocalDir() SyncOpt {
+	return func(su *Sync) {
+		su.dstLocal = true
+	}
+}
+
+// Chunk enables uploading files over the per-file size limit as chunks
+func Chunk(chunkMan *ChunkMan) SyncOpt {
+	return func(su *Sync) {
+		su.chunkMan = chunkMan
+	}
+}
+
 func (su *Sync) Do(ctx context.Context) error {
+	if err := su.Plan(ctx); err != nil {
+		return err
+	}
+	return su.execute(ctx)
+}
+
+// Plan compares src and dst, and decides actions to take without taking
+// them
+func (su *Sync) Plan(ctx context.Context) error {
 	var (
 		src     Src
 		dst     Dst
@@ -273,7 +415,7 @@ func (su *Sync) Do(ctx context.Context) error {
 		return err
 	}
 	if src != nil {
-		srcList, err = su.srcClient.List(ctx, src)
+		srcList, err = su.listSrc(ctx, src)
 		if err != nil {
 			return err
 		}
@@ -293,19 +435,91 @@ func (su *Sync) Do(ctx context.Context) error {
 			return fmt.Errorf("src, dst isdir attr do not match: %v vs. %v", srcIsDir, dstIsDir)
 		}
 	}
+	// copy the whole tree at once
+	if su.remote && src != nil && dst == nil {
+		su.copySrc(src, su.dst, syncCauseAbsentOnDst)
+		return nil
+	}
 	// get dstList if available
 	if dst != nil {
-		dstList, err = su.dstClient.List(ctx, dst)
+		dstList, err = su.listDst(ctx, dst)
 		if err != nil {
 			return err
 		}
 	}
-	if err := su.sync(ctx, srcList, dstList); err != nil {
-		return err
+	return su.sync(ctx, srcList, dstList)
+}
+
+func (su *Sync) execute(ctx context.Context) error {
+	su.stats.Start(su.plan)
+	defer su.stats.Finish()
+	for _, item := range su.plan {
+		item := item
+		do := func(ctx context.Context) error {
+			err := item.do(ctx)
+			su.stats.Done(item, err)
+			return err
+		}
+		var err error
+		if item.transfer {
+			err = util.TryParallelDo(ctx, su.parallelDo, do)
+		} else {
+			err = do(ctx)
+		}
+		if err != nil {
+			if joinErr := util.TryParallelJoin(ctx, su.parallelDo); joinErr != nil {
+				return util.NewMultiError(err, joinErr)
+			}
+			return err
+		}
 	}
 	return util.TryParallelJoin(ctx, su.parallelDo)
 }
 
+// Summary returns counts and bytes of actions taken
+func (su *Sync) Summary() SyncSummary {
+	return su.stats.Summary()
+}
+
+func (su *Sync) listSrc(ctx context.Context, src Src) (SrcList, error) {
+	srcList, err := su.srcClient.List(ctx, src)
+	if err != nil || len(su.excludes) == 0 {
+		return srcList, err
+	}
+	var ret SrcList
+	for _, src := range srcList {
+		if !su.excluded(src) {
+			ret = append(ret, src)
+		}
+	}
+	return ret, nil
+}
+
+func (su *Sync) listDst(ctx context.Context, dst Dst) (DstList, error) {
+	dstList, err := su.dstClient.List(ctx, dst)
+	if err != nil || len(su.excludes) == 0 {
+		return dstList, err
+	}
+	var ret DstList
+	for _, dst := range dstList {
+		if !su.excluded(dst) {
+			ret = append(ret, dst)
+		}
+	}
+	return ret, nil
+}
+
+func (su *Sync) excluded(o OrderI) bool {
+	name := o.Name()
+	for _, pattern := range su.excludes {
+		if ok, _ := filepath.Match(pattern, name); ok {
+			glog.V(config.VerboseOn).Infof("exclude %q: matches %q", name, pattern)
+			return true
+		}
+	}
+	return false
+}
+
 func (su *Sync) sync(
 	ctx context.Context,
 	srcList SrcList,
@@ -334,11 +548,11 @@ func (su *Sync) sync(
 		if srcIsDir {
 			if dstIsDir {
 				if namei == namej {
-					srclist1, err := su.srcClient.List(ctx, src1)
+					srclist1, err := su.listSrc(ctx, src1)
 					if err != nil {
 						return err
 					}
-					dstlist1, err := su.dstClient.List(ctx, dst1)
+					dstlist1, err := su.listDst(ctx, dst1)
 					if err != nil {
 						return err
 					}
@@ -365,30 +579,13 @@ func (su *Sync) sync(
 			} else {
 				// cmp
 				if namei == namej {
-					updateCause := ""
-					ent := su.getOrSetDstCacheEntry(ctx, dst1.AbsPath())
-					if ent == nil {
-						updateCause = "no cache"
-					} else {
-						if src1.Size() != dst1.Size() {
-							updateCause = "local size != remote's"
-						}
-						if src1.Size() != ent.Size() {
-							updateCause = "local size != cache's"
-						}
-						if dst1.Md5() != ent.DstMd5() {
-							updateCause = "remote md5 != cache's"
-						}
-						sce := su.getOrSetSrcCacheEntry(ctx, src1.AbsPath())
-						if sce == nil || sce.Md5() != ent.SrcMd5() {
-							updateCause = "local md5 != cache's"
-						}
-					}
+					updateCause := su.updateCause(ctx, src1, dst1)
 					if updateCause != "" {
-						glog.V(config.VerboseOn).Infof("update %s: %s", src1.AbsPath(), updateCause)
-						if err := su.actionUpdate(ctx, src1, dst1); err != nil {
+						if err := su.actionUpdate(ctx, src1, dst1, updateCause); err != nil {
 							return err
 						}
+					} else {
+						su.stats.Skip(src1.Size())
 					}
 					i += 1
 					j += 1
@@ -402,6 +599,51 @@ func (su *Sync) sync(
 	}
 }
 
+// updateCause tells why src and dst of the same name differ.  It returns
+// empty string if they do not
+func (su *Sync) updateCause(ctx context.Context, src Src, dst Dst) string {
+	if su.remote {
+		sr := src.(SrcRemote)
+		if src.Size() != dst.Size() {
+			return "src size != dst's"
+		}
+		if sr.Md5() != dst.Md5() {
+			return "src md5 != dst's"
+		}
+		return ""
+	}
+	if su.dstLocal {
+		if src.Size() != dst.Size() {
+			return "src size != dst's"
+		}
+		sce := su.getOrSetSrcCacheEntry(ctx, src.AbsPath())
+		if sce == nil || sce.Md5() != dst.Md5() {
+			return "src md5 != dst's"
+		}
+		return ""
+	}
+	updateCause := ""
+	ent := su.getOrSetDstCacheEntry(ctx, dst)
+	if ent == nil {
+		updateCause = "no cache"
+	} else {
+		if src.Size() != dst.Size() {
+			updateCause = "local size != remote's"
+		}
+		if su.cryptMan.StoredSize(src.Size()) != ent.Size() {
+			updateCause = "local size != cache's"
+		}
+		if dst.Md5() != ent.DstMd5() {
+			updateCause = "remote md5 != cache's"
+		}
+		sce := su.getOrSetSrcCacheEntry(ctx, src.AbsPath())
+		if sce == nil || !su.srcMd5Match(sce, ent) {
+			updateCause = "local md5 != cache's"
+		}
+	}
+	return updateCause
+}
+
 func (su *Sync) nameCmpAction(
 	ctx context.Context,
 	src Src,
@@ -427,14 +669,15 @@ func (su *Sync) actionSrcMore(
 	ctx context.Context,
 	srcs ...Src,
 ) error {
-	var action func(context.Context, Src) error
+	const cause = syncCauseAbsentOnDst
+	var action func(context.Context, Src, string) error
 	if su.up {
 		action = su.upSrc
 	} else {
 		action = su.delSrc
 	}
 	for _, src := range srcs {
-		err := action(ctx, src)
+		err := action(ctx, src, cause)
 		if err != nil {
 			return err
 		}
@@ -446,14 +689,15 @@ func (su *Sync) actionDstMore(
 	ctx context.Context,
 	dsts ...Dst,
 ) error {
-	var action func(context.Context, Dst) error
+	const cause = syncCauseAbsentOnSrc
+	var action func(context.Context, Dst, string) error
 	if su.up {
 		action = su.delDst
 	} else {
 		action = su.downDst
 	}
 	for _, dst := range dsts {
-		err := action(ctx, dst)
+		err := action(ctx, dst, cause)
 		if err != nil {
 			return err
 		}
@@ -465,39 +709,83 @@ func (su *Sync) actionUpdate(
 	ctx context.Context,
 	src Src,
 	dst Dst,
+	cause string,
 ) error {
 	if su.up {
-		return su.upSrc(ctx, src)
+		return su.upSrc(ctx, src, cause)
 	} else {
-		return su.downDst(ctx, dst)
+		return su.downDst(ctx, dst, cause)
 	}
 }
 
 func (su *Sync) upSrc(
 	ctx context.Context,
 	src Src,
+	cause string,
 ) error {
+	if su.remote {
+		su.copySrc(src, su.upRemotePath(src), cause)
+		return nil
+	}
 	if src.IsDir() {
-		srcList, err := su.srcClient.List(ctx, src)
+		srcList, err := su.listSrc(ctx, src)
 		if err != nil {
 			return err
 		}
-		return su.upSrcList(ctx, srcList)
+		return su.upSrcList(ctx, srcList, cause)
 	} else {
-		return util.TryParallelDo(ctx, su.parallelDo, func(ctx context.Context) error {
-			return su.upSrc_(ctx, src)
+		su.decide(syncPlanItem{
+			action:   SyncActionUpload,
+			path:     src.AbsPath(),
+			size:     src.Size(),
+			cause:    cause,
+			transfer: true,
+			do: func(ctx context.Context) error {
+				return su.upSrc_(ctx, src)
+			},
+			local:  src.AbsPath(),
+			remote: su.dstAbsPath(su.upRemotePath(src)),
 		})
+		return nil
 	}
 }
 
+// copySrc decides copying remote src to path on server side.  Dirs are
+// copied as a whole
+func (su *Sync) copySrc(src Src, relpath string, cause string) {
+	remote := su.client.AbsPath(relpath)
+	pairs := [][2]string{{src.AbsPath(), remote}}
+	if sr, ok := src.(SrcRemote); ok && sr.chunked {
+		for _, p := range sr.chunkPaths {
+			pairs = append(pairs, [2]string{p, path.Join(path.Dir(remote), path.Base(p))})
+		}
+	}
+	su.decide(syncPlanItem{
+		action: SyncActionCopy,
+		path:   src.AbsPath(),
+		size:   src.Size(),
+		cause:  cause,
+		do: func(ctx context.Context) error {
+			if su.dryrun {
+				glog.Infof("copy: %q to %q", src.AbsPath(), remote)
+				return nil
+			}
+			_, err := su.client.CopyMulti(ctx, pairs, client.Ondup(client.ONDUP_OVERWRITE))
+			return err
+		},
+		local:  src.AbsPath(),
+		remote: remote,
+	})
+}
+
 func (su *Sync) upSrc_(
 	ctx context.Context,
 	src Src,
 ) error {
 	path := su.upRemotePath(src)
-	if su.progress != nil {
+	if progress := su.stats.ProgressMaker(); progress != nil {
 		message := src.AbsPath()
-		pt := NewProgressTracker(su.progress, message)
+		pt := progress.NewTracker(message)
 		ctx = context.WithValue(ctx, client.XloadTrackerKey, pt)
 	}
 	resp, err := su.dstClient.Up(ctx, src, path)
@@ -506,42 +794,111 @@ func (su *Sync) upSrc_(
 	}
 	sce := su.getOrSetSrcCacheEntry(ctx, src.AbsPath())
 	if sce != nil && resp.Md5 != "" {
+		srcMd5 := sce.Md5()
+		if resp.EncMd5 != "" {
+			srcMd5 = resp.EncMd5
+			su.setSrcEncMd5(src.AbsPath(), resp.EncMd5)
+		}
 		su.cacheSetter.SetDst(
 			resp.Path,
 			resp.Md5,
-			sce.Md5(),
+			srcMd5,
+			resp.PlainMd5,
 			int64(resp.Size),
 		)
 	}
 	return nil
 }
 
+// srcMd5Match tells whether local content matches that recorded in dst
+// cache entry.  With encryption, ciphertext differs on each upload, so
+// plaintext md5 is compared, or ciphertext md5 of the last upload
+func (su *Sync) srcMd5Match(sce SrcCacheEntryI, ent DstCacheEntryI) bool {
+	if su.cryptMan == nil {
+		return sce.Md5() == ent.SrcMd5()
+	}
+	if ent.PlainMd5() != "" && ent.PlainMd5() == sce.Md5() {
+		return true
+	}
+	return sce.EncMd5() != "" && sce.EncMd5() == ent.SrcMd5()
+}
+
 func (su *Sync) delSrc(
 	ctx context.Context,
 	src Src,
+	cause string,
 ) error {
 	if su.nodelete {
 		glog.Infof("skip deleting local %q", src.AbsPath())
+		su.stats.Skip(src.Size())
 		return nil
 	} else {
-		return su.srcClient.Delete(ctx, src)
+		su.decide(syncPlanItem{
+			action: SyncActionDelete,
+			path:   src.AbsPath(),
+			size:   src.Size(),
+			cause:  cause,
+			do: func(ctx context.Context) error {
+				return su.srcClient.Delete(ctx, src)
+			},
+			local:  src.AbsPath(),
+			remote: su.dstAbsPath(su.upRemotePath(src)),
+		})
+		return nil
 	}
 }
 
 func (su *Sync) downDst(
 	ctx context.Context,
 	dst Dst,
+	cause string,
 ) error {
+	if dst.IsDir() {
+		dstList, err := su.listDst(ctx, dst)
+		if err != nil {
+			return err
+		}
+		for _, dst := range dstList {
+			if err := su.downDst(ctx, dst, cause); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
 	path := su.downLocalPath(dst)
-	return su.dstClient.Down(ctx, dst, path)
+	su.decide(syncPlanItem{
+		action:   SyncActionDownload,
+		path:     dst.AbsPath(),
+		size:     dst.Size(),
+		cause:    cause,
+		transfer: true,
+		do: func(ctx context.Context) error {
+			return su.dstClient.Down(ctx, dst, path)
+		},
+		local:  path,
+		remote: su.cryptMan.PlainPath(dst.AbsPath()),
+	})
+	return nil
+}
+
+// dstAbsPath returns absolute form of dst path p
+func (su *Sync) dstAbsPath(p string) string {
+	if su.dstLocal {
+		return p
+	}
+	return su.client.AbsPath(p)
 }
 
 func (su *Sync) upRemotePath(src Src) string {
-	return filepath.Join(su.dst, src.RelPath())
+	if su.dstLocal {
+		return filepath.Join(su.dst, src.RelPath())
+	}
+	return path.Join(su.dst, filepath.ToSlash(src.RelPath()))
 }
 
 func (su *Sync) downLocalPath(dst Dst) string {
-	relpath := dst.RelPath()
+	// name instead of that on server, e.g. for chunked file
+	relpath := filepath.Join(filepath.Dir(su.cryptMan.PlainPath(dst.RelPath())), dst.Name())
 	outsub := strings.TrimPrefix(relpath, su.dst)
 	abspath := filepath.Join(su.src, outsub)
 	return abspath
@@ -550,21 +907,35 @@ func (su *Sync) downLocalPath(dst Dst) string {
 func (su *Sync) delDst(
 	ctx context.Context,
 	dst Dst,
+	cause string,
 ) error {
 	if su.nodelete {
 		glog.Infof("skip deleting remote %q", dst.AbsPath())
+		su.stats.Skip(dst.Size())
 		return nil
 	} else {
-		return su.dstClient.Delete(ctx, dst)
+		su.decide(syncPlanItem{
+			action: SyncActionDelete,
+			path:   dst.AbsPath(),
+			size:   dst.Size(),
+			cause:  cause,
+			do: func(ctx context.Context) error {
+				return su.dstClient.Delete(ctx, dst)
+			},
+			local:  su.downLocalPath(dst),
+			remote: su.cryptMan.PlainPath(dst.AbsPath()),
+		})
+		return nil
 	}
 }
 
 func (su *Sync) upSrcList(
 	ctx context.Context,
 	srcList SrcList,
+	cause string,
 ) error {
 	for _, src := range srcList {
-		err := su.upSrc(ctx, src)
+		err := su.upSrc(ctx, src, cause)
 		if err != nil {
 			return err
 		}
@@ -572,14 +943,67 @@ func (su *Sync) upSrcList(
 	return nil
 }
 
-func (su *Sync) getOrSetDstCacheEntry(ctx context.Context, dstAbsPath string) DstCacheEntryI {
+// decide adds an action to the plan
+func (su *Sync) decide(item syncPlanItem) {
+	su.plan = append(su.plan, item)
+	glog.V(config.VerboseOn).Infof("%s %s: %s", item.action, item.path, item.cause)
+	if su.events != nil {
+		su.events.Emit(Event{
+			Event:  EventSync,
+			Action: item.action,
+			Path:   item.path,
+			Size:   item.size,
+			Cause:  item.cause,
+		})
+	}
+}
+
+// Diff returns entries differing between local and remote as found by Plan
+func (su *Sync) Diff() []DiffEntry {
+	ents := make([]DiffEntry, len(su.plan))
+	for i, item := range su.plan {
+		status := DiffStatusModified
+		switch item.cause {
+		case syncCauseAbsentOnDst:
+			status = DiffStatusAdded
+		case syncCauseAbsentOnSrc:
+			status = DiffStatusRemoved
+		}
+		ents[i] = DiffEntry{
+			Status: status,
+			Local:  item.local,
+			Remote: item.remote,
+			Size:   item.size,
+			Cause:  item.cause,
+		}
+	}
+	return ents
+}
+
+func (su *Sync) getOrSetDstCacheEntry(ctx context.Context, dst Dst) DstCacheEntryI {
 	var (
 		v  store.CacheEntry
 		ok bool
+
+		dstAbsPath = dst.AbsPath()
 	)
 	v, ok = su.dstCacheStore.Get(dstAbsPath)
 	if !ok {
 		relpath := su.client.RelPath(dstAbsPath)
+		if dr, isRemote := dst.(DstRemote); isRemote && dr.chunked {
+			// md5 of the whole file is recorded in manifest
+			manifest, err := readChunkManifest(ctx, su.client, su.cryptMan, relpath)
+			if err != nil {
+				glog.Warningf("read chunk manifest %q: %v", dstAbsPath, err)
+				return nil
+			}
+			su.cacheSetter.SetDst(dstAbsPath, dst.Md5(), manifest.Md5, manifest.Md5, su.cryptMan.StoredSize(manifest.Size))
+			v, ok = su.dstCacheStore.Get(dstAbsPath)
+			if !ok {
+				return nil
+			}
+			return NewDstCacheEntryImpl(v.(DstCacheEntry))
+		}
 		meta, err := su.client.FileMetaByPath(ctx, relpath)
 		if err != nil {
 			return nil
@@ -593,7 +1017,7 @@ func (su *Sync) getOrSetDstCacheEntry(ctx context.Context, dstAbsPath string) Ds
 		if srcMd5 == "" {
 			return nil
 		}
-		su.cacheSetter.SetDst(dstAbsPath, meta.Md5, srcMd5, int64(meta.Size))
+		su.cacheSetter.SetDst(dstAbsPath, meta.Md5, srcMd5, "", int64(meta.Size))
 
 		v, ok = su.dstCacheStore.Get(dstAbsPath)
 		if !ok {
@@ -605,6 +1029,12 @@ func (su *Sync) getOrSetDstCacheEntry(ctx context.Context, dstAbsPath string) Ds
 }
 
 func (su *Sync) getOrSetSrcCacheEntry(ctx context.Context, srcAbsPath string) SrcCacheEntryI {
+	return getOrSetFileCacheEntry(su.srcCacheStore, srcAbsPath)
+}
+
+// getOrSetFileCacheEntry returns md5 of local file srcAbsPath, computing it
+// if the cache entry in srcCacheStore is missing or stale
+func getOrSetFileCacheEntry(srcCacheStore *store.FileCacheStore, srcAbsPath string) SrcCacheEntryI {
 	// stat call
 	fi, err := os.Stat(srcAbsPath)
 	if err != nil {
@@ -617,7 +1047,7 @@ func (su *Sync) getOrSetSrcCacheEntry(ctx context.Context, srcAbsPath string) Sr
 	}
 
 	// cache hit?
-	ce, ok := su.srcCacheStore.Get(srcAbsPath)
+	ce, ok := srcCacheStore.Get(srcAbsPath)
 	if ok {
 		sce := ce.(SrcCacheEntry)
 		if sce.Inode == ino && sce.Size == fi.Size() && sce.Mtime.Equal(fi.ModTime()) {
@@ -633,17 +1063,10 @@ func (su *Sync) getOrSetSrcCacheEntry(ctx context.Context, srcAbsPath string) Sr
 
 	// cache miss
 	// calculate hash
-	f, err := os.Open(srcAbsPath)
+	hashStr, err := fileMd5(srcAbsPath)
 	if err != nil {
 		return nil
 	}
-	defer f.Close()
-	h := md5.New()
-	if _, err := io.Copy(h, f); err != nil {
-		return nil
-	}
-	data := h.Sum(nil)
-	hashStr := hex.EncodeToString(data)
 
 	// new cache entry
 	sce := SrcCacheEntry{
@@ -653,12 +1076,24 @@ func (su *Sync) getOrSetSrcCacheEntry(ctx context.Context, srcAbsPath string) Sr
 		Mtime:   fi.ModTime(),
 		Md5:     hashStr,
 	}
-	if err := su.srcCacheStore.Set(sce); err != nil {
+	if err := srcCacheStore.Set(sce); err != nil {
 		glog.Warningf("set src file cache (%s): %v", srcAbsPath, err)
 	}
 	return NewSrcCacheEntryImpl(sce)
 }
 
+func (su *Sync) setSrcEncMd5(srcAbsPath, encMd5 string) {
+	ce, ok := su.srcCacheStore.Get(srcAbsPath)
+	if !ok {
+		return
+	}
+	sce := ce.(SrcCacheEntry)
+	sce.EncMd5 = encMd5
+	if err := su.srcCacheStore.Set(sce); err != nil {
+		glog.Warningf("set src file cache (%s): %v", srcAbsPath, err)
+	}
+}
+
 type CacheSetter struct {
 	dstCacheStore *store.FileCacheStore
 }
@@ -670,12 +1105,13 @@ func NewCacheSetter(dstCacheStore *store.FileCacheStore) *CacheSetter {
 	return cs
 }
 
-func (cs *CacheSetter) SetDst(dstAbsPath, dstMd5, srcMd5 string, size int64) {
+func (cs *CacheSetter) SetDst(dstAbsPath, dstMd5, srcMd5, plainMd5 string, size int64) {
 	if err := cs.dstCacheStore.Set(DstCacheEntry{
 		DstAbsPath: dstAbsPath,
 		DstMd5:     dstMd5,
 		SrcMd5:     srcMd5,
 		Size:       size,
+		PlainMd5:   plainMd5,
 	}); err != nil {
 		glog.Warningf("set dst file cache (%s): %v", dstAbsPath, err)
 	}
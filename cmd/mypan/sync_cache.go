@@ -11,9 +11,13 @@ import (
 
 type DstCacheEntry struct {
 	DstAbsPath string
-	SrcMd5     string
-	DstMd5     string
-	Size       int64
+	// SrcMd5 is md5 of content stored on server, i.e. content-md5.  It's
+	// md5 of ciphertext if encrypted
+	SrcMd5 string
+	DstMd5 string
+	Size   int64
+	// PlainMd5 is md5 of plaintext.  It's set only if encrypted
+	PlainMd5 string `json:",omitempty"`
 }
 
 func (dfc DstCacheEntry) Key() string {
@@ -35,6 +39,9 @@ func (cei CacheEntryImplDst) DstMd5() string {
 func (cei CacheEntryImplDst) SrcMd5() string {
 	return cei.fc.SrcMd5
 }
+func (cei CacheEntryImplDst) PlainMd5() string {
+	return cei.fc.PlainMd5
+}
 func (cei CacheEntryImplDst) Size() int64 {
 	return cei.fc.Size
 }
@@ -52,6 +59,9 @@ type SrcCacheEntry struct {
 	Size    int64
 	Mtime   time.Time
 	Md5     string
+	// EncMd5 is md5 of ciphertext last uploaded.  It's set only if
+	// encrypted
+	EncMd5 string `json:",omitempty"`
 }
 
 func (sce SrcCacheEntry) Key() string {
@@ -76,3 +86,7 @@ func NewSrcCacheEntryImpl(sce SrcCacheEntry) SrcCacheEntryImpl {
 func (scei SrcCacheEntryImpl) Md5() string {
 	return scei.sce.Md5
 }
+
+func (scei SrcCacheEntryImpl) EncMd5() string {
+	return scei.sce.EncMd5
+}
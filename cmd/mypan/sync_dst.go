@@ -5,8 +5,10 @@ package main
 
 import (
 	"context"
+	"path"
 	"path/filepath"
 
+	"mypan/pkg/chunk"
 	"mypan/pkg/client"
 
 	"github.com/golang/glog"
@@ -22,6 +24,11 @@ type DstRemote struct {
 
 	md5  string
 	fsId uint64
+
+	// chunked is true if it's a file stored as chunks.  abspath, relpath,
+	// md5, fsId are then that of the manifest
+	chunked    bool
+	chunkPaths []string
 }
 
 func (dr DstRemote) Name() string {
@@ -48,8 +55,10 @@ func (dr DstRemote) FsId() uint64 {
 }
 
 type DstClientRemote struct {
-	client  client.ClientI
-	downMan *DownMan
+	client   client.ClientI
+	downMan  *DownMan
+	cryptMan *CryptMan
+	chunkMan *ChunkMan
 }
 
 var _ DstClient = DstClientRemote{}
@@ -57,10 +66,14 @@ var _ DstClient = DstClientRemote{}
 func NewDstClientRemote(
 	client client.ClientI,
 	downMan *DownMan,
+	cryptMan *CryptMan,
+	chunkMan *ChunkMan,
 ) DstClientRemote {
 	dcr := DstClientRemote{
-		client:  client,
-		downMan: downMan,
+		client:   client,
+		downMan:  downMan,
+		cryptMan: cryptMan,
+		chunkMan: chunkMan,
 	}
 	return dcr
 }
@@ -69,7 +82,7 @@ func (dcr DstClientRemote) New(ctx context.Context, path string) (Dst, error) {
 	updir := filepath.Dir(path)
 	name := filepath.Base(path)
 
-	dstList, err := dcr.list(ctx, updir)
+	dstList, err := dcr.list(ctx, dcr.cryptMan.RemotePath(updir))
 	if err != nil {
 		return nil, errors.Wrapf(err, "list updir %q", updir)
 	}
@@ -96,42 +109,116 @@ func (dcr DstClientRemote) list(ctx context.Context, path string) (DstList, erro
 	if err != nil {
 		return nil, err
 	}
-	var dstList DstList
+	var (
+		dstList   DstList
+		manifests = map[string]int{}
+		chunks    = map[string][]DstRemote{}
+	)
 	for _, v := range resp.List {
+		name, ok := dcr.cryptMan.PlainName(v.ServerFilename)
+		if !ok {
+			glog.Warningf("skip %q: cannot decrypt name", v.Path)
+			continue
+		}
+		size := int64(v.Size)
+		if v.IsDir == 0 {
+			size = dcr.cryptMan.PlainSize(size)
+		}
 		dr := DstRemote{
-			name:    v.ServerFilename,
-			size:    int64(v.Size),
+			name:    name,
+			size:    size,
 			isDir:   v.IsDir != 0,
 			abspath: v.Path,
 			relpath: dcr.client.RelPath(v.Path),
 			md5:     v.Md5,
 			fsId:    v.FsId,
 		}
+		if !dr.isDir {
+			if base, _, ok := chunk.ParseChunkName(name); ok {
+				chunks[base] = append(chunks[base], dr)
+				continue
+			}
+			if base, ok := chunk.ParseManifestName(name); ok {
+				dr.name = base
+				dr.chunked = true
+				manifests[base] = len(dstList)
+			}
+		}
 		dstList = append(dstList, dr)
 	}
-	return dstList, nil
+	// fold chunks into the logical file.  Chunks without manifest, e.g.
+	// from an interrupted upload, are listed as is
+	for base, chunkList := range chunks {
+		i, ok := manifests[base]
+		if !ok {
+			for _, dr := range chunkList {
+				dstList = append(dstList, dr)
+			}
+			continue
+		}
+		dr := dstList[i].(DstRemote)
+		dr.size = 0
+		for _, chunkDr := range chunkList {
+			dr.size += chunkDr.size
+			dr.chunkPaths = append(dr.chunkPaths, chunkDr.abspath)
+		}
+		dstList[i] = dr
+	}
+	// a plain file of the same name as a chunked one is left over from an
+	// earlier upload
+	var ret DstList
+	for j, dst := range dstList {
+		if i, ok := manifests[dst.Name()]; ok && i != j {
+			glog.Warningf("skip %q: shadowed by chunked file", dst.AbsPath())
+			continue
+		}
+		ret = append(ret, dst)
+	}
+	return ret, nil
 }
 
-func (dcr DstClientRemote) Up(ctx context.Context, src Src, path string) (client.UploadResponse, error) {
-	var resp client.UploadResponse
+func (dcr DstClientRemote) Up(ctx context.Context, src Src, relpath string) (UpResult, error) {
+	var result UpResult
 
 	abspath := src.AbsPath()
 	if src.IsDir() {
-		return resp, errors.Wrap(ErrDirUnexpected, abspath)
+		return result, errors.Wrap(ErrDirUnexpected, abspath)
 	}
-	resp, err := dcr.client.Upload(ctx, abspath, path)
+	needChunk, err := dcr.chunkMan.NeedChunk(ctx, src.Size())
 	if err != nil {
-		return resp, err
+		return result, err
+	}
+	if needChunk {
+		return dcr.chunkMan.Up(ctx, abspath, relpath)
 	}
-	return resp, nil
+	if cm := dcr.cryptMan; cm != nil {
+		result, err = cm.Upload(ctx, abspath, relpath)
+	} else {
+		result.UploadResponse, err = dcr.client.Upload(ctx, abspath, relpath)
+	}
+	if err != nil {
+		return result, err
+	}
+	// a chunked copy from earlier uploads would shadow the new one
+	removeStale(ctx, dcr.client, dcr.cryptMan, path.Dir(relpath), path.Base(relpath), 0)
+	return result, nil
 }
 
 func (dcr DstClientRemote) Down(ctx context.Context, dst Dst, path string) error {
+	if dr, ok := dst.(DstRemote); ok && dr.chunked {
+		return dcr.downMan.downChunked(ctx, dr.relpath, path)
+	}
+	// relpath is as stored on server, with names encrypted if enabled
 	relpath := dst.RelPath()
-	return dcr.downMan.Down(ctx, relpath, path)
+	return dcr.downMan.downRemote(ctx, relpath, path)
 }
 
 func (dcr DstClientRemote) Delete(ctx context.Context, dst Dst) error {
+	if dr, ok := dst.(DstRemote); ok && dr.chunked {
+		paths := append(append([]string{}, dr.chunkPaths...), dr.abspath)
+		_, err := dcr.client.DeleteMulti(ctx, paths)
+		return err
+	}
 	_, err := dcr.client.Delete(ctx, dst.RelPath())
 	return err
 }
@@ -140,10 +227,10 @@ type DstClientRemoteReadOnly struct {
 	DstClientRemote
 }
 
-func (dcrro DstClientRemoteReadOnly) Up(ctx context.Context, src Src, path string) (client.UploadResponse, error) {
+func (dcrro DstClientRemoteReadOnly) Up(ctx context.Context, src Src, path string) (UpResult, error) {
 	remotePath := dcrro.client.AbsPath(path)
 	glog.Infof("upload: %q to %q", src.AbsPath(), remotePath)
-	return client.UploadResponse{}, nil
+	return UpResult{}, nil
 }
 
 func (dcrro DstClientRemoteReadOnly) Down(ctx context.Context, dst Dst, path string) error {
@@ -0,0 +1,199 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+
+	"mypan/pkg/config"
+	"mypan/pkg/store"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+// DstLocal is a file or dir in a local dir as sync destination.  Md5 is
+// computed on demand and cached
+type DstLocal struct {
+	name    string
+	abspath string
+	size    int64
+	isDir   bool
+
+	dcl DstClientLocalDir
+}
+
+func (dl DstLocal) Name() string {
+	return dl.name
+}
+
+// RelPath returns abspath as there is no base dir like the app base dir of
+// remote
+func (dl DstLocal) RelPath() string {
+	return dl.abspath
+}
+func (dl DstLocal) AbsPath() string {
+	return dl.abspath
+}
+func (dl DstLocal) Size() int64 {
+	return dl.size
+}
+func (dl DstLocal) IsDir() bool {
+	return dl.isDir
+}
+func (dl DstLocal) Md5() string {
+	if dl.isDir {
+		return ""
+	}
+	ce := getOrSetFileCacheEntry(dl.dcl.cacheStore, dl.abspath)
+	if ce == nil {
+		return ""
+	}
+	return ce.Md5()
+}
+func (dl DstLocal) FsId() uint64 {
+	return 0
+}
+
+// DstClientLocalDir treats a local dir as sync destination, e.g. for
+// mirroring to a removable disk
+type DstClientLocalDir struct {
+	cacheStore *store.FileCacheStore
+}
+
+var _ DstClient = DstClientLocalDir{}
+
+// NewDstClientLocalDir returns a DstClientLocalDir caching md5 of files in
+// cacheStore of SrcCacheEntry
+func NewDstClientLocalDir(cacheStore *store.FileCacheStore) DstClientLocalDir {
+	dcl := DstClientLocalDir{
+		cacheStore: cacheStore,
+	}
+	return dcl
+}
+
+func (dcl DstClientLocalDir) New(ctx context.Context, path string) (Dst, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := (SrcClientLocal{}).checkFileInfo(fi); err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	abspath, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	return dcl.newDst(abspath, fi), nil
+}
+
+func (dcl DstClientLocalDir) List(ctx context.Context, dst Dst) (DstList, error) {
+	abspath := dst.AbsPath()
+	if !dst.IsDir() {
+		return nil, errors.Wrap(ErrDirExpected, abspath)
+	}
+	des, err := os.ReadDir(abspath)
+	if err != nil {
+		return nil, err
+	}
+	var dstList DstList
+	for _, de := range des {
+		fi, err := de.Info()
+		if err != nil {
+			return nil, err
+		}
+		abspath1 := filepath.Join(abspath, de.Name())
+		if err := (SrcClientLocal{}).checkFileInfo(fi); err != nil {
+			glog.V(config.VerboseOn).Infof("skipping %q: %v", abspath1, err)
+			continue
+		}
+		dstList = append(dstList, dcl.newDst(abspath1, fi))
+	}
+	return dstList, nil
+}
+
+func (dcl DstClientLocalDir) newDst(abspath string, fi os.FileInfo) DstLocal {
+	dl := DstLocal{
+		name:    fi.Name(),
+		abspath: abspath,
+		isDir:   fi.IsDir(),
+		dcl:     dcl,
+	}
+	if !dl.isDir {
+		dl.size = fi.Size()
+	}
+	return dl
+}
+
+func (dcl DstClientLocalDir) Up(ctx context.Context, src Src, path string) (UpResult, error) {
+	var result UpResult
+
+	abspath := src.AbsPath()
+	if src.IsDir() {
+		return result, errors.Wrap(ErrDirUnexpected, abspath)
+	}
+	if err := copyLocalFile(abspath, path); err != nil {
+		return result, errors.Wrapf(err, "copy %q to %q", abspath, path)
+	}
+	return result, nil
+}
+
+func (dcl DstClientLocalDir) Down(ctx context.Context, dst Dst, path string) error {
+	abspath := dst.AbsPath()
+	if dst.IsDir() {
+		return errors.Wrap(ErrDirUnexpected, abspath)
+	}
+	if err := copyLocalFile(abspath, path); err != nil {
+		return errors.Wrapf(err, "copy %q to %q", abspath, path)
+	}
+	return nil
+}
+
+func (dcl DstClientLocalDir) Delete(ctx context.Context, dst Dst) error {
+	return os.RemoveAll(dst.AbsPath())
+}
+
+// copyLocalFile copies file src to dst through a temporary file, so that
+// dst is either the old or the complete new content
+func copyLocalFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	tmp := dst + ".mypantmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := appendFile(f, src); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, dst)
+}
+
+type DstClientLocalDirReadOnly struct {
+	DstClientLocalDir
+}
+
+func (dclro DstClientLocalDirReadOnly) Up(ctx context.Context, src Src, path string) (UpResult, error) {
+	glog.Infof("copy: %q to %q", src.AbsPath(), path)
+	return UpResult{}, nil
+}
+
+func (dclro DstClientLocalDirReadOnly) Down(ctx context.Context, dst Dst, path string) error {
+	glog.Infof("copy: %q to %q", dst.AbsPath(), path)
+	return nil
+}
+
+func (dclro DstClientLocalDirReadOnly) Delete(ctx context.Context, dst Dst) error {
+	glog.Infof("local delete: %q", dst.AbsPath())
+	return nil
+}
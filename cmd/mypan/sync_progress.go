@@ -5,14 +5,47 @@ package main
 
 import (
 	"fmt"
+	"sync"
 	"time"
 
+	"mypan/pkg/client"
+
 	"github.com/jedib0t/go-pretty/progress"
 )
 
+// ProgressMaker makes a tracker for each file upload/download
+type ProgressMaker interface {
+	// NewTracker returns a tracker counting bytes
+	NewTracker(message string) client.XloadTrackerI
+	// NewCountTracker returns a tracker counting items, e.g. files
+	NewCountTracker(message string) client.XloadTrackerI
+}
+
+type BarProgress struct {
+	progress progress.Writer
+}
+
+func NewBarProgress(progress progress.Writer) BarProgress {
+	bp := BarProgress{
+		progress: progress,
+	}
+	return bp
+}
+
+func (bp BarProgress) NewTracker(message string) client.XloadTrackerI {
+	return NewProgressTracker(bp.progress, message)
+}
+
+func (bp BarProgress) NewCountTracker(message string) client.XloadTrackerI {
+	pt := NewProgressTracker(bp.progress, message)
+	pt.units = progress.UnitsDefault
+	return pt
+}
+
 type ProgressTracker struct {
 	progress progress.Writer
 	message  string
+	units    progress.Units
 
 	tracker *progress.Tracker
 }
@@ -21,6 +54,7 @@ func NewProgressTracker(progress progress.Writer, message string) *ProgressTrack
 	pt := &ProgressTracker{
 		progress: progress,
 		message:  message,
+		units:    UnitBytesIEC,
 	}
 	return pt
 }
@@ -28,7 +62,7 @@ func NewProgressTracker(progress progress.Writer, message string) *ProgressTrack
 func (pt *ProgressTracker) Start(total int64) {
 	pt.tracker = &progress.Tracker{
 		Message: fmt.Sprintf("[%s] %s", time.Now().Format(time.RFC3339), pt.message),
-		Units:   UnitBytesIEC,
+		Units:   pt.units,
 		Total:   total,
 	}
 	pt.progress.AppendTracker(pt.tracker)
@@ -41,3 +75,77 @@ func (pt *ProgressTracker) Increment(n int64) {
 func (pt *ProgressTracker) Done() {
 	pt.tracker.MarkAsDone()
 }
+
+type JSONProgress struct {
+	events   *EventWriter
+	interval time.Duration
+}
+
+// NewJSONProgress returns a ProgressMaker emitting xload events.  Progress
+// events of each tracker are emitted at most once per interval
+func NewJSONProgress(events *EventWriter, interval time.Duration) JSONProgress {
+	jp := JSONProgress{
+		events:   events,
+		interval: interval,
+	}
+	return jp
+}
+
+func (jp JSONProgress) NewCountTracker(message string) client.XloadTrackerI {
+	return jp.NewTracker(message)
+}
+
+func (jp JSONProgress) NewTracker(message string) client.XloadTrackerI {
+	jt := &JSONTracker{
+		events:   jp.events,
+		interval: jp.interval,
+		name:     message,
+		mu:       &sync.Mutex{},
+	}
+	return jt
+}
+
+type JSONTracker struct {
+	events   *EventWriter
+	interval time.Duration
+	name     string
+
+	mu       *sync.Mutex
+	total    int64
+	done     int64
+	lastEmit time.Time
+}
+
+func (jt *JSONTracker) Start(total int64) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	jt.total = total
+	jt.done = 0
+	jt.lastEmit = time.Now()
+	jt.emit(EventXloadStart)
+}
+
+func (jt *JSONTracker) Increment(n int64) {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	jt.done += n
+	if now := time.Now(); now.Sub(jt.lastEmit) >= jt.interval {
+		jt.lastEmit = now
+		jt.emit(EventXloadProgress)
+	}
+}
+
+func (jt *JSONTracker) Done() {
+	jt.mu.Lock()
+	defer jt.mu.Unlock()
+	jt.emit(EventXloadDone)
+}
+
+func (jt *JSONTracker) emit(event string) {
+	jt.events.Emit(Event{
+		Event: event,
+		Name:  jt.name,
+		Total: jt.total,
+		Done:  jt.done,
+	})
+}
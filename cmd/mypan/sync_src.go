@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 
@@ -131,3 +132,82 @@ func (sclro SrcClientLocalReadOnly) Delete(ctx context.Context, src Src) error {
 	glog.Infof("local delete: %q", src.AbsPath())
 	return nil
 }
+
+// SrcRemote is a remote entry as source of sync between remote dirs
+type SrcRemote struct {
+	DstRemote
+
+	// base is abspath of the dir relpath is relative to
+	base string
+}
+
+func (sr SrcRemote) RelPath() string {
+	return strings.TrimPrefix(strings.TrimPrefix(sr.abspath, sr.base), "/")
+}
+
+// SrcClientRemote lists remote dirs as source of sync
+type SrcClientRemote struct {
+	dcr DstClientRemote
+}
+
+var _ SrcClient = SrcClientRemote{}
+
+func NewSrcClientRemote(dcr DstClientRemote) SrcClientRemote {
+	scr := SrcClientRemote{
+		dcr: dcr,
+	}
+	return scr
+}
+
+func (scr SrcClientRemote) New(ctx context.Context, relpath string) (Src, error) {
+	dst, err := scr.dcr.New(ctx, relpath)
+	if err != nil {
+		return nil, err
+	}
+	dr := dst.(DstRemote)
+	base := dr.abspath
+	if !dr.isDir {
+		base = path.Dir(base)
+	}
+	sr := SrcRemote{
+		DstRemote: dr,
+		base:      base,
+	}
+	return sr, nil
+}
+
+func (scr SrcClientRemote) List(ctx context.Context, src Src) (SrcList, error) {
+	sr, ok := src.(SrcRemote)
+	if !ok {
+		return nil, fmt.Errorf("not a remote src: %q", src.AbsPath())
+	}
+	dstList, err := scr.dcr.List(ctx, sr.DstRemote)
+	if err != nil {
+		return nil, err
+	}
+	srcList := make(SrcList, len(dstList))
+	for i, dst := range dstList {
+		srcList[i] = SrcRemote{
+			DstRemote: dst.(DstRemote),
+			base:      sr.base,
+		}
+	}
+	return srcList, nil
+}
+
+func (scr SrcClientRemote) Delete(ctx context.Context, src Src) error {
+	sr, ok := src.(SrcRemote)
+	if !ok {
+		return fmt.Errorf("not a remote src: %q", src.AbsPath())
+	}
+	return scr.dcr.Delete(ctx, sr.DstRemote)
+}
+
+type SrcClientRemoteReadOnly struct {
+	SrcClientRemote
+}
+
+func (scrro SrcClientRemoteReadOnly) Delete(ctx context.Context, src Src) error {
+	glog.Infof("remote delete: %q", src.AbsPath())
+	return nil
+}
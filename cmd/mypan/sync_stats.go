@@ -0,0 +1,223 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"mypan/pkg/client"
+
+	"github.com/dustin/go-humanize"
+)
+
+const (
+	SyncResultUploaded   = "uploaded"
+	SyncResultDownloaded = "downloaded"
+	SyncResultDeleted    = "deleted"
+	SyncResultCopied     = "copied"
+	SyncResultSkipped    = "skipped"
+	SyncResultFailed     = "failed"
+)
+
+var syncResults = []string{
+	SyncResultUploaded,
+	SyncResultDownloaded,
+	SyncResultDeleted,
+	SyncResultCopied,
+	SyncResultSkipped,
+	SyncResultFailed,
+}
+
+var syncActionResults = map[string]string{
+	SyncActionUpload:   SyncResultUploaded,
+	SyncActionDownload: SyncResultDownloaded,
+	SyncActionDelete:   SyncResultDeleted,
+	SyncActionCopy:     SyncResultCopied,
+}
+
+type SyncSummaryEntry struct {
+	Result string `json:"result"`
+	Count  int64  `json:"count"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type SyncSummary struct {
+	Entries []SyncSummaryEntry `json:"entries"`
+	Elapsed time.Duration      `json:"elapsed"`
+	// Throughput is bytes uploaded and downloaded per second
+	Throughput float64 `json:"throughput"`
+}
+
+// MarshalJSON marshals elapsed time as a duration string, e.g. "1m2.5s"
+func (summary SyncSummary) MarshalJSON() ([]byte, error) {
+	type syncSummary SyncSummary
+	return json.Marshal(struct {
+		syncSummary
+		Elapsed string `json:"elapsed"`
+	}{
+		syncSummary: syncSummary(summary),
+		Elapsed:     summary.Elapsed.Round(time.Millisecond).String(),
+	})
+}
+
+// String returns summary on one line, e.g. for logging
+func (summary SyncSummary) String() string {
+	var parts []string
+	for _, ent := range summary.Entries {
+		parts = append(parts, fmt.Sprintf("%s %d (%s)", ent.Result, ent.Count, humanize.IBytes(uint64(ent.Bytes))))
+	}
+	return fmt.Sprintf("%s, elapsed %s, %s/s",
+		strings.Join(parts, ", "),
+		summary.Elapsed.Round(time.Millisecond),
+		humanize.IBytes(uint64(summary.Throughput)),
+	)
+}
+
+// SyncStats tracks overall progress of a sync.  Totals are fed by the
+// planning pass
+type SyncStats struct {
+	progress ProgressMaker
+
+	filesTracker client.XloadTrackerI
+	bytesTracker client.XloadTrackerI
+
+	mu      *sync.Mutex
+	start   time.Time
+	end     time.Time
+	results map[string]*SyncSummaryEntry
+}
+
+func NewSyncStats(progress ProgressMaker) *SyncStats {
+	ss := &SyncStats{
+		progress: progress,
+
+		mu:      &sync.Mutex{},
+		start:   time.Now(),
+		results: map[string]*SyncSummaryEntry{},
+	}
+	for _, result := range syncResults {
+		ss.results[result] = &SyncSummaryEntry{
+			Result: result,
+		}
+	}
+	return ss
+}
+
+// ProgressMaker returns a ProgressMaker whose trackers also feed the overall
+// bytes tracker.  It returns nil if progress is not enabled
+func (ss *SyncStats) ProgressMaker() ProgressMaker {
+	if ss.progress == nil {
+		return nil
+	}
+	return syncStatsProgress{
+		ProgressMaker: ss.progress,
+		ss:            ss,
+	}
+}
+
+// Start starts overall trackers with totals of the plan
+func (ss *SyncStats) Start(plan []syncPlanItem) {
+	if ss.progress == nil {
+		return
+	}
+	var files, bytes int64
+	for _, item := range plan {
+		files += 1
+		if item.transfer {
+			bytes += item.size
+		}
+	}
+	ss.filesTracker = ss.progress.NewCountTracker("overall files")
+	ss.filesTracker.Start(files)
+	ss.bytesTracker = ss.progress.NewTracker("overall bytes")
+	ss.bytesTracker.Start(bytes)
+}
+
+func (ss *SyncStats) Skip(size int64) {
+	ss.add(SyncResultSkipped, size)
+}
+
+// Done records result of a plan item
+func (ss *SyncStats) Done(item syncPlanItem, err error) {
+	result := syncActionResults[item.action]
+	if err != nil {
+		result = SyncResultFailed
+	}
+	ss.add(result, item.size)
+	if ss.filesTracker != nil {
+		ss.filesTracker.Increment(1)
+	}
+}
+
+func (ss *SyncStats) Finish() {
+	ss.mu.Lock()
+	ss.end = time.Now()
+	ss.mu.Unlock()
+	if ss.filesTracker != nil {
+		ss.filesTracker.Done()
+	}
+	if ss.bytesTracker != nil {
+		ss.bytesTracker.Done()
+	}
+}
+
+func (ss *SyncStats) Summary() SyncSummary {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	var summary SyncSummary
+	for _, result := range syncResults {
+		summary.Entries = append(summary.Entries, *ss.results[result])
+	}
+	end := ss.end
+	if end.IsZero() {
+		end = time.Now()
+	}
+	summary.Elapsed = end.Sub(ss.start)
+	if secs := summary.Elapsed.Seconds(); secs > 0 {
+		bytes := ss.results[SyncResultUploaded].Bytes + ss.results[SyncResultDownloaded].Bytes
+		summary.Throughput = float64(bytes) / secs
+	}
+	return summary
+}
+
+func (ss *SyncStats) add(result string, size int64) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	ent := ss.results[result]
+	ent.Count += 1
+	ent.Bytes += size
+}
+
+func (ss *SyncStats) increment(n int64) {
+	if ss.bytesTracker != nil {
+		ss.bytesTracker.Increment(n)
+	}
+}
+
+type syncStatsProgress struct {
+	ProgressMaker
+	ss *SyncStats
+}
+
+func (ssp syncStatsProgress) NewTracker(message string) client.XloadTrackerI {
+	sst := syncStatsTracker{
+		XloadTrackerI: ssp.ProgressMaker.NewTracker(message),
+		ss:            ssp.ss,
+	}
+	return sst
+}
+
+type syncStatsTracker struct {
+	client.XloadTrackerI
+	ss *SyncStats
+}
+
+func (sst syncStatsTracker) Increment(n int64) {
+	sst.XloadTrackerI.Increment(n)
+	sst.ss.increment(n)
+}
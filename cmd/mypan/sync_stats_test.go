@@ -0,0 +1,48 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"mypan/pkg/util"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyncStats(t *testing.T) {
+	ss := NewSyncStats(nil)
+	ss.Skip(10)
+	ss.Done(syncPlanItem{action: SyncActionUpload, size: 1000}, nil)
+	ss.Done(syncPlanItem{action: SyncActionUpload, size: 1048}, nil)
+	ss.Done(syncPlanItem{action: SyncActionDownload, size: 2048}, nil)
+	ss.Done(syncPlanItem{action: SyncActionDelete, size: 5}, nil)
+	ss.Done(syncPlanItem{action: SyncActionCopy, size: 7}, nil)
+	ss.Done(syncPlanItem{action: SyncActionUpload, size: 100}, errors.New("x"))
+	ss.Finish()
+	ss.end = ss.start.Add(2*time.Second + 345678*time.Microsecond)
+
+	summary := ss.Summary()
+	assert.Equal(t, []SyncSummaryEntry{
+		{Result: SyncResultUploaded, Count: 2, Bytes: 2048},
+		{Result: SyncResultDownloaded, Count: 1, Bytes: 2048},
+		{Result: SyncResultDeleted, Count: 1, Bytes: 5},
+		{Result: SyncResultCopied, Count: 1, Bytes: 7},
+		{Result: SyncResultSkipped, Count: 1, Bytes: 10},
+		{Result: SyncResultFailed, Count: 1, Bytes: 100},
+	}, summary.Entries)
+	assert.Equal(t, 2345678*time.Microsecond, summary.Elapsed)
+	// only uploaded and downloaded bytes count
+	assert.InDelta(t, 4096/2.345678, summary.Throughput, 0.001)
+
+	assert.Equal(t,
+		"uploaded 2 (2.0 KiB), downloaded 1 (2.0 KiB), deleted 1 (5 B), "+
+			"copied 1 (7 B), skipped 1 (10 B), failed 1 (100 B), "+
+			"elapsed 2.346s, 1.7 KiB/s",
+		summary.String())
+	assert.Contains(t, string(util.MustMarshalJSON(summary)), `"elapsed":"2.346s"`)
+	assert.Contains(t, string(util.MustMarshalJSON(summary)), `{"result":"uploaded","count":2,"bytes":2048}`)
+}
@@ -0,0 +1,257 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"mypan/pkg/chunk"
+	"mypan/pkg/store"
+	"mypan/pkg/util"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		p := filepath.Join(dir, name)
+		require.NoError(t, os.MkdirAll(filepath.Dir(p), 0755))
+		require.NoError(t, os.WriteFile(p, []byte(content), 0644))
+	}
+}
+
+func newCacheStores(t *testing.T) (srcCacheStore, dstCacheStore *store.FileCacheStore) {
+	dirStore, err := store.NewDirStore(t.TempDir())
+	require.NoError(t, err)
+	jsonStore := store.NewJSONStore(dirStore)
+	srcCacheStore, err = store.NewFileCacheStore("src", jsonStore, NewSrcCacheEntry)
+	require.NoError(t, err)
+	dstCacheStore, err = store.NewFileCacheStore("dst", jsonStore, NewDstCacheEntry)
+	require.NoError(t, err)
+	return srcCacheStore, dstCacheStore
+}
+
+func newLocalDirSync(t *testing.T, src, dst string, opts ...SyncOpt) *Sync {
+	srcCacheStore, dstCacheStore := newCacheStores(t)
+	opts = append(opts, DstLocalDir())
+	return NewSyncUp(src, dst, nil, srcCacheStore, dstCacheStore, opts...)
+}
+
+func TestSyncUpLocalDir(t *testing.T) {
+	var (
+		ctx = context.Background()
+		src = t.TempDir()
+		dst = t.TempDir()
+	)
+	writeFiles(t, src, map[string]string{
+		"a":     "a",
+		"same":  "same",
+		"d/b":   "b",
+		"d/e/f": "f",
+	})
+	writeFiles(t, dst, map[string]string{
+		"a":    "old",
+		"same": "same",
+		"c":    "c",
+		"d/c":  "c",
+	})
+
+	su := newLocalDirSync(t, src, dst, DryRun(true))
+	require.NoError(t, su.Plan(ctx))
+	diff := map[string]string{}
+	for _, ent := range su.Diff() {
+		rel, err := filepath.Rel(dst, ent.Remote)
+		require.NoError(t, err)
+		diff[rel] = ent.Status
+	}
+	assert.Equal(t, map[string]string{
+		"a":     DiffStatusModified,
+		"c":     DiffStatusRemoved,
+		"d/b":   DiffStatusAdded,
+		"d/c":   DiffStatusRemoved,
+		"d/e/f": DiffStatusAdded,
+	}, diff)
+
+	su = newLocalDirSync(t, src, dst)
+	require.NoError(t, su.Do(ctx))
+	for name, content := range map[string]string{
+		"a":     "a",
+		"same":  "same",
+		"d/b":   "b",
+		"d/e/f": "f",
+	} {
+		data, err := os.ReadFile(filepath.Join(dst, name))
+		require.NoError(t, err, name)
+		assert.Equal(t, content, string(data), name)
+	}
+	for _, name := range []string{"c", "d/c"} {
+		_, err := os.Stat(filepath.Join(dst, name))
+		assert.True(t, os.IsNotExist(err), name)
+	}
+
+	su = newLocalDirSync(t, src, dst)
+	require.NoError(t, su.Plan(ctx))
+	assert.Empty(t, su.Diff())
+}
+
+func TestRemotePathsOverlap(t *testing.T) {
+	for _, c := range []struct {
+		a, b string
+		want bool
+	}{
+		{"/a", "/a", true},
+		{"/a", "/a/archive", true},
+		{"/a/archive/", "/a", true},
+		{"/a", "/ab", false},
+		{"/a/b", "/a/c", false},
+		{"/", "/a", true},
+	} {
+		assert.Equal(t, c.want, remotePathsOverlap(c.a, c.b), "%s %s", c.a, c.b)
+	}
+}
+
+// remoteNames returns names of remote files in dir relpath
+func remoteNames(fc *fakeClient, relpath string) []string {
+	var names []string
+	for _, f := range fc.files {
+		if path.Dir(f.Path) == fc.AbsPath(relpath) {
+			names = append(names, f.ServerFilename)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func TestSyncUpChunkedToPlain(t *testing.T) {
+	var (
+		ctx = context.Background()
+		src = t.TempDir()
+		fc  = newFakeClient()
+	)
+	writeFiles(t, src, map[string]string{"a": "new"})
+	manifest := chunk.Manifest{
+		Version:   chunk.ManifestVersion,
+		Size:      8,
+		Md5:       "0123456789abcdef0123456789abcdef",
+		ChunkSize: 4,
+		Chunks: []chunk.Chunk{
+			{Name: "a.mypanchunk.000", Size: 4},
+			{Name: "a.mypanchunk.001", Size: 4},
+		},
+	}
+	fc.addContent("d/a.mypanchunk.000", []byte("old-"))
+	fc.addContent("d/a.mypanchunk.001", []byte("data"))
+	fc.addContent("d/a.mypanchunks", util.MustMarshalJSON(manifest))
+	fc.addContent("d/a", []byte("shadowed"))
+
+	srcCacheStore, dstCacheStore := newCacheStores(t)
+	chm := NewChunkMan(fc, 0)
+	su := NewSyncUp(src, "d", fc, srcCacheStore, dstCacheStore, Chunk(chm))
+	require.NoError(t, su.Do(ctx))
+	assert.Equal(t, []string{"a"}, remoteNames(fc, "d"))
+	assert.Equal(t, "new", string(fc.content[fc.AbsPath("d/a")]))
+
+	dst, err := NewDstClientRemote(fc, nil, nil, nil).New(ctx, "d/a")
+	require.NoError(t, err)
+	assert.False(t, dst.(DstRemote).chunked)
+
+	su = NewSyncUp(src, "d", fc, srcCacheStore, dstCacheStore, Chunk(chm))
+	require.NoError(t, su.Plan(ctx))
+	assert.Empty(t, su.Diff())
+}
+
+func TestChunkManUpRemovesPlain(t *testing.T) {
+	var (
+		ctx = context.Background()
+		src = t.TempDir()
+		fc  = newFakeClient()
+	)
+	writeFiles(t, src, map[string]string{"b": "0123456789"})
+	fc.addContent("d/b", []byte("old"))
+	fc.addContent("d/b.mypanchunk.005", []byte("stale"))
+	fc.maxFileSize = 4
+
+	_, err := NewChunkMan(fc, 0).Up(ctx, filepath.Join(src, "b"), "d/b")
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"b.mypanchunk.000",
+		"b.mypanchunk.001",
+		"b.mypanchunk.002",
+		"b.mypanchunks",
+	}, remoteNames(fc, "d"))
+
+	dst, err := NewDstClientRemote(fc, nil, nil, nil).New(ctx, "d/b")
+	require.NoError(t, err)
+	assert.True(t, dst.(DstRemote).chunked)
+	assert.EqualValues(t, 10, dst.Size())
+}
+
+func TestSyncRemote(t *testing.T) {
+	ctx := context.Background()
+	newClient := func() *fakeClient {
+		fc := newFakeClient()
+		for p, content := range map[string]string{
+			"s/same":    "same",
+			"s/mod":     "new",
+			"s/add":     "add",
+			"s/sub/f":   "f",
+			"t/same":    "same",
+			"t/mod":     "old",
+			"t/deleted": "deleted",
+		} {
+			// put sets md5 as that on server
+			fc.addContent(p, nil)
+			fc.put(fc.AbsPath(p), []byte(content))
+		}
+		return fc
+	}
+	diff := func(su *Sync) map[string]string {
+		ret := map[string]string{}
+		for _, ent := range su.Diff() {
+			ret[strings.TrimPrefix(ent.Remote, "/apps/x/t/")] = ent.Status
+		}
+		return ret
+	}
+	wantDiff := map[string]string{
+		"mod":     DiffStatusModified,
+		"add":     DiffStatusAdded,
+		"sub":     DiffStatusAdded,
+		"deleted": DiffStatusRemoved,
+	}
+
+	t.Run("dryrun", func(t *testing.T) {
+		fc := newClient()
+		files := append([]fakeFile{}, fc.files...)
+		su := NewSyncRemote("s", "t", fc, DryRun(true))
+		require.NoError(t, su.Do(ctx))
+		assert.Equal(t, wantDiff, diff(su))
+		assert.Equal(t, files, fc.files)
+	})
+	t.Run("do", func(t *testing.T) {
+		fc := newClient()
+		su := NewSyncRemote("s", "t", fc)
+		require.NoError(t, su.Do(ctx))
+		assert.Equal(t, wantDiff, diff(su))
+		assert.Equal(t, []string{"add", "mod", "same", "sub"}, remoteNames(fc, "t"))
+		for p, content := range map[string]string{
+			"t/same":  "same",
+			"t/mod":   "new",
+			"t/add":   "add",
+			"t/sub/f": "f",
+		} {
+			assert.Equal(t, content, string(fc.content[fc.AbsPath(p)]), p)
+		}
+
+		su = NewSyncRemote("s", "t", fc)
+		require.NoError(t, su.Plan(ctx))
+		assert.Empty(t, su.Diff())
+	})
+}
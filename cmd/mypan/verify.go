@@ -0,0 +1,212 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"mypan/pkg/chunk"
+	"mypan/pkg/client"
+
+	"github.com/golang/glog"
+	"github.com/pkg/errors"
+)
+
+const (
+	VerifyResultOK       = "ok"
+	VerifyResultMismatch = "mismatch"
+	// VerifyResultMissing means the local file does not exist
+	VerifyResultMissing = "missing"
+	// VerifyResultUnknown means server did not provide content-md5
+	VerifyResultUnknown = "unknown"
+)
+
+type VerifyEntry struct {
+	Path      string `json:"path"`
+	LocalPath string `json:"local_path"`
+	Result    string `json:"result"`
+	RemoteMd5 string `json:"remote_md5,omitempty"`
+	LocalMd5  string `json:"local_md5,omitempty"`
+}
+
+// verifyFileMetasMax is the max number of fsids of a filemetas request
+const verifyFileMetasMax = 100
+
+// VerifyMan checks local files against content-md5 of remote ones without
+// downloading them.  Chunked files are checked against md5 in the manifest
+type VerifyMan struct {
+	client client.ClientI
+}
+
+func NewVerifyMan(client client.ClientI) *VerifyMan {
+	vm := &VerifyMan{
+		client: client,
+	}
+	return vm
+}
+
+func (vm *VerifyMan) Verify(
+	ctx context.Context,
+	relpath, localpath string,
+) ([]VerifyEntry, error) {
+	meta, err := vm.client.FileMetaByPath(ctx, relpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "meta")
+	}
+	if meta.IsDir == 0 {
+		ent, err := vm.verify(ctx, meta.Path, localpath, vm.headMd5(meta.DLink))
+		if err != nil {
+			return nil, err
+		}
+		return []VerifyEntry{ent}, nil
+	}
+
+	list, err := vm.client.ListAllEx(ctx, relpath)
+	if err != nil {
+		return nil, errors.Wrap(err, "list all")
+	}
+	// chunks are folded into the chunked file having a manifest, as are
+	// plain files shadowed by it
+	manifests := map[string]string{}
+	for _, f := range list.List {
+		if f.IsDir != 0 {
+			continue
+		}
+		if name, ok := chunk.ParseManifestName(f.ServerFilename); ok {
+			manifests[path.Join(path.Dir(f.Path), name)] = f.Path
+		}
+	}
+	var fsIds []uint64
+	for _, f := range list.List {
+		if f.IsDir != 0 {
+			continue
+		}
+		name, _, ok := chunk.ParseChunkName(f.ServerFilename)
+		if !ok {
+			name, ok = chunk.ParseManifestName(f.ServerFilename)
+		}
+		if !ok {
+			name = f.ServerFilename
+		}
+		if _, ok := manifests[path.Join(path.Dir(f.Path), name)]; ok {
+			continue
+		}
+		fsIds = append(fsIds, f.FsId)
+	}
+	abspath := vm.client.AbsPath(relpath)
+	var ents []VerifyEntry
+	for len(fsIds) > 0 {
+		n := len(fsIds)
+		if n > verifyFileMetasMax {
+			n = verifyFileMetasMax
+		}
+		metas, err := vm.client.FileMetas(ctx, fsIds[:n])
+		if err != nil {
+			return ents, errors.Wrap(err, "metas")
+		}
+		fsIds = fsIds[n:]
+		for _, meta := range metas.List {
+			localpath := filepath.Join(localpath, strings.TrimPrefix(meta.Path, abspath))
+			ent, err := vm.verify(ctx, meta.Path, localpath, vm.headMd5(meta.DLink))
+			if err != nil {
+				return ents, err
+			}
+			ents = append(ents, ent)
+		}
+	}
+	chunked := make([]string, 0, len(manifests))
+	for p := range manifests {
+		chunked = append(chunked, p)
+	}
+	sort.Strings(chunked)
+	for _, p := range chunked {
+		localpath := filepath.Join(localpath, strings.TrimPrefix(p, abspath))
+		ent, err := vm.verify(ctx, p, localpath, vm.manifestMd5(manifests[p]))
+		if err != nil {
+			return ents, err
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+// headMd5 returns content-md5 of remote file by HEAD request to dlink
+func (vm *VerifyMan) headMd5(dlink string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		httpResp, err := vm.client.HeadByDLink(ctx, dlink)
+		if err != nil {
+			return "", err
+		}
+		httpResp.Body.Close()
+		return httpResp.Header.Get("content-md5"), nil
+	}
+}
+
+// manifestMd5 returns md5 of chunked file recorded in manifest at abspath
+func (vm *VerifyMan) manifestMd5(abspath string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		manifest, err := readChunkManifest(ctx, vm.client, nil, abspath)
+		if err != nil {
+			return "", err
+		}
+		return manifest.Md5, nil
+	}
+}
+
+func (vm *VerifyMan) verify(
+	ctx context.Context,
+	abspath, localpath string,
+	remoteMd5 func(ctx context.Context) (string, error),
+) (VerifyEntry, error) {
+	ent := VerifyEntry{
+		Path:      abspath,
+		LocalPath: localpath,
+	}
+	localMd5, err := fileMd5(localpath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			ent.Result = VerifyResultMissing
+			return ent, nil
+		}
+		return ent, err
+	}
+	ent.LocalMd5 = localMd5
+
+	ent.RemoteMd5, err = remoteMd5(ctx)
+	if err != nil {
+		return ent, errors.Wrapf(err, "remote md5 %s", abspath)
+	}
+	switch {
+	case ent.RemoteMd5 == "":
+		glog.Warningf("%s: remote md5 absent", abspath)
+		ent.Result = VerifyResultUnknown
+	case strings.EqualFold(ent.RemoteMd5, localMd5):
+		ent.Result = VerifyResultOK
+	default:
+		ent.Result = VerifyResultMismatch
+	}
+	return ent, nil
+}
+
+// fileMd5 returns hex encoded md5 of file content
+func fileMd5(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
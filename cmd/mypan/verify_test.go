@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyMan(t *testing.T) {
+	ctx := context.Background()
+	local := t.TempDir()
+	writeFiles(t, local, map[string]string{
+		"ok":        "ok",
+		"mismatch":  "local",
+		"e/unknown": "unknown",
+	})
+	fc := newFakeClient()
+	fc.contentMd5 = true
+	fc.put(fc.AbsPath("d/ok"), []byte("ok"))
+	fc.put(fc.AbsPath("d/mismatch"), []byte("remote"))
+	fc.put(fc.AbsPath("d/missing"), []byte("missing"))
+	// no md5 from server
+	fc.addContent("d/e/unknown", []byte("unknown"))
+
+	ents, err := NewVerifyMan(fc).Verify(ctx, "d", local)
+	require.NoError(t, err)
+	results := map[string]string{}
+	for _, ent := range ents {
+		rel, err := filepath.Rel(local, ent.LocalPath)
+		require.NoError(t, err)
+		results[rel] = ent.Result
+	}
+	assert.Equal(t, map[string]string{
+		"ok":        VerifyResultOK,
+		"mismatch":  VerifyResultMismatch,
+		"missing":   VerifyResultMissing,
+		"e/unknown": VerifyResultUnknown,
+	}, results)
+
+	var metas []string
+	for _, call := range fc.calls {
+		if strings.HasPrefix(call, "FileMetas ") {
+			metas = append(metas, call)
+		}
+	}
+	// one batched request for files under d
+	assert.Equal(t, []string{"FileMetas 2 3 4 6"}, metas)
+}
+
+func TestVerifyManBatch(t *testing.T) {
+	ctx := context.Background()
+	local := t.TempDir()
+	fc := newFakeClient()
+	n := verifyFileMetasMax + 1
+	for i := 0; i < n; i++ {
+		fc.put(fc.AbsPath(fmt.Sprintf("d/%03d", i)), []byte("x"))
+	}
+	ents, err := NewVerifyMan(fc).Verify(ctx, "d", local)
+	require.NoError(t, err)
+	assert.Len(t, ents, n)
+	var metas []string
+	for _, call := range fc.calls {
+		if strings.HasPrefix(call, "FileMetas ") {
+			metas = append(metas, call)
+		}
+	}
+	require.Len(t, metas, 2)
+	assert.Len(t, strings.Fields(metas[0]), verifyFileMetasMax+1)
+	assert.Len(t, strings.Fields(metas[1]), 2)
+}
+
+func TestVerifyManChunked(t *testing.T) {
+	ctx := context.Background()
+	data := strings.Repeat("0123456789", 300)
+	local := t.TempDir()
+	writeFiles(t, local, map[string]string{
+		"ok":       data,
+		"mismatch": data[1:],
+	})
+	fc := newFakeClient()
+	fc.contentMd5 = true
+	fc.maxFileSize = 1000
+	for _, name := range []string{"ok", "mismatch", "missing"} {
+		_, err := NewChunkMan(fc, 0).Up(ctx, filepath.Join(local, "ok"), "d/"+name)
+		require.NoError(t, err)
+	}
+	// left over from an earlier upload, shadowed by the chunked one
+	fc.put(fc.AbsPath("d/ok"), []byte("old"))
+
+	ents, err := NewVerifyMan(fc).Verify(ctx, "d", local)
+	require.NoError(t, err)
+	results := map[string]string{}
+	for _, ent := range ents {
+		rel, err := filepath.Rel(local, ent.LocalPath)
+		require.NoError(t, err)
+		results[rel] = ent.Result
+	}
+	assert.Equal(t, map[string]string{
+		"ok":       VerifyResultOK,
+		"mismatch": VerifyResultMismatch,
+		"missing":  VerifyResultMissing,
+	}, results)
+}
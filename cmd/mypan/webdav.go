@@ -0,0 +1,482 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/webdav"
+)
+
+// WebdavFS implements webdav.FileSystem with RemoteFS
+type WebdavFS struct {
+	rfs *RemoteFS
+}
+
+var _ webdav.FileSystem = WebdavFS{}
+
+func NewWebdavFS(rfs *RemoteFS) WebdavFS {
+	wfs := WebdavFS{
+		rfs: rfs,
+	}
+	return wfs
+}
+
+func (wfs WebdavFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	return wfs.rfs.Mkdir(ctx, name)
+}
+
+func (wfs WebdavFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC|os.O_APPEND) != 0 {
+		// only whole file replacement as in PUT is supported
+		if flag&os.O_APPEND != 0 || flag&os.O_TRUNC == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrInvalid}
+		}
+		rfw, err := wfs.rfs.Create(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		return &webdavFile{w: rfw}, nil
+	}
+	info, err := wfs.rfs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &webdavFile{
+			ctx:  ctx,
+			wfs:  wfs,
+			name: name,
+			info: info,
+		}, nil
+	}
+	rfr, err := wfs.rfs.Open(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return &webdavFile{r: rfr, info: info}, nil
+}
+
+func (wfs WebdavFS) RemoveAll(ctx context.Context, name string) error {
+	return wfs.rfs.Remove(ctx, name)
+}
+
+func (wfs WebdavFS) Rename(ctx context.Context, oldName, newName string) error {
+	return wfs.rfs.Rename(ctx, oldName, newName)
+}
+
+func (wfs WebdavFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	info, err := wfs.rfs.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	return webdavFileInfo{info}, nil
+}
+
+// webdavFileInfo tells content type and etag without reading content
+type webdavFileInfo struct {
+	os.FileInfo
+}
+
+func (wfi webdavFileInfo) ContentType(ctx context.Context) (string, error) {
+	if ctype := mime.TypeByExtension(path.Ext(wfi.Name())); ctype != "" {
+		return ctype, nil
+	}
+	return "application/octet-stream", nil
+}
+
+func (wfi webdavFileInfo) ETag(ctx context.Context) (string, error) {
+	if rfi, ok := wfi.FileInfo.(RemoteFileInfo); ok && rfi.Md5() != "" {
+		return fmt.Sprintf(`"%s"`, rfi.Md5()), nil
+	}
+	return "", webdav.ErrNotImplemented
+}
+
+// webdavFile is a dir, a file opened for reading, or one for writing
+type webdavFile struct {
+	// dir
+	ctx     context.Context
+	wfs     WebdavFS
+	name    string
+	entries []os.FileInfo
+	listed  bool
+
+	info os.FileInfo
+	r    *RemoteFileReader
+	w    *RemoteFileWriter
+}
+
+func (wf *webdavFile) Close() error {
+	switch {
+	case wf.r != nil:
+		return wf.r.Close()
+	case wf.w != nil:
+		return wf.w.Close()
+	}
+	return nil
+}
+
+func (wf *webdavFile) Read(p []byte) (int, error) {
+	if wf.r == nil {
+		return 0, os.ErrInvalid
+	}
+	return wf.r.Read(p)
+}
+
+func (wf *webdavFile) Seek(offset int64, whence int) (int64, error) {
+	if wf.r == nil {
+		return 0, os.ErrInvalid
+	}
+	return wf.r.Seek(offset, whence)
+}
+
+func (wf *webdavFile) Write(p []byte) (int, error) {
+	if wf.w == nil {
+		return 0, os.ErrInvalid
+	}
+	return wf.w.Write(p)
+}
+
+func (wf *webdavFile) Readdir(count int) ([]os.FileInfo, error) {
+	if wf.info == nil || !wf.info.IsDir() {
+		return nil, ErrDirExpected
+	}
+	if !wf.listed {
+		infos, err := wf.wfs.rfs.ReadDir(wf.ctx, wf.name)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			wf.entries = append(wf.entries, webdavFileInfo{info})
+		}
+		wf.listed = true
+	}
+	if count <= 0 {
+		entries := wf.entries
+		wf.entries = nil
+		return entries, nil
+	}
+	if len(wf.entries) == 0 {
+		return nil, io.EOF
+	}
+	if count > len(wf.entries) {
+		count = len(wf.entries)
+	}
+	entries := wf.entries[:count]
+	wf.entries = wf.entries[count:]
+	return entries, nil
+}
+
+func (wf *webdavFile) Stat() (os.FileInfo, error) {
+	if wf.w != nil {
+		return wf.w.Stat()
+	}
+	return webdavFileInfo{wf.info}, nil
+}
+
+// webdavWriteMethods are methods making changes
+var webdavWriteMethods = map[string]bool{
+	http.MethodPut:    true,
+	http.MethodDelete: true,
+	"MKCOL":           true,
+	"COPY":            true,
+	"MOVE":            true,
+	"PROPPATCH":       true,
+}
+
+// NewWebdavHandler returns a WebDAV handler of rfs.  COPY is done on server
+// side instead of by reading and writing content.  PUT is handled here so
+// that an incomplete body never replaces the existing file.  Both honor
+// locks as webdav.Handler does
+func NewWebdavHandler(rfs *RemoteFS) http.Handler {
+	ls := webdav.NewMemLS()
+	h := &webdav.Handler{
+		FileSystem: NewWebdavFS(rfs),
+		LockSystem: ls,
+		Logger: func(req *http.Request, err error) {
+			if err != nil {
+				glog.Warningf("webdav: %s %s: %v", req.Method, req.URL.Path, err)
+			}
+		},
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// webdav.Handler answers PUT with 404 on any error of OpenFile
+		if rfs.readOnly && webdavWriteMethods[req.Method] {
+			http.Error(w, "read only", http.StatusForbidden)
+			return
+		}
+		switch req.Method {
+		case "COPY":
+			webdavCopy(rfs, ls, w, req)
+			return
+		case http.MethodPut:
+			webdavPut(rfs, ls, w, req)
+			return
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func webdavCopy(rfs *RemoteFS, ls webdav.LockSystem, w http.ResponseWriter, req *http.Request) {
+	u, err := url.Parse(req.Header.Get("Destination"))
+	if err != nil || u.Path == "" || (u.Host != "" && u.Host != req.Host) {
+		http.Error(w, "invalid destination", http.StatusBadRequest)
+		return
+	}
+	var (
+		ctx = req.Context()
+		src = path.Clean(req.URL.Path)
+		dst = path.Clean(u.Path)
+	)
+	if src == dst {
+		http.Error(w, "destination equals source", http.StatusForbidden)
+		return
+	}
+	// only dst is changed
+	release, status, err := webdavConfirmLocks(ls, req, "", dst)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer release()
+	if _, err := rfs.Stat(ctx, src); err != nil {
+		webdavError(w, err)
+		return
+	}
+	status = http.StatusCreated
+	if _, err := rfs.Stat(ctx, dst); err == nil {
+		if req.Header.Get("Overwrite") == "F" {
+			http.Error(w, "destination exists", http.StatusPreconditionFailed)
+			return
+		}
+		status = http.StatusNoContent
+	} else if !os.IsNotExist(err) {
+		webdavError(w, err)
+		return
+	}
+	if err := rfs.Copy(ctx, src, dst); err != nil {
+		webdavError(w, err)
+		return
+	}
+	w.WriteHeader(status)
+}
+
+// webdavPut uploads the request body only if it was received in whole.
+// webdav.Handler closes, thus uploads, the file even on copy errors
+func webdavPut(rfs *RemoteFS, ls webdav.LockSystem, w http.ResponseWriter, req *http.Request) {
+	ctx := req.Context()
+	name := path.Clean(req.URL.Path)
+	release, status, err := webdavConfirmLocks(ls, req, name, "")
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+	defer release()
+	rfw, err := rfs.Create(ctx, name)
+	if err != nil {
+		webdavError(w, err)
+		return
+	}
+	n, err := io.Copy(rfw, req.Body)
+	if err != nil {
+		rfw.Abort()
+		glog.Warningf("webdav: PUT %s: %v", name, err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.ContentLength >= 0 && n != req.ContentLength {
+		rfw.Abort()
+		glog.Warningf("webdav: PUT %s: got %d bytes, want %d", name, n, req.ContentLength)
+		http.Error(w, "incomplete body", http.StatusBadRequest)
+		return
+	}
+	if err := rfw.Close(); err != nil {
+		glog.Warningf("webdav: PUT %s: %v", name, err)
+		webdavError(w, err)
+		return
+	}
+	if info, err := rfs.Stat(ctx, name); err == nil {
+		if etag, err := (webdavFileInfo{info}).ETag(ctx); err == nil {
+			w.Header().Set("ETag", etag)
+		}
+	}
+	w.WriteHeader(http.StatusCreated)
+}
+
+// webdavConfirmLocks confirms that req may change src and dst, either of
+// which may be empty, as webdav.Handler does.  Without If header, src and
+// dst are locked for the request so that it fails on locks of others.  With
+// it, any of the lists of conditions in it has to hold.  release is to be
+// called once the change is done
+func webdavConfirmLocks(ls webdav.LockSystem, req *http.Request, src, dst string) (release func(), status int, err error) {
+	now := time.Now()
+	hdr := req.Header.Get("If")
+	if hdr == "" {
+		var tokens []string
+		release = func() {
+			for _, token := range tokens {
+				ls.Unlock(now, token)
+			}
+		}
+		for _, name := range []string{src, dst} {
+			if name == "" {
+				continue
+			}
+			token, err := ls.Create(now, webdav.LockDetails{
+				Root: name,
+				// no timeout, it's released with the request
+				Duration:  -1,
+				ZeroDepth: true,
+			})
+			if err == webdav.ErrLocked {
+				release()
+				return nil, http.StatusLocked, err
+			} else if err != nil {
+				release()
+				return nil, http.StatusInternalServerError, err
+			}
+			tokens = append(tokens, token)
+		}
+		return release, 0, nil
+	}
+	lists, ok := parseWebdavIf(hdr)
+	if !ok {
+		return nil, http.StatusBadRequest, fmt.Errorf("invalid If header")
+	}
+	for _, l := range lists {
+		name := src
+		if l.resource != "" {
+			u, err := url.Parse(l.resource)
+			if err != nil || u.Host != req.Host {
+				continue
+			}
+			name = u.Path
+		}
+		release, err := ls.Confirm(now, name, dst, l.conditions...)
+		if err == webdav.ErrConfirmationFailed {
+			continue
+		} else if err != nil {
+			return nil, http.StatusInternalServerError, err
+		}
+		return release, 0, nil
+	}
+	// RFC 4918 section 10.4.1, all lists failing fails the request
+	return nil, http.StatusPreconditionFailed, webdav.ErrLocked
+}
+
+// webdavIfList is a list of conditions in If header, all of which have to
+// hold for resource, or the request URL if resource is empty
+type webdavIfList struct {
+	resource   string
+	conditions []webdav.Condition
+}
+
+// parseWebdavIf parses If header of RFC 4918 section 10.4.  It's either
+// untagged lists
+//
+//	(<token> ["etag"]) (Not <token>)
+//
+// or lists each tagged with a resource
+//
+//	<http://host/a> (<token>) <http://host/b> (<token>)
+func parseWebdavIf(hdr string) ([]webdavIfList, bool) {
+	var (
+		lists    []webdavIfList
+		s        = strings.TrimSpace(hdr)
+		tagged   = strings.HasPrefix(s, "<")
+		resource string
+		n        int
+	)
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return lists, len(lists) > 0 && (!tagged || n > 0)
+		}
+		switch s[0] {
+		case '<':
+			if !tagged || (resource != "" && n == 0) {
+				return nil, false
+			}
+			end := strings.IndexByte(s, '>')
+			if end < 0 {
+				return nil, false
+			}
+			resource, n, s = s[1:end], 0, s[end+1:]
+		case '(':
+			l, rest, ok := parseWebdavIfList(s[1:])
+			if !ok {
+				return nil, false
+			}
+			l.resource = resource
+			lists = append(lists, l)
+			n, s = n+1, rest
+		default:
+			return nil, false
+		}
+	}
+}
+
+// parseWebdavIfList parses conditions of a list up to and including the
+// closing parenthesis
+func parseWebdavIfList(s string) (webdavIfList, string, bool) {
+	var l webdavIfList
+	for {
+		s = strings.TrimLeft(s, " \t")
+		if s == "" {
+			return l, "", false
+		}
+		if s[0] == ')' {
+			return l, s[1:], len(l.conditions) > 0
+		}
+		var c webdav.Condition
+		if rest := strings.TrimPrefix(s, "Not"); rest != s {
+			c.Not = true
+			s = strings.TrimLeft(rest, " \t")
+		}
+		if s == "" {
+			return l, "", false
+		}
+		var closer byte
+		switch s[0] {
+		case '<':
+			closer = '>'
+		case '[':
+			closer = ']'
+		default:
+			return l, "", false
+		}
+		end := strings.IndexByte(s, closer)
+		if end < 0 {
+			return l, "", false
+		}
+		if closer == '>' {
+			c.Token = s[1:end]
+		} else {
+			c.ETag = s[1:end]
+		}
+		l.conditions = append(l.conditions, c)
+		s = s[end+1:]
+	}
+}
+
+func webdavError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case os.IsNotExist(err):
+		status = http.StatusNotFound
+	case os.IsPermission(err):
+		status = http.StatusForbidden
+	}
+	http.Error(w, err.Error(), status)
+}
@@ -0,0 +1,153 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/webdav"
+)
+
+func TestWebdavHandler(t *testing.T) {
+	fc := newFakeClient().addContent("r/a.txt", []byte("hello"))
+	rfs := NewRemoteFS(fc, "r").TmpDir(t.TempDir())
+	h := NewWebdavHandler(rfs)
+	do := func(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("PROPFIND", "/", "", http.Header{"Depth": {"1"}})
+	assert.Equal(t, http.StatusMultiStatus, w.Code)
+	assert.Contains(t, w.Body.String(), "/a.txt")
+
+	w = do(http.MethodGet, "/a.txt", "", nil)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "hello", w.Body.String())
+
+	w = do(http.MethodPut, "/b.txt", "world", nil)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.Equal(t, "world", string(fc.content["/apps/x/r/b.txt"]))
+
+	// interrupted PUT keeps the old content
+	req := httptest.NewRequest(http.MethodPut, "/a.txt", strings.NewReader("hel"))
+	req.ContentLength = 5
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "hello", string(fc.content["/apps/x/r/a.txt"]))
+	req = httptest.NewRequest(http.MethodPut, "/a.txt", io.MultiReader(strings.NewReader("hel"), iotest.ErrReader(io.ErrUnexpectedEOF)))
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Equal(t, "hello", string(fc.content["/apps/x/r/a.txt"]))
+
+	assert.Equal(t, http.StatusBadRequest, do("COPY", "/a.txt", "", nil).Code)
+	assert.Equal(t, http.StatusForbidden, do("COPY", "/a.txt", "", http.Header{"Destination": {"/a.txt"}}).Code)
+	assert.Equal(t, http.StatusNotFound, do("COPY", "/nope", "", http.Header{"Destination": {"/c.txt"}}).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, do("COPY", "/a.txt", "", http.Header{
+		"Destination": {"/b.txt"},
+		"Overwrite":   {"F"},
+	}).Code)
+
+	ro := NewWebdavHandler(NewRemoteFS(fc, "r").ReadOnly(true))
+	req = httptest.NewRequest(http.MethodPut, "/c.txt", strings.NewReader("x"))
+	w = httptest.NewRecorder()
+	ro.ServeHTTP(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.NotContains(t, fc.content, "/apps/x/r/c.txt")
+}
+
+func TestWebdavLocks(t *testing.T) {
+	fc := newFakeClient().
+		addContent("r/a.txt", []byte("hello")).
+		addContent("r/b.txt", []byte("world"))
+	h := NewWebdavHandler(NewRemoteFS(fc, "r").TmpDir(t.TempDir()))
+	do := func(method, target, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do("LOCK", "/a.txt", `<?xml version="1.0" encoding="utf-8"?>
+<D:lockinfo xmlns:D="DAV:"><D:lockscope><D:exclusive/></D:lockscope><D:locktype><D:write/></D:locktype></D:lockinfo>`, nil)
+	require.Equal(t, http.StatusOK, w.Code)
+	token := w.Header().Get("Lock-Token")
+	require.NotEmpty(t, token)
+
+	// others can change neither by PUT nor by COPY
+	assert.Equal(t, http.StatusLocked, do(http.MethodPut, "/a.txt", "other", nil).Code)
+	assert.Equal(t, http.StatusLocked, do("COPY", "/b.txt", "", http.Header{"Destination": {"/a.txt"}}).Code)
+	assert.Equal(t, http.StatusPreconditionFailed, do(http.MethodPut, "/a.txt", "other", http.Header{
+		"If": {"(<opaquelocktoken:nope>)"},
+	}).Code)
+	assert.Equal(t, "hello", string(fc.content["/apps/x/r/a.txt"]))
+
+	// the lock holder can
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/a.txt", "mine", http.Header{
+		"If": {"(" + token + ")"},
+	}).Code)
+	assert.Equal(t, "mine", string(fc.content["/apps/x/r/a.txt"]))
+	assert.Equal(t, http.StatusNoContent, do("COPY", "/b.txt", "", http.Header{
+		"Destination": {"/a.txt"},
+		"If":          {"<http://example.com/a.txt> (" + token + ")"},
+	}).Code)
+
+	// unlocked resources are not affected
+	assert.Equal(t, http.StatusCreated, do(http.MethodPut, "/c.txt", "c", nil).Code)
+}
+
+func TestParseWebdavIf(t *testing.T) {
+	for _, c := range []struct {
+		hdr   string
+		lists []webdavIfList
+		ok    bool
+	}{
+		{
+			hdr: `(<t1> ["e1"]) (Not <t2>)`,
+			lists: []webdavIfList{
+				{conditions: []webdav.Condition{{Token: "t1"}, {ETag: `"e1"`}}},
+				{conditions: []webdav.Condition{{Not: true, Token: "t2"}}},
+			},
+			ok: true,
+		},
+		{
+			hdr: `<http://h/a> (<t1>) (<t2>) <http://h/b> (<t3>)`,
+			lists: []webdavIfList{
+				{resource: "http://h/a", conditions: []webdav.Condition{{Token: "t1"}}},
+				{resource: "http://h/a", conditions: []webdav.Condition{{Token: "t2"}}},
+				{resource: "http://h/b", conditions: []webdav.Condition{{Token: "t3"}}},
+			},
+			ok: true,
+		},
+		{hdr: `()`},
+		{hdr: `(<t1>`},
+		{hdr: `(<t1>) <http://h/a> (<t2>)`},
+		{hdr: `<http://h/a> <http://h/b> (<t2>)`},
+		{hdr: `<http://h/a>`},
+		{hdr: `(t1)`},
+	} {
+		lists, ok := parseWebdavIf(c.hdr)
+		assert.Equal(t, c.ok, ok, c.hdr)
+		if c.ok {
+			assert.Equal(t, c.lists, lists, c.hdr)
+		}
+	}
+}
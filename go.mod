@@ -3,13 +3,19 @@ module mypan
 go 1.18
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/dustin/go-humanize v1.0.1
 	github.com/golang/glog v1.1.2
 	github.com/jedib0t/go-pretty v4.3.0+incompatible
 	github.com/pkg/errors v0.9.1
+	github.com/robfig/cron/v3 v3.0.1
 	github.com/stretchr/testify v1.8.4
 	github.com/urfave/cli/v2 v2.25.7
+	golang.org/x/crypto v0.14.0
+	golang.org/x/net v0.17.0
 	golang.org/x/sync v0.4.0
+	golang.org/x/term v0.13.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -26,6 +32,5 @@ require (
 	github.com/russross/blackfriday/v2 v2.1.0 // indirect
 	github.com/xrash/smetrics v0.0.0-20201216005158-039620a65673 // indirect
 	go.mongodb.org/mongo-driver v1.11.3 // indirect
-	golang.org/x/sys v0.12.0 // indirect
-	gopkg.in/yaml.v3 v3.0.1 // indirect
+	golang.org/x/sys v0.13.0 // indirect
 )
@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+// Package chunk defines how a file larger than the per-file size limit is
+// stored as numbered chunk objects plus a manifest.  For file NAME, they are
+//
+//	NAME.mypanchunk.000
+//	NAME.mypanchunk.001
+//	...
+//	NAME.mypanchunks
+package chunk
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	ManifestSuffix = ".mypanchunks"
+	chunkInfix     = ".mypanchunk."
+
+	// ManifestVersion is the current version of manifest format
+	ManifestVersion = 1
+)
+
+type Chunk struct {
+	Name string `json:"name"`
+	Size int64  `json:"size"`
+	Md5  string `json:"md5"`
+}
+
+type Manifest struct {
+	Version   int     `json:"version"`
+	Size      int64   `json:"size"`
+	Md5       string  `json:"md5"`
+	ChunkSize int64   `json:"chunk_size"`
+	Chunks    []Chunk `json:"chunks"`
+}
+
+func ManifestName(name string) string {
+	return name + ManifestSuffix
+}
+
+// ParseManifestName returns name of the chunked file if manifestName is the
+// name of a manifest
+func ParseManifestName(manifestName string) (string, bool) {
+	name := strings.TrimSuffix(manifestName, ManifestSuffix)
+	if name == manifestName || name == "" {
+		return "", false
+	}
+	return name, true
+}
+
+func ChunkName(name string, i int) string {
+	return fmt.Sprintf("%s%s%03d", name, chunkInfix, i)
+}
+
+// ParseChunkName returns name of the chunked file and index of the chunk if
+// chunkName is the name of a chunk
+func ParseChunkName(chunkName string) (string, int, bool) {
+	i := strings.LastIndex(chunkName, chunkInfix)
+	if i <= 0 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(chunkName[i+len(chunkInfix):])
+	if err != nil || index < 0 {
+		return "", 0, false
+	}
+	return chunkName[:i], index, true
+}
+
+// Sizes returns sizes of chunks splitting size bytes
+func Sizes(size, chunkSize int64) []int64 {
+	var sizes []int64
+	for size > 0 {
+		n := chunkSize
+		if n > size {
+			n = size
+		}
+		sizes = append(sizes, n)
+		size -= n
+	}
+	return sizes
+}
+
+func ParseManifest(data []byte) (*Manifest, error) {
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	if m.Version != ManifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	var size int64
+	for _, c := range m.Chunks {
+		size += c.Size
+	}
+	if size != m.Size {
+		return nil, fmt.Errorf("manifest size %d != sum of chunk sizes %d", m.Size, size)
+	}
+	return &m, nil
+}
@@ -0,0 +1,65 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package chunk
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNames(t *testing.T) {
+	name, ok := ParseManifestName(ManifestName("a.iso"))
+	assert.True(t, ok)
+	assert.Equal(t, "a.iso", name)
+	_, ok = ParseManifestName("a.iso")
+	assert.False(t, ok)
+	_, ok = ParseManifestName(ManifestSuffix)
+	assert.False(t, ok)
+
+	name, i, ok := ParseChunkName(ChunkName("a.iso", 12))
+	assert.True(t, ok)
+	assert.Equal(t, "a.iso", name)
+	assert.Equal(t, 12, i)
+	for _, s := range []string{"a.iso", "a.mypanchunk.x", ".mypanchunk.001"} {
+		_, _, ok := ParseChunkName(s)
+		assert.False(t, ok, s)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	assert.Nil(t, Sizes(0, 10))
+	assert.Equal(t, []int64{10}, Sizes(10, 10))
+	assert.Equal(t, []int64{10, 10, 1}, Sizes(21, 10))
+}
+
+func TestParseManifest(t *testing.T) {
+	m := Manifest{
+		Version:   ManifestVersion,
+		Size:      21,
+		ChunkSize: 10,
+		Chunks: []Chunk{
+			{Name: ChunkName("a", 0), Size: 10},
+			{Name: ChunkName("a", 1), Size: 10},
+			{Name: ChunkName("a", 2), Size: 1},
+		},
+	}
+	data, err := json.Marshal(m)
+	require.NoError(t, err)
+	got, err := ParseManifest(data)
+	require.NoError(t, err)
+	assert.Equal(t, m, *got)
+
+	m.Size = 20
+	data, _ = json.Marshal(m)
+	_, err = ParseManifest(data)
+	assert.Error(t, err)
+
+	m.Version = ManifestVersion + 1
+	data, _ = json.Marshal(m)
+	_, err = ParseManifest(data)
+	assert.Error(t, err)
+}
@@ -46,6 +46,7 @@ const (
 	ONDUP_NEWCOPY   = "newcopy"
 	ONDUP_SKIP      = "skip" // method: filemanager
 
+	RTYPE_FAIL      = 0 // fail if path conflict
 	RTYPE_NEWCOPY   = 1 // newcopy if path conflict
 	RTYPE_NEWCOPY2  = 2 // newcopy if path conflict & blockList differ
 	RTYPE_OVERWRITE = 3 // overwrite if path conflict
@@ -66,6 +67,10 @@ type UploadResponse struct {
 	Mtime uint64 `json:"mtime"`
 	Md5   string `json:"md5"`
 	FsId  uint64 `json:"fs_id"`
+
+	// Skipped is set when dst exists and ONDUP_SKIP is in effect.  Other
+	// fields are then that of the existing file
+	Skipped bool `json:"skipped,omitempty"`
 }
 
 const (
@@ -139,12 +144,37 @@ type UinfoResponse struct {
 	VipType int `json:"vip_type"`
 }
 
+type FileManagerInfo struct {
+	Errno int    `json:"errno"`
+	Path  string `json:"path"`
+	// To is the resulting path when reported by server
+	To string `json:"to,omitempty"`
+
+	// Dest is the resulting path of copy, move, rename.  It's filled by
+	// client, with the name chosen by server for ONDUP_NEWCOPY, and left
+	// empty for entries skipped with ONDUP_SKIP.  DestUnknown is set when
+	// the name of a new copy can not be told
+	Dest        string `json:"dest,omitempty"`
+	DestUnknown bool   `json:"dest_unknown,omitempty"`
+}
+
 type FileManagerResponse struct {
-	Info []struct {
-		Errno int    `json:"errno"`
-		Path  string `json:"path"`
-	} `json:"info"`
-	TaskId uint64 `json:"taskid"`
+	Info   []FileManagerInfo `json:"info"`
+	TaskId uint64            `json:"taskid"`
+}
+
+const (
+	TASK_STATUS_PENDING = "pending"
+	TASK_STATUS_RUNNING = "running"
+	TASK_STATUS_SUCCESS = "success"
+	TASK_STATUS_FAILED  = "failed"
+)
+
+type TaskQueryResponse struct {
+	Errno     int               `json:"errno"`
+	Status    string            `json:"status"`
+	TaskErrno int               `json:"task_errno"`
+	List      []FileManagerInfo `json:"list"`
 }
 
 type FileMetaResponse struct {
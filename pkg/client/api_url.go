@@ -39,6 +39,15 @@ func newFileAPIURL() *url.URL {
 	return u
 }
 
+func newTaskQueryAPIURL() *url.URL {
+	u := &url.URL{
+		Scheme: SchemeHTTPS,
+		Host:   HostPanBaiduCom,
+		Path:   "/share/taskquery",
+	}
+	return u
+}
+
 func newMultimediaAPIURL() *url.URL {
 	u := &url.URL{
 		Scheme: SchemeHTTPS,
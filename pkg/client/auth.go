@@ -13,10 +13,30 @@ import (
 	"github.com/golang/glog"
 )
 
+const (
+	// Refresh token is valid for 10 years according to the doc
+	REFRESH_TOKEN_EXPIRES = 10 * 365 * 24 * time.Hour
+)
+
 type AccessAuth struct {
-	AccessToken           string
-	AccessTokenExpireTime time.Time
-	RefreshToken          string
+	AccessToken            string
+	AccessTokenExpireTime  time.Time
+	RefreshToken           string
+	RefreshTokenExpireTime time.Time
+	Scope                  string
+}
+
+// NewAccessAuth makes AccessAuth from token response received at now
+func NewAccessAuth(resp OauthTokenResponse, now time.Time) AccessAuth {
+	expires := time.Duration(resp.ExpiresIn) * time.Second
+	accessAuth := AccessAuth{
+		AccessToken:            resp.AccessToken,
+		AccessTokenExpireTime:  now.Add(expires),
+		RefreshToken:           resp.RefreshToken,
+		RefreshTokenExpireTime: now.Add(REFRESH_TOKEN_EXPIRES),
+		Scope:                  resp.Scope,
+	}
+	return accessAuth
 }
 
 func (client *Client) OauthGetDeviceCode(ctx context.Context) (OauthDeviceCodeResponse, error) {
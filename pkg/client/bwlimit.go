@@ -0,0 +1,254 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package client
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BwRate is bandwidth limit in bytes per second.  Zero means unlimited
+type BwRate struct {
+	Up   int64
+	Down int64
+}
+
+type BwScheduleEntry struct {
+	// Minute is minutes since midnight
+	Minute int
+	Rate   BwRate
+}
+
+// BwSchedule is a list of rates sorted by time of the day.  A rate takes
+// effect from its time till that of the next entry
+type BwSchedule []BwScheduleEntry
+
+// ParseBwSchedule parses bandwidth limit spec.  It can be a single rate like
+// "10M", or a space separated list of TIME,RATE like "08:00,2M 19:00,off".
+//
+// RATE is bytes per second with optional suffix K, M, G in powers of 1024, or
+// "off" for unlimited.  Separate upload and download rate can be given in the
+// form UP:DOWN, e.g. "10M:off"
+func ParseBwSchedule(s string) (BwSchedule, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 1 && !strings.Contains(fields[0], ",") {
+		rate, err := parseBwRate(fields[0])
+		if err != nil {
+			return nil, err
+		}
+		return BwSchedule{{Rate: rate}}, nil
+	}
+	var sched BwSchedule
+	for _, field := range fields {
+		parts := strings.SplitN(field, ",", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("bwlimit %q: want TIME,RATE", field)
+		}
+		t, err := time.Parse("15:04", parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("bwlimit %q: bad time %q", field, parts[0])
+		}
+		rate, err := parseBwRate(parts[1])
+		if err != nil {
+			return nil, err
+		}
+		sched = append(sched, BwScheduleEntry{
+			Minute: t.Hour()*60 + t.Minute(),
+			Rate:   rate,
+		})
+	}
+	sort.SliceStable(sched, func(i, j int) bool {
+		return sched[i].Minute < sched[j].Minute
+	})
+	return sched, nil
+}
+
+func parseBwRate(s string) (BwRate, error) {
+	var rate BwRate
+	parts := strings.SplitN(s, ":", 2)
+	up, err := parseBwBytes(parts[0])
+	if err != nil {
+		return rate, err
+	}
+	down := up
+	if len(parts) == 2 {
+		down, err = parseBwBytes(parts[1])
+		if err != nil {
+			return rate, err
+		}
+	}
+	rate.Up = up
+	rate.Down = down
+	return rate, nil
+}
+
+func parseBwBytes(s string) (int64, error) {
+	if s == "off" {
+		return 0, nil
+	}
+	if s == "" {
+		return 0, fmt.Errorf("empty bwlimit rate")
+	}
+	mult := int64(1)
+	switch suffix := strings.ToUpper(s[len(s)-1:]); suffix {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult != 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad bwlimit rate %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// RateAt returns the rate in effect at time t
+func (sched BwSchedule) RateAt(t time.Time) BwRate {
+	if len(sched) == 0 {
+		return BwRate{}
+	}
+	minute := t.Hour()*60 + t.Minute()
+	// before the first entry, the last one of the previous day is in effect
+	rate := sched[len(sched)-1].Rate
+	for _, ent := range sched {
+		if ent.Minute > minute {
+			break
+		}
+		rate = ent.Rate
+	}
+	return rate
+}
+
+// bwLimitReadSize caps size of each read through a limiter so that waits
+// are short and rate changes take effect soon
+const bwLimitReadSize = 32 << 10
+
+// BwLimiter is a token bucket shared by all readers it wraps
+type BwLimiter struct {
+	rateFunc func(t time.Time) int64
+
+	mu     *sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func NewBwLimiter(rateFunc func(t time.Time) int64) *BwLimiter {
+	bl := &BwLimiter{
+		rateFunc: rateFunc,
+
+		mu: &sync.Mutex{},
+	}
+	return bl
+}
+
+// WaitN takes n tokens from the bucket, waiting for them if necessary
+func (bl *BwLimiter) WaitN(ctx context.Context, n int) error {
+	wait := bl.reserve(n, time.Now())
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (bl *BwLimiter) reserve(n int, now time.Time) time.Duration {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	rate := bl.rateFunc(now)
+	if rate <= 0 {
+		bl.tokens = 0
+		bl.last = now
+		return 0
+	}
+	if !bl.last.IsZero() {
+		bl.tokens += now.Sub(bl.last).Seconds() * float64(rate)
+	}
+	bl.last = now
+	// allow bursts of at most one second
+	if burst := float64(rate); bl.tokens > burst {
+		bl.tokens = burst
+	}
+	bl.tokens -= float64(n)
+	if bl.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-bl.tokens / float64(rate) * float64(time.Second))
+}
+
+type bwLimitReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *BwLimiter
+}
+
+// newBwLimitReader returns r as is if limiter is nil
+func newBwLimitReader(ctx context.Context, r io.Reader, limiter *BwLimiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	blr := bwLimitReader{
+		ctx:     ctx,
+		reader:  r,
+		limiter: limiter,
+	}
+	return blr
+}
+
+func (blr bwLimitReader) Read(p []byte) (int, error) {
+	if len(p) > bwLimitReadSize {
+		p = p[:bwLimitReadSize]
+	}
+	n, err := blr.reader.Read(p)
+	if n > 0 {
+		if err := blr.limiter.WaitN(blr.ctx, n); err != nil {
+			return n, err
+		}
+	}
+	return n, err
+}
+
+func (blr bwLimitReader) Len() int {
+	if l, ok := blr.reader.(lenI); ok {
+		return l.Len()
+	}
+	return -1
+}
+
+type bwLimitReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func newBwLimitReadCloser(ctx context.Context, rc io.ReadCloser, limiter *BwLimiter) io.ReadCloser {
+	if limiter == nil {
+		return rc
+	}
+	blrc := bwLimitReadCloser{
+		Reader: newBwLimitReader(ctx, rc, limiter),
+		Closer: rc,
+	}
+	return blrc
+}
@@ -0,0 +1,88 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBwSchedule(t *testing.T) {
+	at := func(hhmm string) time.Time {
+		tm, err := time.Parse("15:04", hhmm)
+		require.NoError(t, err)
+		return tm
+	}
+	for _, c := range []struct {
+		Name  string
+		Spec  string
+		Err   bool
+		Rates map[string]BwRate
+	}{
+		{
+			Name: "empty",
+			Spec: "",
+			Rates: map[string]BwRate{
+				"12:00": {},
+			},
+		}, {
+			Name: "single",
+			Spec: "10M",
+			Rates: map[string]BwRate{
+				"00:00": {Up: 10 << 20, Down: 10 << 20},
+			},
+		}, {
+			Name: "updown",
+			Spec: "1.5K:off",
+			Rates: map[string]BwRate{
+				"00:00": {Up: 1536},
+			},
+		}, {
+			Name: "schedule",
+			Spec: "19:00,off 08:00,2M:4M",
+			Rates: map[string]BwRate{
+				"07:59": {},
+				"08:00": {Up: 2 << 20, Down: 4 << 20},
+				"18:59": {Up: 2 << 20, Down: 4 << 20},
+				"19:00": {},
+			},
+		}, {
+			Name: "bad-rate",
+			Spec: "10X",
+			Err:  true,
+		}, {
+			Name: "bad-time",
+			Spec: "25:00,1M",
+			Err:  true,
+		}, {
+			Name: "missing-rate",
+			Spec: "08:00,1M 19:00",
+			Err:  true,
+		},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			sched, err := ParseBwSchedule(c.Spec)
+			if c.Err {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			for hhmm, rate := range c.Rates {
+				assert.Equal(t, rate, sched.RateAt(at(hhmm)), hhmm)
+			}
+		})
+	}
+}
+
+func TestBwLimiter(t *testing.T) {
+	bl := NewBwLimiter(func(time.Time) int64 { return 100 })
+	now := time.Now()
+	assert.Equal(t, time.Duration(0), bl.reserve(0, now))
+	assert.Equal(t, time.Second, bl.reserve(100, now))
+	// tokens are refilled over time
+	assert.Equal(t, time.Duration(0), bl.reserve(100, now.Add(2*time.Second)))
+}
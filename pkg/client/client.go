@@ -13,6 +13,7 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"time"
 
 	"mypan/pkg/config"
 
@@ -28,15 +29,25 @@ type Config struct {
 	AccessAuth AccessAuth
 
 	AppBaseDir string
+	// TmpDir is where content of unknown size is spooled before upload.
+	// os.TempDir() is used if empty
+	TmpDir string
+
+	// BwSchedule limits upload and download bandwidth.  The limits are
+	// shared by all transfers of the client
+	BwSchedule BwSchedule
 }
 
 type Client struct {
 	cfg Config
 
-	httpclient *http.Client
+	httpclient  *http.Client
+	bwLimitUp   *BwLimiter
+	bwLimitDown *BwLimiter
 
 	mu         *sync.Mutex
 	accessAuth AccessAuth
+	vipType    *int
 }
 
 func New(cfg Config) *Client {
@@ -52,6 +63,14 @@ func New(cfg Config) *Client {
 
 		mu: &sync.Mutex{},
 	}
+	if sched := cfg.BwSchedule; len(sched) > 0 {
+		client.bwLimitUp = NewBwLimiter(func(t time.Time) int64 {
+			return sched.RateAt(t).Up
+		})
+		client.bwLimitDown = NewBwLimiter(func(t time.Time) int64 {
+			return sched.RateAt(t).Down
+		})
+	}
 	return client
 }
 
@@ -202,6 +221,7 @@ type ClientI interface {
 	CheckAccessAuth(ctx context.Context) error
 
 	UInfo(ctx context.Context) (UinfoResponse, error)
+	MaxFileSize(ctx context.Context) (int64, error)
 	Quota(ctx context.Context) (QuotaResponse, error)
 
 	FileMetaByPath(ctx context.Context, relpath string) (FileMetaResponse, error)
@@ -218,12 +238,33 @@ type ClientI interface {
 	Upload(
 		ctx context.Context,
 		src, dst string,
+		opts ...WriteOpt,
+	) (UploadResponse, error)
+	UploadReader(
+		ctx context.Context,
+		r io.Reader,
+		size int64,
+		dst string,
+		opts ...WriteOpt,
 	) (UploadResponse, error)
+	UploadReadSeeker(
+		ctx context.Context,
+		r io.ReadSeeker,
+		size int64,
+		dst string,
+		opts ...WriteOpt,
+	) (UploadResponse, error)
+	NewUploadSession(
+		ctx context.Context,
+		dst string,
+		opts ...WriteOpt,
+	) (UploadSessionI, error)
 
 	List(ctx context.Context, dir string, start int) (ListResponse, error)
 	ListEx(ctx context.Context, dir string) (ListResponse, error)
 	ListAll(ctx context.Context, dir string, start int) (ListAllResponse, error)
 	ListAllEx(ctx context.Context, dir string) (ListAllResponse, error)
+	Mkdir(ctx context.Context, dir string) (UploadResponse, error)
 
 	Delete(
 		ctx context.Context,
@@ -236,13 +277,32 @@ type ClientI interface {
 	Rename(
 		ctx context.Context,
 		path, newname string,
+		opts ...WriteOpt,
 	) (FileManagerResponse, error)
 	Copy(
 		ctx context.Context,
 		path, dest string,
+		opts ...WriteOpt,
 	) (FileManagerResponse, error)
 	Move(
 		ctx context.Context,
 		path, dest string,
+		opts ...WriteOpt,
+	) (FileManagerResponse, error)
+	RenameMulti(
+		ctx context.Context,
+		pairs [][2]string,
+		opts ...WriteOpt,
+	) (FileManagerResponse, error)
+	CopyMulti(
+		ctx context.Context,
+		pairs [][2]string,
+		opts ...WriteOpt,
+	) (FileManagerResponse, error)
+	MoveMulti(
+		ctx context.Context,
+		pairs [][2]string,
+		opts ...WriteOpt,
 	) (FileManagerResponse, error)
+	TaskQuery(ctx context.Context, taskId uint64) (TaskQueryResponse, error)
 }
@@ -5,6 +5,7 @@ package client
 
 import (
 	"context"
+	"io"
 
 	"mypan/pkg/config"
 
@@ -29,11 +30,62 @@ func (roc *ReadOnlyClient) log(fmtStr string, args ...interface{}) {
 func (roc *ReadOnlyClient) Upload(
 	ctx context.Context,
 	src, dst string,
+	opts ...WriteOpt,
 ) (UploadResponse, error) {
 	roc.log("skip: upload: src %q, dst %q", src, dst)
 	return UploadResponse{}, nil
 }
 
+func (roc *ReadOnlyClient) UploadReader(
+	ctx context.Context,
+	r io.Reader,
+	size int64,
+	dst string,
+	opts ...WriteOpt,
+) (UploadResponse, error) {
+	roc.log("skip: upload: reader, size %d, dst %q", size, dst)
+	return UploadResponse{}, nil
+}
+
+func (roc *ReadOnlyClient) UploadReadSeeker(
+	ctx context.Context,
+	r io.ReadSeeker,
+	size int64,
+	dst string,
+	opts ...WriteOpt,
+) (UploadResponse, error) {
+	roc.log("skip: upload: reader, size %d, dst %q", size, dst)
+	return UploadResponse{}, nil
+}
+
+func (roc *ReadOnlyClient) NewUploadSession(
+	ctx context.Context,
+	dst string,
+	opts ...WriteOpt,
+) (UploadSessionI, error) {
+	return readOnlyUploadSession{roc: roc, dst: dst}, nil
+}
+
+type readOnlyUploadSession struct {
+	roc *ReadOnlyClient
+	dst string
+}
+
+func (us readOnlyUploadSession) WriteAt(ctx context.Context, off int64, r io.Reader) (int64, error) {
+	n, err := io.Copy(io.Discard, r)
+	us.roc.log("skip: upload piece: dst %q, offset %d, size %d", us.dst, off, n)
+	return n, err
+}
+
+func (us readOnlyUploadSession) Create(ctx context.Context, blockList []string, size int64) (UploadResponse, error) {
+	us.roc.log("skip: upload: blocks %d, size %d, dst %q", len(blockList), size, us.dst)
+	return UploadResponse{}, nil
+}
+
+func (us readOnlyUploadSession) Close() error {
+	return nil
+}
+
 func (roc *ReadOnlyClient) Delete(
 	ctx context.Context,
 	file string,
@@ -49,3 +101,11 @@ func (roc *ReadOnlyClient) DeleteMulti(
 	roc.log("skip: delete multi: file list %q", fileList)
 	return FileManagerResponse{}, nil
 }
+
+func (roc *ReadOnlyClient) Mkdir(
+	ctx context.Context,
+	dir string,
+) (UploadResponse, error) {
+	roc.log("skip: mkdir: dir %q", dir)
+	return UploadResponse{}, nil
+}
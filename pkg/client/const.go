@@ -22,6 +22,20 @@ const (
 	UPLOAD_API_BLOCK_SIZE = 4 * MiB
 )
 
+// UinfoResponse.VipType values
+const (
+	VIP_TYPE_NORMAL = 0
+	VIP_TYPE_VIP    = 1
+	VIP_TYPE_SVIP   = 2
+)
+
+// Per-file size limit by vip type
+const (
+	MAX_FILE_SIZE_NORMAL = 4 * GiB
+	MAX_FILE_SIZE_VIP    = 20 * GiB
+	MAX_FILE_SIZE_SVIP   = 50 * GiB
+)
+
 const (
 	ContentTypeFormUrlEncoded = "application/x-www-form-urlencoded"
 )
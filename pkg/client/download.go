@@ -69,12 +69,12 @@ func (client *Client) DownloadByDLink(ctx context.Context, dlink string, opts ..
 	if err != nil {
 		return nil, errors.Wrapf(err, "http get %s", dlink)
 	}
+	var (
+		contentLen = httpResp.ContentLength
+		total      = contentLen
+		done       = int64(0)
+	)
 	if xlt := xloadTracker(ctx); xlt != nil {
-		var (
-			contentLen = httpResp.ContentLength
-			total      = contentLen
-			done       = int64(0)
-		)
 		if ranges := httpResp.Header.Get("content-range"); ranges != "" {
 			var (
 				unit  string
@@ -88,8 +88,8 @@ func (client *Client) DownloadByDLink(ctx context.Context, dlink string, opts ..
 			}
 			done = total - contentLen
 		}
-		httpResp.Body = newReadCloseTrackerWithCtx(ctx, httpResp.Body, total, done)
 	}
+	httpResp.Body = newReadCloseTrackerWithCtx(ctx, httpResp.Body, client.bwLimitDown, total, done)
 	return httpResp, nil
 }
 
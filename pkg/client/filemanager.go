@@ -7,10 +7,15 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"fmt"
 	"net/url"
-	"path/filepath"
+	"path"
+	"regexp"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/golang/glog"
 	"github.com/pkg/errors"
 )
 
@@ -21,6 +26,10 @@ const (
 	opDelete = "delete"
 )
 
+// fileManagerBatchSize is the max number of entries in one filemanager call.
+// Larger lists are split
+const fileManagerBatchSize = 500
+
 const (
 	asyncNo   = 0 // 同步
 	asyncAuto = 1 // 自适应
@@ -39,77 +48,282 @@ func (client *Client) DeleteMulti(
 	ctx context.Context,
 	fileList []string,
 ) (FileManagerResponse, error) {
-	fileList1 := make([]string, len(fileList))
+	fileList1 := make([]interface{}, len(fileList))
 	for i, file := range fileList {
 		fileList1[i] = client.AbsPath(file)
 	}
-	resp, err := client.doFileManager(ctx, opDelete, fileList1)
+	resp, err := client.doFileManager(ctx, opDelete, fileList1, writeOpts{})
 	return resp, err
 }
 
 func (client *Client) Rename(
 	ctx context.Context,
 	path, newname string,
+	opts ...WriteOpt,
 ) (FileManagerResponse, error) {
-	resp, err := client.renameMulti(ctx, [2]string{path, newname})
+	resp, err := client.RenameMulti(ctx, [][2]string{{path, newname}}, opts...)
 	return resp, err
 }
 
-func (client *Client) renameMulti(
+// RenameMulti renames each pairs[i][0] to name pairs[i][1] in the same dir
+func (client *Client) RenameMulti(
 	ctx context.Context,
-	pairs ...[2]string,
+	pairs [][2]string,
+	opts ...WriteOpt,
 ) (FileManagerResponse, error) {
-	var filelist []map[string]string
+	var (
+		wo       = newWriteOpts(opts...)
+		filelist []interface{}
+		dests    []string
+	)
 	for _, p := range pairs {
+		abspath := client.AbsPath(p[0])
 		filelist = append(filelist, map[string]string{
-			"path":    client.AbsPath(p[0]),
+			"path":    abspath,
 			"newname": p[1],
 		})
+		dests = append(dests, path.Join(path.Dir(abspath), p[1]))
 	}
-	resp, err := client.doFileManager(ctx, opRename, filelist)
+	resp, err := client.doFileManagerDests(ctx, opRename, filelist, dests, wo)
 	return resp, err
 }
 
 func (client *Client) Copy(
 	ctx context.Context,
 	path, dest string,
+	opts ...WriteOpt,
 ) (FileManagerResponse, error) {
-	resp, err := client.copyMoveMulti(ctx, opCopy, [2]string{path, dest})
+	resp, err := client.CopyMulti(ctx, [][2]string{{path, dest}}, opts...)
+	return resp, err
+}
+
+// CopyMulti copies each pairs[i][0] to path pairs[i][1]
+func (client *Client) CopyMulti(
+	ctx context.Context,
+	pairs [][2]string,
+	opts ...WriteOpt,
+) (FileManagerResponse, error) {
+	resp, err := client.copyMoveMulti(ctx, opCopy, newWriteOpts(opts...), pairs)
 	return resp, err
 }
 
 func (client *Client) Move(
 	ctx context.Context,
 	path, dest string,
+	opts ...WriteOpt,
 ) (FileManagerResponse, error) {
-	resp, err := client.copyMoveMulti(ctx, opMove, [2]string{path, dest})
+	resp, err := client.MoveMulti(ctx, [][2]string{{path, dest}}, opts...)
+	return resp, err
+}
+
+// MoveMulti moves each pairs[i][0] to path pairs[i][1]
+func (client *Client) MoveMulti(
+	ctx context.Context,
+	pairs [][2]string,
+	opts ...WriteOpt,
+) (FileManagerResponse, error) {
+	resp, err := client.copyMoveMulti(ctx, opMove, newWriteOpts(opts...), pairs)
 	return resp, err
 }
 
 func (client *Client) copyMoveMulti(
 	ctx context.Context,
 	op string,
-	pairs ...[2]string,
+	wo writeOpts,
+	pairs [][2]string,
 ) (FileManagerResponse, error) {
-	var filelist []map[string]string
+	var (
+		filelist []interface{}
+		dests    []string
+	)
 	for _, p := range pairs {
 		dest := client.AbsPath(p[1])
-		newname := filepath.Base(dest)
-		dest = filepath.Dir(dest)
+		newname := path.Base(dest)
 		filelist = append(filelist, map[string]string{
 			"path":    client.AbsPath(p[0]),
-			"dest":    dest,
+			"dest":    path.Dir(dest),
 			"newname": newname,
 		})
+		dests = append(dests, dest)
 	}
-	resp, err := client.doFileManager(ctx, op, filelist)
+	resp, err := client.doFileManagerDests(ctx, op, filelist, dests, wo)
 	return resp, err
 }
 
+// doFileManagerDests does op then fills resulting paths of entries.  With
+// ONDUP_SKIP and ONDUP_NEWCOPY, dirs of dests are listed before op to tell
+// which dests exist.  With ONDUP_NEWCOPY, dirs where a new copy is made
+// and its name is not returned by server are listed again after op
+func (client *Client) doFileManagerDests(
+	ctx context.Context,
+	op string,
+	filelist []interface{},
+	dests []string,
+	wo writeOpts,
+) (FileManagerResponse, error) {
+	var before map[string]map[string]bool
+	if wo.ondup == ONDUP_SKIP || wo.ondup == ONDUP_NEWCOPY {
+		var err error
+		before, err = client.listDestDirs(ctx, dests)
+		if err != nil {
+			return FileManagerResponse{}, err
+		}
+	}
+	resp, err := client.doFileManager(ctx, op, filelist, wo)
+	listAfter := func(dir string) map[string]bool {
+		names, err := client.listDirNames(ctx, dir)
+		if err != nil {
+			glog.Warningf("%s: find names of new copies: %v", op, err)
+		}
+		return names
+	}
+	resp.setDests(wo, dests, before, listAfter)
+	return resp, err
+}
+
+// listDestDirs returns names in parent dirs of dests, keyed by dir.  Dirs
+// not existing are taken as empty
+func (client *Client) listDestDirs(ctx context.Context, dests []string) (map[string]map[string]bool, error) {
+	dirs := map[string]map[string]bool{}
+	for _, dest := range dests {
+		dir := path.Dir(dest)
+		if _, ok := dirs[dir]; ok {
+			continue
+		}
+		names, err := client.listDirNames(ctx, dir)
+		if err != nil {
+			return nil, err
+		}
+		dirs[dir] = names
+	}
+	return dirs, nil
+}
+
+// listDirNames returns names in dir.  Dir not existing is taken as empty
+func (client *Client) listDirNames(ctx context.Context, dir string) (map[string]bool, error) {
+	resp, err := client.ListEx(ctx, dir)
+	if err != nil && !ErrIsNotExist(err) {
+		return nil, errors.Wrapf(err, "list %q", dir)
+	}
+	names := map[string]bool{}
+	for _, ent := range resp.List {
+		names[path.Base(ent.Path)] = true
+	}
+	return names, nil
+}
+
+// setDests fills resulting paths of successful entries.  Entries are in the
+// order of the request.  before is names in dirs of dests listed before the
+// operation.  listAfter lists names in dir after the operation, and is
+// called at most once for each dir, only for new copies whose name is not
+// returned by server.  Dest is left empty for entries skipped with
+// ONDUP_SKIP, and for new copies whose name is not known, which are marked
+// with DestUnknown
+func (resp *FileManagerResponse) setDests(wo writeOpts, dests []string, before map[string]map[string]bool, listAfter func(dir string) map[string]bool) {
+	if len(resp.Info) != len(dests) {
+		return
+	}
+	after := map[string]map[string]bool{}
+	for i := range resp.Info {
+		info := &resp.Info[i]
+		if info.Errno != 0 {
+			continue
+		}
+		var (
+			dest   = dests[i]
+			dir    = path.Dir(dest)
+			name   = path.Base(dest)
+			names  = before[dir]
+			exists = names[name]
+		)
+		switch {
+		case !exists:
+			info.Dest = dest
+		case wo.ondup == ONDUP_SKIP:
+		case wo.ondup == ONDUP_NEWCOPY:
+			if info.To != "" && path.Dir(info.To) == dir {
+				info.Dest = info.To
+				name = path.Base(info.To)
+				break
+			}
+			afterNames, ok := after[dir]
+			if !ok {
+				afterNames = listAfter(dir)
+				after[dir] = afterNames
+			}
+			if newname := newCopyName(name, names, afterNames); newname != "" {
+				info.Dest = path.Join(dir, newname)
+				name = newname
+			} else {
+				info.DestUnknown = true
+			}
+		default:
+			info.Dest = dest
+		}
+		// taken by this entry for later ones of the same dest
+		if names != nil {
+			names[name] = true
+		}
+	}
+}
+
+// newCopyName returns name of the new copy of name made by server, which is
+// in after but not in before, and named as server does: stem of name
+// followed by _YYYYMMDD_HHMMSS and the extension.  It returns empty string
+// unless there is exactly one such name
+func newCopyName(name string, before, after map[string]bool) string {
+	var (
+		ext        = path.Ext(name)
+		stem       = strings.TrimSuffix(name, ext)
+		re         = regexp.MustCompile(`^` + regexp.QuoteMeta(stem) + `_\d{8}_\d{6}` + regexp.QuoteMeta(ext) + `$`)
+		candidates []string
+	)
+	for n := range after {
+		if !before[n] && re.MatchString(n) {
+			candidates = append(candidates, n)
+		}
+	}
+	if len(candidates) != 1 {
+		return ""
+	}
+	return candidates[0]
+}
+
+// doFileManager does op on filelist in batches.  Info of the response is in
+// the order of filelist
 func (client *Client) doFileManager(
 	ctx context.Context,
 	op string,
-	filelist interface{},
+	filelist []interface{},
+	wo writeOpts,
+) (FileManagerResponse, error) {
+	var resp FileManagerResponse
+	for len(filelist) > 0 {
+		n := fileManagerBatchSize
+		if n > len(filelist) {
+			n = len(filelist)
+		}
+		resp1, err := client.doFileManagerBatch(ctx, op, filelist[:n], wo)
+		resp.Info = append(resp.Info, resp1.Info...)
+		resp.TaskId = resp1.TaskId
+		// per-entry failures are collected after all batches are done
+		var fmErr *FileManagerError
+		if err != nil && !errors.As(err, &fmErr) {
+			return resp, err
+		}
+		filelist = filelist[n:]
+	}
+	if err := newFileManagerError(op, resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+func (client *Client) doFileManagerBatch(
+	ctx context.Context,
+	op string,
+	filelist []interface{},
+	wo writeOpts,
 ) (FileManagerResponse, error) {
 	var (
 		accessAuth = client.GetAccessAuth()
@@ -129,7 +343,7 @@ func (client *Client) doFileManager(
 	bodyArgs.Set("async", strconv.Itoa(asyncAuto))
 	bodyArgs.Set("filelist", string(filelistData))
 	if op != opDelete {
-		bodyArgs.Set("ondup", ONDUP_OVERWRITE)
+		bodyArgs.Set("ondup", wo.ondup)
 	}
 	bodyStr := bodyArgs.Encode()
 	if err := client.doHTTPPostFormJSON(
@@ -141,5 +355,96 @@ func (client *Client) doFileManager(
 	); err != nil {
 		return resp, err
 	}
+	if resp.TaskId != 0 {
+		taskResp, err := client.waitTask(ctx, resp.TaskId)
+		if err != nil {
+			return resp, errors.Wrapf(err, "task %d", resp.TaskId)
+		}
+		if len(taskResp.List) > 0 {
+			resp.Info = taskResp.List
+		}
+		if taskResp.Status == TASK_STATUS_FAILED && len(resp.Info) == 0 {
+			return resp, fmt.Errorf("%s: task %d failed, errno %d", op, resp.TaskId, taskResp.TaskErrno)
+		}
+	}
+	if err := newFileManagerError(op, resp); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
+
+// taskPollInterval is the interval between queries of async task status
+var taskPollInterval = time.Second
+
+// waitTask polls status of async task until it's done
+func (client *Client) waitTask(ctx context.Context, taskId uint64) (TaskQueryResponse, error) {
+	for {
+		resp, err := client.TaskQuery(ctx, taskId)
+		if err != nil {
+			return resp, err
+		}
+		switch resp.Status {
+		case TASK_STATUS_SUCCESS, TASK_STATUS_FAILED:
+			return resp, nil
+		}
+		client.vlog().Infof("task %d: %s", taskId, resp.Status)
+		select {
+		case <-ctx.Done():
+			return resp, ctx.Err()
+		case <-time.After(taskPollInterval):
+		}
+	}
+}
+
+func (client *Client) TaskQuery(ctx context.Context, taskId uint64) (TaskQueryResponse, error) {
+	var (
+		accessAuth = client.GetAccessAuth()
+		resp       TaskQueryResponse
+	)
+	queryArgs := url.Values{}
+	queryArgs.Set("access_token", accessAuth.AccessToken)
+	queryArgs.Set("taskid", strconv.FormatUint(taskId, 10))
+	if err := client.doHTTPGetJSON(
+		ctx,
+		newTaskQueryAPIURL(),
+		queryArgs,
+		&resp,
+	); err != nil {
+		return resp, err
+	}
 	return resp, nil
 }
+
+// FileManagerError is returned when some entries of a file manager operation
+// failed.  Others may have succeeded
+type FileManagerError struct {
+	Op     string
+	Total  int
+	Failed []FileManagerInfo
+}
+
+func newFileManagerError(op string, resp FileManagerResponse) error {
+	var failed []FileManagerInfo
+	for _, info := range resp.Info {
+		if info.Errno != 0 {
+			failed = append(failed, info)
+		}
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	return &FileManagerError{
+		Op:     op,
+		Total:  len(resp.Info),
+		Failed: failed,
+	}
+}
+
+func (err *FileManagerError) Error() string {
+	var items []string
+	for _, info := range err.Failed {
+		items = append(items, fmt.Sprintf("%s (errno %d)", info.Path, info.Errno))
+	}
+	return fmt.Sprintf("%s: %d of %d failed: %s",
+		err.Op, len(err.Failed), err.Total, strings.Join(items, ", "))
+}
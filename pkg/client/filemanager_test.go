@@ -0,0 +1,127 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileManagerError(t *testing.T) {
+	resp := FileManagerResponse{
+		Info: []FileManagerInfo{
+			{Path: "/a"},
+			{Path: "/b", Errno: -9},
+		},
+	}
+	resp.setDests(newWriteOpts(), []string{"/d/a", "/d/b"}, nil, nil)
+	assert.Equal(t, "/d/a", resp.Info[0].Dest)
+	assert.Equal(t, "", resp.Info[1].Dest)
+
+	err := newFileManagerError(opCopy, resp)
+	if assert.IsType(t, &FileManagerError{}, err) {
+		fmErr := err.(*FileManagerError)
+		assert.Equal(t, 2, fmErr.Total)
+		assert.Equal(t, []FileManagerInfo{resp.Info[1]}, fmErr.Failed)
+		assert.Equal(t, "copy: 1 of 2 failed: /b (errno -9)", err.Error())
+	}
+
+	resp.Info = resp.Info[:1]
+	assert.NoError(t, newFileManagerError(opCopy, resp))
+}
+
+func TestSetDests(t *testing.T) {
+	info := func(n int) []FileManagerInfo {
+		return make([]FileManagerInfo, n)
+	}
+	lister := func(after map[string]map[string]bool, listed *[]string) func(string) map[string]bool {
+		return func(dir string) map[string]bool {
+			*listed = append(*listed, dir)
+			return after[dir]
+		}
+	}
+	dests := []string{"/d/a.txt", "/d/b.txt", "/e/a.txt"}
+	testCases := []struct {
+		name   string
+		ondup  string
+		before map[string]map[string]bool
+		after  map[string]map[string]bool
+		want   []string
+		listed []string
+	}{
+		{
+			name:  "overwrite",
+			ondup: ONDUP_OVERWRITE,
+			want:  []string{"/d/a.txt", "/d/b.txt", "/e/a.txt"},
+		},
+		{
+			name:  "skip",
+			ondup: ONDUP_SKIP,
+			before: map[string]map[string]bool{
+				"/d": {"a.txt": true},
+				"/e": {},
+			},
+			want: []string{"", "/d/b.txt", "/e/a.txt"},
+		},
+		{
+			name:  "newcopy",
+			ondup: ONDUP_NEWCOPY,
+			before: map[string]map[string]bool{
+				"/d": {"a.txt": true, "b.txt": true, "a_old.txt": true},
+				"/e": {},
+			},
+			after: map[string]map[string]bool{
+				"/d": {"a.txt": true, "b.txt": true, "a_old.txt": true, "a_20231010_101010.txt": true, "b(1).txt": true},
+				"/e": {"a.txt": true},
+			},
+			// name of b.txt copy not found, b(1).txt not named as server does
+			want:   []string{"/d/a_20231010_101010.txt", "", "/e/a.txt"},
+			listed: []string{"/d"},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			resp := FileManagerResponse{Info: info(len(dests))}
+			var listed []string
+			resp.setDests(newWriteOpts(Ondup(tc.ondup)), dests, tc.before, lister(tc.after, &listed))
+			var got []string
+			for i, info := range resp.Info {
+				got = append(got, info.Dest)
+				assert.Equal(t, tc.ondup == ONDUP_NEWCOPY && i == 1, info.DestUnknown)
+			}
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.listed, listed)
+		})
+	}
+
+	t.Run("same dest", func(t *testing.T) {
+		resp := FileManagerResponse{Info: info(2)}
+		before := map[string]map[string]bool{"/d": {}}
+		after := map[string]map[string]bool{"/d": {"a.txt": true, "a_20231010_101010.txt": true}}
+		var listed []string
+		resp.setDests(newWriteOpts(Ondup(ONDUP_NEWCOPY)), []string{"/d/a.txt", "/d/a.txt"}, before, lister(after, &listed))
+		assert.Equal(t, "/d/a.txt", resp.Info[0].Dest)
+		assert.Equal(t, "/d/a_20231010_101010.txt", resp.Info[1].Dest)
+	})
+
+	t.Run("returned by server", func(t *testing.T) {
+		resp := FileManagerResponse{Info: []FileManagerInfo{{To: "/d/a_20231010_101010.txt"}}}
+		before := map[string]map[string]bool{"/d": {"a.txt": true}}
+		var listed []string
+		resp.setDests(newWriteOpts(Ondup(ONDUP_NEWCOPY)), []string{"/d/a.txt"}, before, lister(nil, &listed))
+		assert.Equal(t, "/d/a_20231010_101010.txt", resp.Info[0].Dest)
+		assert.Empty(t, listed)
+	})
+
+	t.Run("ambiguous", func(t *testing.T) {
+		resp := FileManagerResponse{Info: info(1)}
+		before := map[string]map[string]bool{"/d": {"a.txt": true}}
+		after := map[string]map[string]bool{"/d": {"a.txt": true, "a_20231010_101010.txt": true, "a_20231010_101011.txt": true}}
+		var listed []string
+		resp.setDests(newWriteOpts(Ondup(ONDUP_NEWCOPY)), []string{"/d/a.txt"}, before, lister(after, &listed))
+		assert.Equal(t, "", resp.Info[0].Dest)
+		assert.True(t, resp.Info[0].DestUnknown)
+	})
+}
@@ -0,0 +1,39 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"net/url"
+	"strconv"
+)
+
+// Mkdir creates dir.  It fails if dir exists
+func (client *Client) Mkdir(ctx context.Context, dir string) (UploadResponse, error) {
+	var (
+		accessAuth = client.GetAccessAuth()
+		resp       UploadResponse
+	)
+
+	queryArgs := url.Values{}
+	queryArgs.Set("method", "create")
+	queryArgs.Set("access_token", accessAuth.AccessToken)
+
+	bodyArgs := url.Values{}
+	bodyArgs.Set("path", client.AbsPath(dir))
+	bodyArgs.Set("isdir", "1")
+	bodyArgs.Set("rtype", strconv.Itoa(RTYPE_FAIL))
+	body := bytes.NewBufferString(bodyArgs.Encode())
+	if err := client.doHTTPPostFormJSON(
+		ctx,
+		newFileAPIURL(),
+		queryArgs,
+		body,
+		&resp,
+	); err != nil {
+		return resp, err
+	}
+	return resp, nil
+}
@@ -0,0 +1,100 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package client
+
+import (
+	"context"
+	"fmt"
+)
+
+// OndupValues are accepted values of conflict policy
+var OndupValues = []string{
+	ONDUP_OVERWRITE,
+	ONDUP_FAIL,
+	ONDUP_NEWCOPY,
+	ONDUP_SKIP,
+}
+
+func ParseOndup(s string) (string, error) {
+	for _, v := range OndupValues {
+		if s == v {
+			return s, nil
+		}
+	}
+	return "", fmt.Errorf("invalid ondup %q, allowed values are %v", s, OndupValues)
+}
+
+type writeOpts struct {
+	ondup string
+}
+
+// WriteOpt are options of Upload, Copy, Move, Rename
+type WriteOpt func(*writeOpts)
+
+// Ondup sets what to do when the destination path exists.  Default is
+// ONDUP_OVERWRITE
+func Ondup(ondup string) WriteOpt {
+	return func(wo *writeOpts) {
+		if ondup != "" {
+			wo.ondup = ondup
+		}
+	}
+}
+
+func newWriteOpts(opts ...WriteOpt) writeOpts {
+	wo := writeOpts{
+		ondup: ONDUP_OVERWRITE,
+	}
+	for _, opt := range opts {
+		opt(&wo)
+	}
+	return wo
+}
+
+// uploadOndup returns ondup value for single upload api.  It has no skip,
+// which is done by checking dst first
+func (wo writeOpts) uploadOndup() string {
+	if wo.ondup == ONDUP_SKIP {
+		return ONDUP_FAIL
+	}
+	return wo.ondup
+}
+
+// rtype returns rtype value for precreate and create api
+func (wo writeOpts) rtype() int {
+	switch wo.ondup {
+	case ONDUP_NEWCOPY:
+		return RTYPE_NEWCOPY
+	case ONDUP_FAIL, ONDUP_SKIP:
+		return RTYPE_FAIL
+	default:
+		return RTYPE_OVERWRITE
+	}
+}
+
+// uploadSkip returns response of the existing dst if upload should be
+// skipped
+func (client *Client) uploadSkip(ctx context.Context, wo writeOpts, dst string) (UploadResponse, bool, error) {
+	var resp UploadResponse
+	if wo.ondup != ONDUP_SKIP {
+		return resp, false, nil
+	}
+	meta, err := client.FileMetaByPath(ctx, dst)
+	if err != nil {
+		if ErrIsNotExist(err) {
+			return resp, false, nil
+		}
+		return resp, false, err
+	}
+	resp = UploadResponse{
+		Path:    meta.Path,
+		Size:    meta.Size,
+		Ctime:   meta.ServerCtime,
+		Mtime:   meta.ServerMtime,
+		Md5:     meta.Md5,
+		FsId:    meta.FsId,
+		Skipped: true,
+	}
+	return resp, true, nil
+}
@@ -0,0 +1,31 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteOpts(t *testing.T) {
+	for _, c := range []struct {
+		ondup       string
+		uploadOndup string
+		rtype       int
+	}{
+		{"", ONDUP_OVERWRITE, RTYPE_OVERWRITE},
+		{ONDUP_OVERWRITE, ONDUP_OVERWRITE, RTYPE_OVERWRITE},
+		{ONDUP_FAIL, ONDUP_FAIL, RTYPE_FAIL},
+		{ONDUP_NEWCOPY, ONDUP_NEWCOPY, RTYPE_NEWCOPY},
+		{ONDUP_SKIP, ONDUP_FAIL, RTYPE_FAIL},
+	} {
+		wo := newWriteOpts(Ondup(c.ondup))
+		assert.Equal(t, c.uploadOndup, wo.uploadOndup(), c.ondup)
+		assert.Equal(t, c.rtype, wo.rtype(), c.ondup)
+	}
+
+	_, err := ParseOndup("replace")
+	assert.Error(t, err)
+}
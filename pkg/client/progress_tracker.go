@@ -30,36 +30,67 @@ type lenI interface {
 	Len() int
 }
 
-type readTracker struct {
-	reader  io.Reader
-	tracker XloadTrackerI
+// pieceTracker adds progress of a piece of a file, e.g. a block, to the
+// tracker of the file, which is started and done once for the whole file
+type pieceTracker struct {
+	XloadTrackerI
 }
 
-func newReadTracker(reader io.Reader, tracker XloadTrackerI) readTracker {
-	rt := readTracker{
-		reader:  reader,
-		tracker: tracker,
+func (pt pieceTracker) Start(total int64) {}
+
+func (pt pieceTracker) Done() {}
+
+// startFileTracker starts the tracker from ctx for a file of size, of which
+// done bytes need no transfer.  The returned ctx has the tracker for pieces
+// of the file.  done is to be called when the file is done
+func startFileTracker(ctx context.Context, size, done int64) (context.Context, func()) {
+	xlt := xloadTracker(ctx)
+	if xlt == nil {
+		return ctx, func() {}
+	}
+	if _, ok := xlt.(pieceTracker); ok {
+		return ctx, func() {}
 	}
-	return rt
+	xlt.Start(size)
+	xlt.Increment(done)
+	return context.WithValue(ctx, XloadTrackerKey, pieceTracker{xlt}), xlt.Done
 }
 
-func newReadTrackerWithCtx(ctx context.Context, r io.Reader) (io.Reader, XloadTrackerI) {
+// newPieceReaderWithCtx wraps body of a request carrying n bytes of a file
+// with bandwidth limiter and the tracker from ctx.  Progress is added as
+// the body is read, up to n bytes, so that form fields are not counted
+func newPieceReaderWithCtx(ctx context.Context, body io.Reader, n int64, limiter *BwLimiter) io.Reader {
+	body = newBwLimitReader(ctx, body, limiter)
 	if xlt := xloadTracker(ctx); xlt != nil {
-		rt := newReadTracker(r, xlt)
-		xlt.Start(int64(rt.Len()))
-		return rt, xlt
+		return &pieceReader{
+			reader:  body,
+			tracker: xlt,
+			left:    n,
+		}
 	}
-	return r, nil
+	return body
 }
 
-func (rt readTracker) Read(p []byte) (int, error) {
-	n, err := rt.reader.Read(p)
-	rt.tracker.Increment(int64(n))
+type pieceReader struct {
+	reader  io.Reader
+	tracker XloadTrackerI
+	left    int64
+}
+
+func (pr *pieceReader) Read(p []byte) (int, error) {
+	n, err := pr.reader.Read(p)
+	if inc := int64(n); inc > 0 && pr.left > 0 {
+		if inc > pr.left {
+			inc = pr.left
+		}
+		pr.left -= inc
+		pr.tracker.Increment(inc)
+	}
 	return n, err
 }
 
-func (rt readTracker) Len() int {
-	if l, ok := rt.reader.(lenI); ok {
+func (pr *pieceReader) Len() int {
+	if l, ok := pr.reader.(lenI); ok {
 		return l.Len()
 	}
 	return -1
@@ -78,7 +109,8 @@ func newReadCloseTracker(readCloser io.ReadCloser, tracker XloadTrackerI) readCl
 	return rct
 }
 
-func newReadCloseTrackerWithCtx(ctx context.Context, rc io.ReadCloser, total, done int64) io.ReadCloser {
+func newReadCloseTrackerWithCtx(ctx context.Context, rc io.ReadCloser, limiter *BwLimiter, total, done int64) io.ReadCloser {
+	rc = newBwLimitReadCloser(ctx, rc, limiter)
 	if xlt := xloadTracker(ctx); xlt != nil {
 		rct := newReadCloseTracker(rc, xlt)
 		xlt.Start(total)
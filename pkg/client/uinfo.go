@@ -5,7 +5,10 @@ package client
 
 import (
 	"context"
+	"fmt"
 	"net/url"
+
+	"github.com/pkg/errors"
 )
 
 func (client *Client) UInfo(ctx context.Context) (UinfoResponse, error) {
@@ -26,3 +29,63 @@ func (client *Client) UInfo(ctx context.Context) (UinfoResponse, error) {
 	}
 	return resp, nil
 }
+
+// MaxFileSizeByVipType returns per-file size limit for accounts of vipType
+func MaxFileSizeByVipType(vipType int) int64 {
+	switch vipType {
+	case VIP_TYPE_VIP:
+		return MAX_FILE_SIZE_VIP
+	case VIP_TYPE_SVIP:
+		return MAX_FILE_SIZE_SVIP
+	default:
+		return MAX_FILE_SIZE_NORMAL
+	}
+}
+
+// MaxFileSize returns per-file size limit of the account.  Vip type of the
+// account is fetched once and remembered
+func (client *Client) MaxFileSize(ctx context.Context) (int64, error) {
+	client.mu.Lock()
+	vipType := client.vipType
+	client.mu.Unlock()
+	if vipType == nil {
+		resp, err := client.UInfo(ctx)
+		if err != nil {
+			return 0, errors.Wrap(err, "uinfo")
+		}
+		vipType = &resp.VipType
+		client.mu.Lock()
+		client.vipType = vipType
+		client.mu.Unlock()
+	}
+	return MaxFileSizeByVipType(*vipType), nil
+}
+
+// FileTooLargeError is returned when uploading a file larger than the
+// per-file size limit
+type FileTooLargeError struct {
+	Size  int64
+	Limit int64
+}
+
+func (err *FileTooLargeError) Error() string {
+	return fmt.Sprintf("file size %d exceeds per-file limit %d of the account", err.Size, err.Limit)
+}
+
+func (client *Client) checkFileSize(ctx context.Context, size int64) error {
+	if size <= MAX_FILE_SIZE_NORMAL {
+		// within limit of all accounts
+		return nil
+	}
+	limit, err := client.MaxFileSize(ctx)
+	if err != nil {
+		return err
+	}
+	if size > limit {
+		return &FileTooLargeError{
+			Size:  size,
+			Limit: limit,
+		}
+	}
+	return nil
+}
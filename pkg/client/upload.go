@@ -6,10 +6,15 @@ package client
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
 	"io"
 	"net/url"
 	"os"
+	"path"
 	"strconv"
+	"time"
 
 	"mypan/pkg/sysdep"
 	"mypan/pkg/util"
@@ -17,8 +22,12 @@ import (
 	"github.com/pkg/errors"
 )
 
+// blockListPlaceholder stands for md5 of blocks not read yet in precreate
+const blockListPlaceholder = "5910a591dd8fc18c32a8f3df4fdc1761"
+
 const (
-	// API limit on single upload
+	// API limit on single upload.  Larger files are limited further by
+	// MaxFileSize
 	MAX_SIZE_SINGLE_UPLOAD = 2 * GiB
 
 	// Client limit
@@ -31,18 +40,22 @@ type statOpt struct {
 	Mtime int64
 }
 
-func seekStart(f *os.File) error {
-	_, err := f.Seek(0, 0)
+func seekStart(r io.Seeker) error {
+	_, err := r.Seek(0, io.SeekStart)
 	return err
 }
 
 func (client *Client) Upload(
 	ctx context.Context,
 	src, dst string,
+	opts ...WriteOpt,
 ) (UploadResponse, error) {
-	var resp UploadResponse
-
+	wo := newWriteOpts(opts...)
 	dst = client.AbsPath(dst)
+	resp, skip, err := client.uploadSkip(ctx, wo, dst)
+	if err != nil || skip {
+		return resp, err
+	}
 	f, err := os.Open(src)
 	if err != nil {
 		return resp, err
@@ -61,17 +74,229 @@ func (client *Client) Upload(
 	} else {
 		client.vlog().Infof("fetch ctime failed, stat source: %T", fi.Sys())
 	}
+	return client.upload(ctx, f, f.Name(), statopt, dst, nil, wo)
+}
+
+// UploadReadSeeker uploads size bytes of content from r to dst.  Block list
+// is computed by reading r through before r is seeked back for uploading,
+// so that content is uploaded from r directly as files are
+func (client *Client) UploadReadSeeker(
+	ctx context.Context,
+	r io.ReadSeeker,
+	size int64,
+	dst string,
+	opts ...WriteOpt,
+) (UploadResponse, error) {
+	wo := newWriteOpts(opts...)
+	dst = client.AbsPath(dst)
+	resp, skip, err := client.uploadSkip(ctx, wo, dst)
+	if err != nil || skip {
+		return resp, err
+	}
+	now := time.Now().Unix()
+	statopt := statOpt{
+		Size:  size,
+		Ctime: now,
+		Mtime: now,
+	}
+	return client.upload(ctx, r, path.Base(dst), statopt, dst, nil, wo)
+}
+
+// UploadReader uploads content read from r to dst.  size is the expected
+// size of the content, or -1 if unknown.
+//
+// Content is uploaded block by block as it is read, with one block kept in
+// memory.  See uploadStream
+func (client *Client) UploadReader(
+	ctx context.Context,
+	r io.Reader,
+	size int64,
+	dst string,
+	opts ...WriteOpt,
+) (UploadResponse, error) {
+	wo := newWriteOpts(opts...)
+	dst = client.AbsPath(dst)
+	resp, skip, err := client.uploadSkip(ctx, wo, dst)
+	if err != nil || skip {
+		return resp, err
+	}
+	if size >= 0 {
+		if err := client.checkFileSize(ctx, size); err != nil {
+			return resp, err
+		}
+	}
+	return client.uploadStream(ctx, r, size, dst, wo)
+}
+
+// uploadStream uploads content read from r.  Content shorter than a block
+// is uploaded in one request.
+//
+// Block list is not known until all is read, while precreate asks for it
+// before any block is uploaded.  With size known, precreate is done with
+// placeholders in the block list, which also rules out rapid upload, and
+// the real block list is given to create.  Content of unknown size is
+// spooled, see uploadSpool
+func (client *Client) uploadStream(
+	ctx context.Context,
+	r io.Reader,
+	size int64,
+	dst string,
+	wo writeOpts,
+) (UploadResponse, error) {
+	var (
+		ret UploadResponse
+		buf = make([]byte, UPLOAD_API_BLOCK_SIZE)
+		now = time.Now().Unix()
+	)
+	readBlock := func() (int, error) {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return n, err
+	}
+	checkSize := func(n int64) error {
+		if size >= 0 && n != size {
+			return fmt.Errorf("size mismatch: want %d, got %d", size, n)
+		}
+		return nil
+	}
+	n, err := readBlock()
+	if err != nil {
+		return ret, errors.Wrap(err, "read")
+	}
+	if n < len(buf) {
+		if err := checkSize(int64(n)); err != nil {
+			return ret, err
+		}
+		return client.uploadSingle(ctx, bytes.NewReader(buf[:n]), int64(n), path.Base(dst), dst, wo)
+	}
+	if size < 0 {
+		limit, err := client.MaxFileSize(ctx)
+		if err != nil {
+			return ret, err
+		}
+		return client.uploadSpool(ctx, io.MultiReader(bytes.NewReader(buf[:n]), r), limit, dst, wo)
+	}
+
+	// precreate with placeholders of the expected number of blocks
+	statopt := statOpt{
+		Size:  size,
+		Ctime: now,
+		Mtime: now,
+	}
+	precreateResp, err := client.precreatePlaceholders(ctx, dst, statopt, wo)
+	if err != nil {
+		return ret, err
+	}
+	ctx, trackDone := startFileTracker(ctx, size, 0)
+	defer trackDone()
+
+	var (
+		uploadId  = precreateResp.UploadId
+		blockList []string
+		total     int64
+	)
+	for partSeq := 0; n > 0; partSeq++ {
+		total += int64(n)
+		sum := md5.Sum(buf[:n])
+		blockList = append(blockList, hex.EncodeToString(sum[:]))
+		if err := client.uploadBlock(ctx, dst, uploadId, partSeq, bytes.NewReader(buf[:n]), int64(n)); err != nil {
+			return ret, err
+		}
+		if n < len(buf) {
+			break
+		}
+		if n, err = readBlock(); err != nil {
+			return ret, errors.Wrap(err, "read")
+		}
+	}
+	if err := checkSize(total); err != nil {
+		return ret, err
+	}
+
+	statopt.Size = total
+	ret, err = client.uploadCreate(ctx, dst, statopt, uploadId, string(util.MustMarshalJSON(blockList)), wo)
+	if err != nil {
+		return ret, errors.Wrapf(err, "file create %q", dst)
+	}
+	return ret, nil
+}
+
+// uploadSpool spools content read from r to a temporary file under
+// Config.TmpDir, computing the block list along the way, then uploads the
+// file.  Precreate is thus given the real size and block list.  Spooling
+// stops with FileTooLargeError as soon as more than limit bytes are read
+func (client *Client) uploadSpool(
+	ctx context.Context,
+	r io.Reader,
+	limit int64,
+	dst string,
+	wo writeOpts,
+) (UploadResponse, error) {
+	var resp UploadResponse
+
+	f, err := client.createSpool()
+	if err != nil {
+		return resp, err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	blw := newBlockListWriter()
+	n, err := io.Copy(io.MultiWriter(f, blw), io.LimitReader(r, limit+1))
+	if err != nil {
+		return resp, errors.Wrap(err, "spool")
+	}
+	if n > limit {
+		return resp, &FileTooLargeError{
+			Size:  n,
+			Limit: limit,
+		}
+	}
+	if err := seekStart(f); err != nil {
+		return resp, errors.Wrap(err, "spool seek")
+	}
+	now := time.Now().Unix()
+	statopt := statOpt{
+		Size:  n,
+		Ctime: now,
+		Mtime: now,
+	}
+	return client.upload(ctx, f, path.Base(dst), statopt, dst, blw.BlockList(), wo)
+}
+
+// upload uploads content of r with name.  blockList is computed from r if
+// nil
+func (client *Client) upload(
+	ctx context.Context,
+	r io.ReadSeeker,
+	name string,
+	statopt statOpt,
+	dst string,
+	blockList []string,
+	wo writeOpts,
+) (UploadResponse, error) {
+	// check before computing block list of a large file
+	if err := client.checkFileSize(ctx, statopt.Size); err != nil {
+		return UploadResponse{}, err
+	}
 	if statopt.Size < MIN_SIZE_MULTIPART_UPLOAD {
-		return client.uploadSingle(ctx, f, dst)
+		return client.uploadSingle(ctx, io.LimitReader(r, statopt.Size), statopt.Size, name, dst, wo)
 	} else {
-		return client.uploadMultipart(ctx, f, statopt, dst)
+		return client.uploadMultipart(ctx, r, statopt, dst, blockList, wo)
 	}
 }
 
 func (client *Client) uploadSingle(
 	ctx context.Context,
-	f *os.File,
+	r io.Reader,
+	size int64,
+	name string,
 	dst string,
+	wo writeOpts,
 ) (UploadResponse, error) {
 	var (
 		accessAuth = client.GetAccessAuth()
@@ -80,19 +305,17 @@ func (client *Client) uploadSingle(
 	queryArgs := url.Values{}
 	queryArgs.Set("method", "upload")
 	queryArgs.Set("path", dst)
-	queryArgs.Set("ondup", ONDUP_OVERWRITE)
+	queryArgs.Set("ondup", wo.uploadOndup())
 	queryArgs.Set("access_token", accessAuth.AccessToken)
 
 	body, _ := util.NewMultipartFormFilesBody(util.FormFile{
 		Name:     "file",
-		Filename: f.Name(),
-		Reader:   f,
+		Filename: name,
+		Reader:   r,
 	})
-	bodyReader := body.Reader()
-	bodyReader, xlt := newReadTrackerWithCtx(ctx, bodyReader)
-	if xlt != nil {
-		defer xlt.Done()
-	}
+	ctx, trackDone := startFileTracker(ctx, size, 0)
+	defer trackDone()
+	bodyReader := newPieceReaderWithCtx(ctx, body.Reader(), size, client.bwLimitUp)
 	//body := util.NewMultipartFormFilesBodyChunked(util.FormFile{
 	//        Name:     "file",
 	//        Filename: f.Name(),
@@ -115,67 +338,100 @@ func (client *Client) uploadSingle(
 
 func (client *Client) uploadMultipart(
 	ctx context.Context,
-	f *os.File,
+	rs io.ReadSeeker,
 	statopt statOpt,
 	dst string,
+	blockList []string,
+	wo writeOpts,
 ) (UploadResponse, error) {
 	var ret UploadResponse
 
 	// make md5 blockList
-	blockList, err := computeReaderBlockList(f)
-	if err != nil {
-		return ret, errors.Wrap(err, "compute block list")
-	}
-	if err := seekStart(f); err != nil {
-		return ret, errors.Wrap(err, "file seek")
+	if blockList == nil {
+		var err error
+		blockList, err = computeReaderBlockList(io.LimitReader(rs, statopt.Size))
+		if err != nil {
+			return ret, errors.Wrap(err, "compute block list")
+		}
+		if err := seekStart(rs); err != nil {
+			return ret, errors.Wrap(err, "file seek")
+		}
 	}
 	blockListData := string(util.MustMarshalJSON(blockList))
 
 	// precreate
-	precreateResp, err := client.uploadPrecreate(ctx, dst, statopt, blockListData)
+	precreateResp, err := client.uploadPrecreate(ctx, dst, statopt, blockListData, wo)
 	if err != nil {
 		return ret, errors.Wrapf(err, "precreate %q", dst)
 	}
 
-	// upload parts
+	// upload parts.  Those the server has count as done
 	var (
 		uploadId        = precreateResp.UploadId
 		blockListIndice = precreateResp.BlockList
+		blockSize       = func(partSeq int) int64 {
+			n := statopt.Size - UPLOAD_API_BLOCK_SIZE*int64(partSeq)
+			if n > UPLOAD_API_BLOCK_SIZE {
+				n = UPLOAD_API_BLOCK_SIZE
+			}
+			return n
+		}
+		toUpload int64
 	)
 	for _, partSeq := range blockListIndice {
-		f.Seek(UPLOAD_API_BLOCK_SIZE*int64(partSeq), 0)
-		r := io.LimitReader(f, UPLOAD_API_BLOCK_SIZE)
-		mffb, _ := util.NewMultipartFormFilesBody(util.FormFile{
-			Name:     "file",
-			Filename: f.Name(),
-			Reader:   r,
-		})
-		bodyReader := mffb.Reader()
-		bodyReader, xlt := newReadTrackerWithCtx(ctx, bodyReader)
-		if xlt != nil {
-			defer xlt.Done()
+		toUpload += blockSize(partSeq)
+	}
+	ctx, trackDone := startFileTracker(ctx, statopt.Size, statopt.Size-toUpload)
+	defer trackDone()
+	for _, partSeq := range blockListIndice {
+		if _, err := rs.Seek(UPLOAD_API_BLOCK_SIZE*int64(partSeq), io.SeekStart); err != nil {
+			return ret, errors.Wrap(err, "seek")
 		}
-		contentType := mffb.FormDataContentType()
-		resp, err := client.uploadSuperfile2(ctx, dst, uploadId, partSeq, bodyReader, contentType)
-		if err != nil {
-			return ret, errors.Wrapf(err, "upload %q (%d)", dst, partSeq)
+		r := io.LimitReader(rs, UPLOAD_API_BLOCK_SIZE)
+		if err := client.uploadBlock(ctx, dst, uploadId, partSeq, r, blockSize(partSeq)); err != nil {
+			return ret, err
 		}
-		client.vlog().Infof("upload %s (%d): %s", dst, partSeq, util.MustMarshalJSON(resp))
 	}
 
 	// combine parts
-	ret, err = client.uploadCreate(ctx, dst, statopt, uploadId, blockListData)
+	ret, err = client.uploadCreate(ctx, dst, statopt, uploadId, blockListData, wo)
 	if err != nil {
 		return ret, errors.Wrapf(err, "file create %q", dst)
 	}
 	return ret, nil
 }
 
+// uploadBlock uploads a block of size bytes of multipart upload with
+// superfile2.  Progress adds to the tracker of the file
+func (client *Client) uploadBlock(
+	ctx context.Context,
+	dst string,
+	uploadId string,
+	partSeq int,
+	r io.Reader,
+	size int64,
+) error {
+	mffb, _ := util.NewMultipartFormFilesBody(util.FormFile{
+		Name:     "file",
+		Filename: path.Base(dst),
+		Reader:   r,
+	})
+	bodyReader := newPieceReaderWithCtx(ctx, mffb.Reader(), size, client.bwLimitUp)
+	contentType := mffb.FormDataContentType()
+	resp, err := client.uploadSuperfile2(ctx, dst, uploadId, partSeq, bodyReader, contentType)
+	if err != nil {
+		return errors.Wrapf(err, "upload %q (%d)", dst, partSeq)
+	}
+	client.vlog().Infof("upload %s (%d): %s", dst, partSeq, util.MustMarshalJSON(resp))
+	return nil
+}
+
 func (client *Client) uploadPrecreate(
 	ctx context.Context,
 	dst string,
 	statopt statOpt,
 	blockListData string,
+	wo writeOpts,
 ) (FilePrecreateResponse, error) {
 	var (
 		accessAuth = client.GetAccessAuth()
@@ -192,7 +448,7 @@ func (client *Client) uploadPrecreate(
 	bodyArgs.Set("autoinit", "1")
 	bodyArgs.Set("size", strconv.FormatInt(statopt.Size, 10))
 	bodyArgs.Set("block_list", blockListData)
-	bodyArgs.Set("rtype", strconv.Itoa(RTYPE_OVERWRITE))
+	bodyArgs.Set("rtype", strconv.Itoa(wo.rtype()))
 	body := bytes.NewBufferString(bodyArgs.Encode())
 	if err := client.doHTTPPostFormJSON(
 		ctx,
@@ -246,6 +502,7 @@ func (client *Client) uploadCreate(
 	statopt statOpt,
 	uploadId string,
 	blockListData string,
+	wo writeOpts,
 ) (UploadResponse, error) {
 	var (
 		accessAuth = client.GetAccessAuth()
@@ -261,7 +518,7 @@ func (client *Client) uploadCreate(
 	bodyArgs.Set("isdir", "0")
 	bodyArgs.Set("uploadid", uploadId)
 	bodyArgs.Set("block_list", blockListData)
-	bodyArgs.Set("rtype", strconv.Itoa(RTYPE_OVERWRITE))
+	bodyArgs.Set("rtype", strconv.Itoa(wo.rtype()))
 	bodyArgs.Set("size", strconv.FormatInt(statopt.Size, 10))
 	bodyArgs.Set("local_ctime", strconv.FormatInt(statopt.Ctime, 10))
 	bodyArgs.Set("local_mtime", strconv.FormatInt(statopt.Mtime, 10))
@@ -0,0 +1,145 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package client
+
+import (
+	"context"
+	"io"
+	"os"
+	"path"
+	"time"
+
+	"mypan/pkg/util"
+
+	"github.com/pkg/errors"
+)
+
+// UploadSessionI is a multipart upload of which pieces are written one by
+// one, at any offset and in any order, and combined at the end
+type UploadSessionI interface {
+	// WriteAt writes content read from r at offset off of the file.  It
+	// returns the number of bytes written
+	WriteAt(ctx context.Context, off int64, r io.Reader) (int64, error)
+	// Create combines what's written into the file of size.  Md5 of
+	// blocks are computed if blockList is nil
+	Create(ctx context.Context, blockList []string, size int64) (UploadResponse, error)
+	// Close releases resources of the session, whether Create was called
+	// or not
+	Close() error
+}
+
+// UploadSession spools blocks to a temporary file under Config.TmpDir.
+// Precreate asks for the block list and size of the whole file, which are
+// only known on Create, so the upload is done then
+type UploadSession struct {
+	client *Client
+	dst    string
+	spool  *os.File
+	now    int64
+	wo     writeOpts
+}
+
+// NewUploadSession returns a session uploading to dst.  Options apply on
+// create
+func (client *Client) NewUploadSession(
+	ctx context.Context,
+	dst string,
+	opts ...WriteOpt,
+) (UploadSessionI, error) {
+	spool, err := client.createSpool()
+	if err != nil {
+		return nil, err
+	}
+	us := &UploadSession{
+		client: client,
+		dst:    client.AbsPath(dst),
+		spool:  spool,
+		now:    time.Now().Unix(),
+		wo:     newWriteOpts(opts...),
+	}
+	return us, nil
+}
+
+// WriteAt writes to where it is in the spool file, one block size at a
+// time.  Pieces may be written concurrently
+func (us *UploadSession) WriteAt(ctx context.Context, off int64, r io.Reader) (int64, error) {
+	var (
+		buf   = make([]byte, UPLOAD_API_BLOCK_SIZE)
+		total int64
+	)
+	for {
+		n, err := io.ReadFull(r, buf)
+		if n > 0 {
+			if _, err := us.spool.WriteAt(buf[:n], off+total); err != nil {
+				return total, errors.Wrapf(err, "spool at %d", off+total)
+			}
+			total += int64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return total, nil
+		}
+		if err != nil {
+			return total, errors.Wrapf(err, "read at %d", off+total)
+		}
+		if err := ctx.Err(); err != nil {
+			return total, err
+		}
+	}
+}
+
+// Create uploads the spooled content.  Precreate is given blockList, so
+// that only blocks the server does not have are uploaded
+func (us *UploadSession) Create(ctx context.Context, blockList []string, size int64) (UploadResponse, error) {
+	statopt := statOpt{
+		Size:  size,
+		Ctime: us.now,
+		Mtime: us.now,
+	}
+	if err := seekStart(us.spool); err != nil {
+		return UploadResponse{}, errors.Wrap(err, "spool seek")
+	}
+	return us.client.upload(ctx, us.spool, path.Base(us.dst), statopt, us.dst, blockList, us.wo)
+}
+
+func (us *UploadSession) Close() error {
+	err := us.spool.Close()
+	os.Remove(us.spool.Name())
+	return err
+}
+
+// createSpool creates a temporary file under Config.TmpDir
+func (client *Client) createSpool() (*os.File, error) {
+	tmpDir := client.cfg.TmpDir
+	if tmpDir != "" {
+		if err := util.MkdirAll(tmpDir); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.CreateTemp(tmpDir, "spool-*")
+	if err != nil {
+		return nil, errors.Wrap(err, "create spool file")
+	}
+	return f, nil
+}
+
+// precreatePlaceholders precreates dst with placeholders of the blocks
+// statopt.Size takes.  The number of blocks and the size are those given to
+// create later, only md5 of the blocks are not known yet
+func (client *Client) precreatePlaceholders(
+	ctx context.Context,
+	dst string,
+	statopt statOpt,
+	wo writeOpts,
+) (FilePrecreateResponse, error) {
+	blocks := (statopt.Size + UPLOAD_API_BLOCK_SIZE - 1) / UPLOAD_API_BLOCK_SIZE
+	placeholders := make([]string, blocks)
+	for i := range placeholders {
+		placeholders[i] = blockListPlaceholder
+	}
+	resp, err := client.uploadPrecreate(ctx, dst, statopt, string(util.MustMarshalJSON(placeholders)), wo)
+	if err != nil {
+		return resp, errors.Wrapf(err, "precreate %q", dst)
+	}
+	return resp, nil
+}
@@ -0,0 +1,290 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeUploadServer answers upload API requests and records what it gets
+type fakeUploadServer struct {
+	mu        sync.Mutex
+	methods   []string
+	blocks    map[int][]byte
+	single    []byte
+	precreate url.Values
+	create    url.Values
+}
+
+func (s *fakeUploadServer) RoundTrip(req *http.Request) (*http.Response, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	q := req.URL.Query()
+	method := q.Get("method")
+	if req.URL.Path == "/rest/2.0/pcs/superfile2" {
+		method = "superfile2"
+	}
+	s.methods = append(s.methods, method)
+	var body string
+	switch method {
+	case "precreate":
+		req.ParseForm()
+		s.precreate = req.PostForm
+		body = `{"errno":0,"uploadid":"u1","block_list":[0]}`
+	case "superfile2":
+		data := readFormFile(req)
+		seq, _ := strconv.Atoi(q.Get("partseq"))
+		if s.blocks == nil {
+			s.blocks = map[int][]byte{}
+		}
+		s.blocks[seq] = data
+		body = `{"errno":0,"md5":"x"}`
+	case "upload":
+		s.single = readFormFile(req)
+		body = `{"errno":0,"path":"` + q.Get("path") + `"}`
+	case "uinfo":
+		body = `{"errno":0,"vip_type":2}`
+	case "create":
+		req.ParseForm()
+		s.create = req.PostForm
+		body = `{"errno":0,"path":"` + s.create.Get("path") + `"}`
+	default:
+		body = `{"errno":2}`
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func readFormFile(req *http.Request) []byte {
+	_, params, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	mr := multipart.NewReader(req.Body, params["boundary"])
+	part, err := mr.NextPart()
+	if err != nil {
+		return nil
+	}
+	data, _ := io.ReadAll(part)
+	return data
+}
+
+func newFakeUploadClient() (*Client, *fakeUploadServer) {
+	s := &fakeUploadServer{}
+	c := New(Config{AppBaseDir: "/apps/x"})
+	c.httpclient.Transport = s
+	return c, s
+}
+
+func TestUploadReader(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 2*UPLOAD_API_BLOCK_SIZE+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	blockList, err := computeReaderBlockList(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	t.Run("multipart", func(t *testing.T) {
+		c, s := newFakeUploadClient()
+		resp, err := c.UploadReader(ctx, bytes.NewReader(data), int64(len(data)), "a.bin")
+		require.NoError(t, err)
+		assert.Equal(t, "/apps/x/a.bin", resp.Path)
+		assert.Equal(t, []string{"precreate", "superfile2", "superfile2", "superfile2", "create"}, s.methods)
+		require.Len(t, s.blocks, 3)
+		assert.Equal(t, data, append(append(s.blocks[0], s.blocks[1]...), s.blocks[2]...))
+		placeholders := strings.Repeat(`"`+blockListPlaceholder+`",`, 3)
+		assert.Equal(t, "["+strings.TrimSuffix(placeholders, ",")+"]", s.precreate.Get("block_list"))
+		assert.Equal(t, "8388708", s.precreate.Get("size"))
+		assert.Equal(t, "u1", s.create.Get("uploadid"))
+		assert.Equal(t, `["`+strings.Join(blockList, `","`)+`"]`, s.create.Get("block_list"))
+		assert.Equal(t, "8388708", s.create.Get("size"))
+	})
+	t.Run("unknown size", func(t *testing.T) {
+		c, s := newFakeUploadClient()
+		c.cfg.TmpDir = t.TempDir()
+		resp, err := c.UploadReader(ctx, io.NopCloser(bytes.NewReader(data)), -1, "a.bin")
+		require.NoError(t, err)
+		assert.Equal(t, "/apps/x/a.bin", resp.Path)
+		// limit of spooling is looked up first.  precreate is given the
+		// real block list, the fake server asks for block 0 only
+		assert.Equal(t, []string{"uinfo", "precreate", "superfile2", "create"}, s.methods)
+		assert.Equal(t, data[:UPLOAD_API_BLOCK_SIZE], s.blocks[0])
+		blockListData := `["` + strings.Join(blockList, `","`) + `"]`
+		assert.Equal(t, blockListData, s.precreate.Get("block_list"))
+		assert.Equal(t, "8388708", s.precreate.Get("size"))
+		assert.Equal(t, blockListData, s.create.Get("block_list"))
+		assert.Equal(t, "8388708", s.create.Get("size"))
+		spooled, err := os.ReadDir(c.cfg.TmpDir)
+		require.NoError(t, err)
+		assert.Empty(t, spooled)
+	})
+	t.Run("unknown size too large", func(t *testing.T) {
+		c, s := newFakeUploadClient()
+		c.cfg.TmpDir = t.TempDir()
+		limit := int64(UPLOAD_API_BLOCK_SIZE + 100)
+		_, err := c.uploadSpool(ctx, bytes.NewReader(data), limit, "/apps/x/a.bin", writeOpts{})
+		var tooLarge *FileTooLargeError
+		require.ErrorAs(t, err, &tooLarge)
+		assert.Equal(t, limit, tooLarge.Limit)
+		assert.Empty(t, s.methods)
+		spooled, err := os.ReadDir(c.cfg.TmpDir)
+		require.NoError(t, err)
+		assert.Empty(t, spooled)
+	})
+	t.Run("size mismatch", func(t *testing.T) {
+		c, s := newFakeUploadClient()
+		_, err := c.UploadReader(ctx, bytes.NewReader(data), int64(len(data))+1, "a.bin")
+		assert.Error(t, err)
+		assert.NotContains(t, s.methods, "create")
+	})
+	t.Run("single", func(t *testing.T) {
+		c, s := newFakeUploadClient()
+		_, err := c.UploadReader(ctx, bytes.NewReader(data[:100]), 100, "a.bin")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"upload"}, s.methods)
+		assert.Equal(t, data[:100], s.single)
+	})
+}
+
+// recordTracker records calls of a tracker
+type recordTracker struct {
+	mu     sync.Mutex
+	starts []int64
+	done   int64
+	dones  int
+}
+
+func (rt *recordTracker) Start(total int64) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.starts = append(rt.starts, total)
+}
+
+func (rt *recordTracker) Increment(n int64) {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.done += n
+}
+
+func (rt *recordTracker) Done() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	rt.dones++
+}
+
+func TestUploadTracker(t *testing.T) {
+	data := make([]byte, 2*UPLOAD_API_BLOCK_SIZE+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	for _, size := range []int{len(data), 100} {
+		c, _ := newFakeUploadClient()
+		rt := &recordTracker{}
+		ctx := context.WithValue(context.Background(), XloadTrackerKey, rt)
+		_, err := c.UploadReader(ctx, bytes.NewReader(data[:size]), int64(size), "a.bin")
+		require.NoError(t, err)
+		// once for the whole file, form fields not counted
+		assert.Equal(t, []int64{int64(size)}, rt.starts, size)
+		assert.EqualValues(t, size, rt.done, size)
+		assert.Equal(t, 1, rt.dones, size)
+	}
+
+	// blocks the server has count as done
+	c, s := newFakeUploadClient()
+	rt := &recordTracker{}
+	ctx := context.WithValue(context.Background(), XloadTrackerKey, rt)
+	_, err := c.UploadReadSeeker(ctx, bytes.NewReader(data), int64(len(data)), "a.bin")
+	require.NoError(t, err)
+	assert.Len(t, s.blocks, 1)
+	assert.Equal(t, []int64{int64(len(data))}, rt.starts)
+	assert.EqualValues(t, len(data), rt.done)
+	assert.Equal(t, 1, rt.dones)
+}
+
+func TestUploadReadSeeker(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 2*UPLOAD_API_BLOCK_SIZE+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	blockList, err := computeReaderBlockList(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	t.Run("multipart", func(t *testing.T) {
+		c, s := newFakeUploadClient()
+		// only size bytes from where r is are uploaded
+		r := io.NewSectionReader(bytes.NewReader(append(data, "trailing"...)), 0, int64(len(data)))
+		resp, err := c.UploadReadSeeker(ctx, r, int64(len(data)), "a.bin")
+		require.NoError(t, err)
+		assert.Equal(t, "/apps/x/a.bin", resp.Path)
+		assert.Equal(t, []string{"precreate", "superfile2", "create"}, s.methods)
+		// the fake server asks for block 0 only
+		assert.Equal(t, data[:UPLOAD_API_BLOCK_SIZE], s.blocks[0])
+		blockListData := `["` + strings.Join(blockList, `","`) + `"]`
+		assert.Equal(t, blockListData, s.precreate.Get("block_list"))
+		assert.Equal(t, blockListData, s.create.Get("block_list"))
+		assert.Equal(t, "8388708", s.create.Get("size"))
+	})
+	t.Run("single", func(t *testing.T) {
+		c, s := newFakeUploadClient()
+		_, err := c.UploadReadSeeker(ctx, bytes.NewReader(data), 100, "a.bin")
+		require.NoError(t, err)
+		assert.Equal(t, []string{"upload"}, s.methods)
+		assert.Equal(t, data[:100], s.single)
+	})
+}
+
+func TestUploadSession(t *testing.T) {
+	ctx := context.Background()
+	data := make([]byte, 2*UPLOAD_API_BLOCK_SIZE+100)
+	rand.New(rand.NewSource(1)).Read(data)
+	blockList, err := computeReaderBlockList(bytes.NewReader(data))
+	require.NoError(t, err)
+
+	c, s := newFakeUploadClient()
+	c.cfg.TmpDir = t.TempDir()
+	us, err := c.NewUploadSession(ctx, "a.bin")
+	require.NoError(t, err)
+
+	// pieces not aligned to blocks in any order are spooled till create
+	pieceSize := 5 << 20
+	for _, i := range []int{1, 0} {
+		end := (i + 1) * pieceSize
+		if end > len(data) {
+			end = len(data)
+		}
+		n, err := us.WriteAt(ctx, int64(i*pieceSize), bytes.NewReader(data[i*pieceSize:end]))
+		require.NoError(t, err)
+		assert.Equal(t, int64(end-i*pieceSize), n)
+	}
+	assert.Empty(t, s.methods)
+	resp, err := us.Create(ctx, nil, int64(len(data)))
+	require.NoError(t, err)
+	assert.Equal(t, "/apps/x/a.bin", resp.Path)
+	// the fake server asks for block 0 only
+	assert.Equal(t, []string{"precreate", "superfile2", "create"}, s.methods)
+	assert.Equal(t, data[:UPLOAD_API_BLOCK_SIZE], s.blocks[0])
+	blockListData := `["` + strings.Join(blockList, `","`) + `"]`
+	assert.Equal(t, "/apps/x/a.bin", s.precreate.Get("path"))
+	assert.Equal(t, blockListData, s.precreate.Get("block_list"))
+	assert.Equal(t, "8388708", s.precreate.Get("size"))
+	assert.Equal(t, "u1", s.create.Get("uploadid"))
+	assert.Equal(t, blockListData, s.create.Get("block_list"))
+
+	require.NoError(t, us.Close())
+	spooled, err := os.ReadDir(c.cfg.TmpDir)
+	require.NoError(t, err)
+	assert.Empty(t, spooled)
+}
@@ -6,6 +6,7 @@ package client
 import (
 	"crypto/md5"
 	"encoding/hex"
+	"hash"
 	"io"
 	"os"
 )
@@ -45,3 +46,51 @@ func computeReaderBlockList(r io.Reader) ([]string, error) {
 	}
 	return blockList, nil
 }
+
+// blockListWriter computes block list incrementally from what's written to
+// it
+type blockListWriter struct {
+	csum      hash.Hash
+	n         int64
+	blockList []string
+}
+
+func newBlockListWriter() *blockListWriter {
+	blw := &blockListWriter{
+		csum: md5.New(),
+	}
+	return blw
+}
+
+func (blw *blockListWriter) Write(p []byte) (int, error) {
+	total := len(p)
+	for len(p) > 0 {
+		n := blockSize - blw.n
+		if n > int64(len(p)) {
+			n = int64(len(p))
+		}
+		blw.csum.Write(p[:n])
+		blw.n += n
+		p = p[n:]
+		if blw.n == blockSize {
+			blw.sum()
+		}
+	}
+	return total, nil
+}
+
+func (blw *blockListWriter) sum() {
+	v := make([]byte, 0, blw.csum.Size())
+	v = blw.csum.Sum(v)
+	blw.blockList = append(blw.blockList, hex.EncodeToString(v))
+	blw.csum.Reset()
+	blw.n = 0
+}
+
+// BlockList returns block list of all that has been written
+func (blw *blockListWriter) BlockList() []string {
+	if blw.n > 0 {
+		blw.sum()
+	}
+	return blw.blockList
+}
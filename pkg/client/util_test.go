@@ -5,6 +5,7 @@ package client
 
 import (
 	"bytes"
+	"fmt"
 	"testing"
 )
 
@@ -59,3 +60,29 @@ func TestComputeBlockList(t *testing.T) {
 		})
 	}
 }
+
+func TestBlockListWriter(t *testing.T) {
+	for _, dataLen := range []int{0, 1, blockSize, blockSize + 1, 2*blockSize + 3} {
+		t.Run(fmt.Sprint(dataLen), func(t *testing.T) {
+			data := bytes.Repeat([]byte{'A'}, dataLen)
+			want, err := computeReaderBlockList(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("compute error: %v", err)
+			}
+
+			// written in odd sized pieces
+			blw := newBlockListWriter()
+			for len(data) > 0 {
+				n := 1000003
+				if n > len(data) {
+					n = len(data)
+				}
+				blw.Write(data[:n])
+				data = data[n:]
+			}
+			if got := blw.BlockList(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("block list: want %v, got %v", want, got)
+			}
+		})
+	}
+}
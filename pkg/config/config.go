@@ -53,11 +53,15 @@ const (
 )
 
 const (
-	StoreKeyAccessAuth    = "accessAuth.json"
-	StoreKeyDstCacheEntry = "dst_filecache.json"
-	StoreKeySrcCacheEntry = "src_filecache.json"
+	StoreKeyAccessAuth      = "accessAuth.json"
+	StoreKeyDstCacheEntry   = "dst_filecache.json"
+	StoreKeySrcCacheEntry   = "src_filecache.json"
+	StoreKeyCompletionCache = "completion_cache.json"
 )
 
+// ShellHistoryFile is where lines entered in shell are kept, in CacheDir
+const ShellHistoryFile = "shell_history"
+
 const (
 	VerboseOff = iota
 	// - debug message
@@ -0,0 +1,214 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+
+	"github.com/BurntSushi/toml"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+)
+
+// FileNames are tried in order in the config dir.  The first existing one
+// will be loaded
+var FileNames = []string{
+	"config.toml",
+	"config.yaml",
+	"config.yml",
+}
+
+// FileKeyCommand is the top level key holding per-command defaults.  Its
+// value is a table keyed by command name, e.g.
+//
+//	format = "table"
+//
+//	[command.syncup]
+//	parallel = 4
+//	exclude = ["*.tmp", ".git"]
+const FileKeyCommand = "command"
+
+// FileKeyJob is the top level key holding scheduled sync jobs run by the
+// daemon, e.g.
+//
+//	[job.photos]
+//	schedule = "0 3 * * *"
+//	direction = "up"
+//	src = "/home/user/Photos"
+//	dst = "photos"
+//	parallel = 4
+const FileKeyJob = "job"
+
+const (
+	JobDirectionUp   = "up"
+	JobDirectionDown = "down"
+)
+
+type Job struct {
+	Name string `json:"name"`
+	// Schedule is a cron spec with 5 fields, or descriptors like @daily,
+	// @every 1h
+	Schedule  string `json:"schedule"`
+	Direction string `json:"direction"`
+	// Src is the local path
+	Src string `json:"src"`
+	// Dst is the remote path
+	Dst string `json:"dst"`
+
+	DryRun   bool     `json:"dryrun,omitempty"`
+	NoDelete bool     `json:"nodelete,omitempty"`
+	Parallel int      `json:"parallel,omitempty"`
+	Exclude  []string `json:"exclude,omitempty"`
+}
+
+func (job *Job) validate() error {
+	if job.Schedule == "" {
+		return fmt.Errorf("schedule is required")
+	}
+	if job.Src == "" || job.Dst == "" {
+		return fmt.Errorf("src and dst are required")
+	}
+	if job.Direction != JobDirectionUp && job.Direction != JobDirectionDown {
+		return fmt.Errorf("direction must be %s or %s, got %q",
+			JobDirectionUp, JobDirectionDown, job.Direction)
+	}
+	return nil
+}
+
+type File struct {
+	// Path is empty if no config file was found
+	Path string
+
+	Global   map[string]interface{}
+	Commands map[string]map[string]interface{}
+	Jobs     []Job
+}
+
+func LoadFile(dir string) (*File, error) {
+	for _, name := range FileNames {
+		p := path.Join(dir, name)
+		data, err := ioutil.ReadFile(p)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return nil, err
+		}
+		f, err := ParseFile(name, data)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse %s", p)
+		}
+		f.Path = p
+		return f, nil
+	}
+	f := &File{
+		Global:   map[string]interface{}{},
+		Commands: map[string]map[string]interface{}{},
+	}
+	return f, nil
+}
+
+func ParseFile(name string, data []byte) (*File, error) {
+	var m map[string]interface{}
+	switch ext := path.Ext(name); ext {
+	case ".toml":
+		if err := toml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, &m); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown config file type %q", ext)
+	}
+
+	f := &File{
+		Global:   map[string]interface{}{},
+		Commands: map[string]map[string]interface{}{},
+	}
+	for k, v := range m {
+		if k == FileKeyJob {
+			jobs, err := parseJobs(v)
+			if err != nil {
+				return nil, errors.Wrap(err, k)
+			}
+			f.Jobs = jobs
+			continue
+		}
+		if k != FileKeyCommand {
+			f.Global[k] = v
+			continue
+		}
+		cmds, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%s: want a table, got %T", k, v)
+		}
+		for cmd, v := range cmds {
+			opts, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%s.%s: want a table, got %T", k, cmd, v)
+			}
+			f.Commands[cmd] = opts
+		}
+	}
+	return f, nil
+}
+
+func parseJobs(v interface{}) ([]Job, error) {
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("want a table, got %T", v)
+	}
+	var jobs []Job
+	for _, name := range SortedKeys(m) {
+		// round trip through json for decoding into the typed struct
+		data, err := json.Marshal(m[name])
+		if err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		var job Job
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		job.Name = name
+		if err := job.validate(); err != nil {
+			return nil, errors.Wrap(err, name)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// FileValues converts a config file value to strings suitable for setting a
+// command line flag.  Lists are returned element by element
+func FileValues(v interface{}) []string {
+	switch val := v.(type) {
+	case []interface{}:
+		var strs []string
+		for _, elem := range val {
+			strs = append(strs, FileValues(elem)...)
+		}
+		return strs
+	case []string:
+		return val
+	default:
+		return []string{fmt.Sprint(val)}
+	}
+}
+
+// SortedKeys returns keys of m in sorted order
+func SortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseFile(t *testing.T) {
+	for _, c := range []struct {
+		Name string
+		Data string
+	}{
+		{
+			Name: "config.toml",
+			Data: `
+format = "table"
+
+[command.syncup]
+parallel = 4
+exclude = ["*.tmp", ".git"]
+`,
+		}, {
+			Name: "config.yaml",
+			Data: `
+format: table
+command:
+  syncup:
+    parallel: 4
+    exclude: ["*.tmp", ".git"]
+`,
+		},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			f, err := ParseFile(c.Name, []byte(c.Data))
+			if !assert.NoError(t, err) {
+				return
+			}
+			assert.Equal(t, []string{"table"}, FileValues(f.Global["format"]))
+			syncup := f.Commands["syncup"]
+			assert.Equal(t, []string{"4"}, FileValues(syncup["parallel"]))
+			assert.Equal(t, []string{"*.tmp", ".git"}, FileValues(syncup["exclude"]))
+		})
+	}
+}
+
+func TestParseFileBadCommand(t *testing.T) {
+	_, err := ParseFile("config.toml", []byte(`command = "syncup"`))
+	assert.Error(t, err)
+}
+
+func TestParseFileJobs(t *testing.T) {
+	f, err := ParseFile("config.toml", []byte(`
+[job.photos]
+schedule = "0 3 * * *"
+direction = "up"
+src = "/home/user/Photos"
+dst = "photos"
+parallel = 4
+`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, []Job{
+		{
+			Name:      "photos",
+			Schedule:  "0 3 * * *",
+			Direction: JobDirectionUp,
+			Src:       "/home/user/Photos",
+			Dst:       "photos",
+			Parallel:  4,
+		},
+	}, f.Jobs)
+
+	_, err = ParseFile("config.toml", []byte(`
+[job.photos]
+schedule = "0 3 * * *"
+direction = "sideways"
+src = "/home/user/Photos"
+dst = "photos"
+`))
+	assert.Error(t, err)
+}
@@ -0,0 +1,361 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+// Package crypt implements client side encryption of file content and names.
+//
+// File content is encrypted with AES-256-GCM in chunks of ChunkSize bytes.
+// Each file has a random salt from which the file key is derived.  The last
+// chunk is authenticated as such so that truncation can be detected.  The
+// layout is
+//
+//	magic | salt | chunk0 | chunk1 | ...
+//
+// File names are encrypted deterministically with AES-CTR, using HMAC-SHA256
+// of the plaintext as IV, so that the same name always maps to the same
+// encrypted one and can be looked up
+package crypt
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/hkdf"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	magic     = "MYPANEC1"
+	saltSize  = 32
+	keySize   = 32
+	nonceSize = 12
+	tagSize   = 16
+
+	// HeaderSize is size of the header preceding encrypted chunks
+	HeaderSize = len(magic) + saltSize
+	// ChunkSize is size of plaintext in each chunk
+	ChunkSize = 64 << 10
+
+	chunkCipherSize = ChunkSize + tagSize
+	nameIVSize      = aes.BlockSize
+)
+
+// passphraseSalt is fixed so that the same passphrase derives the same keys
+// on all hosts
+const passphraseSalt = "mypan crypt"
+
+var (
+	ErrBadMagic  = errors.New("crypt: bad magic")
+	ErrAuth      = errors.New("crypt: message authentication failed")
+	ErrTruncated = errors.New("crypt: truncated")
+	ErrBadName   = errors.New("crypt: bad encrypted name")
+)
+
+var nameEncoding = base32.HexEncoding.WithPadding(base32.NoPadding)
+
+type Cipher struct {
+	contentKey []byte
+	nameKey    []byte
+	nameMacKey []byte
+}
+
+// NewCipherFromPassphrase derives keys from passphrase with scrypt
+func NewCipherFromPassphrase(passphrase string) (*Cipher, error) {
+	if passphrase == "" {
+		return nil, fmt.Errorf("crypt: empty passphrase")
+	}
+	master, err := scrypt.Key([]byte(passphrase), []byte(passphraseSalt), 1<<15, 8, 1, keySize)
+	if err != nil {
+		return nil, errors.Wrap(err, "crypt: scrypt")
+	}
+	return newCipher(master)
+}
+
+// NewCipherFromKey derives keys from content of a key file
+func NewCipherFromKey(key []byte) (*Cipher, error) {
+	if len(key) < keySize {
+		return nil, fmt.Errorf("crypt: key too short, want at least %d bytes, got %d", keySize, len(key))
+	}
+	return newCipher(key)
+}
+
+func newCipher(master []byte) (*Cipher, error) {
+	c := &Cipher{}
+	for _, v := range []struct {
+		info string
+		key  *[]byte
+	}{
+		{"content", &c.contentKey},
+		{"name", &c.nameKey},
+		{"name mac", &c.nameMacKey},
+	} {
+		key, err := deriveKey(master, nil, v.info)
+		if err != nil {
+			return nil, err
+		}
+		*v.key = key
+	}
+	return c, nil
+}
+
+func deriveKey(secret, salt []byte, info string) ([]byte, error) {
+	key := make([]byte, keySize)
+	r := hkdf.New(sha256.New, secret, salt, []byte(info))
+	if _, err := io.ReadFull(r, key); err != nil {
+		return nil, errors.Wrap(err, "crypt: derive key")
+	}
+	return key, nil
+}
+
+func (c *Cipher) fileAEAD(salt []byte) (cipher.AEAD, error) {
+	key, err := deriveKey(c.contentKey, salt, "file")
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func chunkNonce(counter uint64) []byte {
+	nonce := make([]byte, nonceSize)
+	binary.BigEndian.PutUint64(nonce, counter)
+	return nonce
+}
+
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// EncryptedSize returns size of encrypted content of size bytes of plaintext
+func EncryptedSize(size int64) int64 {
+	chunks := (size + ChunkSize - 1) / ChunkSize
+	if chunks == 0 {
+		chunks = 1
+	}
+	return int64(HeaderSize) + size + chunks*tagSize
+}
+
+// DecryptedSize returns size of plaintext of size bytes of encrypted content
+func DecryptedSize(size int64) (int64, error) {
+	n := size - int64(HeaderSize)
+	if n < tagSize {
+		return 0, ErrTruncated
+	}
+	chunks := (n + chunkCipherSize - 1) / chunkCipherSize
+	plainSize := n - chunks*tagSize
+	if plainSize < 0 || EncryptedSize(plainSize) != size {
+		return 0, ErrTruncated
+	}
+	return plainSize, nil
+}
+
+type encryptReader struct {
+	aead    cipher.AEAD
+	src     *bufio.Reader
+	plain   []byte
+	buf     []byte
+	counter uint64
+	done    bool
+}
+
+// EncryptReader returns a reader of encrypted content of r
+func (c *Cipher) EncryptReader(r io.Reader) (io.Reader, error) {
+	salt := make([]byte, saltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, errors.Wrap(err, "crypt: salt")
+	}
+	aead, err := c.fileAEAD(salt)
+	if err != nil {
+		return nil, err
+	}
+	er := &encryptReader{
+		aead:  aead,
+		src:   bufio.NewReader(r),
+		plain: make([]byte, ChunkSize),
+		buf:   append([]byte(magic), salt...),
+	}
+	return er, nil
+}
+
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for len(er.buf) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+		if err := er.fill(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, er.buf)
+	er.buf = er.buf[n:]
+	return n, nil
+}
+
+func (er *encryptReader) fill() error {
+	n, err := io.ReadFull(er.src, er.plain)
+	final := false
+	switch err {
+	case nil:
+		if _, err := er.src.Peek(1); err == io.EOF {
+			final = true
+		} else if err != nil {
+			return err
+		}
+	case io.EOF, io.ErrUnexpectedEOF:
+		final = true
+	default:
+		return err
+	}
+	nonce := chunkNonce(er.counter)
+	er.buf = er.aead.Seal(er.buf[:0], nonce, er.plain[:n], chunkAD(final))
+	er.counter += 1
+	er.done = final
+	return nil
+}
+
+type decryptWriter struct {
+	c       *Cipher
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	plain   []byte
+	counter uint64
+}
+
+// DecryptWriter returns a writer which decrypts what's written to it and
+// writes plaintext to w.  Close must be called to flush the last chunk and
+// check for truncation
+func (c *Cipher) DecryptWriter(w io.Writer) io.WriteCloser {
+	dw := &decryptWriter{
+		c:     c,
+		w:     w,
+		plain: make([]byte, 0, ChunkSize),
+	}
+	return dw
+}
+
+func (dw *decryptWriter) Write(p []byte) (int, error) {
+	dw.buf = append(dw.buf, p...)
+	if dw.aead == nil {
+		if len(dw.buf) < HeaderSize {
+			return len(p), nil
+		}
+		if string(dw.buf[:len(magic)]) != magic {
+			return 0, ErrBadMagic
+		}
+		aead, err := dw.c.fileAEAD(dw.buf[len(magic):HeaderSize])
+		if err != nil {
+			return 0, err
+		}
+		dw.aead = aead
+		dw.buf = dw.buf[HeaderSize:]
+	}
+	// a full chunk followed by more data cannot be the final one
+	off := 0
+	for len(dw.buf)-off > chunkCipherSize {
+		if err := dw.open(dw.buf[off:off+chunkCipherSize], false); err != nil {
+			return 0, err
+		}
+		off += chunkCipherSize
+	}
+	dw.buf = append(dw.buf[:0], dw.buf[off:]...)
+	return len(p), nil
+}
+
+func (dw *decryptWriter) Close() error {
+	if dw.aead == nil {
+		return ErrTruncated
+	}
+	return dw.open(dw.buf, true)
+}
+
+func (dw *decryptWriter) open(chunk []byte, final bool) error {
+	nonce := chunkNonce(dw.counter)
+	plain, err := dw.aead.Open(dw.plain[:0], nonce, chunk, chunkAD(final))
+	if err != nil {
+		if final {
+			// a truncated file fails as its last chunk is not
+			// marked final
+			return errors.Wrap(ErrAuth, ErrTruncated.Error())
+		}
+		return ErrAuth
+	}
+	dw.counter += 1
+	_, err = dw.w.Write(plain)
+	return err
+}
+
+// EncryptName encrypts a single path component
+func (c *Cipher) EncryptName(name string) string {
+	mac := hmac.New(sha256.New, c.nameMacKey)
+	mac.Write([]byte(name))
+	iv := mac.Sum(nil)[:nameIVSize]
+
+	block, _ := aes.NewCipher(c.nameKey)
+	data := make([]byte, nameIVSize+len(name))
+	copy(data, iv)
+	cipher.NewCTR(block, iv).XORKeyStream(data[nameIVSize:], []byte(name))
+	return strings.ToLower(nameEncoding.EncodeToString(data))
+}
+
+// DecryptName decrypts a single path component
+func (c *Cipher) DecryptName(encName string) (string, error) {
+	data, err := nameEncoding.DecodeString(strings.ToUpper(encName))
+	if err != nil || len(data) < nameIVSize {
+		return "", ErrBadName
+	}
+	iv := data[:nameIVSize]
+	block, _ := aes.NewCipher(c.nameKey)
+	name := make([]byte, len(data)-nameIVSize)
+	cipher.NewCTR(block, iv).XORKeyStream(name, data[nameIVSize:])
+
+	mac := hmac.New(sha256.New, c.nameMacKey)
+	mac.Write(name)
+	if !hmac.Equal(iv, mac.Sum(nil)[:nameIVSize]) {
+		return "", ErrBadName
+	}
+	return string(name), nil
+}
+
+// EncryptPath encrypts each component of slash separated path p
+func (c *Cipher) EncryptPath(p string) string {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		parts[i] = c.EncryptName(part)
+	}
+	return strings.Join(parts, "/")
+}
+
+// DecryptPath decrypts each component of slash separated path p
+func (c *Cipher) DecryptPath(p string) (string, error) {
+	parts := strings.Split(p, "/")
+	for i, part := range parts {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		name, err := c.DecryptName(part)
+		if err != nil {
+			return "", errors.Wrap(err, part)
+		}
+		parts[i] = name
+	}
+	return strings.Join(parts, "/"), nil
+}
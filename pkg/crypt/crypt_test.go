@@ -0,0 +1,118 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package crypt
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testCipher(t *testing.T) *Cipher {
+	c, err := NewCipherFromKey(bytes.Repeat([]byte{0x5a}, keySize))
+	require.NoError(t, err)
+	return c
+}
+
+func encrypt(t *testing.T, c *Cipher, plain []byte) []byte {
+	r, err := c.EncryptReader(bytes.NewReader(plain))
+	require.NoError(t, err)
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	return data
+}
+
+func decrypt(c *Cipher, data []byte) ([]byte, error) {
+	var out bytes.Buffer
+	w := c.DecryptWriter(&out)
+	// write in odd sized pieces to exercise buffering
+	for len(data) > 0 {
+		n := 7777
+		if n > len(data) {
+			n = len(data)
+		}
+		if _, err := w.Write(data[:n]); err != nil {
+			return nil, err
+		}
+		data = data[n:]
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
+
+func TestContent(t *testing.T) {
+	c := testCipher(t)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3 * ChunkSize} {
+		t.Run(fmt.Sprint(size), func(t *testing.T) {
+			plain := make([]byte, size)
+			rand.Read(plain)
+			data := encrypt(t, c, plain)
+			assert.Equal(t, EncryptedSize(int64(size)), int64(len(data)))
+			plainSize, err := DecryptedSize(int64(len(data)))
+			require.NoError(t, err)
+			assert.Equal(t, int64(size), plainSize)
+
+			got, err := decrypt(c, data)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(plain, got))
+		})
+	}
+}
+
+func TestContentTamper(t *testing.T) {
+	c := testCipher(t)
+	plain := make([]byte, 2*ChunkSize+100)
+	data := encrypt(t, c, plain)
+
+	t.Run("flip", func(t *testing.T) {
+		d := append([]byte{}, data...)
+		d[HeaderSize+10] ^= 1
+		_, err := decrypt(c, d)
+		assert.Equal(t, ErrAuth, errors.Cause(err))
+	})
+	t.Run("truncate", func(t *testing.T) {
+		d := data[:HeaderSize+2*chunkCipherSize]
+		_, err := decrypt(c, d)
+		assert.Equal(t, ErrAuth, errors.Cause(err))
+	})
+	t.Run("magic", func(t *testing.T) {
+		_, err := decrypt(c, plain)
+		assert.Equal(t, ErrBadMagic, err)
+	})
+	t.Run("other key", func(t *testing.T) {
+		c1, err := NewCipherFromPassphrase("other")
+		require.NoError(t, err)
+		_, err = decrypt(c1, data)
+		assert.Error(t, err)
+	})
+}
+
+func TestName(t *testing.T) {
+	c := testCipher(t)
+	for _, name := range []string{"a", "photos", "中文名.jpg", "with space"} {
+		enc := c.EncryptName(name)
+		assert.Equal(t, enc, c.EncryptName(name), "deterministic")
+		assert.NotContains(t, enc, "/")
+		dec, err := c.DecryptName(enc)
+		require.NoError(t, err)
+		assert.Equal(t, name, dec)
+	}
+	_, err := c.DecryptName("plain.txt")
+	assert.Equal(t, ErrBadName, err)
+
+	p := "/a/b/c.txt"
+	enc := c.EncryptPath(p)
+	assert.Equal(t, byte('/'), enc[0])
+	dec, err := c.DecryptPath(enc)
+	require.NoError(t, err)
+	assert.Equal(t, p, dec)
+}
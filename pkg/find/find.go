@@ -0,0 +1,540 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+// Package find parses find(1) like expressions and evaluates them against
+// metadata of remote files.
+//
+// Tests
+//
+//	-name GLOB, -iname GLOB    base name matches GLOB
+//	-path GLOB, -ipath GLOB    relative path matches GLOB, "**" matches any
+//	                           levels
+//	-regex RE, -iregex RE      relative path matches regular expression RE
+//	-size [+-]N                size is more than, less than, or exactly N
+//	                           bytes, N can have binary units as with
+//	                           find(1), 10M and 10MiB both mean 10*2^20
+//	-mtime [+-]T, -ctime [+-]T server mtime, ctime
+//	-lmtime [+-]T, -lctime [+-]T
+//	                           local mtime, ctime.  T is days like 30, a
+//	                           duration like 36h, or a date like 2024-01-01.
+//	                           "+" means older than or before, "-" newer than
+//	                           or since
+//	-type f|d                  file or dir
+//	-category NAME|N           video, music, picture, doc, app, other, seed
+//	-md5 HEX                   md5 as reported by server
+//
+// Operators, in order of decreasing precedence
+//
+//	( EXPR ), ! EXPR, -not EXPR
+//	EXPR EXPR, EXPR -a EXPR, EXPR -and EXPR
+//	EXPR -o EXPR, EXPR -or EXPR
+//
+// Relative path is that below the starting dir with "./" prepended, as
+// find(1) run in the starting dir would see it, e.g. "./photos/a.jpg".
+// Patterns like "./photos/*" or "**/photos/*" work the same whatever the
+// starting dir is
+//
+// Options -maxdepth N, -mindepth N limit depth of entries below the starting
+// dir.  Actions -print, -delete, -exec CMD ARGS... ; apply to all matching
+// entries.  {} in ARGS is replaced by path of the entry.  Entries are
+// printed if there is no action.
+//
+// Actions are accepted only after the whole expression.  Unlike find(1),
+// where an action binds to the operand it follows, actions here apply to
+// entries matching the whole expression.  An expression with -o at top
+// level is rejected before actions, as "A -o B -delete" deletes only B in
+// find(1).  Write "( A -o B ) -delete" instead
+package find
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mypan/pkg/client"
+	"mypan/pkg/util"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Entry is metadata of a remote file or dir
+type Entry struct {
+	Path string
+	// RelPath is path below the starting dir with "./" prepended
+	RelPath     string
+	IsDir       bool
+	Size        int64
+	ServerCtime time.Time
+	ServerMtime time.Time
+	LocalCtime  time.Time
+	LocalMtime  time.Time
+	Category    int
+	Md5         string
+
+	// Depth is 1 for entries directly under the starting dir
+	Depth int
+}
+
+// Expr is a boolean expression on an entry
+type Expr interface {
+	Match(ent *Entry) bool
+}
+
+type exprFunc func(ent *Entry) bool
+
+func (f exprFunc) Match(ent *Entry) bool {
+	return f(ent)
+}
+
+var exprTrue = exprFunc(func(*Entry) bool { return true })
+
+type exprNot struct{ x Expr }
+type exprAnd struct{ x, y Expr }
+type exprOr struct{ x, y Expr }
+
+func (e exprNot) Match(ent *Entry) bool { return !e.x.Match(ent) }
+func (e exprAnd) Match(ent *Entry) bool { return e.x.Match(ent) && e.y.Match(ent) }
+func (e exprOr) Match(ent *Entry) bool  { return e.x.Match(ent) || e.y.Match(ent) }
+
+// Query is a parsed find expression
+type Query struct {
+	Expr     Expr
+	MaxDepth int // negative for no limit
+	MinDepth int
+
+	Print  bool
+	Delete bool
+	Exec   [][]string
+}
+
+// Match tells whether ent matches both depth options and the expression
+func (q *Query) Match(ent *Entry) bool {
+	if ent.Depth < q.MinDepth {
+		return false
+	}
+	if q.MaxDepth >= 0 && ent.Depth > q.MaxDepth {
+		return false
+	}
+	return q.Expr.Match(ent)
+}
+
+var categories = map[string]int{
+	"video":   client.CATEGORY_VIDEO,
+	"music":   client.CATEGORY_MUSIC,
+	"picture": client.CATEGORY_PICTURE,
+	"doc":     client.CATEGORY_DOC,
+	"app":     client.CATEGORY_APP,
+	"other":   client.CATEGORY_OTHER,
+	"seed":    client.CATEGORY_SEED,
+}
+
+// Parse parses args as find expression.  now is the reference time of age
+// in -mtime and the like
+func Parse(args []string, now time.Time) (*Query, error) {
+	p := &parser{
+		args: args,
+		now:  now,
+		q: &Query{
+			Expr:     exprTrue,
+			MaxDepth: -1,
+		},
+	}
+	if tok, ok := p.peek(); ok && !isAction(tok) {
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		p.q.Expr = expr
+	}
+	if err := p.parseActions(); err != nil {
+		return nil, err
+	}
+	if !p.q.Delete && len(p.q.Exec) == 0 {
+		p.q.Print = true
+	}
+	return p.q, nil
+}
+
+type parser struct {
+	args []string
+	i    int
+	now  time.Time
+	q    *Query
+
+	// depth is the nesting level of parentheses
+	depth int
+	// topOr tells whether there is -o at top level
+	topOr bool
+}
+
+func isAction(tok string) bool {
+	switch tok {
+	case "-print", "-delete", "-exec":
+		return true
+	}
+	return false
+}
+
+func (p *parser) peek() (string, bool) {
+	if p.i < len(p.args) {
+		return p.args[p.i], true
+	}
+	return "", false
+}
+
+func (p *parser) next() (string, bool) {
+	tok, ok := p.peek()
+	if ok {
+		p.i++
+	}
+	return tok, ok
+}
+
+func (p *parser) arg(name string) (string, error) {
+	v, ok := p.next()
+	if !ok {
+		return "", fmt.Errorf("%s: missing argument", name)
+	}
+	return v, nil
+}
+
+func (p *parser) parseOr() (Expr, error) {
+	x, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || (tok != "-o" && tok != "-or") {
+			return x, nil
+		}
+		p.next()
+		y, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		x = exprOr{x, y}
+		if p.depth == 0 {
+			p.topOr = true
+		}
+	}
+}
+
+func (p *parser) parseAnd() (Expr, error) {
+	x, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		tok, ok := p.peek()
+		if !ok || tok == "-o" || tok == "-or" || tok == ")" || isAction(tok) {
+			return x, nil
+		}
+		if tok == "-a" || tok == "-and" {
+			p.next()
+		}
+		y, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		x = exprAnd{x, y}
+	}
+}
+
+func (p *parser) parseUnary() (Expr, error) {
+	tok, ok := p.peek()
+	if ok && (tok == "!" || tok == "-not") {
+		p.next()
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return exprNot{x}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *parser) parsePrimary() (Expr, error) {
+	tok, ok := p.next()
+	if !ok {
+		return nil, fmt.Errorf("expression expected")
+	}
+	switch tok {
+	case "(":
+		p.depth++
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if tok, _ := p.next(); tok != ")" {
+			if isAction(tok) {
+				return nil, fmt.Errorf("%s: actions must follow the whole expression", tok)
+			}
+			return nil, fmt.Errorf("missing )")
+		}
+		p.depth--
+		return x, nil
+	case "-name", "-iname", "-path", "-ipath":
+		v, err := p.arg(tok)
+		if err != nil {
+			return nil, err
+		}
+		return newGlobExpr(tok, v)
+	case "-regex", "-iregex":
+		v, err := p.arg(tok)
+		if err != nil {
+			return nil, err
+		}
+		if tok == "-iregex" {
+			v = "(?i)" + v
+		}
+		re, err := regexp.Compile(v)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tok, err)
+		}
+		return exprFunc(func(ent *Entry) bool {
+			return re.MatchString(ent.RelPath)
+		}), nil
+	case "-size":
+		v, err := p.arg(tok)
+		if err != nil {
+			return nil, err
+		}
+		return newSizeExpr(v)
+	case "-mtime", "-ctime", "-lmtime", "-lctime":
+		v, err := p.arg(tok)
+		if err != nil {
+			return nil, err
+		}
+		cmp, err := parseTimeCmp(v, p.now)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tok, err)
+		}
+		field := map[string]func(*Entry) time.Time{
+			"-mtime":  func(ent *Entry) time.Time { return ent.ServerMtime },
+			"-ctime":  func(ent *Entry) time.Time { return ent.ServerCtime },
+			"-lmtime": func(ent *Entry) time.Time { return ent.LocalMtime },
+			"-lctime": func(ent *Entry) time.Time { return ent.LocalCtime },
+		}[tok]
+		return exprFunc(func(ent *Entry) bool {
+			return cmp(field(ent))
+		}), nil
+	case "-type":
+		v, err := p.arg(tok)
+		if err != nil {
+			return nil, err
+		}
+		switch v {
+		case "f":
+			return exprFunc(func(ent *Entry) bool { return !ent.IsDir }), nil
+		case "d":
+			return exprFunc(func(ent *Entry) bool { return ent.IsDir }), nil
+		}
+		return nil, fmt.Errorf("-type: invalid type %q, allowed values are f, d", v)
+	case "-category":
+		v, err := p.arg(tok)
+		if err != nil {
+			return nil, err
+		}
+		category, ok := categories[strings.ToLower(v)]
+		if !ok {
+			category, err = strconv.Atoi(v)
+			if err != nil {
+				return nil, fmt.Errorf("-category: invalid category %q", v)
+			}
+		}
+		return exprFunc(func(ent *Entry) bool { return ent.Category == category }), nil
+	case "-md5":
+		v, err := p.arg(tok)
+		if err != nil {
+			return nil, err
+		}
+		return exprFunc(func(ent *Entry) bool { return strings.EqualFold(ent.Md5, v) }), nil
+	case "-maxdepth", "-mindepth":
+		v, err := p.arg(tok)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("%s: invalid depth %q", tok, v)
+		}
+		if tok == "-maxdepth" {
+			p.q.MaxDepth = n
+		} else {
+			p.q.MinDepth = n
+		}
+		return exprTrue, nil
+	case "-print", "-delete", "-exec":
+		return nil, fmt.Errorf("%s: actions must follow the whole expression", tok)
+	}
+	return nil, fmt.Errorf("unknown predicate %q", tok)
+}
+
+// parseActions parses actions after the expression till the end of args
+func (p *parser) parseActions() error {
+	tok, ok := p.peek()
+	if !ok {
+		return nil
+	}
+	if !isAction(tok) {
+		return fmt.Errorf("unexpected %q", tok)
+	}
+	if p.topOr {
+		return fmt.Errorf("%s: -o at top level, group the expression with ( ) for actions to apply to all of it", tok)
+	}
+	for {
+		tok, ok := p.next()
+		if !ok {
+			return nil
+		}
+		switch tok {
+		case "-print":
+			p.q.Print = true
+		case "-delete":
+			p.q.Delete = true
+		case "-exec":
+			var argv []string
+			for {
+				v, ok := p.next()
+				if !ok {
+					return fmt.Errorf("-exec: missing terminating ;")
+				}
+				if v == ";" {
+					break
+				}
+				argv = append(argv, v)
+			}
+			if len(argv) == 0 {
+				return fmt.Errorf("-exec: missing command")
+			}
+			p.q.Exec = append(p.q.Exec, argv)
+		default:
+			return fmt.Errorf("%q after actions", tok)
+		}
+	}
+}
+
+func newGlobExpr(tok, pattern string) (Expr, error) {
+	fold := strings.HasPrefix(tok, "-i")
+	if fold {
+		pattern = strings.ToLower(pattern)
+	}
+	if _, err := util.MatchGlob(pattern, ""); err != nil {
+		return nil, fmt.Errorf("%s: %v", tok, err)
+	}
+	byName := strings.HasSuffix(tok, "name")
+	return exprFunc(func(ent *Entry) bool {
+		s := ent.RelPath
+		if byName {
+			s = path.Base(ent.Path)
+		}
+		if fold {
+			s = strings.ToLower(s)
+		}
+		ok, _ := util.MatchGlob(pattern, s)
+		return ok
+	}), nil
+}
+
+// splitSign splits leading + or - from s.  sign is 1 for +, -1 for -
+func splitSign(s string) (int, string) {
+	if strings.HasPrefix(s, "+") {
+		return 1, s[1:]
+	} else if strings.HasPrefix(s, "-") {
+		return -1, s[1:]
+	}
+	return 0, s
+}
+
+// parseSize parses s as bytes.  Units are binary whether written as k, M,
+// G or KiB, MiB, GiB, like find(1) rather than humanize
+func parseSize(s string) (uint64, error) {
+	num := strings.TrimRight(s, "BbIi")
+	unit := strings.TrimLeft(num, "0123456789. ")
+	if unit == "" || len(unit) > 1 {
+		return humanize.ParseBytes(s)
+	}
+	if !strings.ContainsAny(unit, "kKmMgGtTpPeE") {
+		return 0, fmt.Errorf("unknown unit %q", s)
+	}
+	return humanize.ParseBytes(num + "iB")
+}
+
+func newSizeExpr(v string) (Expr, error) {
+	sign, s := splitSign(v)
+	n, err := parseSize(s)
+	if err != nil {
+		return nil, fmt.Errorf("-size: %v", err)
+	}
+	size := int64(n)
+	return exprFunc(func(ent *Entry) bool {
+		switch sign {
+		case 1:
+			return ent.Size > size
+		case -1:
+			return ent.Size < size
+		default:
+			return ent.Size == size
+		}
+	}), nil
+}
+
+const day = 24 * time.Hour
+
+// parseTimeCmp parses v as days, duration or date, optionally signed, and
+// returns predicate on time
+func parseTimeCmp(v string, now time.Time) (func(time.Time) bool, error) {
+	sign, s := splitSign(v)
+	if n, err := strconv.Atoi(s); err == nil {
+		// age in whole days, as find(1)
+		return func(t time.Time) bool {
+			days := int(now.Sub(t) / day)
+			switch sign {
+			case 1:
+				return days > n
+			case -1:
+				return days < n
+			default:
+				return days == n
+			}
+		}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		if sign == 0 {
+			return nil, fmt.Errorf("duration %q needs + or -", v)
+		}
+		return func(t time.Time) bool {
+			if sign > 0 {
+				return now.Sub(t) > d
+			}
+			return now.Sub(t) < d
+		}, nil
+	}
+	var (
+		date time.Time
+		err  error
+	)
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		date, err = time.ParseInLocation(layout, s, now.Location())
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid time %q, expecting days, duration or date", v)
+	}
+	return func(t time.Time) bool {
+		switch sign {
+		case 1:
+			return t.Before(date)
+		case -1:
+			return !t.Before(date)
+		default:
+			return !t.Before(date) && t.Before(date.Add(day))
+		}
+	}, nil
+}
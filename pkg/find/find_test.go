@@ -0,0 +1,131 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package find
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"mypan/pkg/client"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	now := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	ents := map[string]*Entry{
+		"big": {
+			Path:        "/apps/mypan/iso/big.iso",
+			RelPath:     "./iso/big.iso",
+			Size:        2 << 30,
+			ServerMtime: time.Date(2023, 5, 1, 0, 0, 0, 0, time.UTC),
+			Category:    client.CATEGORY_OTHER,
+			Depth:       2,
+		},
+		"photo": {
+			Path:        "/apps/mypan/photos/IMG_1.JPG",
+			RelPath:     "./photos/IMG_1.JPG",
+			Size:        3 << 20,
+			ServerMtime: now.Add(-36 * time.Hour),
+			Category:    client.CATEGORY_PICTURE,
+			Md5:         "ABCDEF",
+			Depth:       2,
+		},
+		"dir": {
+			Path:    "/apps/mypan/photos",
+			RelPath: "./photos",
+			IsDir:   true,
+			Depth:   1,
+		},
+	}
+	for _, c := range []struct {
+		expr string
+		want string
+	}{
+		{"", "big dir photo"},
+		{"-type f -size +1GiB -mtime +2024-01-01", "big"},
+		{"-size +1GiB -o -category picture", "big photo"},
+		{"! ( -type d -o -name *.iso )", "photo"},
+		{"-iname img_*.jpg", "photo"},
+		{"-name img_*.jpg", ""},
+		{"-path **/photos/*", "photo"},
+		{"-path ./photos/*", "photo"},
+		{"-path ./photos", "dir"},
+		{"-ipath ./PHOTOS/*.jpg", "photo"},
+		// not the absolute path
+		{"-path /apps/mypan/photos", ""},
+		{"-regex \\.(iso|JPG)$ -not -size -10M", "big"},
+		// binary units as with find(1)
+		{"-size 3M", "photo"},
+		{"-size 3MB -o -size 2GiB", "big photo"},
+		{"-size 3145728", "photo"},
+		{"-regex ^\\./iso/", "big"},
+		{"-regex ^/apps", ""},
+		{"-mtime -2", "photo"},
+		{"-mtime 1", "photo"},
+		{"-mtime -48h -type f", "photo"},
+		{"-md5 abcdef", "photo"},
+		{"-maxdepth 1", "dir"},
+		{"-mindepth 2 -category 6", "big"},
+	} {
+		var args []string
+		if c.expr != "" {
+			args = strings.Split(c.expr, " ")
+		}
+		q, err := Parse(args, now)
+		require.NoError(t, err, c.expr)
+		var got []string
+		for _, name := range []string{"big", "dir", "photo"} {
+			if q.Match(ents[name]) {
+				got = append(got, name)
+			}
+		}
+		assert.Equal(t, c.want, strings.Join(got, " "), c.expr)
+	}
+}
+
+func TestParseActions(t *testing.T) {
+	q, err := Parse([]string{"-name", "*.tmp", "-delete", "-exec", "echo", "{}", ";"}, time.Now())
+	require.NoError(t, err)
+	assert.True(t, q.Delete)
+	assert.False(t, q.Print)
+	assert.Equal(t, [][]string{{"echo", "{}"}}, q.Exec)
+
+	// actions apply to entries matching the whole expression
+	q, err = Parse(strings.Split("( -name a -o -name b ) -delete", " "), time.Now())
+	require.NoError(t, err)
+	assert.True(t, q.Delete)
+	assert.True(t, q.Match(&Entry{Path: "/d/a"}))
+	assert.True(t, q.Match(&Entry{Path: "/d/b"}))
+	assert.False(t, q.Match(&Entry{Path: "/d/c"}))
+
+	q, err = Parse([]string{"-print", "-delete"}, time.Now())
+	require.NoError(t, err)
+	assert.True(t, q.Print)
+	assert.True(t, q.Delete)
+	assert.True(t, q.Match(&Entry{Path: "/d/c"}))
+
+	for _, expr := range []string{
+		"( -name a",
+		"-name",
+		"-type x",
+		"-size +1X",
+		"-mtime yesterday",
+		"-exec echo",
+		"-foo",
+		"-name a )",
+		"-name a -o -name b -delete",
+		"-name a -o -name b -print",
+		"-name a -delete -o -name b",
+		"-delete -name a",
+		"( -name a -delete )",
+		"! -delete",
+		"-name a -o ( -name b -delete )",
+	} {
+		_, err := Parse(strings.Split(expr, " "), time.Now())
+		assert.Error(t, err, expr)
+	}
+}
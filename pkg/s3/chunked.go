@@ -0,0 +1,166 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package s3
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// emptySHA256 is hex sha256 of empty string
+const emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// chunkSigner checks chunk signatures.  Each of them signs data of the
+// chunk and the signature before it, starting from the seed signature of
+// the request
+type chunkSigner struct {
+	key     []byte
+	amzDate string
+	scope   string
+	prev    string
+}
+
+func (cs *chunkSigner) verify(signature string, sum []byte) error {
+	stringToSign := strings.Join([]string{
+		SigV4Algorithm + "-PAYLOAD",
+		cs.amzDate,
+		cs.scope,
+		cs.prev,
+		emptySHA256,
+		hex.EncodeToString(sum),
+	}, "\n")
+	want := hex.EncodeToString(hmacSHA256(cs.key, stringToSign))
+	if subtle.ConstantTimeCompare([]byte(want), []byte(signature)) != 1 {
+		return authError("SignatureDoesNotMatch", "chunk signature does not match")
+	}
+	cs.prev = signature
+	return nil
+}
+
+type chunkedReader struct {
+	r    *bufio.Reader
+	left int64
+	done bool
+	err  error
+
+	// signer and signature of the current chunk, with hash of its data
+	signer    *chunkSigner
+	signature string
+	h         hash.Hash
+}
+
+// NewChunkedReader decodes aws-chunked payload from r.  Chunk signatures
+// and trailers are not checked
+func NewChunkedReader(r io.Reader) io.Reader {
+	return newChunkedReader(r, nil)
+}
+
+// newChunkedReader decodes aws-chunked payload from r, with chunk
+// signatures checked by signer if it's not nil.  Trailers are not checked
+func newChunkedReader(r io.Reader, signer *chunkSigner) io.Reader {
+	return &chunkedReader{
+		r:      bufio.NewReader(r),
+		signer: signer,
+		h:      sha256.New(),
+	}
+}
+
+// Read returns data of chunks.  Errors stick, as callers may drop error
+// along with data
+func (cr *chunkedReader) Read(p []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	n, err := cr.read(p)
+	cr.err = err
+	return n, err
+}
+
+func (cr *chunkedReader) read(p []byte) (int, error) {
+	if cr.done {
+		return 0, io.EOF
+	}
+	if cr.left == 0 {
+		line, err := cr.r.ReadString('\n')
+		if err != nil {
+			return 0, errors.Wrap(unexpectedEOF(err), "aws-chunked: chunk header")
+		}
+		line = strings.TrimRight(line, "\r\n")
+		var ext string
+		if i := strings.IndexByte(line, ';'); i >= 0 {
+			line, ext = line[:i], line[i+1:]
+		}
+		size, err := strconv.ParseInt(line, 16, 64)
+		if err != nil || size < 0 {
+			return 0, errors.Errorf("aws-chunked: bad chunk size %q", line)
+		}
+		if cr.signer != nil {
+			signature, ok := cutPrefix(ext, "chunk-signature=")
+			if !ok {
+				return 0, authError("SignatureDoesNotMatch", "missing chunk signature")
+			}
+			cr.signature = signature
+			cr.h.Reset()
+		}
+		if size == 0 {
+			if err := cr.verify(); err != nil {
+				return 0, err
+			}
+			cr.done = true
+			return 0, io.EOF
+		}
+		cr.left = size
+	}
+	if int64(len(p)) > cr.left {
+		p = p[:cr.left]
+	}
+	n, err := cr.r.Read(p)
+	cr.left -= int64(n)
+	cr.h.Write(p[:n])
+	if err != nil {
+		return n, errors.Wrap(unexpectedEOF(err), "aws-chunked: chunk data")
+	}
+	if cr.left == 0 {
+		crlf := make([]byte, 2)
+		if _, err := io.ReadFull(cr.r, crlf); err != nil {
+			return n, errors.Wrap(unexpectedEOF(err), "aws-chunked: chunk end")
+		}
+		if string(crlf) != "\r\n" {
+			return n, errors.New("aws-chunked: missing CRLF after chunk data")
+		}
+		if err := cr.verify(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (cr *chunkedReader) verify() error {
+	if cr.signer == nil {
+		return nil
+	}
+	return cr.signer.verify(cr.signature, cr.h.Sum(nil))
+}
+
+func cutPrefix(s, prefix string) (string, bool) {
+	if !strings.HasPrefix(s, prefix) {
+		return s, false
+	}
+	return s[len(prefix):], true
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,363 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+// Package s3 has the parts of S3 protocol not tied to the netdisk: request
+// signature verification and aws-chunked payload decoding
+package s3
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	SigV4Algorithm = "AWS4-HMAC-SHA256"
+
+	UnsignedPayload  = "UNSIGNED-PAYLOAD"
+	StreamingPayload = "STREAMING-"
+
+	StreamingSignedPayload        = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD"
+	StreamingSignedPayloadTrailer = "STREAMING-AWS4-HMAC-SHA256-PAYLOAD-TRAILER"
+
+	amzDateFormat = "20060102T150405Z"
+
+	// MaxClockSkew is how far request time may be off
+	MaxClockSkew = 15 * time.Minute
+)
+
+// Credentials is a static access key pair
+type Credentials struct {
+	AccessKey string
+	SecretKey string
+}
+
+// AuthError is a failed authentication with S3 error code
+type AuthError struct {
+	Code    string
+	Message string
+}
+
+func (e *AuthError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+func authError(code, format string, args ...interface{}) error {
+	return &AuthError{
+		Code:    code,
+		Message: fmt.Sprintf(format, args...),
+	}
+}
+
+type sigV4 struct {
+	accessKey     string
+	scope         []string
+	signedHeaders []string
+	signature     string
+	amzDate       string
+	payloadHash   string
+	presigned     bool
+}
+
+// Signature is the verified signature of a request.  It's needed to check
+// the payload, which is read after the request is verified
+type Signature struct {
+	key         []byte
+	amzDate     string
+	scope       string
+	seed        string
+	payloadHash string
+}
+
+// Verify checks signature version 4 of req, signed in Authorization header
+// or in query string as in presigned URLs.  Payload is checked as it is
+// read from Body of the returned signature
+func Verify(req *http.Request, creds Credentials, now time.Time) (*Signature, error) {
+	sig, err := parseSigV4(req)
+	if err != nil {
+		return nil, err
+	}
+	// a request signed without host could be replayed to another host
+	if !sig.signsHeader("host") {
+		return nil, authError("AccessDenied", "host header must be signed")
+	}
+	if sig.accessKey != creds.AccessKey {
+		return nil, authError("InvalidAccessKeyId", "unknown access key %q", sig.accessKey)
+	}
+	t, err := time.Parse(amzDateFormat, sig.amzDate)
+	if err != nil {
+		return nil, authError("AccessDenied", "invalid date %q", sig.amzDate)
+	}
+	if sig.presigned {
+		expires, err := strconv.Atoi(req.URL.Query().Get("X-Amz-Expires"))
+		if err != nil || expires < 0 {
+			return nil, authError("AuthorizationQueryParametersError", "invalid X-Amz-Expires")
+		}
+		if now.After(t.Add(time.Duration(expires) * time.Second)) {
+			return nil, authError("AccessDenied", "request has expired")
+		}
+		if t.Sub(now) > MaxClockSkew {
+			return nil, authError("RequestTimeTooSkewed", "request time too skewed")
+		}
+	} else if d := now.Sub(t); d > MaxClockSkew || d < -MaxClockSkew {
+		return nil, authError("RequestTimeTooSkewed", "request time too skewed")
+	}
+	if len(sig.scope) != 4 || sig.scope[0] != t.Format("20060102") || sig.scope[3] != "aws4_request" {
+		return nil, authError("AuthorizationHeaderMalformed", "invalid credential scope %q", strings.Join(sig.scope, "/"))
+	}
+
+	key := signingKey(creds.SecretKey, sig.scope)
+	want := sig.sign(req, key)
+	if subtle.ConstantTimeCompare([]byte(want), []byte(sig.signature)) != 1 {
+		return nil, authError("SignatureDoesNotMatch", "signature does not match")
+	}
+	return &Signature{
+		key:         key,
+		amzDate:     sig.amzDate,
+		scope:       strings.Join(sig.scope, "/"),
+		seed:        sig.signature,
+		payloadHash: sig.payloadHash,
+	}, nil
+}
+
+// Body returns body of req with aws-chunked encoding removed.  Reading
+// fails if the payload doesn't match the signed hash, or a chunk doesn't
+// match its chunk signature.  Unsigned payload is taken as it is
+func (s *Signature) Body(req *http.Request) io.Reader {
+	switch {
+	case s.payloadHash == StreamingSignedPayload, s.payloadHash == StreamingSignedPayloadTrailer:
+		return newChunkedReader(req.Body, &chunkSigner{
+			key:     s.key,
+			amzDate: s.amzDate,
+			scope:   s.scope,
+			prev:    s.seed,
+		})
+	case strings.HasPrefix(s.payloadHash, StreamingPayload):
+		return NewChunkedReader(req.Body)
+	case s.payloadHash == UnsignedPayload:
+		if strings.Contains(req.Header.Get("Content-Encoding"), "aws-chunked") {
+			return NewChunkedReader(req.Body)
+		}
+		return req.Body
+	}
+	return &hashedReader{
+		r:   req.Body,
+		h:   sha256.New(),
+		sum: s.payloadHash,
+	}
+}
+
+// Sign signs req in Authorization header as clients do, with the payload
+// hash in X-Amz-Content-Sha256, or UNSIGNED-PAYLOAD if it's not set
+func Sign(req *http.Request, creds Credentials, region string, now time.Time) {
+	amzDate := now.UTC().Format(amzDateFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	if req.Header.Get("X-Amz-Content-Sha256") == "" {
+		req.Header.Set("X-Amz-Content-Sha256", UnsignedPayload)
+	}
+	sig := sigV4{
+		accessKey:     creds.AccessKey,
+		scope:         []string{amzDate[:8], region, "s3", "aws4_request"},
+		signedHeaders: []string{"host", "x-amz-content-sha256", "x-amz-date"},
+		amzDate:       amzDate,
+		payloadHash:   req.Header.Get("X-Amz-Content-Sha256"),
+	}
+	signature := sig.sign(req, signingKey(creds.SecretKey, sig.scope))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s,SignedHeaders=%s,Signature=%s",
+		SigV4Algorithm,
+		sig.accessKey,
+		strings.Join(sig.scope, "/"),
+		strings.Join(sig.signedHeaders, ";"),
+		signature,
+	))
+}
+
+// sign returns signature of req with key
+func (sig *sigV4) sign(req *http.Request, key []byte) string {
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		URIEncode(req.URL.Path, false),
+		canonicalQuery(req, sig.presigned),
+		canonicalHeaders(req, sig.signedHeaders),
+		strings.Join(sig.signedHeaders, ";"),
+		sig.payloadHash,
+	}, "\n")
+	h := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{
+		SigV4Algorithm,
+		sig.amzDate,
+		strings.Join(sig.scope, "/"),
+		hex.EncodeToString(h[:]),
+	}, "\n")
+	return hex.EncodeToString(hmacSHA256(key, stringToSign))
+}
+
+func signingKey(secretKey string, scope []string) []byte {
+	key := []byte("AWS4" + secretKey)
+	for _, s := range scope {
+		key = hmacSHA256(key, s)
+	}
+	return key
+}
+
+func parseSigV4(req *http.Request) (sigV4, error) {
+	var sig sigV4
+	if q := req.URL.Query(); q.Get("X-Amz-Algorithm") != "" {
+		if q.Get("X-Amz-Algorithm") != SigV4Algorithm {
+			return sig, authError("AuthorizationQueryParametersError", "unsupported algorithm %q", q.Get("X-Amz-Algorithm"))
+		}
+		sig.presigned = true
+		sig.amzDate = q.Get("X-Amz-Date")
+		sig.signature = q.Get("X-Amz-Signature")
+		sig.signedHeaders = strings.Split(q.Get("X-Amz-SignedHeaders"), ";")
+		sig.payloadHash = UnsignedPayload
+		return sig, sig.setCredential(q.Get("X-Amz-Credential"))
+	}
+	auth := req.Header.Get("Authorization")
+	if auth == "" {
+		return sig, authError("AccessDenied", "missing authorization")
+	}
+	if !strings.HasPrefix(auth, SigV4Algorithm+" ") {
+		return sig, authError("AuthorizationHeaderMalformed", "unsupported authorization %q", strings.SplitN(auth, " ", 2)[0])
+	}
+	var credential string
+	for _, kv := range strings.Split(strings.TrimPrefix(auth, SigV4Algorithm+" "), ",") {
+		kv = strings.TrimSpace(kv)
+		i := strings.IndexByte(kv, '=')
+		if i < 0 {
+			continue
+		}
+		switch k, v := kv[:i], kv[i+1:]; k {
+		case "Credential":
+			credential = v
+		case "SignedHeaders":
+			sig.signedHeaders = strings.Split(v, ";")
+		case "Signature":
+			sig.signature = v
+		}
+	}
+	sig.amzDate = req.Header.Get("X-Amz-Date")
+	sig.payloadHash = req.Header.Get("X-Amz-Content-Sha256")
+	if sig.payloadHash == "" {
+		return sig, authError("InvalidRequest", "missing x-amz-content-sha256")
+	}
+	if sig.payloadHash != UnsignedPayload && !strings.HasPrefix(sig.payloadHash, StreamingPayload) {
+		if b, err := hex.DecodeString(sig.payloadHash); err != nil || len(b) != sha256.Size {
+			return sig, authError("InvalidRequest", "invalid x-amz-content-sha256 %q", sig.payloadHash)
+		}
+	}
+	return sig, sig.setCredential(credential)
+}
+
+func (sig *sigV4) signsHeader(name string) bool {
+	for _, h := range sig.signedHeaders {
+		if h == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (sig *sigV4) setCredential(credential string) error {
+	parts := strings.SplitN(credential, "/", 2)
+	if len(parts) != 2 {
+		return authError("AuthorizationHeaderMalformed", "invalid credential %q", credential)
+	}
+	sig.accessKey = parts[0]
+	sig.scope = strings.Split(parts[1], "/")
+	return nil
+}
+
+func canonicalQuery(req *http.Request, presigned bool) string {
+	var pairs []string
+	for k, vs := range req.URL.Query() {
+		if presigned && k == "X-Amz-Signature" {
+			continue
+		}
+		for _, v := range vs {
+			pairs = append(pairs, URIEncode(k, true)+"="+URIEncode(v, true))
+		}
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, "&")
+}
+
+func canonicalHeaders(req *http.Request, signedHeaders []string) string {
+	var b strings.Builder
+	for _, name := range signedHeaders {
+		var vs []string
+		if name == "host" {
+			vs = []string{req.Host}
+		} else {
+			// values are normalized in a copy, not in req.Header
+			vs = append(vs, req.Header.Values(name)...)
+		}
+		for i, v := range vs {
+			vs[i] = strings.Join(strings.Fields(v), " ")
+		}
+		b.WriteString(name)
+		b.WriteByte(':')
+		b.WriteString(strings.Join(vs, ","))
+		b.WriteByte('\n')
+	}
+	return b.String()
+}
+
+// URIEncode encodes s as in canonical requests.  Unreserved characters are
+// kept, and "/" if encodeSlash is false
+func URIEncode(s string, encodeSlash bool) string {
+	const hexDigits = "0123456789ABCDEF"
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~',
+			c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			b.WriteByte('%')
+			b.WriteByte(hexDigits[c>>4])
+			b.WriteByte(hexDigits[c&15])
+		}
+	}
+	return b.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// hashedReader fails at the end if what is read doesn't hash to sum
+type hashedReader struct {
+	r   io.Reader
+	h   hash.Hash
+	sum string
+}
+
+func (hr *hashedReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	if err == io.EOF {
+		// checked on the next read, as callers may drop error along
+		// with data
+		if n > 0 {
+			return n, nil
+		}
+		if hex.EncodeToString(hr.h.Sum(nil)) != hr.sum {
+			return 0, authError("XAmzContentSHA256Mismatch", "payload does not match x-amz-content-sha256")
+		}
+	}
+	return n, err
+}
@@ -12,6 +12,7 @@ import (
 type StoreSerdeI interface {
 	Set(key string, val interface{}) error
 	Get(key string, val interface{}) error
+	Delete(key string) error
 }
 
 type JSONStore struct {
@@ -65,3 +66,10 @@ func (js *JSONStore) Get(key string, val interface{}) error {
 	}
 	return nil
 }
+
+func (js *JSONStore) Delete(key string) error {
+	if err := js.store.Delete(key); err != nil {
+		return errors.Wrapf(err, "json store delete %s", key)
+	}
+	return nil
+}
@@ -6,6 +6,7 @@ package store
 import (
 	"io/fs"
 	"io/ioutil"
+	"os"
 	"path"
 
 	"mypan/pkg/util"
@@ -16,6 +17,8 @@ import (
 type StoreI interface {
 	Set(key string, data []byte) error
 	Get(key string) ([]byte, error)
+	// Delete removes key.  It's not an error if key does not exist
+	Delete(key string) error
 }
 
 type DirStore struct {
@@ -45,3 +48,12 @@ func (ds *DirStore) Get(key string) ([]byte, error) {
 	data, err := ioutil.ReadFile(filename)
 	return data, err
 }
+
+func (ds *DirStore) Delete(key string) error {
+	filename := path.Join(ds.dir, key)
+	err := os.Remove(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,86 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package util
+
+import (
+	"path"
+	"strings"
+)
+
+// HasGlobMeta tells whether p contains any of the glob meta characters *?[
+// not escaped with backslash
+func HasGlobMeta(p string) bool {
+	for i := 0; i < len(p); i++ {
+		switch p[i] {
+		case '\\':
+			i++
+		case '*', '?', '[':
+			return true
+		}
+	}
+	return false
+}
+
+// UnescapeGlob removes backslashes escaping the following characters in p,
+// which then names a path literally
+func UnescapeGlob(p string) string {
+	if !strings.Contains(p, "\\") {
+		return p
+	}
+	var sb strings.Builder
+	for i := 0; i < len(p); i++ {
+		if p[i] == '\\' && i+1 < len(p) {
+			i++
+		}
+		sb.WriteByte(p[i])
+	}
+	return sb.String()
+}
+
+// SplitGlob splits slash separated pattern into the leading dir without
+// glob meta characters and the rest.  dir is unescaped, while rest is
+// kept as is for matching
+func SplitGlob(pattern string) (dir, rest string) {
+	parts := strings.Split(pattern, "/")
+	for i, part := range parts {
+		if HasGlobMeta(part) {
+			dir = UnescapeGlob(strings.Join(parts[:i], "/"))
+			if dir == "" && strings.HasPrefix(pattern, "/") {
+				dir = "/"
+			}
+			return dir, strings.Join(parts[i:], "/")
+		}
+	}
+	return UnescapeGlob(pattern), ""
+}
+
+// MatchGlob reports whether slash separated name matches pattern.  Each
+// component is matched with path.Match, except that "**" matches zero or
+// more components.  Meta characters escaped with backslash match
+// themselves
+func MatchGlob(pattern, name string) (bool, error) {
+	return matchGlobParts(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchGlobParts(pats, names []string) (bool, error) {
+	for len(pats) > 0 {
+		if pats[0] == "**" {
+			for i := 0; i <= len(names); i++ {
+				if ok, err := matchGlobParts(pats[1:], names[i:]); ok || err != nil {
+					return ok, err
+				}
+			}
+			return false, nil
+		}
+		if len(names) == 0 {
+			return false, nil
+		}
+		ok, err := path.Match(pats[0], names[0])
+		if !ok || err != nil {
+			return false, err
+		}
+		pats, names = pats[1:], names[1:]
+	}
+	return len(names) == 0, nil
+}
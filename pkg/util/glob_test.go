@@ -0,0 +1,77 @@
+// SPDX-License-Identifier: MIT
+// Copyright (c) 2023 Yousong Zhou
+
+package util
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitGlob(t *testing.T) {
+	for _, c := range [][3]string{
+		{"logs/2025-*.gz", "logs", "2025-*.gz"},
+		{"photos/**/*.jpg", "photos", "**/*.jpg"},
+		{"/apps/*/a", "/apps", "*/a"},
+		{"/*", "/", "*"},
+		{"*.txt", "", "*.txt"},
+		{"a/b", "a/b", ""},
+		{`a\[1\]/*.jpg`, "a[1]", "*.jpg"},
+		{`a/b\[1\].jpg`, "a/b[1].jpg", ""},
+	} {
+		dir, rest := SplitGlob(c[0])
+		assert.Equal(t, c[1], dir, c[0])
+		assert.Equal(t, c[2], rest, c[0])
+	}
+}
+
+func TestMatchGlob(t *testing.T) {
+	for _, c := range []struct {
+		pattern string
+		name    string
+		want    bool
+	}{
+		{"*.jpg", "a.jpg", true},
+		{"*.jpg", "d/a.jpg", false},
+		{"**/*.jpg", "a.jpg", true},
+		{"**/*.jpg", "d/e/a.jpg", true},
+		{"d/**", "d/e/a.jpg", true},
+		{"d/**/a.jpg", "d/a.jpg", true},
+		{"d/**/a.jpg", "x/a.jpg", false},
+		{"2025-??.gz", "2025-01.gz", true},
+		{`photo\[1\].jpg`, "photo[1].jpg", true},
+		{`photo\[1\].jpg`, "photo1.jpg", false},
+		{`\*`, "a", false},
+	} {
+		got, err := MatchGlob(c.pattern, c.name)
+		assert.NoError(t, err)
+		assert.Equal(t, c.want, got, "%s %s", c.pattern, c.name)
+	}
+	_, err := MatchGlob("[", "a")
+	assert.Error(t, err)
+}
+
+func TestHasGlobMeta(t *testing.T) {
+	for p, want := range map[string]bool{
+		"a/b.jpg":        false,
+		"a/*.jpg":        true,
+		"photo[1].jpg":   true,
+		`photo\[1\].jpg`: false,
+		`\*\?`:           false,
+		`\\*`:            true,
+	} {
+		assert.Equal(t, want, HasGlobMeta(p), p)
+	}
+}
+
+func TestUnescapeGlob(t *testing.T) {
+	for p, want := range map[string]string{
+		"a/b.jpg":        "a/b.jpg",
+		`photo\[1\].jpg`: "photo[1].jpg",
+		`\\a`:            `\a`,
+		`a\`:             `a\`,
+	} {
+		assert.Equal(t, want, UnescapeGlob(p), p)
+	}
+}